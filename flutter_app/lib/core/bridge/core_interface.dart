@@ -6,16 +6,26 @@ class KeyBundle {
   final Uint8List signedPreKey;
   final Uint8List signature;
 
+  /// Unix seconds the signed prekey was generated, covered by [signature]
+  final int createdAt;
+
+  /// Unix seconds the signed prekey expires; zero means no expiry
+  final int expiresAt;
+
   KeyBundle({
     required this.identityPublicKey,
     required this.signedPreKey,
     required this.signature,
+    this.createdAt = 0,
+    this.expiresAt = 0,
   });
 
   Map<String, dynamic> toJson() => {
     'identity_public_key': identityPublicKey,
     'signed_prekey': signedPreKey,
     'signature': signature,
+    if (createdAt != 0) 'created_at': createdAt,
+    if (expiresAt != 0) 'expires_at': expiresAt,
   };
 }
 
@@ -26,11 +36,19 @@ class PublicKeyBundle {
   final Uint8List signature;
   final Uint8List? oneTimePreKey;
 
+  /// Unix seconds the signed prekey was generated, covered by [signature]
+  final int createdAt;
+
+  /// Unix seconds the signed prekey expires; zero means no expiry
+  final int expiresAt;
+
   PublicKeyBundle({
     required this.identityPublicKey,
     required this.signedPreKey,
     required this.signature,
     this.oneTimePreKey,
+    this.createdAt = 0,
+    this.expiresAt = 0,
   });
 
   factory PublicKeyBundle.fromJson(Map<String, dynamic> json) {
@@ -41,6 +59,8 @@ class PublicKeyBundle {
       oneTimePreKey: json['one_time_prekey'] != null
           ? Uint8List.fromList(json['one_time_prekey'])
           : null,
+      createdAt: json['created_at'] as int? ?? 0,
+      expiresAt: json['expires_at'] as int? ?? 0,
     );
   }
 }
@@ -80,6 +100,20 @@ class QueuedMessage {
   }
 }
 
+/// Thrown by decryptMessage when a message authenticates as coming from a
+/// different contact than the claimed sender
+class SenderMismatchException implements Exception {
+  final String claimedSender;
+  final String actualSender;
+
+  SenderMismatchException(this.claimedSender, this.actualSender);
+
+  @override
+  String toString() =>
+      'SenderMismatchException: message claimed to be from $claimedSender '
+      'is from $actualSender';
+}
+
 /// Abstract interface for messenger core
 /// Both Rust and Go cores implement this interface
 abstract class MessengerCore {
@@ -95,6 +129,14 @@ abstract class MessengerCore {
   /// Initialize a session with a recipient
   Future<void> initSession(String recipientId, PublicKeyBundle recipientKeys);
 
+  /// Rotate our signed prekey, updating every session to follow it.
+  /// Returns the new bundle to publish to peers.
+  Future<PublicKeyBundle> rotateSignedPreKey();
+
+  /// Apply a recipient's rotated key bundle to the existing session
+  Future<void> updatePeerBundle(
+      String recipientId, PublicKeyBundle recipientKeys);
+
   /// Check if we have a session with a recipient
   Future<bool> hasSession(String recipientId);
 
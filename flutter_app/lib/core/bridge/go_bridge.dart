@@ -15,6 +15,10 @@ final class KeyBundleResult extends Struct {
   @Int32()
   external int error;
   external Pointer<Utf8> errorMessage;
+  @Int64()
+  external int createdAt;
+  @Int64()
+  external int expiresAt;
 }
 
 final class ByteArrayResult extends Struct {
@@ -33,9 +37,18 @@ final class StringResult extends Struct {
   external Pointer<Utf8> errorMessage;
 }
 
+final class StatusResult extends Struct {
+  @Int32()
+  external int error;
+  external Pointer<Utf8> errorMessage;
+}
+
 // FFI type definitions for Go library
-typedef InitCoreNative = Int32 Function(Pointer<Utf8>, Pointer<Utf8>);
-typedef InitCoreDart = int Function(Pointer<Utf8>, Pointer<Utf8>);
+typedef InitCoreNative = StatusResult Function(Pointer<Utf8>, Pointer<Utf8>);
+typedef InitCoreDart = StatusResult Function(Pointer<Utf8>, Pointer<Utf8>);
+
+typedef ShutdownCoreNative = StatusResult Function();
+typedef ShutdownCoreDart = StatusResult Function();
 
 typedef GenerateKeysNative = KeyBundleResult Function();
 typedef GenerateKeysDart = KeyBundleResult Function();
@@ -43,8 +56,17 @@ typedef GenerateKeysDart = KeyBundleResult Function();
 typedef GetPublicKeyBundleNative = Pointer<Utf8> Function();
 typedef GetPublicKeyBundleDart = Pointer<Utf8> Function();
 
-typedef InitSessionNative = Int32 Function(Pointer<Utf8>, Pointer<Utf8>);
-typedef InitSessionDart = int Function(Pointer<Utf8>, Pointer<Utf8>);
+typedef InitSessionNative = StatusResult Function(
+    Pointer<Utf8>, Pointer<Utf8>);
+typedef InitSessionDart = StatusResult Function(Pointer<Utf8>, Pointer<Utf8>);
+
+typedef RotateSignedPreKeyNative = Pointer<Utf8> Function();
+typedef RotateSignedPreKeyDart = Pointer<Utf8> Function();
+
+typedef UpdatePeerBundleNative = StatusResult Function(
+    Pointer<Utf8>, Pointer<Utf8>);
+typedef UpdatePeerBundleDart = StatusResult Function(
+    Pointer<Utf8>, Pointer<Utf8>);
 
 typedef HasSessionNative = Int32 Function(Pointer<Utf8>);
 typedef HasSessionDart = int Function(Pointer<Utf8>);
@@ -59,14 +81,14 @@ typedef DecryptMessageNative = StringResult Function(
 typedef DecryptMessageDart = StringResult Function(
     Pointer<Utf8>, Pointer<Uint8>, int);
 
-typedef QueueMessageNative = Int32 Function(Pointer<Utf8>);
-typedef QueueMessageDart = int Function(Pointer<Utf8>);
+typedef QueueMessageNative = StatusResult Function(Pointer<Utf8>);
+typedef QueueMessageDart = StatusResult Function(Pointer<Utf8>);
 
 typedef GetQueuedMessagesNative = Pointer<Utf8> Function();
 typedef GetQueuedMessagesDart = Pointer<Utf8> Function();
 
-typedef ClearQueueNative = Int32 Function(Pointer<Utf8>);
-typedef ClearQueueDart = int Function(Pointer<Utf8>);
+typedef ClearQueueNative = StatusResult Function(Pointer<Utf8>);
+typedef ClearQueueDart = StatusResult Function(Pointer<Utf8>);
 
 typedef FreeCStringNative = Void Function(Pointer<Utf8>);
 typedef FreeCStringDart = void Function(Pointer<Utf8>);
@@ -74,6 +96,10 @@ typedef FreeCStringDart = void Function(Pointer<Utf8>);
 typedef FreeBytesNative = Void Function(Pointer<Uint8>);
 typedef FreeBytesDart = void Function(Pointer<Uint8>);
 
+/// DecryptMessage error code for a message from a different sender than
+/// claimed (resultSenderMismatch in the Go core)
+const _resultSenderMismatch = 3;
+
 /// Go implementation of MessengerCore
 /// Uses dart:ffi to call Go shared library
 class GoMessengerCore implements MessengerCore {
@@ -82,9 +108,12 @@ class GoMessengerCore implements MessengerCore {
 
   // FFI function pointers
   late InitCoreDart _initCore;
+  late ShutdownCoreDart _shutdownCore;
   late GenerateKeysDart _generateKeys;
   late GetPublicKeyBundleDart _getPublicKeyBundle;
   late InitSessionDart _initSession;
+  late RotateSignedPreKeyDart _rotateSignedPreKey;
+  late UpdatePeerBundleDart _updatePeerBundle;
   late HasSessionDart _hasSession;
   late EncryptMessageDart _encryptMessage;
   late DecryptMessageDart _decryptMessage;
@@ -116,6 +145,10 @@ class GoMessengerCore implements MessengerCore {
 
     // Look up functions
     _initCore = _goLib.lookupFunction<InitCoreNative, InitCoreDart>('InitCore');
+    _shutdownCore =
+        _goLib.lookupFunction<ShutdownCoreNative, ShutdownCoreDart>(
+      'ShutdownCore',
+    );
     _generateKeys = _goLib.lookupFunction<GenerateKeysNative, GenerateKeysDart>(
       'GenerateIdentityKeys',
     );
@@ -126,6 +159,14 @@ class GoMessengerCore implements MessengerCore {
     _initSession = _goLib.lookupFunction<InitSessionNative, InitSessionDart>(
       'InitSession',
     );
+    _rotateSignedPreKey =
+        _goLib.lookupFunction<RotateSignedPreKeyNative, RotateSignedPreKeyDart>(
+      'RotateSignedPreKey',
+    );
+    _updatePeerBundle =
+        _goLib.lookupFunction<UpdatePeerBundleNative, UpdatePeerBundleDart>(
+      'UpdatePeerBundle',
+    );
     _hasSession = _goLib.lookupFunction<HasSessionNative, HasSessionDart>(
       'HasSession',
     );
@@ -161,10 +202,8 @@ class GoMessengerCore implements MessengerCore {
     final keyPtr = encryptionKey.toNativeUtf8();
 
     try {
-      final result = _initCore(dbPathPtr, keyPtr);
-      if (result != 0) {
-        throw Exception('Failed to initialize Go core');
-      }
+      _checkStatus(
+          _initCore(dbPathPtr, keyPtr), 'Failed to initialize Go core');
       _initialized = true;
       print('[GoCore] Initialized with db: $dbPath');
     } finally {
@@ -173,6 +212,16 @@ class GoMessengerCore implements MessengerCore {
     }
   }
 
+  /// Persists sessions and queued messages, then closes the Go core.
+  /// Throws on failure; the call can then be retried.
+  Future<void> shutdown() async {
+    if (!_initialized) return;
+
+    _checkStatus(_shutdownCore(), 'Failed to shut down Go core');
+    _initialized = false;
+    print('[GoCore] Shut down');
+  }
+
   @override
   Future<KeyBundle> generateIdentityKeys() async {
     if (!_initialized) throw Exception('Core not initialized');
@@ -189,6 +238,8 @@ class GoMessengerCore implements MessengerCore {
             base64Decode(result.identityPublicKey.toDartString()),
         signedPreKey: base64Decode(result.signedPrekey.toDartString()),
         signature: base64Decode(result.signature.toDartString()),
+        createdAt: result.createdAt,
+        expiresAt: result.expiresAt,
       );
     } finally {
       _freeCString(result.identityPublicKey);
@@ -208,16 +259,7 @@ class GoMessengerCore implements MessengerCore {
 
     try {
       final jsonStr = resultPtr.toDartString();
-      final json = jsonDecode(jsonStr) as Map<String, dynamic>;
-
-      return PublicKeyBundle(
-        identityPublicKey: base64Decode(json['identity_public_key'] as String),
-        signedPreKey: base64Decode(json['signed_prekey'] as String),
-        signature: base64Decode(json['signature'] as String),
-        oneTimePreKey: json['one_time_prekey'] != null
-            ? base64Decode(json['one_time_prekey'] as String)
-            : null,
-      );
+      return _bundleFromJson(jsonDecode(jsonStr) as Map<String, dynamic>);
     } finally {
       _freeCString(resultPtr);
     }
@@ -231,20 +273,11 @@ class GoMessengerCore implements MessengerCore {
     if (!_initialized) throw Exception('Core not initialized');
 
     final recipientPtr = recipientId.toNativeUtf8();
-    final keysJson = jsonEncode({
-      'identity_public_key': base64Encode(recipientKeys.identityPublicKey),
-      'signed_prekey': base64Encode(recipientKeys.signedPreKey),
-      'signature': base64Encode(recipientKeys.signature),
-      if (recipientKeys.oneTimePreKey != null)
-        'one_time_prekey': base64Encode(recipientKeys.oneTimePreKey!),
-    });
-    final keysPtr = keysJson.toNativeUtf8();
+    final keysPtr = _bundleToJson(recipientKeys).toNativeUtf8();
 
     try {
-      final result = _initSession(recipientPtr, keysPtr);
-      if (result != 0) {
-        throw Exception('Failed to initialize session');
-      }
+      _checkStatus(
+          _initSession(recipientPtr, keysPtr), 'Failed to initialize session');
       print('[GoCore] Session initialized with: $recipientId');
     } finally {
       calloc.free(recipientPtr);
@@ -252,6 +285,76 @@ class GoMessengerCore implements MessengerCore {
     }
   }
 
+  @override
+  Future<PublicKeyBundle> rotateSignedPreKey() async {
+    if (!_initialized) throw Exception('Core not initialized');
+
+    final resultPtr = _rotateSignedPreKey();
+    try {
+      final envelope =
+          jsonDecode(resultPtr.toDartString()) as Map<String, dynamic>;
+      if (envelope['ok'] != true) {
+        throw Exception('Failed to rotate signed prekey: ${envelope['error']}');
+      }
+      return _bundleFromJson(envelope['data'] as Map<String, dynamic>);
+    } finally {
+      _freeCString(resultPtr);
+    }
+  }
+
+  @override
+  Future<void> updatePeerBundle(
+    String recipientId,
+    PublicKeyBundle recipientKeys,
+  ) async {
+    if (!_initialized) throw Exception('Core not initialized');
+
+    final recipientPtr = recipientId.toNativeUtf8();
+    final keysPtr = _bundleToJson(recipientKeys).toNativeUtf8();
+
+    try {
+      _checkStatus(_updatePeerBundle(recipientPtr, keysPtr),
+          'Failed to update key bundle');
+      print('[GoCore] Key bundle updated for: $recipientId');
+    } finally {
+      calloc.free(recipientPtr);
+      calloc.free(keysPtr);
+    }
+  }
+
+  /// Throws with the Go core's error message if [result] failed,
+  /// freeing the message either way
+  void _checkStatus(StatusResult result, String failure) {
+    if (result.error == 0) return;
+    final errMsg = result.errorMessage.toDartString();
+    _freeCString(result.errorMessage);
+    throw Exception('$failure: $errMsg');
+  }
+
+  /// Encodes a bundle as the JSON the Go core parses
+  String _bundleToJson(PublicKeyBundle bundle) => jsonEncode({
+        'identity_public_key': base64Encode(bundle.identityPublicKey),
+        'signed_prekey': base64Encode(bundle.signedPreKey),
+        'signature': base64Encode(bundle.signature),
+        if (bundle.oneTimePreKey != null)
+          'one_time_prekey': base64Encode(bundle.oneTimePreKey!),
+        if (bundle.createdAt != 0) 'created_at': bundle.createdAt,
+        if (bundle.expiresAt != 0) 'expires_at': bundle.expiresAt,
+      });
+
+  /// Decodes a bundle from the Go core's JSON
+  PublicKeyBundle _bundleFromJson(Map<String, dynamic> json) =>
+      PublicKeyBundle(
+        identityPublicKey: base64Decode(json['identity_public_key'] as String),
+        signedPreKey: base64Decode(json['signed_prekey'] as String),
+        signature: base64Decode(json['signature'] as String),
+        oneTimePreKey: json['one_time_prekey'] != null
+            ? base64Decode(json['one_time_prekey'] as String)
+            : null,
+        createdAt: json['created_at'] as int? ?? 0,
+        expiresAt: json['expires_at'] as int? ?? 0,
+      );
+
   @override
   Future<bool> hasSession(String recipientId) async {
     if (!_initialized) throw Exception('Core not initialized');
@@ -307,6 +410,11 @@ class GoMessengerCore implements MessengerCore {
     try {
       final result =
           _decryptMessage(senderPtr, ciphertextPtr, ciphertext.length);
+      if (result.error == _resultSenderMismatch) {
+        final actualSender = result.data.toDartString();
+        _freeCString(result.data);
+        throw SenderMismatchException(senderId, actualSender);
+      }
       if (result.error != 0) {
         final errMsg = result.errorMessage.toDartString();
         throw Exception('Decryption failed: $errMsg');
@@ -334,10 +442,7 @@ class GoMessengerCore implements MessengerCore {
     final messagePtr = messageJson.toNativeUtf8();
 
     try {
-      final result = _queueMessage(messagePtr);
-      if (result != 0) {
-        throw Exception('Failed to queue message');
-      }
+      _checkStatus(_queueMessage(messagePtr), 'Failed to queue message');
       print('[GoCore] Queued message: ${message.id}');
     } finally {
       calloc.free(messagePtr);
@@ -355,7 +460,11 @@ class GoMessengerCore implements MessengerCore {
 
     try {
       final jsonStr = resultPtr.toDartString();
-      final list = jsonDecode(jsonStr) as List<dynamic>;
+      final envelope = jsonDecode(jsonStr) as Map<String, dynamic>;
+      if (envelope['ok'] != true) {
+        throw Exception('Failed to get queued messages: ${envelope['error']}');
+      }
+      final list = envelope['data'] as List<dynamic>;
 
       return list.map((item) {
         final map = item as Map<String, dynamic>;
@@ -379,10 +488,7 @@ class GoMessengerCore implements MessengerCore {
     final idsPtr = idsJson.toNativeUtf8();
 
     try {
-      final result = _clearQueue(idsPtr);
-      if (result != 0) {
-        throw Exception('Failed to clear queue');
-      }
+      _checkStatus(_clearQueue(idsPtr), 'Failed to clear queue');
       print('[GoCore] Cleared queue: $messageIds');
     } finally {
       calloc.free(idsPtr);
@@ -97,6 +97,21 @@ class RustMessengerCore implements MessengerCore {
     print('[RustCore] Queuing message: ${message.id}');
   }
 
+  @override
+  Future<PublicKeyBundle> rotateSignedPreKey() async {
+    if (!_initialized) throw Exception('Core not initialized');
+    // Prekey rotation is not yet exposed via FFI
+    throw UnsupportedError('Prekey rotation is not supported by the Rust core');
+  }
+
+  @override
+  Future<void> updatePeerBundle(
+      String recipientId, PublicKeyBundle recipientKeys) async {
+    if (!_initialized) throw Exception('Core not initialized');
+    // Prekey rotation is not yet exposed via FFI
+    throw UnsupportedError('Prekey rotation is not supported by the Rust core');
+  }
+
   @override
   Future<List<QueuedMessage>> getQueuedMessages() async {
     if (!_initialized) throw Exception('Core not initialized');
@@ -152,6 +167,20 @@ class WebMessengerCore implements MessengerCore {
     print('[WebCore] Session initialized with: $recipientId');
   }
 
+  @override
+  Future<PublicKeyBundle> rotateSignedPreKey() async {
+    if (!_initialized) throw Exception('Core not initialized');
+    print('[WebCore] Rotating signed prekey (stub)...');
+    return getPublicKeyBundle();
+  }
+
+  @override
+  Future<void> updatePeerBundle(
+      String recipientId, PublicKeyBundle recipientKeys) async {
+    if (!_initialized) throw Exception('Core not initialized');
+    print('[WebCore] Key bundle updated for: $recipientId');
+  }
+
   @override
   Future<bool> hasSession(String recipientId) async {
     if (!_initialized) throw Exception('Core not initialized');
@@ -39,6 +39,8 @@ class EncryptionService {
         'identity_public_key': keys.identityPublicKey.toList(),
         'signed_prekey': keys.signedPreKey.toList(),
         'signed_prekey_signature': keys.signature.toList(),
+        'signed_prekey_created_at': keys.createdAt,
+        'signed_prekey_expires_at': keys.expiresAt,
       }).eq('id', _currentUserId!);
 
       print('[Encryption] Keys uploaded for $_currentUserId');
@@ -52,7 +54,8 @@ class EncryptionService {
     try {
       final response = await _client
           .from('users')
-          .select('identity_public_key, signed_prekey, signed_prekey_signature')
+          .select('identity_public_key, signed_prekey, signed_prekey_signature, '
+              'signed_prekey_created_at, signed_prekey_expires_at')
           .eq('id', recipientId)
           .maybeSingle();
 
@@ -92,6 +95,8 @@ class EncryptionService {
         signedPreKey: spk,
         signature: sig,
         oneTimePreKey: otpk,
+        createdAt: response['signed_prekey_created_at'] as int? ?? 0,
+        expiresAt: response['signed_prekey_expires_at'] as int? ?? 0,
       );
     } catch (e) {
       print('[Encryption] Failed to fetch keys for $recipientId: $e');
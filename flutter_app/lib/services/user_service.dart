@@ -91,6 +91,8 @@ class UserService {
         profileData['identity_public_key'] = keys.identityPublicKey.toList();
         profileData['signed_prekey'] = keys.signedPreKey.toList();
         profileData['signed_prekey_signature'] = keys.signature.toList();
+        profileData['signed_prekey_created_at'] = keys.createdAt;
+        profileData['signed_prekey_expires_at'] = keys.expiresAt;
       } else {
         // Placeholder keys for users without core initialised
         profileData['identity_public_key'] = [0];
@@ -0,0 +1,38 @@
+// Package audit records security-sensitive operations, such as key
+// imports and session deletion, for later review.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Event names
+const (
+	EventKeyImport         = "key.import"         // A contact's identity key was pinned or replaced
+	EventContactVerify     = "contact.verify"     // A contact was marked verified or unverified
+	EventSessionCreate     = "session.create"     // A new session was established
+	EventSessionDelete     = "session.delete"     // A session was deleted
+	EventRekey             = "storage.rekey"      // The database key was changed
+	EventSessionUnreadable = "session.unreadable" // A stored session couldn't be read and was skipped
+)
+
+// Logger receives audit events. Fields never hold plaintext user IDs or
+// key material; identifiers are passed through Redact.
+type Logger interface {
+	Log(event string, fields map[string]any)
+}
+
+// Nop is a Logger that discards every event
+var Nop Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(string, map[string]any) {}
+
+// Redact returns a short pseudonymous tag for an identifier, so events
+// about the same user can be correlated without recording who it is
+func Redact(id string) string {
+	sum := sha256.Sum256([]byte("merabriar_audit\x00" + id))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,25 @@
+package audit
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tag := Redact("alice@example.com")
+	if tag != Redact("alice@example.com") {
+		t.Error("Redact() should be stable")
+	}
+	if tag == Redact("bob@example.com") {
+		t.Error("different IDs should get different tags")
+	}
+	if len(tag) != 16 || strings.Contains(tag, "alice") {
+		t.Errorf("Redact() = %q, want a 16-char tag without the ID", tag)
+	}
+}
+
+func TestNopDiscards(t *testing.T) {
+	// Must not panic, with or without fields
+	Nop.Log(EventSessionDelete, nil)
+	Nop.Log(EventKeyImport, map[string]any{"contact": Redact("bob")})
+}
@@ -48,7 +48,7 @@ func createMatchedPair(b *testing.B) (sender *crypto.Session, receiver *crypto.S
 	copy(ap[:], alicePreKeyPriv)
 	sharedSecret, _ := curve25519.X25519(ap[:], bobPub.SignedPreKey)
 
-	hkdfReader := hkdf.New(sha256.New, sharedSecret, nil, []byte("merabriar_session"))
+	hkdfReader := hkdf.New(sha256.New, sharedSecret, nil, []byte("merabriar_session\x00\x01\x01merabriar_message"))
 	var rootKey, sendChain, recvChain [32]byte
 	io.ReadFull(hkdfReader, rootKey[:])
 	io.ReadFull(hkdfReader, sendChain[:])
@@ -313,3 +313,39 @@ func BenchmarkEncryptedMessageDeserialize(b *testing.B) {
 		json.Unmarshal(data, &e)
 	}
 }
+
+func BenchmarkEncryptedMessageMarshalBinary(b *testing.B) {
+	enc := &message.EncryptedMessage{
+		ID:               "enc-bench",
+		SenderID:         "alice",
+		RecipientID:      "bob",
+		EncryptedContent: make([]byte, 512),
+		MessageType:      message.TypeText,
+		Timestamp:        1234567890,
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enc.MarshalBinary()
+	}
+}
+
+func BenchmarkEncryptedMessageUnmarshalBinary(b *testing.B) {
+	enc := &message.EncryptedMessage{
+		ID:               "enc-bench",
+		SenderID:         "alice",
+		RecipientID:      "bob",
+		EncryptedContent: make([]byte, 512),
+		MessageType:      message.TypeText,
+		Timestamp:        1234567890,
+	}
+	data, _ := enc.MarshalBinary()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var e message.EncryptedMessage
+		e.UnmarshalBinary(data)
+	}
+}
@@ -0,0 +1,136 @@
+// Package clock abstracts the current time so time-dependent behavior,
+// such as retry backoff and message expiry, can be tested deterministically.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock reports the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// Ticker delivers the time on C at intervals, like time.Ticker. Ticks
+// are dropped rather than queued if the reader falls behind.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// tickerClock is implemented by clocks that drive their own tickers
+type tickerClock interface {
+	NewTicker(d time.Duration) Ticker
+}
+
+// NewTicker returns a ticker every d as measured by c: one driven by c if
+// it can make its own, like Fake, else a real time.Ticker. It panics if d
+// is not positive, as time.NewTicker does.
+func NewTicker(c Clock, d time.Duration) Ticker {
+	if tc, ok := c.(tickerClock); ok {
+		return tc.NewTicker(d)
+	}
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker adapts a time.Ticker to Ticker
+type realTicker struct{ t *time.Ticker }
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop()               { r.t.Stop() }
+
+// System is the real system clock
+var System Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Fake is a Clock that only moves when told to. It is safe for concurrent use.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFake returns a fake clock set to now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the fake clock's current time
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Advance moves the clock forward by d
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	f.fireLocked()
+}
+
+// Set moves the clock to t
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t
+	f.fireLocked()
+}
+
+// NewTicker returns a ticker that ticks when the clock is moved past each
+// multiple of d from now. It panics if d is not positive.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{f: f, d: d, next: f.now.Add(d), c: make(chan time.Time, 1)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// fireLocked ticks every ticker whose next tick is due; f.mu must be held
+func (f *Fake) fireLocked() {
+	for _, t := range f.tickers {
+		if f.now.Before(t.next) {
+			continue
+		}
+		select {
+		case t.c <- f.now:
+		default:
+		}
+		for !f.now.Before(t.next) {
+			t.next = t.next.Add(t.d)
+		}
+	}
+}
+
+// fakeTicker is a Ticker driven by a Fake
+type fakeTicker struct {
+	f    *Fake
+	d    time.Duration
+	next time.Time
+	c    chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	for i, other := range t.f.tickers {
+		if other == t {
+			t.f.tickers = append(t.f.tickers[:i], t.f.tickers[i+1:]...)
+			return
+		}
+	}
+}
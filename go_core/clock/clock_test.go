@@ -0,0 +1,86 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSystemClock(t *testing.T) {
+	before := time.Now()
+	now := System.Now()
+	if now.Before(before) || now.After(time.Now()) {
+		t.Errorf("System.Now() = %v, want the current time", now)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+
+	if !f.Now().Equal(start) {
+		t.Errorf("Now() = %v, want %v", f.Now(), start)
+	}
+
+	f.Advance(90 * time.Second)
+	if want := start.Add(90 * time.Second); !f.Now().Equal(want) {
+		t.Errorf("Now() after Advance = %v, want %v", f.Now(), want)
+	}
+
+	f.Set(time.Unix(5, 0))
+	if f.Now().Unix() != 5 {
+		t.Errorf("Now() after Set = %v, want unix 5", f.Now())
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(time.Unix(1000, 0))
+	ticker := NewTicker(f, time.Minute)
+
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker should not tick before the clock moves")
+	default:
+	}
+
+	f.Advance(30 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker should not tick before its interval")
+	default:
+	}
+
+	// Several intervals at once deliver a single tick
+	f.Advance(3 * time.Minute)
+	select {
+	case now := <-ticker.C():
+		if now.Unix() != 1210 {
+			t.Errorf("tick = %v, want the clock's time", now.Unix())
+		}
+	default:
+		t.Fatal("ticker should tick once the interval passes")
+	}
+	select {
+	case <-ticker.C():
+		t.Error("missed ticks should be dropped, not queued")
+	default:
+	}
+
+	ticker.Stop()
+	f.Advance(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Error("stopped ticker should not tick")
+	default:
+	}
+}
+
+func TestSystemTicker(t *testing.T) {
+	ticker := NewTicker(System, time.Millisecond)
+	defer ticker.Stop()
+
+	select {
+	case <-ticker.C():
+	case <-time.After(time.Second):
+		t.Fatal("system ticker should tick in real time")
+	}
+}
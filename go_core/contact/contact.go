@@ -0,0 +1,108 @@
+// Package contact manages contacts and their identity keys.
+// This mirrors Briar's briar-api/contact/ContactManager
+package contact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"merabriar_core/crypto"
+)
+
+// ErrNotFound is returned when a contact doesn't exist
+var ErrNotFound = errors.New("contact not found")
+
+// Contact represents a known peer
+type Contact struct {
+	ID          string                  `json:"id"`
+	DisplayName string                  `json:"display_name"`
+	PhoneHash   string                  `json:"phone_hash,omitempty"`
+	PublicKeys  *crypto.PublicKeyBundle `json:"public_keys,omitempty"` // Last seen bundle
+	IsVerified  bool                    `json:"is_verified"`
+	IsBlocked   bool                    `json:"is_blocked"` // Inbound messages are dropped
+	CreatedAt   int64                   `json:"created_at"`
+
+	// Identity key the contact is pinned to; a bundle with a different
+	// identity key is reported as a key change
+	PinnedIdentityKey []byte `json:"pinned_identity_key,omitempty"`
+	// Fingerprint of the pinned identity key (crypto.PublicKeyBundle.Fingerprint)
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// Store persists contacts. It is implemented by storage.Storage.
+type Store interface {
+	GetContact(id string) (*Contact, error)
+	StoreContact(c *Contact) error
+}
+
+// Manager applies contact rules on top of a Store
+type Manager struct {
+	store Store
+}
+
+// NewManager creates a contact manager
+func NewManager(store Store) *Manager {
+	return &Manager{store: store}
+}
+
+// DetectKeyChange records newBundle as the contact's latest bundle and
+// reports whether its identity key differs from the pinned one.
+// The first bundle seen is pinned (trust on first use). A changed key is
+// not re-pinned and clears the contact's verified flag; re-verifying the
+// contact pins the new key.
+func (m *Manager) DetectKeyChange(contactID string, newBundle *crypto.PublicKeyBundle) (changed bool, err error) {
+	c, err := m.store.GetContact(contactID)
+	if err != nil {
+		return false, err
+	}
+
+	if len(c.PinnedIdentityKey) == 0 {
+		c.PinnedIdentityKey = newBundle.IdentityPublicKey
+		c.Fingerprint = newBundle.Fingerprint()
+	} else if !bytes.Equal(c.PinnedIdentityKey, newBundle.IdentityPublicKey) {
+		changed = true
+		c.IsVerified = false
+	}
+	c.PublicKeys = newBundle
+
+	return changed, m.store.StoreContact(c)
+}
+
+// ImportFromBundle adds or updates a contact from a bundle exchanged in
+// person, e.g. by scanning a QR code. The bundle's signature is verified
+// and, because the exchange itself authenticates the peer, the contact is
+// stored as verified with the bundle's identity key pinned, replacing any
+// previously pinned key.
+func (m *Manager) ImportFromBundle(id, displayName string, bundleJSON []byte) (*Contact, error) {
+	var bundle crypto.PublicKeyBundle
+	if err := json.Unmarshal(bundleJSON, &bundle); err != nil {
+		return nil, crypto.ErrInvalidBundle
+	}
+	if err := bundle.Verify(); err != nil {
+		return nil, err
+	}
+	if bundle.Expired(time.Now()) {
+		return nil, crypto.ErrBundleExpired
+	}
+
+	c, err := m.store.GetContact(id)
+	if errors.Is(err, ErrNotFound) {
+		c, err = &Contact{ID: id}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.DisplayName = displayName
+	c.PublicKeys = &bundle
+	c.PinnedIdentityKey = bundle.IdentityPublicKey
+	c.Fingerprint = bundle.Fingerprint()
+	c.IsVerified = true
+
+	if err := m.store.StoreContact(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,173 @@
+// Package contact tests - key pinning and change detection
+package contact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"merabriar_core/crypto"
+)
+
+// memStore is an in-memory Store
+type memStore map[string]Contact
+
+func (m memStore) GetContact(id string) (*Contact, error) {
+	c, ok := m[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &c, nil
+}
+
+func (m memStore) StoreContact(c *Contact) error {
+	m[c.ID] = *c
+	return nil
+}
+
+func newBundle(t *testing.T) *crypto.PublicKeyBundle {
+	t.Helper()
+	km := crypto.NewKeyManager()
+	if _, err := km.GenerateIdentityKeys(); err != nil {
+		t.Fatalf("GenerateIdentityKeys() error: %v", err)
+	}
+	bundle, _ := km.GetPublicKeyBundle()
+	return bundle
+}
+
+// ═══════════════════════════════════════
+// 1. Key Change Detection
+// ═══════════════════════════════════════
+
+func TestDetectKeyChangeFirstSeenPins(t *testing.T) {
+	store := memStore{"bob": {ID: "bob"}}
+	m := NewManager(store)
+	bundle := newBundle(t)
+
+	changed, err := m.DetectKeyChange("bob", bundle)
+	if err != nil {
+		t.Fatalf("DetectKeyChange() error: %v", err)
+	}
+	if changed {
+		t.Error("first bundle should not be reported as a change")
+	}
+	if !bytes.Equal(store["bob"].PinnedIdentityKey, bundle.IdentityPublicKey) {
+		t.Error("first bundle's identity key should be pinned")
+	}
+}
+
+func TestDetectKeyChangeUnchanged(t *testing.T) {
+	bundle := newBundle(t)
+	store := memStore{"bob": {ID: "bob", IsVerified: true, PinnedIdentityKey: bundle.IdentityPublicKey}}
+	m := NewManager(store)
+
+	changed, err := m.DetectKeyChange("bob", bundle)
+	if err != nil {
+		t.Fatalf("DetectKeyChange() error: %v", err)
+	}
+	if changed {
+		t.Error("same identity key should not be reported as a change")
+	}
+	if !store["bob"].IsVerified {
+		t.Error("unchanged key should keep the contact verified")
+	}
+}
+
+func TestDetectKeyChangeChanged(t *testing.T) {
+	old, replacement := newBundle(t), newBundle(t)
+	store := memStore{"bob": {ID: "bob", IsVerified: true, PinnedIdentityKey: old.IdentityPublicKey}}
+	m := NewManager(store)
+
+	changed, err := m.DetectKeyChange("bob", replacement)
+	if err != nil {
+		t.Fatalf("DetectKeyChange() error: %v", err)
+	}
+	if !changed {
+		t.Error("different identity key should be reported as a change")
+	}
+
+	bob := store["bob"]
+	if bob.IsVerified {
+		t.Error("a key change should clear the verified flag")
+	}
+	if !bytes.Equal(bob.PinnedIdentityKey, old.IdentityPublicKey) {
+		t.Error("a key change must not re-pin automatically")
+	}
+	if bob.PublicKeys != replacement {
+		t.Error("the new bundle should be recorded as last seen")
+	}
+}
+
+func TestDetectKeyChangeUnknownContact(t *testing.T) {
+	m := NewManager(memStore{})
+
+	if _, err := m.DetectKeyChange("nobody", newBundle(t)); err != ErrNotFound {
+		t.Errorf("DetectKeyChange() error = %v, want ErrNotFound", err)
+	}
+}
+
+// ═══════════════════════════════════════
+// 2. Bundle Import
+// ═══════════════════════════════════════
+
+func TestImportFromBundle(t *testing.T) {
+	store := memStore{}
+	m := NewManager(store)
+	bundle := newBundle(t)
+	data, _ := json.Marshal(bundle)
+
+	c, err := m.ImportFromBundle("bob", "Bob", data)
+	if err != nil {
+		t.Fatalf("ImportFromBundle() error: %v", err)
+	}
+	if c.DisplayName != "Bob" || !c.IsVerified {
+		t.Errorf("imported contact = %+v, want verified Bob", c)
+	}
+	if c.Fingerprint != bundle.Fingerprint() {
+		t.Errorf("Fingerprint = %q, want %q", c.Fingerprint, bundle.Fingerprint())
+	}
+
+	stored := store["bob"]
+	if !stored.IsVerified || !bytes.Equal(stored.PinnedIdentityKey, bundle.IdentityPublicKey) {
+		t.Error("imported contact should be stored verified with its key pinned")
+	}
+}
+
+func TestImportFromBundleRepinsExistingContact(t *testing.T) {
+	old, scanned := newBundle(t), newBundle(t)
+	store := memStore{"bob": {ID: "bob", DisplayName: "B", PinnedIdentityKey: old.IdentityPublicKey, CreatedAt: 42}}
+	m := NewManager(store)
+	data, _ := json.Marshal(scanned)
+
+	if _, err := m.ImportFromBundle("bob", "Bob", data); err != nil {
+		t.Fatalf("ImportFromBundle() error: %v", err)
+	}
+
+	bob := store["bob"]
+	if !bytes.Equal(bob.PinnedIdentityKey, scanned.IdentityPublicKey) {
+		t.Error("an in-person scan should pin the scanned key")
+	}
+	if bob.CreatedAt != 42 {
+		t.Errorf("CreatedAt = %d, want existing 42", bob.CreatedAt)
+	}
+}
+
+func TestImportFromBundleRejectsTampered(t *testing.T) {
+	store := memStore{}
+	m := NewManager(store)
+
+	bundle := newBundle(t)
+	bundle.SignedPreKey[0] ^= 0xFF
+	data, _ := json.Marshal(bundle)
+
+	if _, err := m.ImportFromBundle("bob", "Bob", data); !errors.Is(err, crypto.ErrInvalidBundle) {
+		t.Errorf("ImportFromBundle() with tampered bundle error = %v, want ErrInvalidBundle", err)
+	}
+	if _, err := m.ImportFromBundle("bob", "Bob", []byte("{not json")); !errors.Is(err, crypto.ErrInvalidBundle) {
+		t.Errorf("ImportFromBundle() with malformed JSON error = %v, want ErrInvalidBundle", err)
+	}
+	if len(store) != 0 {
+		t.Error("rejected bundles must not be stored")
+	}
+}
@@ -0,0 +1,68 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"errors"
+	"io"
+)
+
+// aeadVersion identifies the AEADSeal format: AES-256-GCM with a random
+// 12-byte nonce
+const aeadVersion = 1
+
+// AEADKeySize is the key length AEADSeal and AEADOpen require
+const AEADKeySize = 32
+
+var (
+	// ErrInvalidAEADKey is returned for a key that isn't AEADKeySize bytes
+	ErrInvalidAEADKey = errors.New("invalid AEAD key size")
+	// ErrAEADOpen is returned when sealed data is malformed, was tampered
+	// with, or was sealed with a different key or associated data
+	ErrAEADOpen = errors.New("AEAD open failed")
+)
+
+// AEADSeal encrypts and authenticates plaintext, binding aad.
+// The result is version byte || nonce || ciphertext, for app-level
+// encryption of data at rest (database columns, backups).
+func AEADSeal(key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := aeadFor(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out[0] = aeadVersion
+	nonce := out[1:]
+	if _, err := io.ReadFull(randReader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plaintext, aad), nil
+}
+
+// AEADOpen decrypts data produced by AEADSeal with the same key and aad
+func AEADOpen(key, sealed, aad []byte) ([]byte, error) {
+	aead, err := aeadFor(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < 1+aead.NonceSize()+aead.Overhead() || sealed[0] != aeadVersion {
+		return nil, ErrAEADOpen
+	}
+	nonce, ciphertext := sealed[1:1+aead.NonceSize()], sealed[1+aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrAEADOpen
+	}
+	return plaintext, nil
+}
+
+func aeadFor(key []byte) (cipher.AEAD, error) {
+	if len(key) != AEADKeySize {
+		return nil, ErrInvalidAEADKey
+	}
+	var k [32]byte
+	copy(k[:], key)
+	return newGCM(SuiteAES256GCM, k)
+}
@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testAEADKey() []byte {
+	key := make([]byte, AEADKeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func TestAEADRoundTrip(t *testing.T) {
+	key := testAEADKey()
+
+	sealed, err := AEADSeal(key, []byte("at rest"), []byte("row-1"))
+	if err != nil {
+		t.Fatalf("AEADSeal() error: %v", err)
+	}
+	if sealed[0] != aeadVersion {
+		t.Errorf("version byte = %d, want %d", sealed[0], aeadVersion)
+	}
+	if bytes.Contains(sealed, []byte("at rest")) {
+		t.Error("sealed data contains the plaintext")
+	}
+
+	opened, err := AEADOpen(key, sealed, []byte("row-1"))
+	if err != nil {
+		t.Fatalf("AEADOpen() error: %v", err)
+	}
+	if string(opened) != "at rest" {
+		t.Errorf("opened = %q, want %q", opened, "at rest")
+	}
+}
+
+func TestAEADSealUsesFreshNonce(t *testing.T) {
+	key := testAEADKey()
+
+	a, _ := AEADSeal(key, []byte("same"), nil)
+	b, _ := AEADSeal(key, []byte("same"), nil)
+	if bytes.Equal(a, b) {
+		t.Error("sealing the same plaintext twice should differ")
+	}
+}
+
+func TestAEADOpenTampered(t *testing.T) {
+	key := testAEADKey()
+	sealed, _ := AEADSeal(key, []byte("integrity"), nil)
+
+	for i := range sealed {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 0x01
+		if _, err := AEADOpen(key, tampered, nil); err != ErrAEADOpen {
+			t.Fatalf("byte %d flipped: AEADOpen() error = %v, want ErrAEADOpen", i, err)
+		}
+	}
+
+	if _, err := AEADOpen(key, sealed[:10], nil); err != ErrAEADOpen {
+		t.Errorf("truncated: AEADOpen() error = %v, want ErrAEADOpen", err)
+	}
+}
+
+func TestAEADOpenAADMismatch(t *testing.T) {
+	key := testAEADKey()
+	sealed, _ := AEADSeal(key, []byte("bound"), []byte("row-1"))
+
+	if _, err := AEADOpen(key, sealed, []byte("row-2")); err != ErrAEADOpen {
+		t.Errorf("AEADOpen() with wrong aad error = %v, want ErrAEADOpen", err)
+	}
+	if _, err := AEADOpen(key, sealed, nil); err != ErrAEADOpen {
+		t.Errorf("AEADOpen() without aad error = %v, want ErrAEADOpen", err)
+	}
+}
+
+func TestAEADWrongKey(t *testing.T) {
+	sealed, _ := AEADSeal(testAEADKey(), []byte("secret"), nil)
+
+	other := make([]byte, AEADKeySize)
+	if _, err := AEADOpen(other, sealed, nil); err != ErrAEADOpen {
+		t.Errorf("AEADOpen() with wrong key error = %v, want ErrAEADOpen", err)
+	}
+	if _, err := AEADSeal([]byte("short"), []byte("x"), nil); err != ErrInvalidAEADKey {
+		t.Errorf("AEADSeal() with short key error = %v, want ErrInvalidAEADKey", err)
+	}
+}
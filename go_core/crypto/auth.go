@@ -0,0 +1,183 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// AuthChallengeSize is the length of an authentication challenge nonce
+const AuthChallengeSize = 32
+
+// authContext domain-separates authentication signatures from prekey signatures
+const authContext = "merabriar_auth_v1"
+
+// keyConfirmLabel prefixes the message MACed by KeyConfirmation, and
+// keyConfirmInfo derives its key from the root key
+const (
+	keyConfirmLabel = "merabriar_key_confirm_v1"
+	keyConfirmInfo  = "merabriar_key_confirm_key_v1"
+)
+
+// KeyConfirmationSize is the length of a KeyConfirmation MAC
+const KeyConfirmationSize = sha256.Size
+
+var (
+	// ErrNoIdentityKey is returned when a session has no identity key to sign with
+	ErrNoIdentityKey = errors.New("session has no identity key")
+	// ErrNoPeerIdentity is returned when a session doesn't know its
+	// peer's identity key
+	ErrNoPeerIdentity = errors.New("session has no peer identity")
+	// ErrInvalidChallenge is returned for a challenge of the wrong size
+	ErrInvalidChallenge = errors.New("invalid auth challenge")
+	// ErrKeyConfirmationFailed is returned when the peer's key
+	// confirmation doesn't match our root key: the handshake went wrong,
+	// or someone in the middle agreed keys with each side
+	ErrKeyConfirmationFailed = errors.New("key confirmation failed")
+)
+
+// WithIdentityKey sets our identity private key, used by AuthResponse.
+// NewSession sets it from the KeyManager; use this for sessions created
+// with NewSessionDirect or DeserializeSession.
+func WithIdentityKey(priv ed25519.PrivateKey) SessionOption {
+	return func(s *Session) {
+		s.identityKey = priv
+	}
+}
+
+// WithPeerIdentity sets the peer's identity public key. NewSession sets
+// it from the recipient's bundle; use this for sessions created with
+// NewSessionDirect.
+func WithPeerIdentity(pub ed25519.PublicKey) SessionOption {
+	return func(s *Session) {
+		s.peerIdentity = bytes.Clone(pub)
+	}
+}
+
+// PeerIdentity returns a copy of the identity public key of the peer the
+// session was created with, or nil if it isn't known
+func (s *Session) PeerIdentity() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.peerIdentity)
+}
+
+// AuthChallenge returns a random nonce for the peer to sign with AuthResponse
+func (s *Session) AuthChallenge() ([]byte, error) {
+	challenge := make([]byte, AuthChallengeSize)
+	if _, err := io.ReadFull(randReader, challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// AuthResponse proves ownership of our identity key by signing the peer's
+// challenge. The signature is bound to this session, so it can't be relayed
+// into a session with someone else.
+func (s *Session) AuthResponse(challenge []byte) ([]byte, error) {
+	if len(challenge) != AuthChallengeSize {
+		return nil, ErrInvalidChallenge
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.identityKey) != ed25519.PrivateKeySize {
+		return nil, ErrNoIdentityKey
+	}
+	return ed25519.Sign(s.identityKey, s.authMessage(challenge)), nil
+}
+
+// VerifyAuthResponse checks that response is peerIdentity's signature over
+// challenge for this session
+func (s *Session) VerifyAuthResponse(challenge, response, peerIdentity []byte) bool {
+	if len(challenge) != AuthChallengeSize || len(peerIdentity) != ed25519.PublicKeySize {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ed25519.Verify(peerIdentity, s.authMessage(challenge), response)
+}
+
+// VerifyPeerAuthResponse is VerifyAuthResponse against the session's own
+// PeerIdentity. It fails if the peer identity isn't known.
+func (s *Session) VerifyPeerAuthResponse(challenge, response []byte) bool {
+	return s.VerifyAuthResponse(challenge, response, s.PeerIdentity())
+}
+
+// authMessage is the signed payload: context, a hash of the shared root key
+// binding the proof to this session, and the challenge. The caller must
+// hold s.mu.
+func (s *Session) authMessage(challenge []byte) []byte {
+	binding := sha256.Sum256(append([]byte(authContext), s.rootKey[:]...))
+
+	msg := make([]byte, 0, len(authContext)+len(binding)+len(challenge))
+	msg = append(msg, authContext...)
+	msg = append(msg, binding[:]...)
+	return append(msg, challenge...)
+}
+
+// KeyConfirmation returns a MAC proving we derived the session's root
+// key. The initiator sends it as its first message, before any encrypted
+// ones, so the responder can check with VerifyKeyConfirmation that both
+// derived the same keys. It reveals nothing about the key.
+//
+// The MAC covers our identity key then the peer's, so it only verifies
+// in one direction: a confirmation reflected back at its sender fails.
+// Both identity keys must be known.
+func (s *Session) KeyConfirmation() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ours, peer, err := s.identityPair()
+	if err != nil {
+		return nil, err
+	}
+	return s.keyConfirmationMAC(ours, peer), nil
+}
+
+// VerifyKeyConfirmation checks the peer's KeyConfirmation against our
+// root key, returning ErrKeyConfirmationFailed on a mismatch
+func (s *Session) VerifyKeyConfirmation(confirmation []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ours, peer, err := s.identityPair()
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(confirmation, s.keyConfirmationMAC(peer, ours)) {
+		return ErrKeyConfirmationFailed
+	}
+	return nil
+}
+
+// identityPair returns our identity public key and the peer's
+func (s *Session) identityPair() (ours, peer []byte, err error) {
+	if len(s.identityKey) != ed25519.PrivateKeySize {
+		return nil, nil, ErrNoIdentityKey
+	}
+	if len(s.peerIdentity) != ed25519.PublicKeySize {
+		return nil, nil, ErrNoPeerIdentity
+	}
+	return s.identityKey.Public().(ed25519.PublicKey), s.peerIdentity, nil
+}
+
+// keyConfirmationMAC is the confirmation sent by the holder of identity
+// key from to the holder of to. Its key is derived from the root key, so
+// the root key itself is only ever used as KDF input.
+func (s *Session) keyConfirmationMAC(from, to []byte) []byte {
+	key := make([]byte, sha256.Size)
+	io.ReadFull(hkdf.New(sha256.New, s.rootKey[:], nil, []byte(keyConfirmInfo)), key)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyConfirmLabel))
+	mac.Write(from)
+	mac.Write(to)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// Message header flags
+const (
+	// flagCompressed marks a DEFLATE-compressed plaintext
+	flagCompressed byte = 1 << 0
+	// flagRatchet marks a header followed by the ratchet extension
+	// (see ratchetExtSize)
+	flagRatchet byte = 1 << 1
+
+	knownFlags = flagCompressed | flagRatchet
+)
+
+// ErrUnknownFlags is returned for a ciphertext whose header sets flags
+// this build doesn't support
+var ErrUnknownFlags = errors.New("unknown message header flags")
+
+// WithCompression makes the session DEFLATE-compress each plaintext
+// before encrypting it, when that makes it smaller. Decrypt handles
+// compressed messages whether or not this is set.
+func WithCompression(enabled bool) SessionOption {
+	return func(s *Session) {
+		s.compress = enabled
+	}
+}
+
+// deflate compresses p, returning nil if that doesn't make it smaller
+func deflate(p []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(p)
+	w.Close()
+
+	if buf.Len() >= len(p) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// inflate decompresses p, failing with ErrTooLarge beyond limit bytes
+func inflate(p []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
@@ -3,18 +3,29 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 )
 
+// randReader is the entropy source for all key and nonce generation.
+// It is always crypto/rand outside of tests.
+var randReader io.Reader = rand.Reader
+
 // KeyBundle contains all identity keys (private + public)
 type KeyBundle struct {
 	IdentityPublicKey   []byte `json:"identity_public_key"`
@@ -22,19 +33,112 @@ type KeyBundle struct {
 	SignedPreKey        []byte `json:"signed_prekey"`
 	SignedPreKeyPrivate []byte `json:"-"` // Never export
 	Signature           []byte `json:"signature"`
+	CreatedAt           int64  `json:"created_at,omitempty"` // Unix seconds the signed prekey was generated
+	ExpiresAt           int64  `json:"expires_at,omitempty"` // Unix seconds; zero means no expiry
 }
 
-// PublicKeyBundle contains only public keys (safe to share)
+// PublicKeyBundle contains only public keys (safe to share). CreatedAt and
+// ExpiresAt belong to the signed prekey and are covered by its signature.
 type PublicKeyBundle struct {
 	IdentityPublicKey []byte `json:"identity_public_key"`
 	SignedPreKey      []byte `json:"signed_prekey"`
 	Signature         []byte `json:"signature"`
 	OneTimePreKey     []byte `json:"one_time_prekey,omitempty"`
+	CreatedAt         int64  `json:"created_at,omitempty"` // Unix seconds
+	ExpiresAt         int64  `json:"expires_at,omitempty"` // Unix seconds; zero means no expiry
+}
+
+// ErrBundleExpired is returned when creating a session from an expired bundle
+var ErrBundleExpired = errors.New("key bundle expired")
+
+var (
+	// ErrInvalidBundle is returned when a bundle's keys are malformed or
+	// its signed prekey signature doesn't verify
+	ErrInvalidBundle = errors.New("invalid key bundle")
+	// ErrSignatureInvalid is returned, wrapped in ErrInvalidBundle, when a
+	// bundle's signed prekey signature doesn't verify
+	ErrSignatureInvalid = errors.New("signature invalid")
+)
+
+// ErrKeysNotInitialized is returned by KeyManager methods that need
+// identity keys before they are generated or imported
+var ErrKeysNotInitialized = errors.New("keys not initialized")
+
+// Expired reports whether the bundle's expiry has passed at now
+func (b *PublicKeyBundle) Expired(now time.Time) bool {
+	return b.ExpiresAt != 0 && now.Unix() >= b.ExpiresAt
+}
+
+// Verify checks key sizes and that the signed prekey is signed by the
+// identity key
+func (b *PublicKeyBundle) Verify() error {
+	if len(b.IdentityPublicKey) != ed25519.PublicKeySize ||
+		len(b.SignedPreKey) != 32 ||
+		len(b.Signature) != ed25519.SignatureSize {
+		return ErrInvalidBundle
+	}
+	message := signedPreKeyMessage(b.SignedPreKey, b.CreatedAt, b.ExpiresAt)
+	if !ed25519.Verify(b.IdentityPublicKey, message, b.Signature) {
+		return fmt.Errorf("%w: %w", ErrInvalidBundle, ErrSignatureInvalid)
+	}
+	return nil
+}
+
+// signedPreKeyMessage returns the bytes a signed prekey's signature
+// covers: the prekey, then its creation and expiry times as big-endian
+// int64s. Bundles from before prekeys were stamped have neither time and
+// sign the prekey alone; stripping the times from a stamped bundle breaks
+// its signature.
+func signedPreKeyMessage(preKey []byte, createdAt, expiresAt int64) []byte {
+	if createdAt == 0 && expiresAt == 0 {
+		return preKey
+	}
+	message := bytes.Clone(preKey)
+	message = binary.BigEndian.AppendUint64(message, uint64(createdAt))
+	return binary.BigEndian.AppendUint64(message, uint64(expiresAt))
+}
+
+// Fingerprint returns the hex SHA-256 of the identity key, for comparing
+// out of band
+func (b *PublicKeyBundle) Fingerprint() string {
+	sum := sha256.Sum256(b.IdentityPublicKey)
+	return hex.EncodeToString(sum[:])
 }
 
-// KeyManager manages cryptographic keys
+// canonicalBundleVersion is the current CanonicalBytes layout
+const canonicalBundleVersion = 1
+
+// CanonicalBytes returns a fixed binary encoding of the bundle for
+// hashing or signing it as a whole, so the Go and Rust cores agree on the
+// bytes regardless of JSON field order or byte-slice encoding. Layout: a
+// version byte; the identity key, signed prekey, signature and one-time
+// prekey, each as a big-endian uint32 length then the raw bytes; then
+// CreatedAt and ExpiresAt as big-endian int64s.
+func (b *PublicKeyBundle) CanonicalBytes() []byte {
+	fields := [][]byte{b.IdentityPublicKey, b.SignedPreKey, b.Signature, b.OneTimePreKey}
+
+	size := 1 + 4*len(fields) + 16
+	for _, f := range fields {
+		size += len(f)
+	}
+	buf := make([]byte, 0, size)
+
+	buf = append(buf, canonicalBundleVersion)
+	for _, f := range fields {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(f)))
+		buf = append(buf, f...)
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(b.CreatedAt))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(b.ExpiresAt))
+	return buf
+}
+
+// KeyManager manages cryptographic keys. It is safe for concurrent use.
 type KeyManager struct {
-	identityKeys *KeyBundle
+	mu             sync.Mutex
+	identityKeys   *KeyBundle
+	prevPreKey     []byte // Signed prekey private replaced by the last rotation
+	bundleLifetime time.Duration
 }
 
 // NewKeyManager creates a new key manager
@@ -46,80 +150,333 @@ func NewKeyManager() *KeyManager {
 // This is called once during signup
 func (km *KeyManager) GenerateIdentityKeys() (*KeyBundle, error) {
 	// Generate Ed25519 identity key pair (for signing)
-	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(randReader, seed); err != nil {
 		return nil, err
 	}
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
 
-	// Generate X25519 signed prekey (for key agreement)
-	var preKeyPrivate [32]byte
-	if _, err := io.ReadFull(rand.Reader, preKeyPrivate[:]); err != nil {
+	bundle := &KeyBundle{
+		IdentityPublicKey:  publicKey,
+		IdentityPrivateKey: privateKey,
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	if err := bundle.newSignedPreKey(km.bundleLifetime); err != nil {
 		return nil, err
 	}
+	km.identityKeys, km.prevPreKey = bundle, nil
+	return bundle, nil
+}
 
-	var preKeyPublic [32]byte
-	curve25519.ScalarBaseMult(&preKeyPublic, &preKeyPrivate)
+// RotateSignedPreKey replaces the signed prekey, keeping the identity
+// keys. The previous prekey is kept until the next rotation, so sessions
+// can still follow peer rekeys made against it. Peers pick up the new
+// bundle with Session.UpdatePeerBundle; pass the new private key to
+// existing sessions with Session.UpdateOwnPreKey, or rotate through
+// SessionManager.RotateSignedPreKey, which does both.
+func (km *KeyManager) RotateSignedPreKey() (*KeyBundle, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
 
-	// Sign the signed prekey with identity key
-	signature := ed25519.Sign(privateKey, preKeyPublic[:])
+	if km.identityKeys == nil {
+		return nil, ErrKeysNotInitialized
+	}
+	bundle := *km.identityKeys
+	if err := bundle.newSignedPreKey(km.bundleLifetime); err != nil {
+		return nil, err
+	}
+	km.prevPreKey = km.identityKeys.SignedPreKeyPrivate
+	km.identityKeys = &bundle
+	return &bundle, nil
+}
 
-	bundle := &KeyBundle{
-		IdentityPublicKey:   publicKey,
-		IdentityPrivateKey:  privateKey,
-		SignedPreKey:        preKeyPublic[:],
-		SignedPreKeyPrivate: preKeyPrivate[:],
-		Signature:           signature,
+// newSignedPreKey generates an X25519 signed prekey (for key agreement),
+// stamps it with the current time and, for a nonzero lifetime, an expiry,
+// and signs the prekey and both times with the identity key
+func (b *KeyBundle) newSignedPreKey(lifetime time.Duration) error {
+	var preKeyPrivate [32]byte
+	if _, err := io.ReadFull(randReader, preKeyPrivate[:]); err != nil {
+		return err
 	}
 
-	km.identityKeys = bundle
-	return bundle, nil
+	var preKeyPublic [32]byte
+	curve25519.ScalarBaseMult(&preKeyPublic, &preKeyPrivate)
+
+	now := time.Now()
+	b.SignedPreKey = preKeyPublic[:]
+	b.SignedPreKeyPrivate = preKeyPrivate[:]
+	b.CreatedAt, b.ExpiresAt = now.Unix(), 0
+	if lifetime > 0 {
+		b.ExpiresAt = now.Add(lifetime).Unix()
+	}
+	b.Signature = ed25519.Sign(b.IdentityPrivateKey, signedPreKeyMessage(b.SignedPreKey, b.CreatedAt, b.ExpiresAt))
+	return nil
 }
 
-// GetPublicKeyBundle returns the public key bundle (safe to share)
+// GetPublicKeyBundle returns the public key bundle (safe to share). Its
+// times are those signed with the prekey, so repeated calls return the
+// same bundle until the next rotation.
 func (km *KeyManager) GetPublicKeyBundle() (*PublicKeyBundle, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
 	if km.identityKeys == nil {
-		return nil, errors.New("keys not initialized")
+		return nil, ErrKeysNotInitialized
 	}
 
 	return &PublicKeyBundle{
 		IdentityPublicKey: km.identityKeys.IdentityPublicKey,
 		SignedPreKey:      km.identityKeys.SignedPreKey,
 		Signature:         km.identityKeys.Signature,
+		CreatedAt:         km.identityKeys.CreatedAt,
+		ExpiresAt:         km.identityKeys.ExpiresAt,
 	}, nil
 }
 
+// Reset discards the identity keys and previous signed prekey, e.g. for
+// a factory reset. Keys must be generated or imported again before use.
+func (km *KeyManager) Reset() {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	km.identityKeys, km.prevPreKey = nil, nil
+}
+
+// SetBundleLifetime makes signed prekeys generated from now on, by
+// GenerateIdentityKeys or RotateSignedPreKey, expire after d. The current
+// prekey keeps the expiry it was signed with. Zero (the default) means
+// prekeys don't expire.
+func (km *KeyManager) SetBundleLifetime(d time.Duration) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	km.bundleLifetime = d
+}
+
 // GetSignedPreKeyPrivate returns the private signed prekey (for session creation)
 func (km *KeyManager) GetSignedPreKeyPrivate() ([]byte, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
 	if km.identityKeys == nil {
-		return nil, errors.New("keys not initialized")
+		return nil, ErrKeysNotInitialized
 	}
 	return km.identityKeys.SignedPreKeyPrivate, nil
 }
 
-// Session represents an encrypted session with a contact
+// previousSignedPreKeyPrivate returns the signed prekey private replaced
+// by the last RotateSignedPreKey, or nil
+func (km *KeyManager) previousSignedPreKeyPrivate() []byte {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	return km.prevPreKey
+}
+
+// identityPrivateKey returns the identity private key, or nil before
+// keys are generated or imported
+func (km *KeyManager) identityPrivateKey() ed25519.PrivateKey {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if km.identityKeys == nil {
+		return nil
+	}
+	return km.identityKeys.IdentityPrivateKey
+}
+
+// KDFConfig holds the HKDF parameters used for key derivation.
+// Sessions created with different configs derive unrelated keys from the
+// same shared secret, which keeps protocol versions and test vectors apart.
+type KDFConfig struct {
+	SessionInfo string           // HKDF info for root/chain key derivation
+	MessageInfo string           // HKDF info for per-message key derivation
+	Hash        func() hash.Hash // Hash function used by HKDF
+
+	// AppLabel namespaces sessions by deployment, e.g. "staging", so apps
+	// sharing key bundles can't establish cross-decryptable sessions.
+	// It is mixed into the session info; empty leaves it unchanged.
+	AppLabel string
+}
+
+// DefaultKDFConfig returns the KDF parameters of the current protocol
+func DefaultKDFConfig() KDFConfig {
+	return KDFConfig{
+		SessionInfo: "merabriar_session",
+		MessageInfo: "merabriar_message",
+		Hash:        sha256.New,
+	}
+}
+
+// withDefaults fills any unset fields from DefaultKDFConfig
+func (c KDFConfig) withDefaults() KDFConfig {
+	def := DefaultKDFConfig()
+	if c.SessionInfo == "" {
+		c.SessionInfo = def.SessionInfo
+	}
+	if c.MessageInfo == "" {
+		c.MessageInfo = def.MessageInfo
+	}
+	if c.Hash == nil {
+		c.Hash = def.Hash
+	}
+	return c
+}
+
+// sessionInfo returns the session info, with the app label if set
+func (c KDFConfig) sessionInfo() []byte {
+	if c.AppLabel == "" {
+		return []byte(c.SessionInfo)
+	}
+	return []byte(c.SessionInfo + "\x00" + c.AppLabel)
+}
+
+// handshakeInfo returns the HKDF info for session key derivation: the
+// session info, a zero byte, the protocol version and cipher suite, then
+// the message info. Peers that disagree on any of them derive unrelated
+// keys, so a downgraded parameter can't go unnoticed.
+func (c KDFConfig) handshakeInfo(version uint8, suite CipherSuite) []byte {
+	info := append(c.sessionInfo(), 0, version, byte(suite))
+	return append(info, c.MessageInfo...)
+}
+
+// CipherSuite identifies the AEAD used to encrypt session messages
+type CipherSuite uint8
+
+const (
+	// SuiteAES256GCM is AES-256 in GCM mode with 96-bit random nonces
+	SuiteAES256GCM CipherSuite = 1
+	// SuiteAES128GCM is AES-128 in GCM mode with 96-bit random nonces,
+	// for constrained devices. The key is the first 16 bytes of the
+	// message key.
+	SuiteAES128GCM CipherSuite = 2
+)
+
+var (
+	// ErrUnknownCipherSuite is returned for a ciphertext or option naming
+	// a suite this build doesn't support
+	ErrUnknownCipherSuite = errors.New("unknown cipher suite")
+	// ErrCipherSuiteMismatch is returned for a ciphertext naming a
+	// different suite than the session's
+	ErrCipherSuiteMismatch = errors.New("cipher suite mismatch")
+)
+
+// valid reports whether the suite is known to this build
+func (c CipherSuite) valid() bool {
+	return c == SuiteAES256GCM || c == SuiteAES128GCM
+}
+
+// KeySize returns the AES key length in bytes, or 0 for an unknown suite
+func (c CipherSuite) KeySize() int {
+	switch c {
+	case SuiteAES256GCM:
+		return 32
+	case SuiteAES128GCM:
+		return 16
+	}
+	return 0
+}
+
+// SessionOption configures optional Session parameters
+type SessionOption func(*Session)
+
+// WithCipherSuite sets the suite the session encrypts with. Both peers
+// must use the same suite: NewSession binds it into the session keys, and
+// Decrypt rejects a ciphertext naming another suite with
+// ErrCipherSuiteMismatch. An unknown suite makes Encrypt fail.
+func WithCipherSuite(suite CipherSuite) SessionOption {
+	return func(s *Session) {
+		s.suite = suite
+	}
+}
+
+// WithKDFConfig sets the KDF parameters used by the session
+func WithKDFConfig(cfg KDFConfig) SessionOption {
+	return func(s *Session) {
+		s.kdf = cfg.withDefaults()
+		s.msgKDF = nil
+	}
+}
+
+// WithAppLabel sets the session's KDFConfig.AppLabel. Both peers must
+// use the same label. Apply it after any WithKDFConfig, which replaces the
+// whole config.
+func WithAppLabel(label string) SessionOption {
+	return func(s *Session) {
+		s.kdf.AppLabel = label
+	}
+}
+
+// Session represents an encrypted session with a contact.
+// It is safe for concurrent use.
 type Session struct {
+	mu sync.Mutex
+
 	RecipientID  string
 	rootKey      [32]byte
 	sendChainKey [32]byte
 	recvChainKey [32]byte
 	sendCounter  uint32
 	recvCounter  uint32
+	kdf          KDFConfig
+	msgKDF       *messageKDF // Built from kdf on first use
+	suite        CipherSuite
+	compress     bool
+	version      uint8
+	ratchet      ratchetState
+
+	// Keys for messages skipped on the receive chain
+	skipped        skippedKeyCache
+	maxSkippedKeys int
+	maxSkip        uint32
+
+	// Largest ciphertext Decrypt will accept; zero means DefaultMaxMessageSize
+	maxMessageSize int
+
+	// Our identity private key, for AuthResponse. Not serialized.
+	identityKey ed25519.PrivateKey
+
+	// The peer's identity public key from the bundle the session was
+	// created from; nil if unknown
+	peerIdentity []byte
+
+	// Our keys, for the ratchet private key (see ratchetPrivate). Set by
+	// NewSession and SessionManager; not serialized.
+	keys *KeyManager
 }
 
 // NewSessionDirect creates a session with explicit chain keys (for testing/benchmarking)
-func NewSessionDirect(recipientID string, rootKey, sendChain, recvChain [32]byte) *Session {
-	return &Session{
+func NewSessionDirect(recipientID string, rootKey, sendChain, recvChain [32]byte, opts ...SessionOption) *Session {
+	s := &Session{
 		RecipientID:  recipientID,
 		rootKey:      rootKey,
 		sendChainKey: sendChain,
 		recvChainKey: recvChain,
 		sendCounter:  0,
 		recvCounter:  0,
+		kdf:          DefaultKDFConfig(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // NewSession creates a new session with a recipient
-func NewSession(recipientID string, km *KeyManager, recipientKeys *PublicKeyBundle) (*Session, error) {
+func NewSession(recipientID string, km *KeyManager, recipientKeys *PublicKeyBundle, opts ...SessionOption) (*Session, error) {
+	if recipientKeys == nil {
+		return nil, ErrInvalidBundle
+	}
+	// The key agreed with below must be exactly the signed bytes; Verify
+	// also rejects keys of the wrong length, which the copy into a
+	// [32]byte would otherwise truncate or pad
+	if err := recipientKeys.Verify(); err != nil {
+		return nil, err
+	}
+	if recipientKeys.Expired(time.Now()) {
+		return nil, ErrBundleExpired
+	}
+
 	// Get our signed prekey private
 	ourPreKeyPrivate, err := km.GetSignedPreKeyPrivate()
 	if err != nil {
@@ -138,86 +495,470 @@ func NewSession(recipientID string, km *KeyManager, recipientKeys *PublicKeyBund
 		return nil, err
 	}
 
+	session := &Session{
+		RecipientID:  recipientID,
+		kdf:          DefaultKDFConfig(),
+		identityKey:  km.identityPrivateKey(),
+		peerIdentity: bytes.Clone(recipientKeys.IdentityPublicKey),
+		keys:         km,
+		ratchet: ratchetState{
+			peerPublic: bytes.Clone(recipientKeys.SignedPreKey),
+		},
+	}
+	for _, opt := range opts {
+		opt(session)
+	}
+
 	// Derive keys using HKDF
-	hkdfReader := hkdf.New(sha256.New, sharedSecret, nil, []byte("merabriar_session"))
+	session.rootKey, session.sendChainKey, session.recvChainKey = deriveSessionKeys(
+		sharedSecret, session.kdf, session.ProtocolVersion(), session.CipherSuite())
+
+	return session, nil
+}
+
+// deriveSessionKeys derives the root key and both chain keys from a
+// shared secret, bound to the session's protocol version and cipher suite
+func deriveSessionKeys(sharedSecret []byte, cfg KDFConfig, version uint8, suite CipherSuite) (rootKey, sendChain, recvChain [32]byte) {
+	hkdfReader := hkdf.New(cfg.Hash, sharedSecret, nil, cfg.handshakeInfo(version, suite))
 
-	var rootKey, sendChain, recvChain [32]byte
 	io.ReadFull(hkdfReader, rootKey[:])
 	io.ReadFull(hkdfReader, sendChain[:])
 	io.ReadFull(hkdfReader, recvChain[:])
 
-	return &Session{
-		RecipientID:  recipientID,
-		rootKey:      rootKey,
-		sendChainKey: sendChain,
-		recvChainKey: recvChain,
-		sendCounter:  0,
-		recvCounter:  0,
-	}, nil
+	return rootKey, sendChain, recvChain
+}
+
+// headerSize is the length of the plaintext message header: the sender's
+// chain counter as a big-endian uint32, the CipherSuite byte, a flags
+// byte (see flagCompressed), then the session's protocol version. When
+// flagRatchet is set, the ratchet extension follows. The header, with any
+// extension, is authenticated as AAD.
+const headerSize = 7
+
+// ProtocolVersion is the message protocol version sessions are created
+// with. It is fixed for the life of a session and carried in every
+// message header, so a message can't be passed off under another version.
+const ProtocolVersion uint8 = 1
+
+// ErrProtocolVersionMismatch is returned for a message whose header
+// names a different protocol version than the session's
+var ErrProtocolVersionMismatch = errors.New("protocol version mismatch")
+
+// WithProtocolVersion sets the session's protocol version. Both peers must
+// agree on it; zero means ProtocolVersion.
+func WithProtocolVersion(v uint8) SessionOption {
+	return func(s *Session) {
+		s.version = v
+	}
+}
+
+// ProtocolVersion returns the session's protocol version
+func (s *Session) ProtocolVersion() uint8 {
+	if s.version == 0 {
+		return ProtocolVersion
+	}
+	return s.version
+}
+
+// DefaultMaxSkip is the default limit on how far ahead of the receive
+// chain a message counter may be
+const DefaultMaxSkip = 1000
+
+// DefaultMaxSkippedKeys is the default number of skipped message keys a
+// session retains
+const DefaultMaxSkippedKeys = 1000
+
+var (
+	// ErrMessageKeyNotFound is returned for a message whose key was already
+	// used or was never retained (duplicate or very old message)
+	ErrMessageKeyNotFound = errors.New("message key not found")
+	// ErrCounterTooFarAhead is returned when a message is too far ahead of
+	// the receive chain
+	ErrCounterTooFarAhead = errors.New("message counter too far ahead")
+	// ErrTooLarge is returned when a ciphertext exceeds the session's
+	// maximum message size
+	ErrTooLarge = errors.New("ciphertext too large")
+	// ErrCiphertextTooShort is returned for a ciphertext too short to hold
+	// its header and nonce
+	ErrCiphertextTooShort = errors.New("ciphertext too short")
+	// ErrDecryptFailed is returned when a ciphertext doesn't authenticate:
+	// it was tampered with or encrypted under a different key
+	ErrDecryptFailed = errors.New("decryption failed")
+)
+
+// DefaultMaxMessageSize is the default largest ciphertext Decrypt accepts
+const DefaultMaxMessageSize = 16 << 20
+
+// WithMaxMessageSize sets the largest ciphertext Decrypt will accept.
+// Zero uses DefaultMaxMessageSize.
+func WithMaxMessageSize(n int) SessionOption {
+	return func(s *Session) {
+		s.maxMessageSize = n
+	}
+}
+
+// MaxMessageSize returns the largest ciphertext Decrypt will accept
+func (s *Session) MaxMessageSize() int {
+	if s.maxMessageSize <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return s.maxMessageSize
+}
+
+// WithMaxSkippedKeys caps how many skipped message keys the session
+// retains, and so how many Serialize persists. When full, the oldest key is
+// evicted. Zero uses DefaultMaxSkippedKeys.
+func WithMaxSkippedKeys(n int) SessionOption {
+	return func(s *Session) {
+		s.maxSkippedKeys = n
+	}
+}
+
+// WithMaxSkip limits how far ahead of the receive chain a message counter
+// may be. Zero uses DefaultMaxSkip.
+func WithMaxSkip(n uint32) SessionOption {
+	return func(s *Session) {
+		s.maxSkip = n
+	}
+}
+
+// skippedKeyLimit returns the skipped-key cache capacity
+func (s *Session) skippedKeyLimit() int {
+	if s.maxSkippedKeys <= 0 {
+		return DefaultMaxSkippedKeys
+	}
+	return s.maxSkippedKeys
+}
+
+// maxSkipAhead returns how far ahead a message counter may be
+func (s *Session) maxSkipAhead() uint32 {
+	if s.maxSkip == 0 {
+		return DefaultMaxSkip
+	}
+	return s.maxSkip
 }
 
 // Encrypt encrypts a message for the recipient
 func (s *Session) Encrypt(plaintext []byte) ([]byte, error) {
-	// Derive message key
-	messageKey := s.deriveSendKey()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Create AES-GCM cipher
-	block, err := aes.NewCipher(messageKey[:])
-	if err != nil {
-		return nil, err
+	suite := s.CipherSuite()
+	if !suite.valid() {
+		return nil, ErrUnknownCipherSuite
+	}
+
+	if s.rekeyDue() {
+		if err := s.rekeyLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Header carries the counter so the receiver can handle reordering,
+	// and the suite so it knows the key size
+	header := make([]byte, headerSize, headerSize+ratchetExtSize)
+	binary.BigEndian.PutUint32(header, s.sendCounter)
+	header[4] = byte(suite)
+	header[6] = s.ProtocolVersion()
+	header = s.appendRatchetExt(header)
+
+	if s.compress {
+		if compressed := deflate(plaintext); compressed != nil {
+			plaintext = compressed
+			header[5] |= flagCompressed
+		}
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	// Derive message key; the cipher keeps its own expanded copy
+	messageKey := s.deriveSendKey()
+
+	// Create AES-GCM cipher
+	aesGCM, err := newGCM(suite, messageKey)
+	clear(messageKey[:])
 	if err != nil {
 		return nil, err
 	}
 
 	// Generate random nonce
 	nonce := make([]byte, aesGCM.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	if _, err := io.ReadFull(randReader, nonce); err != nil {
 		return nil, err
 	}
 
-	// Encrypt (nonce is prepended to ciphertext)
-	ciphertext := aesGCM.Seal(nonce, nonce, plaintext, nil)
+	// Encrypt (header and nonce are prepended to ciphertext)
+	out := append(header, nonce...)
+	ciphertext := aesGCM.Seal(out, nonce, plaintext, header)
 
 	return ciphertext, nil
 }
 
-// Decrypt decrypts a message from the sender
+// Decrypt decrypts a message from the sender.
+// Messages may arrive out of order: keys for skipped counters are retained
+// so the earlier messages can still be decrypted when they arrive.
 func (s *Session) Decrypt(ciphertext []byte) ([]byte, error) {
-	// Derive message key
-	messageKey := s.deriveRecvKey()
+	if len(ciphertext) > s.MaxMessageSize() {
+		return nil, ErrTooLarge
+	}
 
-	// Create AES-GCM cipher
-	block, err := aes.NewCipher(messageKey[:])
-	if err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.decryptLocked(ciphertext)
+}
+
+// DecryptBatch decrypts ciphertexts in order under a single lock, e.g.
+// when catching up on queued messages after reconnecting. Results are
+// positional: plaintexts[i] is nil where errs[i] is set. A failed
+// message doesn't stop the rest and, as with Decrypt, leaves the ratchet
+// unchanged.
+func (s *Session) DecryptBatch(ciphertexts [][]byte) (plaintexts [][]byte, errs []error) {
+	plaintexts = make([][]byte, len(ciphertexts))
+	errs = make([]error, len(ciphertexts))
+	maxSize := s.MaxMessageSize()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, ciphertext := range ciphertexts {
+		if len(ciphertext) > maxSize {
+			errs[i] = ErrTooLarge
+			continue
+		}
+		plaintexts[i], errs[i] = s.decryptLocked(ciphertext)
+	}
+	return plaintexts, errs
+}
+
+// Authenticates reports whether ciphertext is the next message from the
+// session's peer, or one whose skipped key is retained. It is a cheap
+// probe for checking a message against many sessions: unlike Decrypt it
+// never derives keys ahead of the receive chain, follows a peer rekey or
+// decompresses, so it rejects some messages Decrypt would accept. The
+// ratchet is unchanged.
+func (s *Session) Authenticates(ciphertext []byte) bool {
+	if len(ciphertext) > s.MaxMessageSize() {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.openLocked(ciphertext, nil, s.rootKey, true)
+	return err == nil
+}
+
+// decryptLocked decrypts one message; s.mu must be held
+func (s *Session) decryptLocked(ciphertext []byte) ([]byte, error) {
+	private := s.ratchetPrivate()
+	plaintext, err := s.openLocked(ciphertext, private, s.rootKey, false)
+	if !errors.Is(err, ErrDecryptFailed) {
+		return plaintext, err
+	}
+
+	// The peer's first rekey against our rotated prekey
+	if len(s.ratchet.pendingRoot) > 0 {
+		var pending [32]byte
+		copy(pending[:], s.ratchet.pendingRoot)
+		if plaintext, err := s.openLocked(ciphertext, private, pending, false); err == nil {
+			s.commitRootStep(pending)
+			return plaintext, nil
+		}
+	}
+
+	// A peer rekey made before the last prekey change on either side
+	prevPrivate, prevRoot := s.prevRatchetPrivate(), s.rootKey
+	if len(s.ratchet.prevRoot) > 0 {
+		copy(prevRoot[:], s.ratchet.prevRoot)
+	} else if prevPrivate == nil {
 		return nil, err
 	}
+	if prevPrivate == nil {
+		prevPrivate = private
+	}
+	return s.openLocked(ciphertext, prevPrivate, prevRoot, false)
+}
+
+// openLocked decrypts ciphertext, following any new peer rekey with our
+// ratchet private key ratchetPrivate under root key root, and commits
+// the ratchet state. With
+// probe set it only authenticates: the ratchet is unchanged, and messages
+// that would need skipped keys derived or a rekey followed are rejected,
+// so the cost is one key derivation. s.mu must be held.
+func (s *Session) openLocked(ciphertext, ratchetPrivate []byte, root [32]byte, probe bool) ([]byte, error) {
+	if len(ciphertext) < headerSize {
+		return nil, ErrCiphertextTooShort
+	}
+	counter := binary.BigEndian.Uint32(ciphertext)
+	suite := CipherSuite(ciphertext[4])
+	flags := ciphertext[5]
+	version := ciphertext[6]
+
+	// Reject headers naming other parameters before deriving any keys
+	if !suite.valid() {
+		return nil, ErrUnknownCipherSuite
+	}
+	if suite != s.CipherSuite() {
+		return nil, ErrCipherSuiteMismatch
+	}
+	if flags&^knownFlags != 0 {
+		return nil, ErrUnknownFlags
+	}
+	if version != s.ProtocolVersion() {
+		return nil, ErrProtocolVersionMismatch
+	}
+
+	// Messages sent after a rekey carry the sender's ratchet key and the
+	// counter it took effect from
+	header := ciphertext[:headerSize]
+	var ratchetPublic []byte
+	var ratchetStart uint32
+	if flags&flagRatchet != 0 {
+		if len(ciphertext) < headerSize+ratchetExtSize {
+			return nil, ErrCiphertextTooShort
+		}
+		header = ciphertext[:headerSize+ratchetExtSize]
+		ratchetPublic = header[headerSize : headerSize+32]
+		ratchetStart = binary.BigEndian.Uint32(header[headerSize+32:])
+		if ratchetStart > counter {
+			return nil, ErrRatchetOutOfOrder
+		}
+	}
+
+	// Derive message key without committing chain state until
+	// the message authenticates
+	var messageKey, chainKey [32]byte
+	var skipped []skippedEntry
+	var followed []byte
+
+	if counter < s.recvCounter {
+		key, ok := s.skipped.get(counter)
+		if !ok {
+			return nil, ErrMessageKeyNotFound
+		}
+		messageKey = key
+	} else {
+		if counter-s.recvCounter > s.maxSkipAhead() || (probe && counter != s.recvCounter) {
+			return nil, ErrCounterTooFarAhead
+		}
+		chainKey = s.recvChainKey
+		c := s.recvCounter
+		if ratchetPublic != nil && !bytes.Equal(ratchetPublic, s.ratchet.recvPublic) {
+			// A new peer rekey: finish the old chain up to where it
+			// took effect, then switch
+			if ratchetStart < s.recvCounter || probe {
+				return nil, ErrRatchetOutOfOrder
+			}
+			for ; c < ratchetStart; c++ {
+				var key [32]byte
+				key, chainKey = s.deriveMessageKey(chainKey, c)
+				skipped = append(skipped, skippedEntry{c, key})
+			}
+			var err error
+			if chainKey, err = s.followRatchet(ratchetPrivate, ratchetPublic, root); err != nil {
+				return nil, err
+			}
+			followed = ratchetPublic
+		}
+		for ; c < counter; c++ {
+			var key [32]byte
+			key, chainKey = s.deriveMessageKey(chainKey, c)
+			skipped = append(skipped, skippedEntry{c, key})
+		}
+		messageKey, chainKey = s.deriveMessageKey(chainKey, counter)
+	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	// Create AES-GCM cipher
+	aesGCM, err := newGCM(suite, messageKey)
+	clear(messageKey[:])
 	if err != nil {
 		return nil, err
 	}
 
 	nonceSize := aesGCM.NonceSize()
-	if len(ciphertext) < nonceSize {
-		return nil, errors.New("ciphertext too short")
+	if len(ciphertext) < len(header)+nonceSize {
+		return nil, ErrCiphertextTooShort
 	}
 
 	// Extract nonce and ciphertext
-	nonce, encrypted := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	nonce, encrypted := ciphertext[len(header):len(header)+nonceSize], ciphertext[len(header)+nonceSize:]
 
 	// Decrypt
-	plaintext, err := aesGCM.Open(nil, nonce, encrypted, nil)
+	plaintext, err := aesGCM.Open(nil, nonce, encrypted, header)
 	if err != nil {
-		return nil, err
+		return nil, ErrDecryptFailed
+	}
+	if probe {
+		return plaintext, nil
+	}
+	if flags&flagCompressed != 0 {
+		if plaintext, err = inflate(plaintext, s.MaxMessageSize()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Commit ratchet state
+	if counter < s.recvCounter {
+		s.skipped.remove(counter)
+	} else {
+		limit := s.skippedKeyLimit()
+		for _, entry := range skipped {
+			s.skipped.put(entry.counter, entry.key, limit)
+		}
+		s.recvChainKey = chainKey
+		s.recvCounter = counter + 1
+		if followed != nil {
+			s.ratchet.recvPublic = bytes.Clone(followed)
+		}
 	}
 
 	return plaintext, nil
 }
 
-// deriveSendKey derives the next message key for sending
+// CipherSuite returns the AEAD the session encrypts with (default
+// SuiteAES256GCM)
+func (s *Session) CipherSuite() CipherSuite {
+	if s.suite == 0 {
+		return SuiteAES256GCM
+	}
+	return s.suite
+}
+
+// Counters returns the send and receive chain counters, for diagnostics
+func (s *Session) Counters() (send, recv uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sendCounter, s.recvCounter
+}
+
+// SkippedKeys returns how many skipped message keys the session retains
+func (s *Session) SkippedKeys() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.skipped.len()
+}
+
+// SkippedKeyEvictions returns how many skipped message keys were dropped
+// because the cache was full, for diagnostics
+func (s *Session) SkippedKeyEvictions() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.skipped.evictions
+}
+
+// newBlockCipher creates the AES block cipher; tests wrap it to observe
+// key sizes
+var newBlockCipher = aes.NewCipher
+
+// newGCM creates an AES-GCM AEAD for a message key, truncating the key to
+// the suite's key size
+func newGCM(suite CipherSuite, key [32]byte) (cipher.AEAD, error) {
+	block, err := newBlockCipher(key[:suite.KeySize()])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveSendKey derives the next message key for sending. The chain only
+// steps forward, so the old chain key isn't recoverable from the new one.
 func (s *Session) deriveSendKey() [32]byte {
 	messageKey, newChainKey := s.deriveMessageKey(s.sendChainKey, s.sendCounter)
 	s.sendChainKey = newChainKey
@@ -235,14 +976,19 @@ func (s *Session) deriveRecvKey() [32]byte {
 
 // deriveMessageKey derives a message key from chain key using HKDF
 func (s *Session) deriveMessageKey(chainKey [32]byte, counter uint32) ([32]byte, [32]byte) {
-	// Use counter as salt
-	salt := []byte{byte(counter >> 24), byte(counter >> 16), byte(counter >> 8), byte(counter)}
+	if s.msgKDF == nil {
+		s.msgKDF = newMessageKDF(s.kdf.withDefaults())
+	}
+	k := s.msgKDF
 
-	hkdfReader := hkdf.New(sha256.New, chainKey[:], salt, []byte("merabriar_message"))
+	// Use counter as salt
+	binary.BigEndian.PutUint32(k.salt[:], counter)
+	copy(k.secret[:], chainKey[:])
+	k.derive(k.secret[:], k.salt[:], k.out[:])
 
 	var messageKey, newChainKey [32]byte
-	io.ReadFull(hkdfReader, messageKey[:])
-	io.ReadFull(hkdfReader, newChainKey[:])
-
+	copy(messageKey[:], k.out[:32])
+	copy(newChainKey[:], k.out[32:])
+	k.wipe()
 	return messageKey, newChainKey
 }
@@ -0,0 +1,117 @@
+package crypto
+
+import "hash"
+
+// messageKDF computes the per-message HKDF (RFC 5869) with reusable hash
+// states and buffers, so deriving a message key doesn't allocate. Every
+// message sent or received runs one derivation; BenchmarkDeriveMessageKey
+// against BenchmarkDeriveMessageKeyHKDF measures about half the time,
+// with no allocations where hkdf.New makes 22 per derivation. The
+// output is checked against the RFC 5869 test vectors and against
+// hkdf.New with the same parameters. It is not safe for concurrent use;
+// a Session guards its own with s.mu.
+type messageKDF struct {
+	inner, outer hash.Hash
+	info         []byte
+	ipad, opad   []byte // HMAC key pads, one block each
+	prk, sum, t  []byte // Hash-sized scratch
+	counter      [1]byte
+
+	// Inputs and output of a message key derivation, kept here so they
+	// don't escape to the heap through the hash.Hash interface
+	secret [32]byte
+	salt   [4]byte
+	out    [64]byte
+}
+
+func newMessageKDF(cfg KDFConfig) *messageKDF {
+	inner, outer := cfg.Hash(), cfg.Hash()
+	block, size := inner.BlockSize(), inner.Size()
+	return &messageKDF{
+		inner: inner,
+		outer: outer,
+		info:  []byte(cfg.MessageInfo),
+		ipad:  make([]byte, block),
+		opad:  make([]byte, block),
+		prk:   make([]byte, 0, size),
+		sum:   make([]byte, 0, size),
+		t:     make([]byte, 0, size),
+	}
+}
+
+// setKey prepares the HMAC pads for key
+func (k *messageKDF) setKey(key []byte) {
+	if len(key) > len(k.ipad) {
+		k.outer.Reset()
+		k.outer.Write(key)
+		key = k.outer.Sum(k.sum[:0])
+	}
+	clear(k.ipad)
+	copy(k.ipad, key)
+	copy(k.opad, k.ipad)
+	for i := range k.ipad {
+		k.ipad[i] ^= 0x36
+		k.opad[i] ^= 0x5c
+	}
+}
+
+// finish completes the HMAC whose message was written to k.inner,
+// appending the tag to dst
+func (k *messageKDF) finish(dst []byte) []byte {
+	k.sum = k.inner.Sum(k.sum[:0])
+	k.outer.Reset()
+	k.outer.Write(k.opad)
+	k.outer.Write(k.sum)
+	return k.outer.Sum(dst)
+}
+
+// wipe zeroes the scratch buffers k owns and resets the hash states, so
+// the input chain key and derived keys aren't left in k between
+// derivations. It is best effort: Reset doesn't zero a hash's internal
+// block buffer, which still holds the last expand output, and Go may
+// leave other copies on the stack or heap. Forward secrecy rests on the
+// chain only stepping forward, not on this.
+func (k *messageKDF) wipe() {
+	if chainKeyScratchHook != nil {
+		chainKeyScratchHook(k.secret[:])
+	}
+	clear(k.secret[:])
+	clear(k.out[:])
+	clear(k.ipad)
+	clear(k.opad)
+	clear(k.prk[:cap(k.prk)])
+	clear(k.sum[:cap(k.sum)])
+	clear(k.t[:cap(k.t)])
+	k.inner.Reset()
+	k.outer.Reset()
+}
+
+// chainKeyScratchHook, if set, is called by wipe with the buffer holding
+// the chain key just derived from, before it is zeroed. Tests set it to
+// check the buffer doesn't retain the old key.
+var chainKeyScratchHook func(buf []byte)
+
+// derive fills out with HKDF(secret, salt, k.info)
+func (k *messageKDF) derive(secret, salt, out []byte) {
+	// Extract
+	k.setKey(salt)
+	k.inner.Reset()
+	k.inner.Write(k.ipad)
+	k.inner.Write(secret)
+	k.prk = k.finish(k.prk[:0])
+
+	// Expand
+	k.setKey(k.prk)
+	k.t = k.t[:0]
+	for n := 0; n < len(out); {
+		k.counter[0]++
+		k.inner.Reset()
+		k.inner.Write(k.ipad)
+		k.inner.Write(k.t)
+		k.inner.Write(k.info)
+		k.inner.Write(k.counter[:])
+		k.t = k.finish(k.t[:0])
+		n += copy(out[n:], k.t)
+	}
+	k.counter[0] = 0
+}
@@ -0,0 +1,281 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ratchetInfo is the HKDF info for deriving a chain key from a ratchet
+// DH output, and rootInfo for deriving a new root key when a signed
+// prekey changes
+const (
+	ratchetInfo = "merabriar_ratchet"
+	rootInfo    = "merabriar_root"
+)
+
+// ratchetExtSize is the length of the header extension carried, after the
+// fixed header, by every message sent once the session has rekeyed: the
+// sender's current ratchet public key, then the counter its chain took
+// effect from as a big-endian uint32. It is authenticated with the header.
+const ratchetExtSize = 36
+
+var (
+	// ErrNoRatchetKeys is returned when a session needs to rekey, or
+	// follow the peer's rekey, but has no ratchet keys
+	ErrNoRatchetKeys = errors.New("session has no ratchet keys")
+	// ErrRatchetOutOfOrder is returned for a message from a rekeyed chain
+	// that can't be followed from the current receive chain, e.g. one
+	// that arrives before any message of the previous rekey
+	ErrRatchetOutOfOrder = errors.New("message from an unknown ratchet step")
+	// ErrPeerIdentityMismatch is returned by UpdatePeerBundle for a bundle
+	// signed by an identity other than the session's peer
+	ErrPeerIdentityMismatch = errors.New("bundle identity doesn't match session peer")
+)
+
+// ratchetState is a session's DH rekeying state
+type ratchetState struct {
+	every uint32 // Rekey when the send counter reaches a multiple; zero never
+
+	// Follows the peer's rekeys. Nil for sessions created by NewSession,
+	// which use the KeyManager's signed prekey instead (see
+	// ratchetPrivate). Not serialized.
+	ourPrivate  []byte
+	prevPrivate []byte // Replaced by UpdateOwnPreKey; follows older rekeys. Not serialized.
+	peerPublic  []byte // Our rekeys agree with it
+
+	sendPublic []byte // Public key of our latest rekey; nil before the first
+	sendStart  uint32 // Send counter of our latest rekey
+	recvPublic []byte // Public key of the latest peer rekey followed
+
+	// Root keys around a signed prekey change (see UpdatePeerBundle)
+	prevRoot    []byte // Root key before the last root step; follows older rekeys
+	pendingRoot []byte // Root step for our rotated prekey, until the peer uses it
+}
+
+// WithRekeyEvery makes Encrypt perform a DH ratchet step on the send
+// chain every n messages, so a compromised chain key only exposes
+// messages up to the next rekey. Zero disables rekeying. The session needs
+// ratchet keys, which NewSession sets; see WithRatchetKeys.
+func WithRekeyEvery(n uint32) SessionOption {
+	return func(s *Session) {
+		s.ratchet.every = n
+	}
+}
+
+// WithRatchetKeys sets our X25519 ratchet private key, used to follow the
+// peer's rekeys, and the peer's ratchet public key, used for our own.
+// NewSession uses both sides' signed prekeys. The private key isn't
+// serialized; pass the option again to DeserializeSession.
+func WithRatchetKeys(ourPrivate, peerPublic []byte) SessionOption {
+	return func(s *Session) {
+		s.ratchet.ourPrivate = bytes.Clone(ourPrivate)
+		s.ratchet.peerPublic = bytes.Clone(peerPublic)
+	}
+}
+
+// UpdatePeerBundle switches the session to the peer's rotated signed
+// prekey. The bundle must verify, be unexpired and carry the session's
+// peer identity, if known. The root key takes a DH ratchet step with the
+// new prekey, and the send chain immediately rekeys from the new root, so
+// our next message uses fresh key material that only the holder of the
+// new private key can derive. Peer rekeys made under the old root key
+// can still be followed.
+func (s *Session) UpdatePeerBundle(newBundle *PublicKeyBundle) error {
+	if newBundle == nil {
+		return ErrInvalidBundle
+	}
+	if err := newBundle.Verify(); err != nil {
+		return err
+	}
+	if newBundle.Expired(time.Now()) {
+		return ErrBundleExpired
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.peerIdentity) > 0 && !bytes.Equal(s.peerIdentity, newBundle.IdentityPublicKey) {
+		return ErrPeerIdentityMismatch
+	}
+	if bytes.Equal(s.ratchet.peerPublic, newBundle.SignedPreKey) {
+		return nil
+	}
+
+	root, err := s.rootStep(s.ratchetPrivate(), newBundle.SignedPreKey)
+	if err != nil {
+		return err
+	}
+
+	r := &s.ratchet
+	prevRoot, prevPeer := s.rootKey, r.peerPublic
+	s.rootKey, r.peerPublic = root, bytes.Clone(newBundle.SignedPreKey)
+	if err := s.rekeyLocked(); err != nil {
+		s.rootKey, r.peerPublic = prevRoot, prevPeer
+		return err
+	}
+	clear(r.prevRoot)
+	clear(r.pendingRoot)
+	r.prevRoot, r.pendingRoot = prevRoot[:], nil
+	return nil
+}
+
+// UpdateOwnPreKey sets the ratchet private key after our signed prekey
+// is rotated (see KeyManager.RotateSignedPreKey). The previous key is kept
+// to follow peer rekeys made before the peer saw the new bundle. The
+// matching root step is held back until the first peer rekey against
+// the new prekey, so our own rekeys stay followable by a peer that hasn't
+// seen the new bundle yet.
+func (s *Session) UpdateOwnPreKey(private []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bytes.Equal(s.ratchet.ourPrivate, private) {
+		return nil
+	}
+
+	r := &s.ratchet
+	var pending []byte
+	if len(r.peerPublic) > 0 {
+		root, err := s.rootStep(private, r.peerPublic)
+		if err != nil {
+			return err
+		}
+		pending = root[:]
+	}
+	clear(r.prevPrivate)
+	clear(r.pendingRoot)
+	r.prevPrivate = r.ourPrivate
+	r.ourPrivate = bytes.Clone(private)
+	r.pendingRoot = pending
+	return nil
+}
+
+// rootStep returns the root key after a signed prekey change: our
+// ratchet private key agreed with the peer's signed prekey, mixed with
+// the current root key. Both peers derive it once they know the new
+// prekey, without exchanging anything else.
+func (s *Session) rootStep(private, peerPublic []byte) ([32]byte, error) {
+	if len(private) == 0 {
+		return [32]byte{}, ErrNoRatchetKeys
+	}
+	shared, err := curve25519.X25519(private, peerPublic)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var root [32]byte
+	io.ReadFull(hkdf.New(s.kdf.withDefaults().Hash, shared, s.rootKey[:], []byte(rootInfo)), root[:])
+	return root, nil
+}
+
+// commitRootStep makes the pending root step current, once a peer rekey
+// has been followed with it
+func (s *Session) commitRootStep(root [32]byte) {
+	r := &s.ratchet
+	clear(r.prevRoot)
+	clear(r.pendingRoot)
+	r.prevRoot, r.pendingRoot = bytes.Clone(s.rootKey[:]), nil
+	s.rootKey = root
+}
+
+// rekeyDue reports whether the next message should start a new send
+// chain; s.mu must be held
+func (s *Session) rekeyDue() bool {
+	r := &s.ratchet
+	if r.every == 0 || s.sendCounter == 0 || s.sendCounter%r.every != 0 {
+		return false
+	}
+	// Don't step twice at one counter if an Encrypt failed after rekeying
+	return r.sendPublic == nil || r.sendStart != s.sendCounter
+}
+
+// rekeyLocked starts a new send chain derived from a DH between a fresh
+// ratchet key and the peer's ratchet public key. s.mu must be held.
+func (s *Session) rekeyLocked() error {
+	if len(s.ratchet.peerPublic) == 0 {
+		return ErrNoRatchetKeys
+	}
+
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(randReader, private); err != nil {
+		return err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	shared, err := curve25519.X25519(private, s.ratchet.peerPublic)
+	if err != nil {
+		return err
+	}
+
+	s.sendChainKey = s.ratchetChain(s.rootKey, shared)
+	s.ratchet.sendPublic, s.ratchet.sendStart = public, s.sendCounter
+	return nil
+}
+
+// appendRatchetExt appends the ratchet header extension to header if the
+// session has rekeyed, setting flagRatchet
+func (s *Session) appendRatchetExt(header []byte) []byte {
+	if s.ratchet.sendPublic == nil {
+		return header
+	}
+	header[5] |= flagRatchet
+	header = append(header, s.ratchet.sendPublic...)
+	return binary.BigEndian.AppendUint32(header, s.ratchet.sendStart)
+}
+
+// ratchetPrivate returns our ratchet private key: the one set with
+// WithRatchetKeys or UpdateOwnPreKey, else the KeyManager's current
+// signed prekey, referenced rather than copied so it isn't serialized
+// with the session. Nil if there is neither.
+func (s *Session) ratchetPrivate() []byte {
+	if len(s.ratchet.ourPrivate) > 0 {
+		return s.ratchet.ourPrivate
+	}
+	if s.keys != nil {
+		if private, err := s.keys.GetSignedPreKeyPrivate(); err == nil {
+			return private
+		}
+	}
+	return nil
+}
+
+// prevRatchetPrivate returns our ratchet private key before the last
+// prekey rotation: the one replaced by UpdateOwnPreKey, else the
+// KeyManager's previous signed prekey. Nil if there is neither.
+func (s *Session) prevRatchetPrivate() []byte {
+	if len(s.ratchet.prevPrivate) > 0 {
+		return s.ratchet.prevPrivate
+	}
+	if s.keys != nil {
+		return s.keys.previousSignedPreKeyPrivate()
+	}
+	return nil
+}
+
+// followRatchet returns the receive chain key after the peer's rekey with
+// public, given our ratchet private key and the root key it was made under
+func (s *Session) followRatchet(private, public []byte, root [32]byte) ([32]byte, error) {
+	if len(private) == 0 {
+		return [32]byte{}, ErrNoRatchetKeys
+	}
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return s.ratchetChain(root, shared), nil
+}
+
+// ratchetChain derives the chain key started by a ratchet step with DH
+// output shared. It depends only on the root key and shared, not on the
+// chain it replaces, so a receiver that missed every message of one
+// rekey can still follow the next.
+func (s *Session) ratchetChain(root [32]byte, shared []byte) [32]byte {
+	var next [32]byte
+	io.ReadFull(hkdf.New(s.kdf.withDefaults().Hash, shared, root[:], []byte(ratchetInfo)), next[:])
+	return next
+}
@@ -0,0 +1,382 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// sessionFormatVersion is the current Session serialization format
+const sessionFormatVersion = 2
+
+// keyBundleFormatVersion is the current KeyBundle export format. Version 1
+// lacks the signed prekey's creation and expiry times.
+const keyBundleFormatVersion = 2
+
+var (
+	// ErrInvalidSessionData is returned when serialized session data is malformed
+	ErrInvalidSessionData = errors.New("invalid session data")
+	// ErrInvalidKeyData is returned when an exported identity is malformed
+	ErrInvalidKeyData = errors.New("invalid key data")
+)
+
+// MarshalBinary exports the full bundle, including private keys, for backup
+// or device transfer. Layout: version byte, then each key as a uint16
+// length-prefixed field, then CreatedAt and ExpiresAt as big-endian
+// int64s. Unlike the JSON form, this includes secrets.
+func (b *KeyBundle) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteByte(keyBundleFormatVersion)
+	for _, field := range [][]byte{
+		b.IdentityPublicKey,
+		b.IdentityPrivateKey,
+		b.SignedPreKey,
+		b.SignedPreKeyPrivate,
+		b.Signature,
+	} {
+		writeBytes16(&buf, field)
+	}
+	binary.Write(&buf, binary.BigEndian, [2]int64{b.CreatedAt, b.ExpiresAt})
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary restores a bundle produced by MarshalBinary.
+// Key sizes, the identity key pair and the prekey signature are validated.
+func (b *KeyBundle) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+
+	version, err := r.ReadByte()
+	if err != nil || version < 1 || version > keyBundleFormatVersion {
+		return ErrInvalidKeyData
+	}
+
+	var fields [5][]byte
+	for i := range fields {
+		if fields[i], err = readBytes16(r); err != nil {
+			return ErrInvalidKeyData
+		}
+	}
+	var times [2]int64
+	if version >= 2 {
+		if err := binary.Read(r, binary.BigEndian, &times); err != nil {
+			return ErrInvalidKeyData
+		}
+	}
+	if r.Len() != 0 {
+		return ErrInvalidKeyData
+	}
+
+	decoded := KeyBundle{
+		IdentityPublicKey:   fields[0],
+		IdentityPrivateKey:  fields[1],
+		SignedPreKey:        fields[2],
+		SignedPreKeyPrivate: fields[3],
+		Signature:           fields[4],
+		CreatedAt:           times[0],
+		ExpiresAt:           times[1],
+	}
+	if !decoded.valid() {
+		return ErrInvalidKeyData
+	}
+
+	*b = decoded
+	return nil
+}
+
+// valid checks key sizes and that the keys belong together
+func (b *KeyBundle) valid() bool {
+	if len(b.IdentityPublicKey) != ed25519.PublicKeySize ||
+		len(b.IdentityPrivateKey) != ed25519.PrivateKeySize ||
+		len(b.SignedPreKey) != 32 ||
+		len(b.SignedPreKeyPrivate) != 32 ||
+		len(b.Signature) != ed25519.SignatureSize {
+		return false
+	}
+
+	derived := ed25519.PrivateKey(b.IdentityPrivateKey).Public().(ed25519.PublicKey)
+	if !bytes.Equal(derived, b.IdentityPublicKey) {
+		return false
+	}
+	message := signedPreKeyMessage(b.SignedPreKey, b.CreatedAt, b.ExpiresAt)
+	return ed25519.Verify(b.IdentityPublicKey, message, b.Signature)
+}
+
+// ExportIdentity returns the binary export of the current identity
+func (km *KeyManager) ExportIdentity() ([]byte, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if km.identityKeys == nil {
+		return nil, ErrKeysNotInitialized
+	}
+	return km.identityKeys.MarshalBinary()
+}
+
+// ImportIdentity replaces the current identity with an exported one
+func (km *KeyManager) ImportIdentity(data []byte) error {
+	var bundle KeyBundle
+	if err := bundle.UnmarshalBinary(data); err != nil {
+		return err
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	km.identityKeys, km.prevPreKey = &bundle, nil
+	return nil
+}
+
+// Session wire format:
+//
+//	magic "MBRS" | version (1 byte) | TLV fields...
+//
+// Each field is a 1-byte tag, a uint32 big-endian length and the value.
+// Unknown tags are skipped so fields can be added within a version;
+// incompatible layout changes bump the version.
+var sessionMagic = []byte("MBRS")
+
+// Session field tags
+const (
+	tagRecipientID byte = iota + 1
+	tagRootKey
+	tagSendChainKey
+	tagRecvChainKey
+	tagSendCounter
+	tagRecvCounter
+	tagCipherSuite
+	tagSkippedKeys
+	tagCompression
+	tagPeerIdentity
+	tagProtocolVersion
+	tagRekeyEvery
+	tagRatchetPrivate // Read only: written before ratchet private keys were referenced
+	tagPeerRatchetKey
+	tagSendRatchet
+	tagRecvRatchet
+	tagPrevRatchetPrivate // Read only: written before previous prekeys came from the KeyManager
+	tagPrevRoot
+	tagPendingRoot
+)
+
+// ErrUnsupportedSessionVersion is returned for session data written in a
+// format version this build doesn't understand
+var ErrUnsupportedSessionVersion = errors.New("unsupported session format version")
+
+// Serialize encodes the session's ratchet state, including retained skipped
+// message keys, for persistence via storage.StoreSession.
+func (s *Session) Serialize() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf bytes.Buffer
+
+	buf.Write(sessionMagic)
+	buf.WriteByte(sessionFormatVersion)
+
+	writeTLV(&buf, tagRecipientID, []byte(s.RecipientID))
+	writeTLV(&buf, tagRootKey, s.rootKey[:])
+	writeTLV(&buf, tagSendChainKey, s.sendChainKey[:])
+	writeTLV(&buf, tagRecvChainKey, s.recvChainKey[:])
+	writeTLV(&buf, tagSendCounter, binary.BigEndian.AppendUint32(nil, s.sendCounter))
+	writeTLV(&buf, tagRecvCounter, binary.BigEndian.AppendUint32(nil, s.recvCounter))
+	writeTLV(&buf, tagCipherSuite, []byte{byte(s.CipherSuite())})
+
+	// Skipped keys, oldest first: repeated (counter uint32, key [32]byte)
+	skipped := make([]byte, 0, s.skipped.len()*36)
+	s.skipped.each(func(counter uint32, key [32]byte) {
+		skipped = binary.BigEndian.AppendUint32(skipped, counter)
+		skipped = append(skipped, key[:]...)
+	})
+	writeTLV(&buf, tagSkippedKeys, skipped)
+
+	var compress byte
+	if s.compress {
+		compress = 1
+	}
+	writeTLV(&buf, tagCompression, []byte{compress})
+	writeTLV(&buf, tagProtocolVersion, []byte{s.ProtocolVersion()})
+	if len(s.peerIdentity) > 0 {
+		writeTLV(&buf, tagPeerIdentity, s.peerIdentity)
+	}
+
+	// Ratchet state, each only when set
+	r := &s.ratchet
+	if r.every != 0 {
+		writeTLV(&buf, tagRekeyEvery, binary.BigEndian.AppendUint32(nil, r.every))
+	}
+	if len(r.peerPublic) > 0 {
+		writeTLV(&buf, tagPeerRatchetKey, r.peerPublic)
+	}
+	if r.sendPublic != nil {
+		writeTLV(&buf, tagSendRatchet, binary.BigEndian.AppendUint32(bytes.Clone(r.sendPublic), r.sendStart))
+	}
+	if r.recvPublic != nil {
+		writeTLV(&buf, tagRecvRatchet, r.recvPublic)
+	}
+	if len(r.prevRoot) > 0 {
+		writeTLV(&buf, tagPrevRoot, r.prevRoot)
+	}
+	if len(r.pendingRoot) > 0 {
+		writeTLV(&buf, tagPendingRoot, r.pendingRoot)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DeserializeSession restores a session produced by Serialize.
+// KDF parameters are not persisted; pass the same options used to create
+// the original session.
+func DeserializeSession(data []byte, opts ...SessionOption) (*Session, error) {
+	if len(data) < len(sessionMagic)+1 || !bytes.Equal(data[:len(sessionMagic)], sessionMagic) {
+		return nil, ErrInvalidSessionData
+	}
+	if version := data[len(sessionMagic)]; version != sessionFormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSessionVersion, version)
+	}
+
+	fields, err := readTLVs(data[len(sessionMagic)+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Every field except skipped keys is required
+	for _, tag := range []byte{tagRecipientID, tagRootKey, tagSendChainKey, tagRecvChainKey, tagSendCounter, tagRecvCounter, tagCipherSuite} {
+		if _, ok := fields[tag]; !ok {
+			return nil, ErrInvalidSessionData
+		}
+	}
+	if len(fields[tagRootKey]) != 32 || len(fields[tagSendChainKey]) != 32 || len(fields[tagRecvChainKey]) != 32 ||
+		len(fields[tagSendCounter]) != 4 || len(fields[tagRecvCounter]) != 4 ||
+		len(fields[tagCipherSuite]) != 1 || len(fields[tagSkippedKeys])%36 != 0 {
+		return nil, ErrInvalidSessionData
+	}
+
+	suite := CipherSuite(fields[tagCipherSuite][0])
+	if !suite.valid() {
+		return nil, fmt.Errorf("%w: unknown cipher suite %d", ErrInvalidSessionData, suite)
+	}
+
+	var rootKey, sendChain, recvChain [32]byte
+	copy(rootKey[:], fields[tagRootKey])
+	copy(sendChain[:], fields[tagSendChainKey])
+	copy(recvChain[:], fields[tagRecvChainKey])
+
+	s := NewSessionDirect(string(fields[tagRecipientID]), rootKey, sendChain, recvChain, opts...)
+	s.sendCounter = binary.BigEndian.Uint32(fields[tagSendCounter])
+	s.recvCounter = binary.BigEndian.Uint32(fields[tagRecvCounter])
+	s.suite = suite
+	if c, ok := fields[tagCompression]; ok { // Optional: absent before compression existed
+		s.compress = len(c) == 1 && c[0] == 1
+	}
+	if v, ok := fields[tagProtocolVersion]; ok { // Optional: absent means version 1
+		if len(v) != 1 {
+			return nil, ErrInvalidSessionData
+		}
+		s.version = v[0]
+	}
+	if peer, ok := fields[tagPeerIdentity]; ok {
+		if len(peer) != ed25519.PublicKeySize {
+			return nil, ErrInvalidSessionData
+		}
+		s.peerIdentity = bytes.Clone(peer)
+	}
+	if err := deserializeRatchet(&s.ratchet, fields); err != nil {
+		return nil, err
+	}
+
+	// Restoring into a smaller cache keeps the newest keys
+	skipped, limit := fields[tagSkippedKeys], s.skippedKeyLimit()
+	for i := 0; i < len(skipped); i += 36 {
+		var key [32]byte
+		copy(key[:], skipped[i+4:i+36])
+		s.skipped.put(binary.BigEndian.Uint32(skipped[i:]), key, limit)
+	}
+
+	return s, nil
+}
+
+// deserializeRatchet restores the optional ratchet fields into r
+func deserializeRatchet(r *ratchetState, fields map[byte][]byte) error {
+	if v, ok := fields[tagRekeyEvery]; ok {
+		if len(v) != 4 {
+			return ErrInvalidSessionData
+		}
+		r.every = binary.BigEndian.Uint32(v)
+	}
+	for _, f := range []struct {
+		tag byte
+		dst *[]byte
+	}{
+		{tagRatchetPrivate, &r.ourPrivate},
+		{tagPeerRatchetKey, &r.peerPublic},
+		{tagRecvRatchet, &r.recvPublic},
+		{tagPrevRatchetPrivate, &r.prevPrivate},
+		{tagPrevRoot, &r.prevRoot},
+		{tagPendingRoot, &r.pendingRoot},
+	} {
+		if v, ok := fields[f.tag]; ok {
+			if len(v) != 32 {
+				return ErrInvalidSessionData
+			}
+			*f.dst = bytes.Clone(v)
+		}
+	}
+	if v, ok := fields[tagSendRatchet]; ok {
+		if len(v) != ratchetExtSize {
+			return ErrInvalidSessionData
+		}
+		r.sendPublic = bytes.Clone(v[:32])
+		r.sendStart = binary.BigEndian.Uint32(v[32:])
+	}
+	return nil
+}
+
+// writeTLV appends a tag-length-value field
+func writeTLV(buf *bytes.Buffer, tag byte, value []byte) {
+	buf.WriteByte(tag)
+	binary.Write(buf, binary.BigEndian, uint32(len(value)))
+	buf.Write(value)
+}
+
+// readTLVs parses a sequence of TLV fields, keyed by tag
+func readTLVs(data []byte) (map[byte][]byte, error) {
+	fields := make(map[byte][]byte)
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return nil, ErrInvalidSessionData
+		}
+		tag := data[0]
+		n := binary.BigEndian.Uint32(data[1:5])
+		data = data[5:]
+		if uint64(n) > uint64(len(data)) {
+			return nil, ErrInvalidSessionData
+		}
+		if _, dup := fields[tag]; dup {
+			return nil, ErrInvalidSessionData
+		}
+		fields[tag] = data[:n]
+		data = data[n:]
+	}
+	return fields, nil
+}
+
+func writeBytes16(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b)
+}
+
+func readBytes16(r *bytes.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,409 @@
+// Package crypto tests - session serialization
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSerializeRoundTrip(t *testing.T) {
+	sender, receiver := createMatchedSessionPair(t)
+
+	for i := 0; i < 3; i++ {
+		ct, _ := sender.Encrypt([]byte("msg"))
+		receiver.Decrypt(ct)
+	}
+	receiver.deriveSendKey()
+
+	data, err := receiver.Serialize()
+	if err != nil {
+		t.Fatalf("Serialize() error: %v", err)
+	}
+
+	restored, err := DeserializeSession(data)
+	if err != nil {
+		t.Fatalf("DeserializeSession() error: %v", err)
+	}
+
+	if restored.RecipientID != receiver.RecipientID {
+		t.Errorf("RecipientID = %q, want %q", restored.RecipientID, receiver.RecipientID)
+	}
+	if restored.rootKey != receiver.rootKey {
+		t.Error("root key should survive serialization")
+	}
+	if restored.sendChainKey != receiver.sendChainKey || restored.recvChainKey != receiver.recvChainKey {
+		t.Error("chain keys should survive serialization")
+	}
+	if restored.sendCounter != 1 || restored.recvCounter != 3 {
+		t.Errorf("counters = %d/%d, want 1/3", restored.sendCounter, restored.recvCounter)
+	}
+
+	// The restored session continues the conversation
+	ct, _ := sender.Encrypt([]byte("after restore"))
+	pt, err := restored.Decrypt(ct)
+	if err != nil {
+		t.Fatalf("Decrypt() after restore error: %v", err)
+	}
+	if string(pt) != "after restore" {
+		t.Errorf("decrypted = %q, want %q", pt, "after restore")
+	}
+}
+
+func TestSerializePreservesSkippedKeys(t *testing.T) {
+	sender, receiver := createMatchedSessionPair(t)
+
+	skippedCT, _ := sender.Encrypt([]byte("delayed"))
+	laterCT, _ := sender.Encrypt([]byte("arrives first"))
+
+	if _, err := receiver.Decrypt(laterCT); err != nil {
+		t.Fatalf("Decrypt(later) error: %v", err)
+	}
+	if receiver.SkippedKeys() != 1 {
+		t.Fatalf("skipped keys = %d, want 1", receiver.SkippedKeys())
+	}
+
+	// Simulate a restart
+	data, _ := receiver.Serialize()
+	restored, err := DeserializeSession(data)
+	if err != nil {
+		t.Fatalf("DeserializeSession() error: %v", err)
+	}
+
+	pt, err := restored.Decrypt(skippedCT)
+	if err != nil {
+		t.Fatalf("Decrypt(skipped) after restore error: %v", err)
+	}
+	if string(pt) != "delayed" {
+		t.Errorf("decrypted = %q, want %q", pt, "delayed")
+	}
+}
+
+func TestSerializeCapsSkippedKeys(t *testing.T) {
+	sender, receiver := createMatchedSessionPair(t)
+	WithMaxSkippedKeys(2)(receiver)
+
+	var cts [][]byte
+	for i := 0; i < 5; i++ {
+		ct, _ := sender.Encrypt([]byte{byte(i)})
+		cts = append(cts, ct)
+	}
+
+	// Skip counters 0..3; only the newest two are retained
+	receiver.Decrypt(cts[4])
+	if receiver.SkippedKeys() != 2 {
+		t.Fatalf("skipped keys = %d, want 2", receiver.SkippedKeys())
+	}
+
+	data, _ := receiver.Serialize()
+	restored, _ := DeserializeSession(data, WithMaxSkippedKeys(2))
+
+	if restored.SkippedKeys() != 2 {
+		t.Fatalf("persisted skipped keys = %d, want 2", restored.SkippedKeys())
+	}
+
+	// The newest skipped keys are kept
+	if _, err := restored.Decrypt(cts[3]); err != nil {
+		t.Errorf("newest skipped key should be kept: %v", err)
+	}
+	if _, err := restored.Decrypt(cts[0]); err != ErrMessageKeyNotFound {
+		t.Errorf("oldest skipped key should be dropped, got %v", err)
+	}
+}
+
+func TestDeserializeInvalidData(t *testing.T) {
+	sender, _ := createMatchedSessionPair(t)
+	valid, _ := sender.Serialize()
+
+	cases := map[string][]byte{
+		"empty":         {},
+		"wrong version": append([]byte{0xFF}, valid[1:]...),
+		"truncated":     valid[:len(valid)-8],
+		"trailing":      append(bytes.Clone(valid), 0x00),
+	}
+
+	for name, data := range cases {
+		if _, err := DeserializeSession(data); err != ErrInvalidSessionData {
+			t.Errorf("%s: error = %v, want ErrInvalidSessionData", name, err)
+		}
+	}
+}
+
+func TestSerializeFormatHeader(t *testing.T) {
+	sender, _ := createMatchedSessionPair(t)
+	data, _ := sender.Serialize()
+
+	if !bytes.HasPrefix(data, []byte("MBRS")) {
+		t.Errorf("serialized session should start with magic, got %x", data[:4])
+	}
+	if data[4] != sessionFormatVersion {
+		t.Errorf("version byte = %d, want %d", data[4], sessionFormatVersion)
+	}
+}
+
+func TestDeserializeRejectsOtherVersions(t *testing.T) {
+	sender, _ := createMatchedSessionPair(t)
+	current, _ := sender.Serialize()
+
+	// A blob from the previous format version
+	older := bytes.Clone(current)
+	older[4] = sessionFormatVersion - 1
+	if _, err := DeserializeSession(older); !errors.Is(err, ErrUnsupportedSessionVersion) {
+		t.Errorf("older version error = %v, want ErrUnsupportedSessionVersion", err)
+	}
+
+	// A blob from a newer build
+	newer := bytes.Clone(current)
+	newer[4] = sessionFormatVersion + 1
+	if _, err := DeserializeSession(newer); !errors.Is(err, ErrUnsupportedSessionVersion) {
+		t.Errorf("newer version error = %v, want ErrUnsupportedSessionVersion", err)
+	}
+}
+
+func TestSerializeRoundTripPreservesEveryField(t *testing.T) {
+	sender, receiver := createMatchedSessionPair(t)
+
+	ct0, _ := sender.Encrypt([]byte("zero"))
+	ct1, _ := sender.Encrypt([]byte("one"))
+	receiver.Decrypt(ct1) // skips counter 0
+	receiver.deriveSendKey()
+	receiver.deriveSendKey()
+
+	data, _ := receiver.Serialize()
+	restored, err := DeserializeSession(data)
+	if err != nil {
+		t.Fatalf("DeserializeSession() error: %v", err)
+	}
+
+	if restored.RecipientID != receiver.RecipientID ||
+		restored.rootKey != receiver.rootKey ||
+		restored.sendChainKey != receiver.sendChainKey ||
+		restored.recvChainKey != receiver.recvChainKey ||
+		restored.sendCounter != receiver.sendCounter ||
+		restored.recvCounter != receiver.recvCounter ||
+		restored.CipherSuite() != receiver.CipherSuite() {
+		t.Error("restored session fields should match the original")
+	}
+	want, _ := receiver.skipped.get(0)
+	if got, ok := restored.skipped.get(0); restored.SkippedKeys() != 1 || !ok || got != want {
+		t.Errorf("restored %d skipped keys, want counter 0 only", restored.SkippedKeys())
+	}
+	if _, err := restored.Decrypt(ct0); err != nil {
+		t.Errorf("restored session should decrypt the skipped message: %v", err)
+	}
+}
+
+func TestSerializePreservesRatchet(t *testing.T) {
+	sender, receiver := createRekeyingPair(t, 2)
+	for i := 0; i < 3; i++ {
+		ct, _ := sender.Encrypt([]byte("before"))
+		receiver.Decrypt(ct)
+	}
+
+	// Both sides are mid-chain after a rekey. The receiver's ratchet
+	// private key isn't serialized, so it is passed again.
+	restore := func(s *Session, opts ...SessionOption) *Session {
+		data, _ := s.Serialize()
+		if private := s.ratchetPrivate(); private != nil && bytes.Contains(data, private) {
+			t.Error("Serialize() should not include the ratchet private key")
+		}
+		restored, err := DeserializeSession(data, opts...)
+		if err != nil {
+			t.Fatalf("DeserializeSession() error: %v", err)
+		}
+		return restored
+	}
+	receiverKeys := WithRatchetKeys(receiver.ratchet.ourPrivate, receiver.ratchet.peerPublic)
+	sender, receiver = restore(sender), restore(receiver, receiverKeys)
+
+	for i := 0; i < 3; i++ {
+		ct, err := sender.Encrypt([]byte("after"))
+		if err != nil {
+			t.Fatalf("restored Encrypt() error: %v", err)
+		}
+		if pt, err := receiver.Decrypt(ct); err != nil || string(pt) != "after" {
+			t.Fatalf("restored Decrypt() = %q, %v", pt, err)
+		}
+	}
+}
+
+func TestDeserializeSkipsUnknownFields(t *testing.T) {
+	sender, _ := createMatchedSessionPair(t)
+	data, _ := sender.Serialize()
+
+	var buf bytes.Buffer
+	buf.Write(data)
+	writeTLV(&buf, 0xEE, []byte("from a newer minor revision"))
+
+	if _, err := DeserializeSession(buf.Bytes()); err != nil {
+		t.Errorf("unknown TLV field should be skipped, got %v", err)
+	}
+}
+
+func TestDeserializeMissingField(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(sessionMagic)
+	buf.WriteByte(sessionFormatVersion)
+	writeTLV(&buf, tagRecipientID, []byte("bob"))
+
+	if _, err := DeserializeSession(buf.Bytes()); err != ErrInvalidSessionData {
+		t.Errorf("missing fields error = %v, want ErrInvalidSessionData", err)
+	}
+}
+
+func TestDeserializeMalformedNoPanic(t *testing.T) {
+	sender, receiver := createMatchedSessionPair(t)
+	sender.Encrypt([]byte("zero"))
+	ct, _ := sender.Encrypt([]byte("one"))
+	receiver.Decrypt(ct) // include a skipped key
+	withSkipped, _ := receiver.Serialize()
+
+	// Every truncation into the required fields fails. They are followed
+	// by optional fields, starting with the skipped keys.
+	required, _ := sender.Serialize()
+	requiredLen := len(sessionMagic) + 1
+	for required[requiredLen] != tagSkippedKeys {
+		requiredLen += 5 + int(binary.BigEndian.Uint32(required[requiredLen+1:]))
+	}
+	for i := 0; i < requiredLen; i++ {
+		if _, err := DeserializeSession(required[:i]); err == nil {
+			t.Errorf("truncated to %d bytes: expected error", i)
+		}
+	}
+
+	// Truncations and single-byte corruption never panic
+	for i := 0; i < len(withSkipped); i++ {
+		DeserializeSession(withSkipped[:i])
+
+		corrupt := bytes.Clone(withSkipped)
+		corrupt[i] ^= 0xFF
+		DeserializeSession(corrupt)
+	}
+}
+
+// ═══════════════════════════════════════
+// Identity Export / Import
+// ═══════════════════════════════════════
+
+func TestKeyBundleBinaryRoundTrip(t *testing.T) {
+	km := NewKeyManager()
+	original, _ := km.GenerateIdentityKeys()
+
+	data, err := original.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error: %v", err)
+	}
+
+	var restored KeyBundle
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() error: %v", err)
+	}
+
+	if !bytes.Equal(restored.IdentityPublicKey, original.IdentityPublicKey) ||
+		!bytes.Equal(restored.IdentityPrivateKey, original.IdentityPrivateKey) ||
+		!bytes.Equal(restored.SignedPreKey, original.SignedPreKey) ||
+		!bytes.Equal(restored.SignedPreKeyPrivate, original.SignedPreKeyPrivate) ||
+		!bytes.Equal(restored.Signature, original.Signature) {
+		t.Error("every key should survive the binary round trip")
+	}
+}
+
+func TestImportIdentity(t *testing.T) {
+	source := NewKeyManager()
+	source.GenerateIdentityKeys()
+	exported, err := source.ExportIdentity()
+	if err != nil {
+		t.Fatalf("ExportIdentity() error: %v", err)
+	}
+
+	target := NewKeyManager()
+	if err := target.ImportIdentity(exported); err != nil {
+		t.Fatalf("ImportIdentity() error: %v", err)
+	}
+
+	srcPub, _ := source.GetPublicKeyBundle()
+	dstPub, _ := target.GetPublicKeyBundle()
+	if !bytes.Equal(srcPub.IdentityPublicKey, dstPub.IdentityPublicKey) {
+		t.Error("imported identity should match the exported one")
+	}
+
+	// Both key managers derive the same session with a peer
+	peer := NewKeyManager()
+	peer.GenerateIdentityKeys()
+	peerPub, _ := peer.GetPublicKeyBundle()
+
+	s1, _ := NewSession("peer", source, peerPub)
+	s2, _ := NewSession("peer", target, peerPub)
+	if s1.rootKey != s2.rootKey {
+		t.Error("imported identity should derive identical sessions")
+	}
+}
+
+func TestImportIdentityRejectsBadData(t *testing.T) {
+	km := NewKeyManager()
+	bundle, _ := km.GenerateIdentityKeys()
+	valid, _ := bundle.MarshalBinary()
+
+	tamperedSig := bytes.Clone(valid)
+	tamperedSig[len(tamperedSig)-1] ^= 0xFF
+
+	other, _ := NewKeyManager().GenerateIdentityKeys()
+	mismatched := *bundle
+	mismatched.IdentityPublicKey = other.IdentityPublicKey
+	mismatchedData, _ := mismatched.MarshalBinary()
+
+	cases := map[string][]byte{
+		"empty":                {},
+		"wrong version":        append([]byte{keyBundleFormatVersion + 1}, valid[1:]...),
+		"version 1 with times": append([]byte{1}, valid[1:]...),
+		"truncated":            valid[:len(valid)-10],
+		"trailing bytes":       append(bytes.Clone(valid), 0x00),
+		"bad signature":        tamperedSig,
+		"mismatched key pair":  mismatchedData,
+	}
+
+	for name, data := range cases {
+		target := NewKeyManager()
+		if err := target.ImportIdentity(data); err != ErrInvalidKeyData {
+			t.Errorf("%s: ImportIdentity() error = %v, want ErrInvalidKeyData", name, err)
+		}
+		if _, err := target.GetPublicKeyBundle(); err == nil {
+			t.Errorf("%s: failed import should not install keys", name)
+		}
+	}
+}
+
+func TestImportIdentityVersion1(t *testing.T) {
+	bundle, _ := NewKeyManager().GenerateIdentityKeys()
+
+	// A version 1 export: unstamped prekey signed alone, no times
+	bundle.CreatedAt, bundle.ExpiresAt = 0, 0
+	bundle.Signature = ed25519.Sign(bundle.IdentityPrivateKey, bundle.SignedPreKey)
+	data, _ := bundle.MarshalBinary()
+	data = append([]byte{1}, data[1:len(data)-16]...)
+
+	km := NewKeyManager()
+	if err := km.ImportIdentity(data); err != nil {
+		t.Fatalf("ImportIdentity(version 1) error: %v", err)
+	}
+	pub, _ := km.GetPublicKeyBundle()
+	if pub.CreatedAt != 0 || pub.ExpiresAt != 0 {
+		t.Errorf("imported times = %d, %d, want 0, 0", pub.CreatedAt, pub.ExpiresAt)
+	}
+	if err := pub.Verify(); err != nil {
+		t.Errorf("Verify() on version 1 bundle error: %v", err)
+	}
+}
+
+func TestKeyBundleJSONExcludesPrivateKeys(t *testing.T) {
+	bundle, _ := NewKeyManager().GenerateIdentityKeys()
+
+	data, _ := json.Marshal(bundle)
+	if strings.Contains(string(data), "private") {
+		t.Errorf("JSON export should never include private keys: %s", data)
+	}
+}
@@ -0,0 +1,323 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"merabriar_core/audit"
+)
+
+var (
+	// ErrSessionNotFound is returned when there is no session for a recipient
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSenderMismatch is returned by DecryptFrom for a message that
+	// authenticates under another peer's session than the claimed sender's
+	ErrSenderMismatch = errors.New("message is from a different sender")
+)
+
+// SessionStore persists serialized sessions. GetSession returns
+// ErrSessionNotFound when there is no session, as storage.Storage does.
+type SessionStore interface {
+	StoreSession(recipientID string, sessionData []byte) error
+	GetSession(recipientID string) ([]byte, error)
+	GetAllSessions() (map[string][]byte, error)
+	DeleteSession(recipientID string) error
+}
+
+// SessionManager caches sessions by recipient, loading them from and
+// persisting them to a SessionStore. It is safe for concurrent use.
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	store    SessionStore
+	keys     *KeyManager
+	opts     []SessionOption
+	audit    audit.Logger
+}
+
+// NewSessionManager creates a session manager. New sessions are created
+// with keys and opts; opts also apply to sessions loaded from store.
+func NewSessionManager(store SessionStore, keys *KeyManager, opts ...SessionOption) *SessionManager {
+	return &SessionManager{
+		sessions: make(map[string]*Session),
+		store:    store,
+		keys:     keys,
+		opts:     opts,
+		audit:    audit.Nop,
+	}
+}
+
+// SetAuditLogger makes the manager report session creation and deletion
+// to l. Nil discards the events.
+func (m *SessionManager) SetAuditLogger(l audit.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l == nil {
+		l = audit.Nop
+	}
+	m.audit = l
+}
+
+// GetOrCreate returns the session for recipientID from the cache or the
+// store, so re-initializing after a restart keeps the ratchet state.
+// Otherwise it creates a session from bundle and persists it.
+func (m *SessionManager) GetOrCreate(recipientID string, bundle *PublicKeyBundle) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, err := m.get(recipientID)
+	if !errors.Is(err, ErrSessionNotFound) {
+		return session, err
+	}
+
+	session, err = NewSession(recipientID, m.keys, bundle, m.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.save(session); err != nil {
+		return nil, err
+	}
+	m.sessions[recipientID] = session
+	m.audit.Log(audit.EventSessionCreate, map[string]any{"recipient": audit.Redact(recipientID)})
+	return session, nil
+}
+
+// Get returns the session for recipientID from the cache or the store.
+// Returns ErrSessionNotFound if there is none.
+func (m *SessionManager) Get(recipientID string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(recipientID)
+}
+
+func (m *SessionManager) get(recipientID string) (*Session, error) {
+	if session, ok := m.sessions[recipientID]; ok {
+		return session, nil
+	}
+
+	data, err := m.store.GetSession(recipientID)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := m.restore(data)
+	if err != nil {
+		return nil, err
+	}
+	m.sessions[recipientID] = session
+	return session, nil
+}
+
+// DecryptFrom decrypts a message claimed to be from senderID and returns
+// the sender it is cryptographically bound to: the peer whose session
+// authenticates it. Sessions are pairwise, so on success that is always
+// senderID. If the claimed sender's session fails to authenticate the
+// message but another peer's cached session does (see
+// Session.Authenticates), DecryptFrom returns that peer with
+// ErrSenderMismatch, leaving both ratchets unchanged. Other failures,
+// such as a replayed or far-ahead counter, are returned as they are.
+func (m *SessionManager) DecryptFrom(senderID string, ciphertext []byte) (plaintext []byte, sender string, err error) {
+	m.mu.Lock()
+	session, err := m.get(senderID)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, "", err
+	}
+
+	plaintext, err = session.Decrypt(ciphertext)
+	if err == nil {
+		return plaintext, senderID, nil
+	}
+	if !errors.Is(err, ErrDecryptFailed) {
+		return nil, "", err
+	}
+
+	// Probe the other sessions without blocking the manager
+	m.mu.Lock()
+	others := make(map[string]*Session, len(m.sessions))
+	for id, other := range m.sessions {
+		if id != senderID {
+			others[id] = other
+		}
+	}
+	m.mu.Unlock()
+
+	for id, other := range others {
+		if other.Authenticates(ciphertext) {
+			return nil, id, fmt.Errorf("%w: claimed %s", ErrSenderMismatch, senderID)
+		}
+	}
+	return nil, "", err
+}
+
+// RotateSignedPreKey rotates our signed prekey (see
+// KeyManager.RotateSignedPreKey), passes the new private key to every
+// session with Session.UpdateOwnPreKey and persists them. Sessions only
+// in the store are loaded first, so none is left without the new key.
+// It returns the new bundle to publish to peers.
+func (m *SessionManager) RotateSignedPreKey() (*PublicKeyBundle, error) {
+	blobs, err := m.store.GetAllSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for recipientID, data := range blobs {
+		if _, ok := m.sessions[recipientID]; ok {
+			continue
+		}
+		session, err := m.restore(data)
+		if err != nil {
+			m.skipUnreadable(recipientID, err)
+			continue
+		}
+		m.sessions[recipientID] = session
+	}
+
+	rotated, err := m.keys.RotateSignedPreKey()
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range m.sessions {
+		if err := session.UpdateOwnPreKey(rotated.SignedPreKeyPrivate); err != nil {
+			return nil, err
+		}
+		if err := m.save(session); err != nil {
+			return nil, err
+		}
+	}
+	return m.keys.GetPublicKeyBundle()
+}
+
+// UpdatePeerBundle applies a peer's rotated bundle to its session (see
+// Session.UpdatePeerBundle) and persists the session
+func (m *SessionManager) UpdatePeerBundle(recipientID string, bundle *PublicKeyBundle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, err := m.get(recipientID)
+	if err != nil {
+		return err
+	}
+	if err := session.UpdatePeerBundle(bundle); err != nil {
+		return err
+	}
+	return m.save(session)
+}
+
+// Delete removes the session for recipientID from the cache and the store
+func (m *SessionManager) Delete(recipientID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, recipientID)
+	if err := m.store.DeleteSession(recipientID); err != nil {
+		return err
+	}
+	m.audit.Log(audit.EventSessionDelete, map[string]any{"recipient": audit.Redact(recipientID)})
+	return nil
+}
+
+// Persist saves the cached session for recipientID, e.g. after it
+// encrypted or decrypted a message
+func (m *SessionManager) Persist(recipientID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[recipientID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return m.save(session)
+}
+
+// PersistAll saves every cached session
+func (m *SessionManager) PersistAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, session := range m.sessions {
+		if err := m.save(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadAll caches every stored session, e.g. at startup. Sessions that
+// fail to deserialize are skipped and reported to the audit logger as
+// audit.EventSessionUnreadable, so one corrupt blob doesn't block the
+// rest.
+func (m *SessionManager) LoadAll() error {
+	blobs, err := m.store.GetAllSessions()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for recipientID, data := range blobs {
+		session, err := m.restore(data)
+		if err != nil {
+			m.skipUnreadable(recipientID, err)
+			continue
+		}
+		m.sessions[recipientID] = session
+	}
+	return nil
+}
+
+// skipUnreadable reports a stored session that failed to deserialize.
+// The caller must hold m.mu.
+func (m *SessionManager) skipUnreadable(recipientID string, err error) {
+	m.audit.Log(audit.EventSessionUnreadable, map[string]any{
+		"contact": audit.Redact(recipientID),
+		"error":   err.Error(),
+	})
+}
+
+// Reset drops every cached session without persisting it, e.g. after the
+// store is wiped
+func (m *SessionManager) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions = make(map[string]*Session)
+}
+
+// Len returns the number of cached sessions
+func (m *SessionManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// restore deserializes a stored session. Our identity and ratchet
+// private keys aren't persisted, so they come from the key manager when
+// available.
+func (m *SessionManager) restore(data []byte) (*Session, error) {
+	session, err := DeserializeSession(data, m.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if m.keys != nil {
+		if identity := m.keys.identityPrivateKey(); identity != nil {
+			session.identityKey = identity
+			session.keys = m.keys
+		}
+	}
+	return session, nil
+}
+
+// save persists the session's current ratchet state
+func (m *SessionManager) save(session *Session) error {
+	data, err := session.Serialize()
+	if err != nil {
+		return err
+	}
+	return m.store.StoreSession(session.RecipientID, data)
+}
@@ -0,0 +1,428 @@
+// Package crypto tests - session manager cache and persistence
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"merabriar_core/audit"
+)
+
+// memSessionStore is an in-memory SessionStore
+type memSessionStore struct {
+	data  map[string][]byte
+	reads int
+}
+
+func newMemSessionStore() *memSessionStore {
+	return &memSessionStore{data: make(map[string][]byte)}
+}
+
+func (m *memSessionStore) StoreSession(recipientID string, sessionData []byte) error {
+	m.data[recipientID] = sessionData
+	return nil
+}
+
+func (m *memSessionStore) GetSession(recipientID string) ([]byte, error) {
+	m.reads++
+	data, ok := m.data[recipientID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return data, nil
+}
+
+func (m *memSessionStore) GetAllSessions() (map[string][]byte, error) {
+	all := make(map[string][]byte, len(m.data))
+	for id, data := range m.data {
+		all[id] = data
+	}
+	return all, nil
+}
+
+func (m *memSessionStore) DeleteSession(recipientID string) error {
+	delete(m.data, recipientID)
+	return nil
+}
+
+// newManagerWithPeer returns a session manager for a fresh identity and
+// a peer's public bundle
+func newManagerWithPeer(t *testing.T, store SessionStore) (*SessionManager, *PublicKeyBundle) {
+	t.Helper()
+	km := NewKeyManager()
+	km.GenerateIdentityKeys()
+	peer := NewKeyManager()
+	peer.GenerateIdentityKeys()
+	bundle, _ := peer.GetPublicKeyBundle()
+	return NewSessionManager(store, km), bundle
+}
+
+func TestSessionManagerCreatesAndPersists(t *testing.T) {
+	store := newMemSessionStore()
+	m, bundle := newManagerWithPeer(t, store)
+
+	session, err := m.GetOrCreate("bob", bundle)
+	if err != nil {
+		t.Fatalf("GetOrCreate() error: %v", err)
+	}
+	if session.RecipientID != "bob" {
+		t.Errorf("RecipientID = %q, want bob", session.RecipientID)
+	}
+	if _, ok := store.data["bob"]; !ok {
+		t.Error("new session should be persisted")
+	}
+	if session.identityKey == nil {
+		t.Error("new session should carry the identity key")
+	}
+}
+
+func TestSessionManagerRejectsNilBundle(t *testing.T) {
+	store := newMemSessionStore()
+	m, _ := newManagerWithPeer(t, store)
+
+	if _, err := m.GetOrCreate("bob", nil); err != ErrInvalidBundle {
+		t.Errorf("GetOrCreate() with nil bundle error = %v, want ErrInvalidBundle", err)
+	}
+	if len(store.data) != 0 {
+		t.Error("a rejected bundle should not persist a session")
+	}
+}
+
+func TestSessionManagerCacheHit(t *testing.T) {
+	store := newMemSessionStore()
+	m, bundle := newManagerWithPeer(t, store)
+
+	first, _ := m.GetOrCreate("bob", bundle)
+	reads := store.reads
+
+	second, err := m.GetOrCreate("bob", bundle)
+	if err != nil {
+		t.Fatalf("GetOrCreate() error: %v", err)
+	}
+	if second != first {
+		t.Error("cached session should be returned")
+	}
+	if store.reads != reads {
+		t.Error("cache hit should not read the store")
+	}
+}
+
+func TestSessionManagerStorageHit(t *testing.T) {
+	store := newMemSessionStore()
+	m, bundle := newManagerWithPeer(t, store)
+
+	session, _ := m.GetOrCreate("bob", bundle)
+	session.Encrypt([]byte("one"))
+	session.Encrypt([]byte("two"))
+	if err := m.Persist("bob"); err != nil {
+		t.Fatalf("Persist() error: %v", err)
+	}
+
+	// A new manager over the same store, as after a restart
+	restarted := NewSessionManager(store, m.keys)
+	restored, err := restarted.GetOrCreate("bob", bundle)
+	if err != nil {
+		t.Fatalf("GetOrCreate() after restart error: %v", err)
+	}
+	if send, _ := restored.Counters(); send != 2 {
+		t.Errorf("restored send counter = %d, want 2 (not a fresh session)", send)
+	}
+	if !bytes.Equal(restored.identityKey, session.identityKey) {
+		t.Error("restored session should carry the identity key")
+	}
+}
+
+func TestSessionManagerGetAndDelete(t *testing.T) {
+	store := newMemSessionStore()
+	m, bundle := newManagerWithPeer(t, store)
+
+	if _, err := m.Get("bob"); err != ErrSessionNotFound {
+		t.Errorf("Get() before creation error = %v, want ErrSessionNotFound", err)
+	}
+
+	m.GetOrCreate("bob", bundle)
+	if _, err := m.Get("bob"); err != nil {
+		t.Errorf("Get() error: %v", err)
+	}
+
+	if err := m.Delete("bob"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if _, err := m.Get("bob"); err != ErrSessionNotFound {
+		t.Errorf("Get() after Delete error = %v, want ErrSessionNotFound", err)
+	}
+	if _, ok := store.data["bob"]; ok {
+		t.Error("Delete should remove the stored session")
+	}
+	if err := m.Persist("bob"); err != ErrSessionNotFound {
+		t.Errorf("Persist() after Delete error = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestSessionManagerReset(t *testing.T) {
+	store := newMemSessionStore()
+	m, bundle := newManagerWithPeer(t, store)
+	m.GetOrCreate("bob", bundle)
+
+	// As after a factory reset: the store is wiped, then the manager
+	delete(store.data, "bob")
+	m.Reset()
+	m.keys.Reset()
+
+	if m.Len() != 0 {
+		t.Errorf("Len() after Reset = %d, want 0", m.Len())
+	}
+	if _, err := m.Get("bob"); err != ErrSessionNotFound {
+		t.Errorf("Get() after Reset error = %v, want ErrSessionNotFound", err)
+	}
+	if _, err := m.keys.GetPublicKeyBundle(); err != ErrKeysNotInitialized {
+		t.Errorf("GetPublicKeyBundle() after KeyManager.Reset error = %v, want ErrKeysNotInitialized", err)
+	}
+}
+
+func TestSessionManagerDecryptFromRejectsOtherSender(t *testing.T) {
+	m, _ := newManagerWithPeer(t, newMemSessionStore())
+	fromAlice, aliceSession := createMatchedSessionPair(t)
+	fromBob, bobSession := createMatchedSessionPair(t)
+	m.sessions["alice"], m.sessions["bob"] = aliceSession, bobSession
+
+	// Alice's message claimed to be from Bob is rejected, naming Alice
+	ct, _ := fromAlice.Encrypt([]byte("from alice"))
+	plaintext, sender, err := m.DecryptFrom("bob", ct)
+	if !errors.Is(err, ErrSenderMismatch) || sender != "alice" || plaintext != nil {
+		t.Fatalf("DecryptFrom(bob, alice's message) = %q, %q, %v; want alice, ErrSenderMismatch", plaintext, sender, err)
+	}
+
+	reply, _ := fromBob.Encrypt([]byte("from bob"))
+	if _, sender, err := m.DecryptFrom("bob", reply); err != nil || sender != "bob" {
+		t.Fatalf("DecryptFrom(bob) = %q, %v", sender, err)
+	}
+
+	// Neither ratchet moved, so the honest claim still succeeds
+	plaintext, sender, err = m.DecryptFrom("alice", ct)
+	if err != nil || sender != "alice" || string(plaintext) != "from alice" {
+		t.Fatalf("DecryptFrom(alice) = %q, %q, %v", plaintext, sender, err)
+	}
+
+	// A message no session accepts keeps the claimed session's error
+	stranger, _ := createMatchedSessionPair(t)
+	ct, _ = stranger.Encrypt([]byte("from nobody"))
+	if _, sender, err := m.DecryptFrom("alice", ct); !errors.Is(err, ErrMessageKeyNotFound) || sender != "" {
+		t.Errorf("DecryptFrom(stranger's message) = %q, %v; want ErrMessageKeyNotFound", sender, err)
+	}
+	if _, _, err := m.DecryptFrom("carol", ct); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("DecryptFrom(no session) error = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestSessionManagerDecryptFromProbeDoesNotSkipAhead(t *testing.T) {
+	m, _ := newManagerWithPeer(t, newMemSessionStore())
+	fromAlice, aliceSession := createMatchedSessionPair(t)
+	_, bobSession := createMatchedSessionPair(t)
+	m.sessions["alice"], m.sessions["bob"] = aliceSession, bobSession
+
+	// Alice's second message would need a skipped key derived, which a
+	// probe of her session won't do
+	fromAlice.Encrypt([]byte("lost"))
+	ct, _ := fromAlice.Encrypt([]byte("second"))
+	if _, sender, err := m.DecryptFrom("bob", ct); !errors.Is(err, ErrDecryptFailed) || sender != "" {
+		t.Errorf("DecryptFrom(bob, alice's second message) = %q, %v; want ErrDecryptFailed", sender, err)
+	}
+	if aliceSession.Authenticates(ct) {
+		t.Error("Authenticates() should reject a message ahead of the receive chain")
+	}
+	if _, err := aliceSession.Decrypt(ct); err != nil {
+		t.Errorf("Decrypt() error = %v; the probe should leave the chain intact", err)
+	}
+}
+
+func TestSessionManagerRestoredSessionFollowsRekey(t *testing.T) {
+	alice, bob := NewKeyManager(), NewKeyManager()
+	alice.GenerateIdentityKeys()
+	bob.GenerateIdentityKeys()
+	bobPub, _ := bob.GetPublicKeyBundle()
+	sender, _ := NewSession("bob", alice, bobPub, WithRekeyEvery(1))
+
+	// Bob's stored session has no ratchet private key of its own; the
+	// manager supplies his signed prekey
+	receiver := NewSessionDirect("alice", sender.rootKey, sender.recvChainKey, sender.sendChainKey)
+	data, _ := receiver.Serialize()
+	store := newMemSessionStore()
+	store.data["alice"] = data
+	restored, err := NewSessionManager(store, bob).Get("alice")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+
+	for _, label := range []string{"zero", "one", "two"} {
+		ct, _ := sender.Encrypt([]byte(label))
+		if pt, err := restored.Decrypt(ct); err != nil || string(pt) != label {
+			t.Fatalf("Decrypt(%s) = %q, %v", label, pt, err)
+		}
+	}
+}
+
+func TestSessionManagerRotateSignedPreKey(t *testing.T) {
+	alice, bob := NewKeyManager(), NewKeyManager()
+	alice.GenerateIdentityKeys()
+	bob.GenerateIdentityKeys()
+	alicePub, _ := alice.GetPublicKeyBundle()
+	bobPub, _ := bob.GetPublicKeyBundle()
+
+	aliceMgr := NewSessionManager(newMemSessionStore(), alice, WithRekeyEvery(1))
+	sender, err := aliceMgr.GetOrCreate("bob", bobPub)
+	if err != nil {
+		t.Fatalf("GetOrCreate() error: %v", err)
+	}
+
+	// Bob's session is only in his store when he rotates
+	receiver := NewSessionDirect("alice", sender.rootKey, sender.recvChainKey, sender.sendChainKey,
+		WithRatchetKeys(nil, alicePub.SignedPreKey))
+	data, _ := receiver.Serialize()
+	bobStore := newMemSessionStore()
+	bobStore.data["alice"] = data
+	bobMgr := NewSessionManager(bobStore, bob)
+
+	newBundle, err := bobMgr.RotateSignedPreKey()
+	if err != nil {
+		t.Fatalf("RotateSignedPreKey() error: %v", err)
+	}
+	if bytes.Equal(newBundle.SignedPreKey, bobPub.SignedPreKey) {
+		t.Fatal("RotateSignedPreKey() should return the new prekey")
+	}
+
+	deliver := func(m *SessionManager, label string) {
+		t.Helper()
+		ct, err := sender.Encrypt([]byte(label))
+		if err != nil {
+			t.Fatalf("Encrypt(%s) error: %v", label, err)
+		}
+		if pt, _, err := m.DecryptFrom("alice", ct); err != nil || string(pt) != label {
+			t.Fatalf("DecryptFrom(%s) = %q, %v", label, pt, err)
+		}
+		m.Persist("alice")
+	}
+
+	// Alice rekeys against the old prekey until she applies the new bundle
+	deliver(bobMgr, "before update")
+	stale, _ := aliceMgr.store.GetSession("bob")
+	if err := aliceMgr.UpdatePeerBundle("bob", newBundle); err != nil {
+		t.Fatalf("UpdatePeerBundle() error: %v", err)
+	}
+	deliver(bobMgr, "after update")
+
+	// A restart keeps following with the rotated prekey
+	restarted := NewSessionManager(bobStore, bob)
+	deliver(restarted, "after restart")
+	if stored, _ := aliceMgr.store.GetSession("bob"); bytes.Equal(stored, stale) {
+		t.Error("UpdatePeerBundle() should persist the session")
+	}
+}
+
+func TestSessionManagerCorruptStoredSession(t *testing.T) {
+	store := newMemSessionStore()
+	store.data["bob"] = []byte("garbage")
+	m, bundle := newManagerWithPeer(t, store)
+
+	if _, err := m.GetOrCreate("bob", bundle); err == nil {
+		t.Error("corrupt stored session should return error, not be silently replaced")
+	}
+}
+
+func TestSessionManagerLoadAllSkipsCorrupt(t *testing.T) {
+	store := newMemSessionStore()
+	sender, _ := createMatchedSessionPair(t)
+	valid, _ := sender.Serialize()
+
+	wrongVersion := bytes.Clone(valid)
+	wrongVersion[4] = 0xFF
+	store.data["bob"] = valid
+	store.data["truncated"] = valid[:len(valid)/2]
+	store.data["empty"] = []byte{}
+	store.data["wrong-version"] = wrongVersion
+
+	m := NewSessionManager(store, NewKeyManager())
+	logger := &captureLogger{}
+	m.SetAuditLogger(logger)
+	if err := m.LoadAll(); err != nil {
+		t.Fatalf("LoadAll() error: %v", err)
+	}
+	if m.Len() != 1 {
+		t.Errorf("LoadAll() cached %d sessions, want only the valid one", m.Len())
+	}
+
+	// Each skipped session is audited under its redacted ID
+	skipped := map[any]bool{}
+	for _, e := range logger.events {
+		if e.event != audit.EventSessionUnreadable {
+			t.Errorf("unexpected audit event %s", e.event)
+		}
+		skipped[e.fields["contact"]] = true
+	}
+	for _, id := range []string{"truncated", "empty", "wrong-version"} {
+		if !skipped[audit.Redact(id)] {
+			t.Errorf("skipping %s should be audited with its redacted ID", id)
+		}
+	}
+	if len(logger.events) != 3 {
+		t.Errorf("audit events = %v, want one per skipped session", logger.events)
+	}
+}
+
+func TestSessionManagerPersistAll(t *testing.T) {
+	store := newMemSessionStore()
+	m, bundle := newManagerWithPeer(t, store)
+
+	bob, _ := m.GetOrCreate("bob", bundle)
+	carol, _ := m.GetOrCreate("carol", bundle)
+	bob.Encrypt([]byte("x"))
+	carol.Encrypt([]byte("y"))
+
+	if err := m.PersistAll(); err != nil {
+		t.Fatalf("PersistAll() error: %v", err)
+	}
+	for _, id := range []string{"bob", "carol"} {
+		restored, _ := DeserializeSession(store.data[id])
+		if send, _ := restored.Counters(); send != 1 {
+			t.Errorf("%s persisted send counter = %d, want 1", id, send)
+		}
+	}
+}
+
+// auditEvent is one captured audit log call
+type auditEvent struct {
+	event  string
+	fields map[string]any
+}
+
+// captureLogger is an audit.Logger that records every event
+type captureLogger struct{ events []auditEvent }
+
+func (l *captureLogger) Log(event string, fields map[string]any) {
+	l.events = append(l.events, auditEvent{event, fields})
+}
+
+func TestSessionManagerAuditsCreateAndDelete(t *testing.T) {
+	store := newMemSessionStore()
+	m, bundle := newManagerWithPeer(t, store)
+	logger := &captureLogger{}
+	m.SetAuditLogger(logger)
+
+	m.GetOrCreate("bob", bundle)
+	m.GetOrCreate("bob", bundle) // Cache hit: nothing new
+	m.Delete("bob")
+
+	if len(logger.events) != 2 {
+		t.Fatalf("audit events = %v, want create then delete", logger.events)
+	}
+	if logger.events[0].event != audit.EventSessionCreate || logger.events[1].event != audit.EventSessionDelete {
+		t.Errorf("audit events = %s, %s; want %s, %s", logger.events[0].event, logger.events[1].event,
+			audit.EventSessionCreate, audit.EventSessionDelete)
+	}
+	for _, e := range logger.events {
+		if e.fields["recipient"] != audit.Redact("bob") {
+			t.Errorf("%s recipient = %v, want the redacted ID", e.event, e.fields["recipient"])
+		}
+	}
+}
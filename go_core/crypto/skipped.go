@@ -0,0 +1,66 @@
+package crypto
+
+import "container/list"
+
+// skippedKeyCache holds message keys for skipped receive counters.
+// Keys are added in increasing counter order and removed once used, so
+// insertion order is also recency order: when the cache is full the
+// oldest key is evicted.
+type skippedKeyCache struct {
+	entries   map[uint32]*list.Element
+	order     list.List // of skippedEntry, oldest at front
+	evictions uint64
+}
+
+type skippedEntry struct {
+	counter uint32
+	key     [32]byte
+}
+
+// put stores a key, evicting the oldest entries beyond limit
+func (c *skippedKeyCache) put(counter uint32, key [32]byte, limit int) {
+	if c.entries == nil {
+		c.entries = make(map[uint32]*list.Element)
+	}
+	if e, ok := c.entries[counter]; ok {
+		e.Value = skippedEntry{counter, key}
+		return
+	}
+
+	c.entries[counter] = c.order.PushBack(skippedEntry{counter, key})
+	for c.order.Len() > limit {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(skippedEntry).counter)
+		c.evictions++
+	}
+}
+
+// get returns the key for counter, if retained
+func (c *skippedKeyCache) get(counter uint32) ([32]byte, bool) {
+	e, ok := c.entries[counter]
+	if !ok {
+		return [32]byte{}, false
+	}
+	return e.Value.(skippedEntry).key, true
+}
+
+// remove drops the key for counter
+func (c *skippedKeyCache) remove(counter uint32) {
+	if e, ok := c.entries[counter]; ok {
+		c.order.Remove(e)
+		delete(c.entries, counter)
+	}
+}
+
+func (c *skippedKeyCache) len() int {
+	return len(c.entries)
+}
+
+// each calls fn for every retained key, oldest first
+func (c *skippedKeyCache) each(fn func(counter uint32, key [32]byte)) {
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(skippedEntry)
+		fn(entry.counter, entry.key)
+	}
+}
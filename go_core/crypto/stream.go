@@ -0,0 +1,267 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// NonceStrategy selects how a StreamSealer picks the nonce for each chunk
+type NonceStrategy uint8
+
+const (
+	// NonceRandom seals each chunk as AEADSeal does, with a fresh random
+	// nonce under the caller's key, and binds its position through the
+	// associated data.
+	NonceRandom NonceStrategy = iota
+	// NonceCounter derives a subkey for the stream from the caller's key
+	// and a random stream ID, then uses the chunk counter as the nonce.
+	// No two chunks of a stream share a nonce, and chunks of different
+	// streams use different keys, however many chunks are sealed.
+	NonceCounter
+)
+
+// streamVersion identifies a chunk sealed with NonceCounter: version byte
+// || counter nonce || ciphertext, under the stream's subkey. The nonce is
+// three zero bytes, the final-chunk flag, then the 64-bit chunk counter.
+const streamVersion = 2
+
+// StreamIDSize is the length of a NonceCounter stream ID
+const StreamIDSize = 32
+
+// streamInfo is the HKDF info for stream subkeys
+const streamInfo = "merabriar_stream"
+
+var (
+	// ErrUnknownNonceStrategy is returned by NewStreamSealer for an
+	// unsupported strategy
+	ErrUnknownNonceStrategy = errors.New("unknown nonce strategy")
+	// ErrStreamExhausted is returned once a stream has sealed as many
+	// chunks as its counter can number
+	ErrStreamExhausted = errors.New("stream chunk counter exhausted")
+	// ErrStreamFinished is returned for a chunk after a stream's final one
+	ErrStreamFinished = errors.New("stream already finished")
+	// ErrStreamTruncated is returned by StreamOpener.Close when the final
+	// chunk was never opened
+	ErrStreamTruncated = errors.New("stream truncated before its final chunk")
+)
+
+// StreamSealer seals the chunks of one stream, e.g. an attachment being
+// sent, under a key shared by many chunks. Each chunk is bound to its
+// position and the last one is marked final, so a StreamOpener detects
+// reordered, dropped and truncated chunks. It is safe for concurrent use.
+type StreamSealer struct {
+	key      []byte
+	strategy NonceStrategy
+	id       []byte      // NonceCounter only
+	aead     cipher.AEAD // NonceCounter only
+
+	mu       sync.Mutex
+	counter  uint64
+	finished bool
+}
+
+// NewStreamSealer starts a stream sealed under key, which must be
+// AEADKeySize bytes
+func NewStreamSealer(key []byte, strategy NonceStrategy) (*StreamSealer, error) {
+	if len(key) != AEADKeySize {
+		return nil, ErrInvalidAEADKey
+	}
+
+	s := &StreamSealer{key: key, strategy: strategy}
+	switch strategy {
+	case NonceRandom:
+	case NonceCounter:
+		s.id = make([]byte, StreamIDSize)
+		if _, err := io.ReadFull(randReader, s.id); err != nil {
+			return nil, err
+		}
+		aead, err := streamAEAD(key, s.id)
+		if err != nil {
+			return nil, err
+		}
+		s.aead = aead
+	default:
+		return nil, ErrUnknownNonceStrategy
+	}
+	return s, nil
+}
+
+// StreamID returns the ID needed to open the stream's chunks, to be stored
+// alongside them. It is nil for NonceRandom.
+func (s *StreamSealer) StreamID() []byte {
+	return s.id
+}
+
+// Seal encrypts and authenticates the stream's next chunk, binding aad.
+// The last chunk must be sealed with SealFinal instead.
+func (s *StreamSealer) Seal(plaintext, aad []byte) ([]byte, error) {
+	return s.seal(plaintext, aad, false)
+}
+
+// SealFinal seals the stream's last chunk. The stream can't seal any more
+// chunks afterwards.
+func (s *StreamSealer) SealFinal(plaintext, aad []byte) ([]byte, error) {
+	return s.seal(plaintext, aad, true)
+}
+
+func (s *StreamSealer) seal(plaintext, aad []byte, final bool) ([]byte, error) {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return nil, ErrStreamFinished
+	}
+	if s.counter == math.MaxUint64 {
+		s.mu.Unlock()
+		return nil, ErrStreamExhausted
+	}
+	counter := s.counter
+	s.counter++
+	s.finished = final
+	s.mu.Unlock()
+
+	if s.strategy == NonceRandom {
+		sealed, err := AEADSeal(s.key, plaintext, randomChunkAAD(aad, counter, final))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{finalFlag(final)}, sealed...), nil
+	}
+
+	nonceSize := s.aead.NonceSize()
+	out := make([]byte, 1+nonceSize, 1+nonceSize+len(plaintext)+s.aead.Overhead())
+	out[0] = streamVersion
+	putCounterNonce(out[1:], counter, final)
+	return s.aead.Seal(out, out[1:], plaintext, aad), nil
+}
+
+// StreamOpener opens the chunks of one stream in the order they were
+// sealed. A chunk out of place fails to open, and Close reports a stream
+// that ended before its final chunk. It is safe for concurrent use, but
+// chunks must be passed in order.
+type StreamOpener struct {
+	key  []byte
+	aead cipher.AEAD // NonceCounter only
+
+	mu       sync.Mutex
+	next     uint64
+	finished bool
+}
+
+// NewStreamOpener starts opening a stream sealed under key. streamID is
+// the sealer's StreamID, nil for a NonceRandom stream.
+func NewStreamOpener(key, streamID []byte) (*StreamOpener, error) {
+	if len(key) != AEADKeySize {
+		return nil, ErrInvalidAEADKey
+	}
+
+	o := &StreamOpener{key: key}
+	if streamID != nil {
+		if len(streamID) != StreamIDSize {
+			return nil, ErrAEADOpen
+		}
+		aead, err := streamAEAD(key, streamID)
+		if err != nil {
+			return nil, err
+		}
+		o.aead = aead
+	}
+	return o, nil
+}
+
+// Open decrypts the stream's next chunk, which must have been sealed with
+// the same aad. It returns ErrAEADOpen for a chunk that isn't the next
+// one, and ErrStreamFinished once the final chunk has been opened.
+func (o *StreamOpener) Open(sealed, aad []byte) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.finished {
+		return nil, ErrStreamFinished
+	}
+	if len(sealed) == 0 {
+		return nil, ErrAEADOpen
+	}
+
+	var plaintext []byte
+	var final bool
+	if o.aead == nil {
+		if sealed[0] > 1 {
+			return nil, ErrAEADOpen
+		}
+		final = sealed[0] == 1
+		var err error
+		if plaintext, err = AEADOpen(o.key, sealed[1:], randomChunkAAD(aad, o.next, final)); err != nil {
+			return nil, err
+		}
+	} else {
+		nonceSize := o.aead.NonceSize()
+		if sealed[0] != streamVersion || len(sealed) < 1+nonceSize+o.aead.Overhead() {
+			return nil, ErrAEADOpen
+		}
+		nonce, ciphertext := sealed[1:1+nonceSize], sealed[1+nonceSize:]
+
+		// Open under the nonce this position expects, so a chunk from
+		// anywhere else in the stream fails authentication
+		final = nonce[nonceSize-9] == 1
+		expected := make([]byte, nonceSize)
+		putCounterNonce(expected, o.next, final)
+		var err error
+		if plaintext, err = o.aead.Open(nil, expected, ciphertext, aad); err != nil {
+			return nil, ErrAEADOpen
+		}
+	}
+
+	o.next++
+	o.finished = final
+	return plaintext, nil
+}
+
+// Close reports whether the whole stream was opened. It returns
+// ErrStreamTruncated unless the final chunk has been opened.
+func (o *StreamOpener) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.finished {
+		return ErrStreamTruncated
+	}
+	return nil
+}
+
+// putCounterNonce writes the nonce for a NonceCounter chunk
+func putCounterNonce(nonce []byte, counter uint64, final bool) {
+	clear(nonce)
+	nonce[len(nonce)-9] = finalFlag(final)
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+}
+
+// randomChunkAAD binds a NonceRandom chunk's position and final flag to
+// the caller's aad
+func randomChunkAAD(aad []byte, counter uint64, final bool) []byte {
+	out := make([]byte, len(aad), len(aad)+9)
+	copy(out, aad)
+	out = binary.BigEndian.AppendUint64(out, counter)
+	return append(out, finalFlag(final))
+}
+
+func finalFlag(final bool) byte {
+	if final {
+		return 1
+	}
+	return 0
+}
+
+// streamAEAD derives a stream's subkey from key and its ID
+func streamAEAD(key, streamID []byte) (cipher.AEAD, error) {
+	var subkey [32]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, streamID, []byte(streamInfo)), subkey[:]); err != nil {
+		return nil, err
+	}
+	return newGCM(SuiteAES256GCM, subkey)
+}
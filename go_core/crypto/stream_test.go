@@ -0,0 +1,174 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var streamStrategies = []NonceStrategy{NonceRandom, NonceCounter}
+
+// sealStream seals chunks as one stream, marking the last one final
+func sealStream(t *testing.T, s *StreamSealer, chunks ...string) [][]byte {
+	t.Helper()
+	sealed := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		seal := s.Seal
+		if i == len(chunks)-1 {
+			seal = s.SealFinal
+		}
+		var err error
+		if sealed[i], err = seal([]byte(chunk), []byte("att-1")); err != nil {
+			t.Fatalf("sealing chunk %d: %v", i, err)
+		}
+	}
+	return sealed
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testAEADKey()
+
+	for _, strategy := range streamStrategies {
+		s, err := NewStreamSealer(key, strategy)
+		if err != nil {
+			t.Fatalf("NewStreamSealer(%d) error: %v", strategy, err)
+		}
+		chunks := []string{"chunk 0", "chunk 1", "chunk 2"}
+		sealed := sealStream(t, s, chunks...)
+
+		o, err := NewStreamOpener(key, s.StreamID())
+		if err != nil {
+			t.Fatalf("strategy %d: NewStreamOpener() error: %v", strategy, err)
+		}
+		if _, err := o.Open(sealed[0], []byte("att-2")); !errors.Is(err, ErrAEADOpen) {
+			t.Errorf("strategy %d: wrong aad error = %v, want ErrAEADOpen", strategy, err)
+		}
+		for i, chunk := range chunks {
+			opened, err := o.Open(sealed[i], []byte("att-1"))
+			if err != nil || string(opened) != chunk {
+				t.Errorf("strategy %d: Open(%d) = %q, %v; want %q", strategy, i, opened, err, chunk)
+			}
+		}
+		if err := o.Close(); err != nil {
+			t.Errorf("strategy %d: Close() error: %v", strategy, err)
+		}
+		if _, err := o.Open(sealed[2], []byte("att-1")); !errors.Is(err, ErrStreamFinished) {
+			t.Errorf("strategy %d: Open() after final error = %v, want ErrStreamFinished", strategy, err)
+		}
+		if _, err := s.Seal([]byte("chunk 3"), []byte("att-1")); !errors.Is(err, ErrStreamFinished) {
+			t.Errorf("strategy %d: Seal() after final error = %v, want ErrStreamFinished", strategy, err)
+		}
+	}
+}
+
+func TestStreamOpenerRejectsReorder(t *testing.T) {
+	key := testAEADKey()
+
+	for _, strategy := range streamStrategies {
+		s, _ := NewStreamSealer(key, strategy)
+		sealed := sealStream(t, s, "chunk 0", "chunk 1", "chunk 2")
+
+		o, _ := NewStreamOpener(key, s.StreamID())
+		if _, err := o.Open(sealed[1], []byte("att-1")); !errors.Is(err, ErrAEADOpen) {
+			t.Errorf("strategy %d: skipped chunk error = %v, want ErrAEADOpen", strategy, err)
+		}
+		if _, err := o.Open(sealed[0], []byte("att-1")); err != nil {
+			t.Fatalf("strategy %d: Open(0) error: %v", strategy, err)
+		}
+		if _, err := o.Open(sealed[0], []byte("att-1")); !errors.Is(err, ErrAEADOpen) {
+			t.Errorf("strategy %d: replayed chunk error = %v, want ErrAEADOpen", strategy, err)
+		}
+		if _, err := o.Open(sealed[2], []byte("att-1")); !errors.Is(err, ErrAEADOpen) {
+			t.Errorf("strategy %d: final chunk out of place error = %v, want ErrAEADOpen", strategy, err)
+		}
+	}
+}
+
+func TestStreamOpenerDetectsTruncation(t *testing.T) {
+	key := testAEADKey()
+
+	for _, strategy := range streamStrategies {
+		s, _ := NewStreamSealer(key, strategy)
+		sealed := sealStream(t, s, "chunk 0", "chunk 1", "chunk 2")
+
+		o, _ := NewStreamOpener(key, s.StreamID())
+		for _, chunk := range sealed[:2] {
+			if _, err := o.Open(chunk, []byte("att-1")); err != nil {
+				t.Fatalf("strategy %d: Open() error: %v", strategy, err)
+			}
+		}
+		if err := o.Close(); !errors.Is(err, ErrStreamTruncated) {
+			t.Errorf("strategy %d: Close() error = %v, want ErrStreamTruncated", strategy, err)
+		}
+
+		// Flipping a chunk's final flag doesn't end the stream early
+		forged := bytes.Clone(sealed[1])
+		if strategy == NonceRandom {
+			forged[0] = 1
+		} else {
+			forged[1+12-9] = 1
+		}
+		o, _ = NewStreamOpener(key, s.StreamID())
+		o.Open(sealed[0], []byte("att-1"))
+		if _, err := o.Open(forged, []byte("att-1")); !errors.Is(err, ErrAEADOpen) {
+			t.Errorf("strategy %d: forged final flag error = %v, want ErrAEADOpen", strategy, err)
+		}
+	}
+}
+
+func TestStreamCounterNoncesUnique(t *testing.T) {
+	s, _ := NewStreamSealer(testAEADKey(), NonceCounter)
+
+	seen := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		sealed, err := s.Seal([]byte("same chunk"), nil)
+		if err != nil {
+			t.Fatalf("Seal(%d) error: %v", i, err)
+		}
+		nonce := string(sealed[1:13])
+		if prev, ok := seen[nonce]; ok {
+			t.Fatalf("chunks %d and %d share a nonce", prev, i)
+		}
+		seen[nonce] = i
+	}
+}
+
+func TestStreamCounterSeparatesStreams(t *testing.T) {
+	key := testAEADKey()
+	a, _ := NewStreamSealer(key, NonceCounter)
+	b, _ := NewStreamSealer(key, NonceCounter)
+	if bytes.Equal(a.StreamID(), b.StreamID()) {
+		t.Fatal("streams should get distinct IDs")
+	}
+
+	// Both streams' first chunks use counter 0, but under different
+	// subkeys, so one stream's chunk doesn't open as the other's
+	sealedA, _ := a.Seal([]byte("from a"), nil)
+	sealedB, _ := b.Seal([]byte("from a"), nil)
+	if bytes.Equal(sealedA, sealedB) {
+		t.Error("same chunk in two streams should seal differently")
+	}
+	o, _ := NewStreamOpener(key, b.StreamID())
+	if _, err := o.Open(sealedA, nil); !errors.Is(err, ErrAEADOpen) {
+		t.Errorf("opening with another stream's ID error = %v, want ErrAEADOpen", err)
+	}
+}
+
+func TestStreamSealerRejectsBadInput(t *testing.T) {
+	if _, err := NewStreamSealer(make([]byte, 16), NonceCounter); !errors.Is(err, ErrInvalidAEADKey) {
+		t.Errorf("short key error = %v, want ErrInvalidAEADKey", err)
+	}
+	if _, err := NewStreamSealer(testAEADKey(), NonceStrategy(9)); !errors.Is(err, ErrUnknownNonceStrategy) {
+		t.Errorf("unknown strategy error = %v, want ErrUnknownNonceStrategy", err)
+	}
+
+	if _, err := NewStreamOpener(testAEADKey(), make([]byte, 16)); !errors.Is(err, ErrAEADOpen) {
+		t.Errorf("short stream ID error = %v, want ErrAEADOpen", err)
+	}
+
+	s, _ := NewStreamSealer(testAEADKey(), NonceCounter)
+	s.counter = ^uint64(0)
+	if _, err := s.Seal([]byte("one too many"), nil); !errors.Is(err, ErrStreamExhausted) {
+		t.Errorf("exhausted stream error = %v, want ErrStreamExhausted", err)
+	}
+}
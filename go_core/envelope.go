@@ -0,0 +1,31 @@
+package main
+
+import "encoding/json"
+
+// envelope is the JSON returned by getter-style exports, so callers can
+// tell an error from an empty result:
+//
+//	{"ok":true,"data":...}
+//	{"ok":false,"error":"..."}
+type envelope struct {
+	OK    bool   `json:"ok"`
+	Data  any    `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// envelopeJSON wraps data, or err if it is non-nil. A nil data on
+// success is encoded as null; pass an empty slice for an empty list.
+func envelopeJSON(data any, err error) []byte {
+	if err != nil {
+		out, _ := json.Marshal(envelope{Error: err.Error()})
+		return out
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		out, _ := json.Marshal(envelope{Error: err.Error()})
+		return out
+	}
+	out, _ := json.Marshal(envelope{OK: true, Data: json.RawMessage(raw)})
+	return out
+}
@@ -3,9 +3,12 @@ module merabriar_core
 go 1.21
 
 require (
+	github.com/gorilla/websocket v1.5.3
 	github.com/mattn/go-sqlite3 v1.14.22
 	golang.org/x/crypto v0.18.0
 )
 
+require golang.org/x/sys v0.16.0 // indirect
+
 // Note: For SQLCipher support, you need to build with CGO and link against SQLCipher
 // CGO_ENABLED=1 go build -tags sqlite_userauth
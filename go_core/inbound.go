@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+
+	"merabriar_core/crypto"
+	"merabriar_core/message"
+)
+
+// resultBlocked is the error code returned by DecryptMessage and
+// StoreMessage for messages from a blocked sender
+const resultBlocked = 2
+
+// resultSenderMismatch is the error code returned by DecryptMessage for a
+// ciphertext that was sent by a different peer than the claimed sender.
+// The result's data is the actual sender's ID.
+const resultSenderMismatch = 3
+
+// errSenderBlocked is returned for inbound messages from a blocked contact
+var errSenderBlocked = errors.New("sender is blocked")
+
+// blockList is the subset of storage.Storage used to drop messages from
+// blocked contacts
+type blockList interface {
+	IsBlocked(id string) (bool, error)
+}
+
+// messageStore is the subset of storage.Storage used to store messages
+type messageStore interface {
+	blockList
+	StoreMessage(msg *message.Message) error
+}
+
+// checkSender returns errSenderBlocked if senderID is blocked
+func checkSender(blocked blockList, senderID string) error {
+	isBlocked, err := blocked.IsBlocked(senderID)
+	if err != nil {
+		return err
+	}
+	if isBlocked {
+		return errSenderBlocked
+	}
+	return nil
+}
+
+// storeMessage stores msg unless its sender is blocked
+func storeMessage(store messageStore, msg *message.Message) error {
+	if err := checkSender(store, msg.SenderID); err != nil {
+		return err
+	}
+	return store.StoreMessage(msg)
+}
+
+// resultCode maps an error to an FFI error code
+func resultCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errSenderBlocked):
+		return resultBlocked
+	case errors.Is(err, crypto.ErrSenderMismatch):
+		return resultSenderMismatch
+	default:
+		return 1
+	}
+}
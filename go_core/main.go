@@ -28,6 +28,8 @@ typedef struct {
     char* signature;
     int error;
     char* error_message;
+    long long created_at; // Unix seconds, signed with the prekey
+    long long expires_at; // Unix seconds; zero means no expiry
 } KeyBundleResult;
 
 // Byte array for encrypted data
@@ -44,12 +46,19 @@ typedef struct {
     int error;
     char* error_message;
 } StringResult;
+
+// Status of an export that returns no data
+typedef struct {
+    int error;
+    char* error_message;
+} StatusResult;
 */
 import "C"
 
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"merabriar_core/crypto"
 	"merabriar_core/message"
 	"merabriar_core/storage"
@@ -59,31 +68,78 @@ import (
 
 // Global state
 var (
-	db      *storage.Storage
-	queue   *sync.MessageQueue
-	keyMgr  *crypto.KeyManager
-	sessions = make(map[string]*crypto.Session)
+	db       *storage.Storage
+	queue    *sync.MessageQueue
+	keyMgr   *crypto.KeyManager
+	sessions *crypto.SessionManager
+	readOnly bool // Opened with InitCoreWithOptions' read_only
 )
 
+// statusResult returns the status for err: a zero error on success,
+// else its result code (see resultCode) and message. The caller frees
+// error_message with FreeCString.
+func statusResult(err error) C.StatusResult {
+	if err == nil {
+		return C.StatusResult{}
+	}
+	return C.StatusResult{
+		error:         C.int(resultCode(err)),
+		error_message: C.CString(err.Error()),
+	}
+}
+
 //export InitCore
-func InitCore(dbPath *C.char, encryptionKey *C.char) C.int {
-	path := C.GoString(dbPath)
-	key := C.GoString(encryptionKey)
+func InitCore(dbPath *C.char, encryptionKey *C.char) C.StatusResult {
+	return statusResult(openCore(storage.Options{
+		Path:          C.GoString(dbPath),
+		EncryptionKey: C.GoString(encryptionKey),
+	}))
+}
 
-	// Initialize storage
-	var err error
-	db, err = storage.New(path, key)
+// InitCoreWithOptions is InitCore configured by an options JSON object:
+//
+//	{"path": "...", "encryption_key": "...", "wal": true,
+//	 "busy_timeout_ms": 5000, "read_only": false}
+//
+// path and encryption_key are required; a path of ":memory:" selects an
+// in-memory database. A read-only core rejects all writes and leaves
+// queued messages in storage.
+//
+//export InitCoreWithOptions
+func InitCoreWithOptions(optionsJson *C.char) C.StatusResult {
+	opts, err := parseCoreOptions(C.GoString(optionsJson))
 	if err != nil {
-		return 1
+		return statusResult(err)
+	}
+	return statusResult(openCore(opts))
+}
+
+// ShutdownCore persists sessions and queued messages, then closes the
+// database. On failure nothing is released, so the call can be retried.
+//
+//export ShutdownCore
+func ShutdownCore() C.StatusResult {
+	if db == nil {
+		return statusResult(nil)
 	}
 
-	// Initialize queue
-	queue = sync.NewMessageQueue()
+	if !readOnly {
+		if err := persistState(db, queue, sessions); err != nil {
+			return statusResult(err)
+		}
+	}
 
-	// Initialize key manager
-	keyMgr = crypto.NewKeyManager()
+	err := db.Close()
+	db, queue, keyMgr, sessions, readOnly = nil, nil, nil, nil, false
+	return statusResult(err)
+}
 
-	return 0
+// SelfTest succeeds if the core is initialized and its database is
+// reachable
+//
+//export SelfTest
+func SelfTest() C.StatusResult {
+	return statusResult(selfTest(db))
 }
 
 //export GenerateIdentityKeys
@@ -101,6 +157,8 @@ func GenerateIdentityKeys() C.KeyBundleResult {
 		signed_prekey:       C.CString(base64.StdEncoding.EncodeToString(bundle.SignedPreKey)),
 		signature:           C.CString(base64.StdEncoding.EncodeToString(bundle.Signature)),
 		error:               0,
+		created_at:          C.longlong(bundle.CreatedAt),
+		expires_at:          C.longlong(bundle.ExpiresAt),
 	}
 }
 
@@ -116,40 +174,76 @@ func GetPublicKeyBundle() *C.char {
 }
 
 //export InitSession
-func InitSession(recipientId *C.char, keysJson *C.char) C.int {
+func InitSession(recipientId *C.char, keysJson *C.char) C.StatusResult {
 	rid := C.GoString(recipientId)
-	keysStr := C.GoString(keysJson)
 
-	var keys crypto.PublicKeyBundle
-	if err := json.Unmarshal([]byte(keysStr), &keys); err != nil {
-		return 1
+	keys, err := parseKeyBundle(C.GoString(keysJson))
+	if err != nil {
+		return statusResult(err)
 	}
 
-	session, err := crypto.NewSession(rid, keyMgr, &keys)
+	// Reuse persisted ratchet state so re-initializing doesn't reset counters
+	_, err = sessions.GetOrCreate(rid, keys)
+	return statusResult(err)
+}
+
+// RotateSignedPreKey replaces our signed prekey and passes it to every
+// session. Returns the new public key bundle, for publishing to peers, in
+// a JSON envelope (see envelopeJSON).
+//
+//export RotateSignedPreKey
+func RotateSignedPreKey() *C.char {
+	bundle, err := sessions.RotateSignedPreKey()
+	return C.CString(string(envelopeJSON(bundle, err)))
+}
+
+// UpdatePeerBundle applies a recipient's rotated public key bundle to the
+// existing session with them
+//
+//export UpdatePeerBundle
+func UpdatePeerBundle(recipientId *C.char, keysJson *C.char) C.StatusResult {
+	keys, err := parseKeyBundle(C.GoString(keysJson))
 	if err != nil {
-		return 1
+		return statusResult(err)
 	}
-
-	sessions[rid] = session
-	return 0
+	return statusResult(sessions.UpdatePeerBundle(C.GoString(recipientId), keys))
 }
 
 //export HasSession
 func HasSession(recipientId *C.char) C.int {
 	rid := C.GoString(recipientId)
-	if _, exists := sessions[rid]; exists {
+	if _, err := sessions.Get(rid); err == nil {
 		return 1
 	}
 	return 0
 }
 
+// GetSessionCounters returns a session's send/recv counters as JSON, for
+// debugging sync issues. Returns NULL if there is no session.
+//
+//export GetSessionCounters
+func GetSessionCounters(recipientId *C.char) *C.char {
+	rid := C.GoString(recipientId)
+
+	session, err := sessions.Get(rid)
+	if err != nil {
+		return nil
+	}
+
+	jsonBytes, err := sessionCountersJSON(session)
+	if err != nil {
+		return nil
+	}
+	return C.CString(string(jsonBytes))
+}
+
 //export EncryptMessage
 func EncryptMessage(recipientId *C.char, plaintext *C.char) C.ByteArrayResult {
 	rid := C.GoString(recipientId)
 	pt := C.GoString(plaintext)
 
-	session, exists := sessions[rid]
-	if !exists {
+	session, err := sessions.Get(rid)
+	if err != nil {
 		return C.ByteArrayResult{
 			error:         1,
 			error_message: C.CString("No session for recipient"),
@@ -164,6 +258,14 @@ func EncryptMessage(recipientId *C.char, plaintext *C.char) C.ByteArrayResult {
 		}
 	}
 
+	// Persist the advanced send chain
+	if err := sessions.Persist(rid); err != nil {
+		return C.ByteArrayResult{
+			error:         1,
+			error_message: C.CString(err.Error()),
+		}
+	}
+
 	// Copy to C memory
 	cData := C.CBytes(ciphertext)
 	return C.ByteArrayResult{
@@ -173,21 +275,58 @@ func EncryptMessage(recipientId *C.char, plaintext *C.char) C.ByteArrayResult {
 	}
 }
 
+// DecryptMessage decrypts a message from senderId. The error code is
+// resultBlocked for a blocked sender, and resultSenderMismatch if the
+// ciphertext authenticates under another peer's session; data then holds
+// that peer's ID, the sender the message is actually bound to.
+//
 //export DecryptMessage
 func DecryptMessage(senderId *C.char, ciphertext *C.uint8_t, length C.int) C.StringResult {
 	sid := C.GoString(senderId)
-	ct := C.GoBytes(unsafe.Pointer(ciphertext), length)
 
-	session, exists := sessions[sid]
-	if !exists {
+	// Drop messages from blocked contacts without touching the ratchet
+	if err := checkSender(db, sid); err != nil {
+		return C.StringResult{
+			error:         C.int(resultCode(err)),
+			error_message: C.CString(err.Error()),
+		}
+	}
+
+	session, err := sessions.Get(sid)
+	if err != nil {
 		return C.StringResult{
 			error:         1,
 			error_message: C.CString("No session for sender"),
 		}
 	}
 
-	plaintext, err := session.Decrypt(ct)
+	// Reject oversized input before copying it into Go memory
+	if int(length) > session.MaxMessageSize() {
+		return C.StringResult{
+			error:         1,
+			error_message: C.CString(crypto.ErrTooLarge.Error()),
+		}
+	}
+	ct := C.GoBytes(unsafe.Pointer(ciphertext), length)
+
+	// Only accept the message if it authenticates under sid's session
+	plaintext, sender, err := sessions.DecryptFrom(sid, ct)
+	if errors.Is(err, crypto.ErrSenderMismatch) {
+		return C.StringResult{
+			data:          C.CString(sender),
+			error:         resultSenderMismatch,
+			error_message: C.CString(err.Error()),
+		}
+	}
 	if err != nil {
+		return C.StringResult{
+			error:         C.int(resultCode(err)),
+			error_message: C.CString(err.Error()),
+		}
+	}
+
+	// Persist the advanced receive chain
+	if err := sessions.Persist(sid); err != nil {
 		return C.StringResult{
 			error:         1,
 			error_message: C.CString(err.Error()),
@@ -200,66 +339,122 @@ func DecryptMessage(senderId *C.char, ciphertext *C.uint8_t, length C.int) C.Str
 	}
 }
 
-//export QueueMessage
-func QueueMessage(messageJson *C.char) C.int {
-	msgStr := C.GoString(messageJson)
+//export GenerateMessageID
+func GenerateMessageID() *C.char {
+	return C.CString(message.NewID())
+}
 
-	var msg sync.QueuedMessage
-	if err := json.Unmarshal([]byte(msgStr), &msg); err != nil {
-		return 1
+// ConversationIDFor returns the conversation ID for a 1:1 chat, the same
+// on both sides (see message.ConversationIDFor)
+//
+//export ConversationIDFor
+func ConversationIDFor(userA *C.char, userB *C.char) *C.char {
+	return C.CString(message.ConversationIDFor(C.GoString(userA), C.GoString(userB)))
+}
+
+//export QueueMessage
+func QueueMessage(messageJson *C.char) C.StatusResult {
+	msg, err := parseQueuedMessage(C.GoString(messageJson))
+	if err != nil {
+		return statusResult(err)
 	}
 
-	queue.Enqueue(&msg)
-	return 0
+	queue.Enqueue(msg)
+	return statusResult(nil)
 }
 
+// GetQueuedMessages returns the queued messages in a JSON envelope (see
+// envelopeJSON)
+//
 //export GetQueuedMessages
 func GetQueuedMessages() *C.char {
-	messages := queue.GetAll()
-	jsonBytes, _ := json.Marshal(messages)
-	return C.CString(string(jsonBytes))
+	return C.CString(string(envelopeJSON(queue.GetAll(), nil)))
 }
 
-//export ClearQueue
-func ClearQueue(idsJson *C.char) C.int {
-	idsStr := C.GoString(idsJson)
+// GetQueuedMessagesPage returns up to limit queued messages after cursor,
+// at most maxQueuePageSize, in a JSON envelope whose data is a queuePage.
+// Pass 0 for the first page and the page's next cursor after that.
+//
+//export GetQueuedMessagesPage
+func GetQueuedMessagesPage(limit C.int, cursor C.longlong) *C.char {
+	page, err := queuedMessagesPage(queue, int(limit), int64(cursor))
+	return C.CString(string(envelopeJSON(page, err)))
+}
 
-	var ids []string
-	if err := json.Unmarshal([]byte(idsStr), &ids); err != nil {
-		return 1
+//export ClearQueue
+func ClearQueue(idsJson *C.char) C.StatusResult {
+	ids, err := parseIDs(C.GoString(idsJson))
+	if err != nil {
+		return statusResult(err)
 	}
 
 	queue.Clear(ids)
-	return 0
+	if !readOnly {
+		return statusResult(db.DeleteQueuedMessages(ids))
+	}
+	return statusResult(nil)
 }
 
 //export StoreMessage
-func StoreMessage(messageJson *C.char) C.int {
-	msgStr := C.GoString(messageJson)
+func StoreMessage(messageJson *C.char) C.StatusResult {
+	msg, err := parseMessage(C.GoString(messageJson))
+	if err != nil {
+		return statusResult(err)
+	}
+	return statusResult(storeMessage(db, msg))
+}
 
-	var msg message.Message
-	if err := json.Unmarshal([]byte(msgStr), &msg); err != nil {
+//export SetContactBlocked
+func SetContactBlocked(contactId *C.char, blocked C.int) C.int {
+	if err := db.SetContactBlocked(C.GoString(contactId), blocked != 0); err != nil {
 		return 1
 	}
+	return 0
+}
 
-	if err := db.StoreMessage(&msg); err != nil {
-		return 1
+// WipeAllData deletes all local data (a factory reset) and clears the
+// in-memory queue, sessions and identity keys. The core stays initialized,
+// but the database is switched to newKey and only opens with it from now
+// on, so anything left of the old data can't be decrypted with the old key.
+//
+//export WipeAllData
+func WipeAllData(newKey *C.char) C.StatusResult {
+	if err := db.WipeAll(C.GoString(newKey)); err != nil {
+		return statusResult(err)
 	}
 
-	return 0
+	// Reset in place: other exports may be using these concurrently
+	queue.DrainAll()
+	sessions.Reset()
+	keyMgr.Reset()
+	return statusResult(nil)
 }
 
+// GetMessages returns a page of a conversation's messages in a JSON
+// envelope (see envelopeJSON)
+//
 //export GetMessages
 func GetMessages(conversationId *C.char, limit C.int, offset C.int) *C.char {
 	convId := C.GoString(conversationId)
 
 	messages, err := db.GetMessages(convId, int(limit), int(offset))
-	if err != nil {
-		return nil
+	if messages == nil {
+		messages = []*message.Message{}
 	}
+	return C.CString(string(envelopeJSON(messages, err)))
+}
 
-	jsonBytes, _ := json.Marshal(messages)
-	return C.CString(string(jsonBytes))
+// GetMessagePreviews is GetMessages for list views: each message has only
+// its ID, sender, timestamp, status, type, deleted flag and a preview of
+// its content cut to storage.PreviewMaxRunes runes
+//
+//export GetMessagePreviews
+func GetMessagePreviews(conversationId *C.char, limit C.int, offset C.int) *C.char {
+	previews, err := db.GetMessagePreviews(C.GoString(conversationId), int(limit), int(offset))
+	if previews == nil {
+		previews = []*storage.MessagePreview{}
+	}
+	return C.CString(string(envelopeJSON(previews, err)))
 }
 
 // Free C memory (call from Flutter)
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"merabriar_core/contact"
+	"merabriar_core/crypto"
+	"merabriar_core/message"
+	"merabriar_core/storage"
+	"merabriar_core/sync"
+)
+
+// memSessionStore is an in-memory crypto.SessionStore
+type memSessionStore map[string][]byte
+
+func (m memSessionStore) StoreSession(recipientID string, sessionData []byte) error {
+	m[recipientID] = sessionData
+	return nil
+}
+
+func (m memSessionStore) GetSession(recipientID string) ([]byte, error) {
+	data, ok := m[recipientID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return data, nil
+}
+
+func (m memSessionStore) GetAllSessions() (map[string][]byte, error) {
+	all := make(map[string][]byte, len(m))
+	for id, data := range m {
+		all[id] = data
+	}
+	return all, nil
+}
+
+func (m memSessionStore) DeleteSession(recipientID string) error {
+	delete(m, recipientID)
+	return nil
+}
+
+func newTestSession(recipientID string) *crypto.Session {
+	var root, send, recv [32]byte
+	root[0], send[0], recv[0] = 1, 2, 3
+	return crypto.NewSessionDirect(recipientID, root, send, recv)
+}
+
+// storeTestSession persists a new test session for recipientID
+func storeTestSession(store memSessionStore, recipientID string) {
+	data, _ := newTestSession(recipientID).Serialize()
+	store.StoreSession(recipientID, data)
+}
+
+// memCoreStore is an in-memory coreStore
+type memCoreStore struct {
+	memSessionStore
+	queued   []*sync.QueuedMessage
+	queueErr error
+}
+
+func (m *memCoreStore) StoreQueuedMessages(msgs []*sync.QueuedMessage) error {
+	if m.queueErr != nil {
+		return m.queueErr
+	}
+	for _, msg := range msgs {
+		m.DeleteQueuedMessages([]string{msg.ID})
+		m.queued = append(m.queued, msg)
+	}
+	return nil
+}
+
+func (m *memCoreStore) GetQueuedMessages() ([]*sync.QueuedMessage, error) {
+	return append([]*sync.QueuedMessage(nil), m.queued...), nil
+}
+
+func (m *memCoreStore) DeleteQueuedMessages(ids []string) error {
+	for _, id := range ids {
+		for i, msg := range m.queued {
+			if msg.ID == id {
+				m.queued = append(m.queued[:i], m.queued[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// ═══════════════════════════════════════
+// 1. Shutdown Persistence
+// ═══════════════════════════════════════
+
+func TestPersistStateSavesSessionsAndDrainsQueue(t *testing.T) {
+	store := &memCoreStore{memSessionStore: memSessionStore{}}
+	storeTestSession(store.memSessionStore, "bob")
+	storeTestSession(store.memSessionStore, "carol")
+
+	sessions := crypto.NewSessionManager(store, crypto.NewKeyManager())
+	sessions.LoadAll()
+	bob, _ := sessions.Get("bob")
+	bob.Encrypt([]byte("advance the chain"))
+
+	q := sync.NewMessageQueue()
+	q.Enqueue(sync.NewQueuedMessage("m1", "bob", []byte{1}))
+	q.Enqueue(sync.NewQueuedMessage("m2", "carol", []byte{2}))
+
+	if err := persistState(store, q, sessions); err != nil {
+		t.Fatalf("persistState() error: %v", err)
+	}
+
+	if !q.IsEmpty() {
+		t.Errorf("queue length after persist = %d, want 0", q.Len())
+	}
+	if len(store.queued) != 2 || store.queued[0].ID != "m1" || store.queued[1].ID != "m2" {
+		t.Errorf("persisted queue = %v, want m1, m2 in order", store.queued)
+	}
+
+	restored, err := crypto.DeserializeSession(store.memSessionStore["bob"])
+	if err != nil {
+		t.Fatalf("DeserializeSession(bob) error: %v", err)
+	}
+	ct, _ := restored.Encrypt([]byte("next"))
+	if ct[3] != 1 {
+		t.Errorf("restored send counter = %d, want 1", ct[3])
+	}
+	if _, ok := store.memSessionStore["carol"]; !ok {
+		t.Error("every active session should be persisted")
+	}
+}
+
+func TestPersistStateQueueFailureKeepsMessages(t *testing.T) {
+	store := &memCoreStore{memSessionStore: memSessionStore{}, queueErr: errors.New("disk full")}
+	sessions := crypto.NewSessionManager(store, crypto.NewKeyManager())
+
+	q := sync.NewMessageQueue()
+	q.Enqueue(sync.NewQueuedMessage("m1", "bob", []byte{1}))
+
+	if err := persistState(store, q, sessions); err == nil {
+		t.Fatal("persistState() should report the store failure")
+	}
+	if _, ok := q.Get("m1"); !ok {
+		t.Error("drained message should be put back on failure")
+	}
+}
+
+func TestRestoreQueue(t *testing.T) {
+	store := &memCoreStore{memSessionStore: memSessionStore{}}
+	store.queued = []*sync.QueuedMessage{
+		sync.NewQueuedMessage("m1", "bob", []byte{1}),
+		sync.NewQueuedMessage("m2", "bob", []byte{2}),
+	}
+
+	q := sync.NewMessageQueue()
+	if err := restoreQueue(store, q); err != nil {
+		t.Fatalf("restoreQueue() error: %v", err)
+	}
+
+	if q.Len() != 2 || q.Peek().ID != "m1" {
+		t.Errorf("restored queue length = %d, want 2 starting at m1", q.Len())
+	}
+	if len(store.queued) != 2 {
+		t.Error("restored messages should stay in the store until cleared")
+	}
+}
+
+// ═══════════════════════════════════════
+// 2. Diagnostics
+// ═══════════════════════════════════════
+
+func TestSessionCountersJSON(t *testing.T) {
+	session := newTestSession("bob")
+	session.Encrypt([]byte("one"))
+	session.Encrypt([]byte("two"))
+
+	data, err := sessionCountersJSON(session)
+	if err != nil {
+		t.Fatalf("sessionCountersJSON() error: %v", err)
+	}
+
+	var got sessionCounters
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("json.Unmarshal error: %v", err)
+	}
+	if got.RecipientID != "bob" || got.SendCounter != 2 || got.RecvCounter != 0 {
+		t.Errorf("counters = %+v, want bob 2/0", got)
+	}
+
+	if send, _ := session.Counters(); send != 2 {
+		t.Errorf("send counter after reporting = %d, want 2", send)
+	}
+}
+
+// ═══════════════════════════════════════
+// 3. Blocking
+// ═══════════════════════════════════════
+
+func TestStoreMessageDropsBlockedSender(t *testing.T) {
+	store, err := storage.NewWithOptions(storage.Options{InMemory: true, EncryptionKey: "test_key"})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	store.StoreContact(&contact.Contact{ID: "mallory", DisplayName: "Mallory"})
+	store.SetContactBlocked("mallory", true)
+
+	inbound := func(id string) *message.Message {
+		return &message.Message{
+			ID: id, ConversationID: "conv", SenderID: "mallory",
+			Content: "hi", Timestamp: 1000, Status: message.StatusDelivered,
+		}
+	}
+
+	err = storeMessage(store, inbound("m1"))
+	if !errors.Is(err, errSenderBlocked) {
+		t.Fatalf("storeMessage() from blocked sender error = %v, want errSenderBlocked", err)
+	}
+	if code := resultCode(err); code != resultBlocked {
+		t.Errorf("resultCode() = %d, want %d", code, resultBlocked)
+	}
+	if _, err := store.GetMessage("m1"); err == nil {
+		t.Error("message from blocked sender should not be stored")
+	}
+
+	// Unblocking restores delivery
+	store.SetContactBlocked("mallory", false)
+	if err := storeMessage(store, inbound("m2")); err != nil {
+		t.Fatalf("storeMessage() after unblocking error: %v", err)
+	}
+	if _, err := store.GetMessage("m2"); err != nil {
+		t.Errorf("message after unblocking should be stored: %v", err)
+	}
+}
+
+func TestResultCodeSenderMismatch(t *testing.T) {
+	err := fmt.Errorf("%w: claimed bob", crypto.ErrSenderMismatch)
+	if code := resultCode(err); code != resultSenderMismatch {
+		t.Errorf("resultCode(sender mismatch) = %d, want %d", code, resultSenderMismatch)
+	}
+	if code := resultCode(crypto.ErrDecryptFailed); code != 1 {
+		t.Errorf("resultCode(decrypt failed) = %d, want 1", code)
+	}
+}
+
+func TestCheckSenderUnknownAllowed(t *testing.T) {
+	store, err := storage.NewWithOptions(storage.Options{InMemory: true, EncryptionKey: "test_key"})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	if err := checkSender(store, "stranger"); err != nil {
+		t.Errorf("checkSender(unknown) error = %v, want nil", err)
+	}
+}
+
+// ═══════════════════════════════════════
+// 4. Result Envelopes
+// ═══════════════════════════════════════
+
+func TestEnvelopeJSONSuccess(t *testing.T) {
+	got := string(envelopeJSON([]*message.Message{{ID: "m1"}}, nil))
+
+	var env struct {
+		OK    bool              `json:"ok"`
+		Data  []message.Message `json:"data"`
+		Error *string           `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(got), &env); err != nil {
+		t.Fatalf("json.Unmarshal(%s) error: %v", got, err)
+	}
+	if !env.OK || len(env.Data) != 1 || env.Data[0].ID != "m1" || env.Error != nil {
+		t.Errorf("envelope = %s, want ok with one message and no error", got)
+	}
+}
+
+func TestEnvelopeJSONEmptyList(t *testing.T) {
+	if got, want := string(envelopeJSON([]*message.Message{}, nil)), `{"ok":true,"data":[]}`; got != want {
+		t.Errorf("envelopeJSON(empty) = %s, want %s", got, want)
+	}
+}
+
+func TestEnvelopeJSONFailure(t *testing.T) {
+	got := string(envelopeJSON([]*message.Message{}, errors.New("database is locked")))
+	if want := `{"ok":false,"error":"database is locked"}`; got != want {
+		t.Errorf("envelopeJSON(error) = %s, want %s", got, want)
+	}
+
+	// Data that can't be encoded is reported as an error too
+	got = string(envelopeJSON(make(chan int), nil))
+	var env envelope
+	json.Unmarshal([]byte(got), &env)
+	if env.OK || env.Error == "" {
+		t.Errorf("envelopeJSON(unencodable) = %s, want an error envelope", got)
+	}
+}
+
+// ═══════════════════════════════════════
+// 5. FFI Argument Parsing
+// ═══════════════════════════════════════
+
+func TestParseKeyBundle(t *testing.T) {
+	km := crypto.NewKeyManager()
+	km.GenerateIdentityKeys()
+	bundle, _ := km.GetPublicKeyBundle()
+	valid, _ := json.Marshal(bundle)
+
+	keys, err := parseKeyBundle(string(valid))
+	if err != nil {
+		t.Fatalf("parseKeyBundle(valid) error: %v", err)
+	}
+	if keys.Verify() != nil {
+		t.Error("parsed bundle should verify")
+	}
+
+	tests := []struct {
+		name, json, field string
+	}{
+		{"missing field", `{"identity_public_key":"AQ==","signature":"AQ=="}`, "signed_prekey"},
+		{"empty field", `{"identity_public_key":"","signed_prekey":"AQ==","signature":"AQ=="}`, "identity_public_key"},
+		{"null field", `{"identity_public_key":"AQ==","signed_prekey":"AQ==","signature":null}`, "signature"},
+		{"bad base64", `{"identity_public_key":"AQ==","signed_prekey":"not base64!","signature":"AQ=="}`, "signed_prekey"},
+		{"wrong type", `{"identity_public_key":"AQ==","signed_prekey":"AQ==","signature":"AQ==","created_at":"soon"}`, "created_at"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseKeyBundle(tt.json)
+			var fieldErr *fieldError
+			if !errors.As(err, &fieldErr) || fieldErr.Field != tt.field {
+				t.Errorf("parseKeyBundle() error = %v, want one naming %q", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestParseMalformedJSON(t *testing.T) {
+	for _, input := range []string{"", "{", "null", "[]", `"bundle"`} {
+		if _, err := parseKeyBundle(input); err == nil || !strings.Contains(err.Error(), "invalid JSON") {
+			t.Errorf("parseKeyBundle(%q) error = %v, want invalid JSON", input, err)
+		}
+	}
+	if _, err := parseIDs(`{"id":"m1"}`); err == nil || !strings.Contains(err.Error(), "invalid JSON") {
+		t.Errorf("parseIDs(object) error = %v, want invalid JSON", err)
+	}
+}
+
+func TestParseQueuedMessage(t *testing.T) {
+	msg, err := parseQueuedMessage(`{"id":"q1","recipient_id":"bob","encrypted_content":"AQID"}`)
+	if err != nil {
+		t.Fatalf("parseQueuedMessage() error: %v", err)
+	}
+	if msg.ID != "q1" || msg.RecipientID != "bob" || string(msg.EncryptedContent) != "\x01\x02\x03" {
+		t.Errorf("parseQueuedMessage() = %+v", msg)
+	}
+
+	_, err = parseQueuedMessage(`{"id":"q1","encrypted_content":"AQID"}`)
+	if !errors.Is(err, errMissingField) || !strings.Contains(err.Error(), "recipient_id") {
+		t.Errorf("missing recipient error = %v, want one naming recipient_id", err)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	if _, err := parseMessage(`{"id":"m1","conversation_id":"c1","sender_id":"alice","content":"hi"}`); err != nil {
+		t.Errorf("parseMessage() error: %v", err)
+	}
+	_, err := parseMessage(`{"id":"m1","sender_id":"alice"}`)
+	var fieldErr *fieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "conversation_id" {
+		t.Errorf("missing conversation error = %v, want one naming conversation_id", err)
+	}
+}
+
+func TestParseIDs(t *testing.T) {
+	ids, err := parseIDs(`["a","b"]`)
+	if err != nil || len(ids) != 2 {
+		t.Errorf("parseIDs() = %v, %v; want [a b]", ids, err)
+	}
+	if _, err := parseIDs(`["a",""]`); !errors.Is(err, errMissingField) || !strings.Contains(err.Error(), "[1]") {
+		t.Errorf("parseIDs(empty ID) error = %v, want one naming [1]", err)
+	}
+}
+
+// ═══════════════════════════════════════
+// 6. Core Options
+// ═══════════════════════════════════════
+
+func TestParseCoreOptions(t *testing.T) {
+	opts, err := parseCoreOptions(`{"path":"/data/core.db","encryption_key":"k"}`)
+	if err != nil {
+		t.Fatalf("parseCoreOptions() error: %v", err)
+	}
+	if opts.Path != "/data/core.db" || opts.EncryptionKey != "k" || opts.InMemory || opts.DisableWAL || opts.ReadOnly || opts.BusyTimeout != 0 {
+		t.Errorf("defaults = %+v", opts)
+	}
+
+	opts, _ = parseCoreOptions(`{"path":":memory:","encryption_key":"k","wal":false,"busy_timeout_ms":250}`)
+	if !opts.InMemory || opts.Path != "" || !opts.DisableWAL || opts.BusyTimeout != 250 {
+		t.Errorf("in-memory options = %+v", opts)
+	}
+
+	opts, _ = parseCoreOptions(`{"path":"/data/core.db","encryption_key":"k","read_only":true,"wal":true}`)
+	if !opts.ReadOnly || opts.DisableWAL {
+		t.Errorf("read-only options = %+v", opts)
+	}
+
+	tests := []struct {
+		name, json string
+		want       error
+	}{
+		{"missing path", `{"encryption_key":"k"}`, errMissingField},
+		{"missing key", `{"path":":memory:"}`, errMissingField},
+		{"read-only memory", `{"path":":memory:","encryption_key":"k","read_only":true}`, errReadOnlyMemory},
+	}
+	for _, tt := range tests {
+		if _, err := parseCoreOptions(tt.json); !errors.Is(err, tt.want) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if _, err := parseCoreOptions(`{"path":":memory:","encryption_key":"k","wal":"yes"}`); err == nil || !strings.Contains(err.Error(), "wal") {
+		t.Errorf("bad wal error = %v, want one naming wal", err)
+	}
+}
+
+func TestOpenCoreInMemory(t *testing.T) {
+	opts, _ := parseCoreOptions(`{"path":":memory:","encryption_key":"k"}`)
+	if err := openCore(opts); err != nil {
+		t.Fatalf("openCore() error: %v", err)
+	}
+	defer db.Close()
+
+	if queue == nil || keyMgr == nil || sessions == nil || readOnly {
+		t.Fatal("openCore() should set up the engine state")
+	}
+	if err := db.StoreMessage(message.NewMessage("m1", "conv-1", "alice", "hi", 1000)); err != nil {
+		t.Errorf("StoreMessage() in memory error: %v", err)
+	}
+}
+
+func TestOpenCoreReadOnly(t *testing.T) {
+	path := t.TempDir() + "/core.db"
+	store, err := storage.New(path, "k")
+	if err != nil {
+		t.Fatalf("storage.New() error: %v", err)
+	}
+	store.StoreQueuedMessages([]*sync.QueuedMessage{sync.NewQueuedMessage("q1", "bob", []byte{1})})
+	store.Close()
+
+	if err := openCore(storage.Options{Path: path, EncryptionKey: "k", ReadOnly: true}); err != nil {
+		t.Fatalf("openCore(read-only) error: %v", err)
+	}
+	defer db.Close()
+
+	if !readOnly || queue.Len() != 1 {
+		t.Errorf("read-only core: readOnly = %v, queue = %d; want true, 1", readOnly, queue.Len())
+	}
+	if err := db.StoreMessage(message.NewMessage("m1", "conv-1", "alice", "hi", 1000)); err == nil {
+		t.Error("read-only core should reject writes")
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := selfTest(nil); !errors.Is(err, errCoreNotInitialized) {
+		t.Errorf("selfTest(nil) error = %v, want errCoreNotInitialized", err)
+	}
+
+	store, err := storage.NewWithOptions(storage.Options{InMemory: true})
+	if err != nil {
+		t.Fatalf("storage.NewWithOptions() error: %v", err)
+	}
+	if err := selfTest(store); err != nil {
+		t.Errorf("selfTest(open) error: %v", err)
+	}
+	store.Close()
+	if err := selfTest(store); err == nil {
+		t.Error("selfTest(closed) should fail")
+	}
+}
+
+// ═══════════════════════════════════════
+// 7. Queue Paging
+// ═══════════════════════════════════════
+
+func TestQueuedMessagesPage(t *testing.T) {
+	q := sync.NewMessageQueue()
+	for _, id := range []string{"q0", "q1", "q2", "q3", "q4"} {
+		q.Enqueue(sync.NewQueuedMessage(id, "bob", []byte(id)))
+	}
+
+	var ids []string
+	var cursor int64
+	pages := 0
+	for {
+		page, err := queuedMessagesPage(q, 2, cursor)
+		if err != nil {
+			t.Fatalf("queuedMessagesPage(2, %d) error: %v", cursor, err)
+		}
+		pages++
+		for _, msg := range page.Messages {
+			ids = append(ids, msg.ID)
+		}
+		// Acking what was just read must not shift the next page
+		for _, msg := range page.Messages {
+			q.Ack(msg.ID)
+		}
+		if !page.HasMore {
+			break
+		}
+		cursor = page.Next
+	}
+	if got := strings.Join(ids, ","); got != "q0,q1,q2,q3,q4" || pages != 3 {
+		t.Errorf("paged through %s in %d pages, want q0..q4 in 3", got, pages)
+	}
+
+	// A page past the end is empty, keeps its cursor, and encodes as an
+	// empty list
+	page, err := queuedMessagesPage(q, 2, cursor+2)
+	if err != nil || len(page.Messages) != 0 || page.HasMore || page.Next != cursor+2 {
+		t.Fatalf("final page = %+v, %v; want empty", page, err)
+	}
+	want := fmt.Sprintf(`{"ok":true,"data":{"messages":[],"next":%d,"has_more":false}}`, cursor+2)
+	if got := string(envelopeJSON(page, nil)); got != want {
+		t.Errorf("envelopeJSON(final page) = %s, want %s", got, want)
+	}
+}
+
+func TestQueuedMessagesPageLimits(t *testing.T) {
+	q := sync.NewMessageQueue()
+	for i := 0; i < maxQueuePageSize+1; i++ {
+		q.Enqueue(sync.NewQueuedMessage(strings.Repeat("x", i+1), "bob", nil))
+	}
+
+	page, err := queuedMessagesPage(q, maxQueuePageSize*2, 0)
+	if err != nil || len(page.Messages) != maxQueuePageSize || !page.HasMore {
+		t.Errorf("oversized limit: %d messages, has more %v, err %v; want capped at %d", len(page.Messages), page.HasMore, err, maxQueuePageSize)
+	}
+
+	for _, tt := range []struct {
+		limit  int
+		cursor int64
+	}{{0, 0}, {-1, 0}, {10, -1}} {
+		if _, err := queuedMessagesPage(q, tt.limit, tt.cursor); !errors.Is(err, errInvalidPage) {
+			t.Errorf("queuedMessagesPage(%d, %d) error = %v, want errInvalidPage", tt.limit, tt.cursor, err)
+		}
+	}
+}
@@ -34,6 +34,8 @@ typedef struct {
     char* signature;
     int error;
     char* error_message;
+    long long created_at; // Unix seconds, signed with the prekey
+    long long expires_at; // Unix seconds; zero means no expiry
 } KeyBundleResult;
 
 // Byte array for encrypted data
@@ -51,6 +53,12 @@ typedef struct {
     char* error_message;
 } StringResult;
 
+// Status of an export that returns no data
+typedef struct {
+    int error;
+    char* error_message;
+} StatusResult;
+
 #line 1 "cgo-generated-wrapper"
 
 
@@ -113,18 +121,30 @@ typedef struct { void *data; GoInt len; GoInt cap; } GoSlice;
 extern "C" {
 #endif
 
-extern __declspec(dllexport) int InitCore(char* dbPath, char* encryptionKey);
+extern __declspec(dllexport) StatusResult InitCore(char* dbPath, char* encryptionKey);
+extern __declspec(dllexport) StatusResult InitCoreWithOptions(char* optionsJson);
+extern __declspec(dllexport) StatusResult ShutdownCore(void);
+extern __declspec(dllexport) StatusResult SelfTest(void);
 extern __declspec(dllexport) KeyBundleResult GenerateIdentityKeys(void);
 extern __declspec(dllexport) char* GetPublicKeyBundle(void);
-extern __declspec(dllexport) int InitSession(char* recipientId, char* keysJson);
+extern __declspec(dllexport) StatusResult InitSession(char* recipientId, char* keysJson);
+extern __declspec(dllexport) char* RotateSignedPreKey(void);
+extern __declspec(dllexport) StatusResult UpdatePeerBundle(char* recipientId, char* keysJson);
 extern __declspec(dllexport) int HasSession(char* recipientId);
+extern __declspec(dllexport) char* GetSessionCounters(char* recipientId);
 extern __declspec(dllexport) ByteArrayResult EncryptMessage(char* recipientId, char* plaintext);
 extern __declspec(dllexport) StringResult DecryptMessage(char* senderId, uint8_t* ciphertext, int length);
-extern __declspec(dllexport) int QueueMessage(char* messageJson);
+extern __declspec(dllexport) char* GenerateMessageID(void);
+extern __declspec(dllexport) char* ConversationIDFor(char* userA, char* userB);
+extern __declspec(dllexport) StatusResult QueueMessage(char* messageJson);
 extern __declspec(dllexport) char* GetQueuedMessages(void);
-extern __declspec(dllexport) int ClearQueue(char* idsJson);
-extern __declspec(dllexport) int StoreMessage(char* messageJson);
+extern __declspec(dllexport) char* GetQueuedMessagesPage(int limit, long long cursor);
+extern __declspec(dllexport) StatusResult ClearQueue(char* idsJson);
+extern __declspec(dllexport) StatusResult StoreMessage(char* messageJson);
+extern __declspec(dllexport) int SetContactBlocked(char* contactId, int blocked);
+extern __declspec(dllexport) StatusResult WipeAllData(char* newKey);
 extern __declspec(dllexport) char* GetMessages(char* conversationId, int limit, int offset);
+extern __declspec(dllexport) char* GetMessagePreviews(char* conversationId, int limit, int offset);
 extern __declspec(dllexport) void FreeCString(char* s);
 extern __declspec(dllexport) void FreeBytes(uint8_t* data);
 
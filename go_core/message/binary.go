@@ -0,0 +1,115 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// EncryptedMessage binary layouts. Version 2 appends the relay metadata;
+// messages without any are still written as version 1, so peers that
+// predate it can decode them.
+const (
+	encryptedMessageBinaryV1 = 1
+	encryptedMessageBinaryV2 = 2
+)
+
+// ErrInvalidBinary is returned when binary message data is malformed
+var ErrInvalidBinary = errors.New("invalid binary message")
+
+// MarshalBinary encodes the message compactly for transports where the
+// base64 overhead of JSON matters. Layout: version byte, then ID,
+// sender, recipient, content and type as uvarint length-prefixed bytes,
+// then the timestamp as a varint. Version 2 follows with the transport
+// hint, length-prefixed, and the hop count as a uvarint.
+func (m *EncryptedMessage) MarshalBinary() ([]byte, error) {
+	if m.HopCount < 0 {
+		return nil, ErrInvalidBinary
+	}
+	size := 1 + binary.MaxVarintLen64*8 + len(m.ID) + len(m.SenderID) +
+		len(m.RecipientID) + len(m.EncryptedContent) + len(m.MessageType) + len(m.TransportHint)
+	buf := make([]byte, 0, size)
+
+	relayed := m.TransportHint != "" || m.HopCount != 0
+	if relayed {
+		buf = append(buf, encryptedMessageBinaryV2)
+	} else {
+		buf = append(buf, encryptedMessageBinaryV1)
+	}
+	for _, field := range [][]byte{
+		[]byte(m.ID),
+		[]byte(m.SenderID),
+		[]byte(m.RecipientID),
+		m.EncryptedContent,
+		[]byte(m.MessageType),
+	} {
+		buf = binary.AppendUvarint(buf, uint64(len(field)))
+		buf = append(buf, field...)
+	}
+	buf = binary.AppendVarint(buf, m.Timestamp)
+	if relayed {
+		buf = binary.AppendUvarint(buf, uint64(len(m.TransportHint)))
+		buf = append(buf, m.TransportHint...)
+		buf = binary.AppendUvarint(buf, uint64(m.HopCount))
+	}
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a message produced by MarshalBinary
+func (m *EncryptedMessage) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || (data[0] != encryptedMessageBinaryV1 && data[0] != encryptedMessageBinaryV2) {
+		return ErrInvalidBinary
+	}
+	version := data[0]
+	data = data[1:]
+
+	var fields [5][]byte
+	for i := range fields {
+		n, read := binary.Uvarint(data)
+		if read <= 0 || n > uint64(len(data)-read) {
+			return ErrInvalidBinary
+		}
+		fields[i] = data[read : read+int(n)]
+		data = data[read+int(n):]
+	}
+
+	timestamp, read := binary.Varint(data)
+	if read <= 0 {
+		return ErrInvalidBinary
+	}
+	data = data[read:]
+
+	var hint []byte
+	var hops uint64
+	if version == encryptedMessageBinaryV2 {
+		n, read := binary.Uvarint(data)
+		if read <= 0 || n > uint64(len(data)-read) {
+			return ErrInvalidBinary
+		}
+		hint, data = data[read:read+int(n)], data[read+int(n):]
+		if hops, read = binary.Uvarint(data); read <= 0 || hops > math.MaxInt32 {
+			return ErrInvalidBinary
+		}
+		data = data[read:]
+	}
+	if len(data) != 0 {
+		return ErrInvalidBinary
+	}
+
+	decoded := EncryptedMessage{
+		ID:            string(fields[0]),
+		SenderID:      string(fields[1]),
+		RecipientID:   string(fields[2]),
+		MessageType:   MessageType(fields[4]),
+		Timestamp:     timestamp,
+		TransportHint: string(hint),
+		HopCount:      int(hops),
+	}
+	if len(fields[3]) > 0 {
+		decoded.EncryptedContent = append([]byte(nil), fields[3]...)
+	}
+
+	*m = decoded
+	return nil
+}
@@ -0,0 +1,99 @@
+package message
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEncryptedMessageBinaryRoundTrip(t *testing.T) {
+	msgs := []*EncryptedMessage{
+		{
+			ID:               "enc-1",
+			SenderID:         "alice",
+			RecipientID:      "bob",
+			EncryptedContent: []byte{0x00, 0xFF, 0x10, 0x20},
+			MessageType:      TypeImage,
+			Timestamp:        1234567890,
+		},
+		{ID: "empty"},
+		{ID: "ünïcode-✓", Timestamp: -42, EncryptedContent: make([]byte, 70000)},
+		{ID: "relayed", SenderID: "alice", TransportHint: "org.merabriar.lan", HopCount: 3},
+	}
+
+	for _, msg := range msgs {
+		data, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() error: %v", err)
+		}
+
+		var fromBinary EncryptedMessage
+		if err := fromBinary.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary() error: %v", err)
+		}
+
+		// Binary and JSON must decode to the same message
+		jsonData, _ := json.Marshal(msg)
+		var fromJSON EncryptedMessage
+		json.Unmarshal(jsonData, &fromJSON)
+
+		if !reflect.DeepEqual(fromBinary, fromJSON) {
+			t.Errorf("binary = %+v, JSON = %+v", fromBinary, fromJSON)
+		}
+		if !reflect.DeepEqual(&fromBinary, msg) {
+			t.Errorf("round trip = %+v, want %+v", fromBinary, msg)
+		}
+	}
+}
+
+func TestEncryptedMessageBinaryRelayVersion(t *testing.T) {
+	// Messages without relay metadata keep the version 1 layout
+	direct, _ := (&EncryptedMessage{ID: "m1"}).MarshalBinary()
+	relayed, _ := (&EncryptedMessage{ID: "m1", HopCount: 1}).MarshalBinary()
+	if direct[0] != 1 || relayed[0] != 2 {
+		t.Errorf("versions = %d, %d; want 1 without relay metadata, 2 with", direct[0], relayed[0])
+	}
+
+	if _, err := (&EncryptedMessage{HopCount: -1}).MarshalBinary(); err != ErrInvalidBinary {
+		t.Errorf("MarshalBinary(negative hops) error = %v, want ErrInvalidBinary", err)
+	}
+	var msg EncryptedMessage
+	if err := msg.UnmarshalBinary(relayed[:len(relayed)-1]); err != ErrInvalidBinary {
+		t.Errorf("UnmarshalBinary(truncated hop count) error = %v, want ErrInvalidBinary", err)
+	}
+}
+
+func TestEncryptedMessageBinarySmallerThanJSON(t *testing.T) {
+	msg := &EncryptedMessage{
+		ID:               "enc-1",
+		SenderID:         "alice",
+		RecipientID:      "bob",
+		EncryptedContent: make([]byte, 512),
+		MessageType:      TypeText,
+		Timestamp:        1234567890,
+	}
+
+	binaryData, _ := msg.MarshalBinary()
+	jsonData, _ := json.Marshal(msg)
+	if len(binaryData) >= len(jsonData) {
+		t.Errorf("binary = %d bytes, JSON = %d bytes; binary should be smaller", len(binaryData), len(jsonData))
+	}
+}
+
+func TestEncryptedMessageUnmarshalBinaryInvalid(t *testing.T) {
+	valid, _ := (&EncryptedMessage{ID: "x", EncryptedContent: []byte{1, 2, 3}, Timestamp: 5}).MarshalBinary()
+
+	cases := map[string][]byte{
+		"empty":         nil,
+		"wrong version": append([]byte{99}, valid[1:]...),
+		"truncated":     valid[:len(valid)-2],
+		"trailing data": append(append([]byte(nil), valid...), 0),
+		"huge length":   {1, 0xFF, 0xFF, 0xFF, 0xFF, 0x0F},
+	}
+	for name, data := range cases {
+		var msg EncryptedMessage
+		if err := msg.UnmarshalBinary(data); err != ErrInvalidBinary {
+			t.Errorf("%s: UnmarshalBinary() error = %v, want ErrInvalidBinary", name, err)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// ChainHash links a message to the one stored before it in its
+// conversation. It hashes prevHash, id, content and timestamp, each
+// length-prefixed so field boundaries can't shift, and returns hex.
+func ChainHash(prevHash, id, content string, timestamp int64) string {
+	h := sha256.New()
+	h.Write([]byte("merabriar_chain\x00"))
+	for _, field := range []string{prevHash, id, content} {
+		h.Write(binary.AppendUvarint(nil, uint64(len(field))))
+		h.Write([]byte(field))
+	}
+	h.Write(binary.AppendVarint(nil, timestamp))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ComputeHash returns the chain hash of m given its PrevHash
+func (m *Message) ComputeHash() string {
+	return ChainHash(m.PrevHash, m.ID, m.Content, m.Timestamp)
+}
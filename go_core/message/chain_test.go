@@ -0,0 +1,29 @@
+// Package message tests - conversation hash chain
+package message
+
+import "testing"
+
+func TestChainHashCoversEveryField(t *testing.T) {
+	base := ChainHash("prev", "m1", "hello", 1000)
+	if base != ChainHash("prev", "m1", "hello", 1000) {
+		t.Fatal("ChainHash() should be deterministic")
+	}
+
+	for name, h := range map[string]string{
+		"prevHash":  ChainHash("other", "m1", "hello", 1000),
+		"id":        ChainHash("prev", "m2", "hello", 1000),
+		"content":   ChainHash("prev", "m1", "hellO", 1000),
+		"timestamp": ChainHash("prev", "m1", "hello", 1001),
+		"boundary":  ChainHash("prevm", "1", "hello", 1000),
+	} {
+		if h == base {
+			t.Errorf("changing %s should change the hash", name)
+		}
+	}
+
+	msg := NewMessage("m1", "conv", "alice", "hello", 1000)
+	msg.PrevHash = "prev"
+	if msg.ComputeHash() != base {
+		t.Errorf("ComputeHash() = %s, want %s", msg.ComputeHash(), base)
+	}
+}
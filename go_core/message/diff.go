@@ -0,0 +1,54 @@
+package message
+
+import "bytes"
+
+// Equal reports whether m and other have identical fields, ignoring the
+// local-only chain fields Seq, Hash and PrevHash, which each store assigns
+// itself. Two nil messages are equal; a nil and a non-nil message are not.
+func (m *Message) Equal(other *Message) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	return m.SchemaVersion == other.SchemaVersion &&
+		m.ID == other.ID &&
+		m.ConversationID == other.ConversationID &&
+		m.SenderID == other.SenderID &&
+		m.Content == other.Content &&
+		m.Timestamp == other.Timestamp &&
+		m.Status == other.Status &&
+		m.MessageType == other.MessageType &&
+		m.EditedAt == other.EditedAt &&
+		m.Deleted == other.Deleted &&
+		m.ExpiresAt == other.ExpiresAt &&
+		bytes.Equal(m.EncryptedContent, other.EncryptedContent)
+}
+
+// Diff compares local and remote message sets by ID. added holds remote
+// messages missing locally, changed holds remote messages whose local copy
+// differs, and removed holds local messages missing remotely. added and
+// changed follow remote's order; removed follows local's.
+func Diff(local, remote []*Message) (added, changed, removed []*Message) {
+	localByID := make(map[string]*Message, len(local))
+	for _, m := range local {
+		localByID[m.ID] = m
+	}
+	remoteIDs := make(map[string]bool, len(remote))
+
+	for _, r := range remote {
+		remoteIDs[r.ID] = true
+		l, ok := localByID[r.ID]
+		switch {
+		case !ok:
+			added = append(added, r)
+		case !l.Equal(r):
+			changed = append(changed, r)
+		}
+	}
+
+	for _, l := range local {
+		if !remoteIDs[l.ID] {
+			removed = append(removed, l)
+		}
+	}
+	return added, changed, removed
+}
@@ -0,0 +1,100 @@
+// Package message tests - equality and reconciliation diffs
+package message
+
+import "testing"
+
+// messageIDs returns the IDs of msgs in order
+func messageIDs(msgs []*Message) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.ID
+	}
+	return out
+}
+
+func TestMessageEqual(t *testing.T) {
+	a := NewMessage("m1", "conv", "alice", "hi", 1000)
+	b := NewMessage("m1", "conv", "alice", "hi", 1000)
+	if !a.Equal(b) {
+		t.Error("messages with identical fields should be equal")
+	}
+
+	a.EncryptedContent, b.EncryptedContent = []byte{1, 2}, []byte{1, 2}
+	if !a.Equal(b) {
+		t.Error("messages with equal ciphertext should be equal")
+	}
+
+	b.EncryptedContent = []byte{1, 3}
+	if a.Equal(b) {
+		t.Error("messages differing in EncryptedContent should not be equal")
+	}
+
+	b.EncryptedContent = a.EncryptedContent
+	b.EditedAt = 2000
+	if a.Equal(b) {
+		t.Error("messages differing in EditedAt should not be equal")
+	}
+
+	b.EditedAt = a.EditedAt
+	b.Seq, b.Hash, b.PrevHash = 7, "hash", "prev"
+	if !a.Equal(b) {
+		t.Error("messages differing only in local chain fields should be equal")
+	}
+
+	var nilMsg *Message
+	if !nilMsg.Equal(nil) || a.Equal(nil) || nilMsg.Equal(a) {
+		t.Error("nil should only equal nil")
+	}
+}
+
+func TestDiffIdentical(t *testing.T) {
+	local := []*Message{NewMessage("m1", "conv", "alice", "hi", 1000), NewMessage("m2", "conv", "bob", "yo", 2000)}
+	remote := []*Message{NewMessage("m2", "conv", "bob", "yo", 2000), NewMessage("m1", "conv", "alice", "hi", 1000)}
+
+	added, changed, removed := Diff(local, remote)
+	if len(added) != 0 || len(changed) != 0 || len(removed) != 0 {
+		t.Errorf("Diff(identical) = %v, %v, %v; want all empty", messageIDs(added), messageIDs(changed), messageIDs(removed))
+	}
+}
+
+func TestDiffIgnoresLocalChain(t *testing.T) {
+	stored := NewMessage("m1", "conv", "alice", "hi", 1000)
+	stored.Seq, stored.Hash, stored.PrevHash = 3, "local-hash", "local-prev"
+	remote := []*Message{NewMessage("m1", "conv", "alice", "hi", 1000)}
+
+	added, changed, removed := Diff([]*Message{stored}, remote)
+	if len(added) != 0 || len(changed) != 0 || len(removed) != 0 {
+		t.Errorf("Diff(stored, remote) = %v, %v, %v; want all empty", messageIDs(added), messageIDs(changed), messageIDs(removed))
+	}
+}
+
+func TestDiffChangedStatus(t *testing.T) {
+	local := []*Message{NewMessage("m1", "conv", "alice", "hi", 1000), NewMessage("m2", "conv", "alice", "yo", 2000)}
+	updated := NewMessage("m2", "conv", "alice", "yo", 2000)
+	updated.Status = StatusRead
+	remote := []*Message{NewMessage("m1", "conv", "alice", "hi", 1000), updated}
+
+	added, changed, removed := Diff(local, remote)
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("Diff() added = %v, removed = %v; want none", messageIDs(added), messageIDs(removed))
+	}
+	if len(changed) != 1 || changed[0] != updated {
+		t.Errorf("Diff() changed = %v, want the remote m2", messageIDs(changed))
+	}
+}
+
+func TestDiffDisjoint(t *testing.T) {
+	local := []*Message{NewMessage("m1", "conv", "alice", "hi", 1000), NewMessage("m2", "conv", "alice", "yo", 2000)}
+	remote := []*Message{NewMessage("m3", "conv", "bob", "hey", 3000), NewMessage("m4", "conv", "bob", "sup", 4000)}
+
+	added, changed, removed := Diff(local, remote)
+	if got := messageIDs(added); len(got) != 2 || got[0] != "m3" || got[1] != "m4" {
+		t.Errorf("Diff() added = %v, want [m3 m4]", got)
+	}
+	if len(changed) != 0 {
+		t.Errorf("Diff() changed = %v, want none", messageIDs(changed))
+	}
+	if got := messageIDs(removed); len(got) != 2 || got[0] != "m1" || got[1] != "m2" {
+		t.Errorf("Diff() removed = %v, want [m1 m2]", got)
+	}
+}
@@ -0,0 +1,91 @@
+package message
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// crockford is the Crockford base32 alphabet used by ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// idGenerator produces ULID-like IDs: a 48-bit millisecond timestamp
+// followed by 80 random bits, encoded as 26 Crockford base32 characters.
+// IDs from the same millisecond increment the random part, so IDs from
+// one process always sort in generation order.
+type idGenerator struct {
+	mu   sync.Mutex
+	last [16]byte
+	ms   uint64
+}
+
+var ids idGenerator
+
+// NewID returns a new unique message ID. IDs sort lexicographically in
+// the order they were generated.
+func NewID() string {
+	return ids.next(time.Now())
+}
+
+func (g *idGenerator) next(now time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	if ms <= g.ms {
+		// Same millisecond, or the clock went backwards: keep the last
+		// timestamp and increment the random part
+		for i := 15; i >= 6; i-- {
+			g.last[i]++
+			if g.last[i] != 0 {
+				break
+			}
+		}
+	} else {
+		g.ms = ms
+		for i := 0; i < 6; i++ {
+			g.last[i] = byte(ms >> (40 - 8*i))
+		}
+		if _, err := rand.Read(g.last[6:]); err != nil {
+			panic("message: reading random bytes: " + err.Error())
+		}
+	}
+
+	return encodeID(g.last)
+}
+
+// encodeID encodes 128 bits as 26 base32 characters, most significant first
+func encodeID(id [16]byte) string {
+	var out [26]byte
+	// 26 characters hold 130 bits; the first character carries the top 3
+	var hi, lo uint64
+	for i := 0; i < 8; i++ {
+		hi = hi<<8 | uint64(id[i])
+		lo = lo<<8 | uint64(id[8+i])
+	}
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1F]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// ConversationIDFor returns the conversation ID of the 1:1 chat between
+// users a and b. The IDs are sorted before hashing, so both participants
+// derive the same ID. Group conversations don't use this; they carry an
+// explicit ID chosen when the group is created.
+func ConversationIDFor(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+
+	h := sha256.New()
+	h.Write([]byte("merabriar_conversation\x00"))
+	h.Write([]byte(a))
+	h.Write([]byte{0})
+	h.Write([]byte(b))
+	return hex.EncodeToString(h.Sum(nil))
+}
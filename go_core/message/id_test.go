@@ -0,0 +1,96 @@
+package message
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewIDUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100000; i++ {
+		id := NewID()
+		if len(id) != 26 {
+			t.Fatalf("len(NewID()) = %d, want 26", len(id))
+		}
+		if seen[id] {
+			t.Fatalf("NewID() returned duplicate %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestNewIDMonotonic(t *testing.T) {
+	prev := NewID()
+	for i := 0; i < 10000; i++ {
+		id := NewID()
+		if id <= prev {
+			t.Fatalf("NewID() = %q, not after %q", id, prev)
+		}
+		prev = id
+	}
+
+	// Across milliseconds
+	time.Sleep(2 * time.Millisecond)
+	if id := NewID(); id <= prev {
+		t.Errorf("NewID() = %q after sleeping, not after %q", id, prev)
+	}
+}
+
+func TestNewIDClockBackwards(t *testing.T) {
+	var g idGenerator
+	now := time.Now()
+
+	first := g.next(now)
+	second := g.next(now.Add(-time.Second))
+	if second <= first {
+		t.Errorf("ID after clock step back = %q, not after %q", second, first)
+	}
+}
+
+func TestEncodeIDTimestampPrefix(t *testing.T) {
+	var g idGenerator
+	earlier := g.next(time.UnixMilli(1000))
+	var h idGenerator
+	later := h.next(time.UnixMilli(2000))
+
+	if earlier[:10] >= later[:10] {
+		t.Errorf("timestamp prefix %q should sort before %q", earlier[:10], later[:10])
+	}
+	if got := encodeID([16]byte{}); got != "00000000000000000000000000" {
+		t.Errorf("encodeID(zero) = %q", got)
+	}
+}
+
+func TestConversationIDForSymmetric(t *testing.T) {
+	ab, ba := ConversationIDFor("alice", "bob"), ConversationIDFor("bob", "alice")
+	if ab != ba {
+		t.Errorf("ConversationIDFor(alice, bob) = %q, (bob, alice) = %q; want equal", ab, ba)
+	}
+	if len(ab) != 64 {
+		t.Errorf("len(ConversationIDFor()) = %d, want 64", len(ab))
+	}
+	if ab != ConversationIDFor("alice", "bob") {
+		t.Error("ConversationIDFor() should be deterministic")
+	}
+}
+
+func TestConversationIDForDistinctPairs(t *testing.T) {
+	pairs := [][2]string{
+		{"alice", "bob"},
+		{"alice", "carol"},
+		{"bob", "carol"},
+		{"alice", "alice"},
+		// Concatenation alone would make these collide
+		{"ab", "c"},
+		{"a", "bc"},
+	}
+
+	seen := make(map[string][2]string)
+	for _, p := range pairs {
+		id := ConversationIDFor(p[0], p[1])
+		if prev, ok := seen[id]; ok {
+			t.Errorf("ConversationIDFor%v = ConversationIDFor%v", p, prev)
+		}
+		seen[id] = p
+	}
+}
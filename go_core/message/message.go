@@ -2,6 +2,11 @@
 // This mirrors Briar's message types in briar-api
 package message
 
+import (
+	"encoding/json"
+	"errors"
+)
+
 // MessageStatus represents the status of a message
 type MessageStatus string
 
@@ -13,14 +18,34 @@ const (
 	StatusFailed    MessageStatus = "failed"
 )
 
+// CurrentSchemaVersion is the Message JSON layout this build writes.
+// JSON without a version predates versioning and is treated as version 1.
+const CurrentSchemaVersion = 1
+
 // Message represents a chat message
 type Message struct {
-	ID             string        `json:"id"`
-	ConversationID string        `json:"conversation_id"`
-	SenderID       string        `json:"sender_id"`
-	Content        string        `json:"content"`
-	Timestamp      int64         `json:"timestamp"`
-	Status         MessageStatus `json:"status"`
+	SchemaVersion    int           `json:"v"`
+	ID               string        `json:"id"`
+	ConversationID   string        `json:"conversation_id"`
+	SenderID         string        `json:"sender_id"`
+	Content          string        `json:"content"`
+	Timestamp        int64         `json:"timestamp"`
+	Status           MessageStatus `json:"status"`
+	MessageType      MessageType   `json:"message_type,omitempty"`
+	EditedAt         int64         `json:"edited_at,omitempty"`
+	Deleted          bool          `json:"deleted,omitempty"`           // Tombstone: content has been erased
+	ExpiresAt        int64         `json:"expires_at,omitempty"`        // Unix seconds after which the message is purged; zero means never
+	EncryptedContent []byte        `json:"encrypted_content,omitempty"` // Ciphertext as sent or received, for re-sending
+	PrevHash         string        `json:"prev_hash,omitempty"`         // Hash of the previous message in the conversation's chain
+	Hash             string        `json:"hash,omitempty"`              // ChainHash of this message, set when it is stored
+	Seq              int64         `json:"seq,omitempty"`               // Per-conversation sequence number, set when it is stored
+}
+
+// MessageEdit is a previous version of an edited message
+type MessageEdit struct {
+	MessageID string `json:"message_id"`
+	Content   string `json:"content"`   // Content before this edit
+	EditedAt  int64  `json:"edited_at"` // When it was replaced
 }
 
 // NewMessage creates a new message
@@ -32,7 +57,34 @@ func NewMessage(id, conversationID, senderID, content string, timestamp int64) *
 		Content:        content,
 		Timestamp:      timestamp,
 		Status:         StatusPending,
+		SchemaVersion:  CurrentSchemaVersion,
+	}
+}
+
+// UnmarshalJSON decodes a message, recording the sender's schema version.
+// Unknown fields from newer versions are ignored; known fields are kept.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plain Message
+	aux := struct {
+		*plain
+		Version *int `json:"v"`
+	}{plain: (*plain)(m)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	m.SchemaVersion = 1
+	if aux.Version != nil {
+		m.SchemaVersion = *aux.Version
 	}
+	return nil
+}
+
+// IsNewerSchema reports whether the message was written by a newer
+// client, so fields this build doesn't know about may have been dropped
+func (m *Message) IsNewerSchema() bool {
+	return m.SchemaVersion > CurrentSchemaVersion
 }
 
 // MessageType represents different content types
@@ -46,6 +98,10 @@ const (
 	TypeFile     MessageType = "file"
 	TypeLocation MessageType = "location"
 	TypeContact  MessageType = "contact"
+
+	// Ephemeral signals, see IsEphemeral
+	TypeTyping   MessageType = "typing"
+	TypePresence MessageType = "presence"
 )
 
 // EncryptedMessage represents a message ready for transport
@@ -56,4 +112,38 @@ type EncryptedMessage struct {
 	EncryptedContent []byte      `json:"encrypted_content"`
 	MessageType      MessageType `json:"message_type"`
 	Timestamp        int64       `json:"timestamp"`
+
+	// TransportHint is the ID (a transport.TransportID) of the transport
+	// the message was last sent over, for debugging delivery
+	TransportHint string `json:"transport_hint,omitempty"`
+	// HopCount is the number of relays that have forwarded the message
+	HopCount int `json:"hop_count,omitempty"`
+}
+
+// MaxHopCount is the most relays a message may pass through. Receivers
+// drop messages with a higher HopCount, so a relay loop can't circulate
+// a message forever.
+const MaxHopCount = 8
+
+// ErrHopLimitExceeded is returned when relaying a message that has
+// already passed through MaxHopCount relays
+var ErrHopLimitExceeded = errors.New("message hop limit exceeded")
+
+// Relayed returns a copy of the message for a relay to forward over the
+// transport via, with HopCount incremented. It returns
+// ErrHopLimitExceeded if that would exceed MaxHopCount.
+func (m *EncryptedMessage) Relayed(via string) (*EncryptedMessage, error) {
+	if m.HopCount >= MaxHopCount {
+		return nil, ErrHopLimitExceeded
+	}
+	relayed := *m
+	relayed.TransportHint = via
+	relayed.HopCount++
+	return &relayed, nil
+}
+
+// HopLimitExceeded reports whether the message has passed through more
+// than MaxHopCount relays and should be dropped
+func (m *EncryptedMessage) HopLimitExceeded() bool {
+	return m.HopCount > MaxHopCount
 }
@@ -180,6 +180,53 @@ func TestEncryptedMessageSerialization(t *testing.T) {
 	}
 }
 
+func TestEncryptedMessageRelayFields(t *testing.T) {
+	// Relay metadata is omitted from direct messages
+	data, _ := json.Marshal(&EncryptedMessage{ID: "enc-1"})
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	if _, ok := fields["transport_hint"]; ok {
+		t.Errorf("direct message JSON %s should omit transport_hint", data)
+	}
+	if _, ok := fields["hop_count"]; ok {
+		t.Errorf("direct message JSON %s should omit hop_count", data)
+	}
+
+	relayed := &EncryptedMessage{ID: "enc-1", TransportHint: "org.merabriar.lan", HopCount: 2}
+	data, _ = json.Marshal(relayed)
+	var restored EncryptedMessage
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("json.Unmarshal error: %v", err)
+	}
+	if restored.TransportHint != relayed.TransportHint || restored.HopCount != relayed.HopCount {
+		t.Errorf("restored relay fields = %q/%d, want %q/%d", restored.TransportHint, restored.HopCount, relayed.TransportHint, relayed.HopCount)
+	}
+}
+
+func TestEncryptedMessageRelayed(t *testing.T) {
+	msg := &EncryptedMessage{ID: "enc-1"}
+	for hop := 1; hop <= MaxHopCount; hop++ {
+		next, err := msg.Relayed("org.merabriar.lan")
+		if err != nil {
+			t.Fatalf("Relayed() at hop %d error: %v", hop, err)
+		}
+		if next.HopCount != hop || next.TransportHint != "org.merabriar.lan" || next.HopLimitExceeded() {
+			t.Fatalf("hop %d: got %+v", hop, next)
+		}
+		msg = next
+	}
+
+	if _, err := msg.Relayed("org.merabriar.lan"); err != ErrHopLimitExceeded {
+		t.Errorf("Relayed() past MaxHopCount error = %v, want ErrHopLimitExceeded", err)
+	}
+	if msg.HopCount != MaxHopCount {
+		t.Errorf("Relayed() should not modify the original, HopCount = %d", msg.HopCount)
+	}
+	if over := (&EncryptedMessage{HopCount: MaxHopCount + 1}); !over.HopLimitExceeded() {
+		t.Error("HopLimitExceeded() should be true past MaxHopCount")
+	}
+}
+
 // ═══════════════════════════════════════
 // 4. Message Types
 // ═══════════════════════════════════════
@@ -283,3 +330,120 @@ func containsSubstring(s, substr string) bool {
 	}
 	return false
 }
+
+// ═══════════════════════════════════════
+// 6. Ephemeral Signals
+// ═══════════════════════════════════════
+
+func TestIsEphemeral(t *testing.T) {
+	for _, mt := range []MessageType{TypeTyping, TypePresence} {
+		if !IsEphemeral(mt) {
+			t.Errorf("IsEphemeral(%q) = false, want true", mt)
+		}
+	}
+	for _, mt := range []MessageType{TypeText, TypeImage, TypeVoice, TypeVideo, TypeFile, TypeLocation, TypeContact, ""} {
+		if IsEphemeral(mt) {
+			t.Errorf("IsEphemeral(%q) = true, want false", mt)
+		}
+	}
+}
+
+func TestTypingSignalSerialization(t *testing.T) {
+	signal := TypingSignal{ConversationID: "conv-1", Typing: true}
+
+	data, err := json.Marshal(signal)
+	if err != nil {
+		t.Fatalf("json.Marshal() error: %v", err)
+	}
+	if string(data) != `{"conversation_id":"conv-1","typing":true}` {
+		t.Errorf("json = %s", data)
+	}
+
+	var decoded TypingSignal
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+	if decoded != signal {
+		t.Errorf("decoded = %+v, want %+v", decoded, signal)
+	}
+}
+
+func TestPresenceSignalSerialization(t *testing.T) {
+	online, _ := json.Marshal(PresenceSignal{Online: true})
+	if string(online) != `{"online":true}` {
+		t.Errorf("online json = %s, last_seen should be omitted", online)
+	}
+
+	signal := PresenceSignal{Online: false, LastSeen: 1700000000}
+	data, _ := json.Marshal(signal)
+
+	var decoded PresenceSignal
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+	if decoded != signal {
+		t.Errorf("decoded = %+v, want %+v", decoded, signal)
+	}
+}
+
+// ═══════════════════════════════════════
+// 7. Schema Versioning
+// ═══════════════════════════════════════
+
+func TestNewMessageSchemaVersion(t *testing.T) {
+	msg := NewMessage("v-1", "conv-1", "alice", "Hello", 1000)
+	if msg.SchemaVersion != CurrentSchemaVersion {
+		t.Errorf("SchemaVersion = %d, want %d", msg.SchemaVersion, CurrentSchemaVersion)
+	}
+
+	data, _ := json.Marshal(msg)
+	if !contains(string(data), `"v":1`) {
+		t.Errorf("JSON should contain the schema version, got: %s", data)
+	}
+
+	var restored Message
+	json.Unmarshal(data, &restored)
+	if restored.SchemaVersion != CurrentSchemaVersion || restored.IsNewerSchema() {
+		t.Errorf("restored SchemaVersion = %d, want %d", restored.SchemaVersion, CurrentSchemaVersion)
+	}
+}
+
+func TestUnmarshalNewerSchemaKeepsKnownFields(t *testing.T) {
+	data := []byte(`{
+		"v": 7,
+		"id": "future-1",
+		"conversation_id": "conv-1",
+		"sender_id": "alice",
+		"content": "from the future",
+		"timestamp": 1234,
+		"status": "sent",
+		"reactions": {"👍": 3},
+		"thread": {"root": "x"}
+	}`)
+
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("json.Unmarshal error: %v", err)
+	}
+
+	if msg.SchemaVersion != 7 || !msg.IsNewerSchema() {
+		t.Errorf("SchemaVersion = %d, want 7 flagged as newer", msg.SchemaVersion)
+	}
+	if msg.ID != "future-1" || msg.ConversationID != "conv-1" || msg.SenderID != "alice" ||
+		msg.Content != "from the future" || msg.Timestamp != 1234 || msg.Status != StatusSent {
+		t.Errorf("known fields lost: %+v", msg)
+	}
+}
+
+func TestUnmarshalUnversionedIsVersionOne(t *testing.T) {
+	var msg Message
+	if err := json.Unmarshal([]byte(`{"id":"old","content":"hi","timestamp":1}`), &msg); err != nil {
+		t.Fatalf("json.Unmarshal error: %v", err)
+	}
+	if msg.SchemaVersion != 1 {
+		t.Errorf("SchemaVersion = %d, want 1", msg.SchemaVersion)
+	}
+	if msg.ID != "old" || msg.Content != "hi" {
+		t.Errorf("fields lost: %+v", msg)
+	}
+}
@@ -0,0 +1,22 @@
+package message
+
+// Ephemeral signals are delivered to the peer but never persisted:
+// they must not be passed to storage.StoreMessage, which rejects them.
+
+// IsEphemeral reports whether messages of type t are transient signals
+// that are never stored
+func IsEphemeral(t MessageType) bool {
+	return t == TypeTyping || t == TypePresence
+}
+
+// TypingSignal is the content of a TypeTyping message
+type TypingSignal struct {
+	ConversationID string `json:"conversation_id"`
+	Typing         bool   `json:"typing"` // false when the user stops typing
+}
+
+// PresenceSignal is the content of a TypePresence message
+type PresenceSignal struct {
+	Online   bool  `json:"online"`
+	LastSeen int64 `json:"last_seen,omitempty"` // Unix seconds, when offline
+}
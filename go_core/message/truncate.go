@@ -0,0 +1,19 @@
+package message
+
+// TruncateRunes returns the first maxRunes runes of s, or s if it is no
+// longer. It never splits a multi-byte rune, so valid UTF-8 stays valid.
+// It counts runes, not user-perceived characters: a combining mark may
+// be cut from the rune it modifies. A non-positive maxRunes gives "".
+func TruncateRunes(s string, maxRunes int) string {
+	if maxRunes <= 0 {
+		return ""
+	}
+	n := 0
+	for i := range s {
+		if n == maxRunes {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
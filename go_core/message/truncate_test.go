@@ -0,0 +1,56 @@
+package message
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		maxRunes int
+		want     string
+	}{
+		{"ascii", "hello world", 5, "hello"},
+		{"shorter than limit", "hi", 5, "hi"},
+		{"exact length", "hello", 5, "hello"},
+		{"empty", "", 3, ""},
+		{"zero limit", "hello", 0, ""},
+		{"negative limit", "hello", -1, ""},
+		{"two-byte runes", "héllo", 2, "hé"},
+		{"emoji", "🙂🙃😉", 2, "🙂🙃"},
+		{"emoji after ascii", "ok👍", 3, "ok👍"},
+		// The ZWJ sequence 👩‍💻 is three runes: woman, ZWJ, laptop
+		{"zwj sequence", "\U0001F469\u200d\U0001F4BB!", 2, "\U0001F469\u200d"},
+		// e followed by a combining acute accent is two runes
+		{"combining mark", "e\u0301e\u0301", 3, "e\u0301e"},
+		{"combining mark kept", "e\u0301x", 2, "e\u0301"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TruncateRunes(tt.s, tt.maxRunes)
+			if got != tt.want {
+				t.Errorf("TruncateRunes(%q, %d) = %q, want %q", tt.s, tt.maxRunes, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("TruncateRunes(%q, %d) = %q is not valid UTF-8", tt.s, tt.maxRunes, got)
+			}
+			if n := utf8.RuneCountInString(got); n > max(tt.maxRunes, 0) {
+				t.Errorf("TruncateRunes(%q, %d) has %d runes", tt.s, tt.maxRunes, n)
+			}
+		})
+	}
+}
+
+func TestTruncateRunesNeverSplitsRunes(t *testing.T) {
+	s := "a€😀ß字👩‍👩‍👧"
+	total := utf8.RuneCountInString(s)
+	for n := 0; n <= total+1; n++ {
+		got := TruncateRunes(s, n)
+		if !utf8.ValidString(got) || utf8.RuneCountInString(got) != min(n, total) {
+			t.Errorf("TruncateRunes(%d) = %q, %d runes; want %d valid runes", n, got, utf8.RuneCountInString(got), min(n, total))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Content limits
+const (
+	MaxTextLength  = 4096      // Characters in a text message
+	MaxContentSize = 64 * 1024 // Bytes of content for any other type
+)
+
+var (
+	// ErrInvalidContent is returned when content doesn't match its type
+	ErrInvalidContent = errors.New("invalid message content")
+	// ErrContentTooLong is returned when content exceeds its type's limit
+	ErrContentTooLong = errors.New("message content too long")
+)
+
+// Location is the content of a TypeLocation message
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// ValidateContent checks content against the rules for its message type:
+//   - text: at most MaxTextLength characters
+//   - location: JSON Location with in-range coordinates
+//   - contact: a vCard (BEGIN:VCARD ... END:VCARD) with an FN line
+//   - media/file: at most MaxContentSize bytes
+func ValidateContent(t MessageType, content string) error {
+	switch t {
+	case TypeText:
+		if utf8.RuneCountInString(content) > MaxTextLength {
+			return fmt.Errorf("%w: text exceeds %d characters", ErrContentTooLong, MaxTextLength)
+		}
+		return nil
+
+	case TypeLocation:
+		return validateLocation(content)
+
+	case TypeContact:
+		return validateContact(content)
+
+	case TypeImage, TypeVoice, TypeVideo, TypeFile:
+		if len(content) > MaxContentSize {
+			return fmt.Errorf("%w: %s content exceeds %d bytes", ErrContentTooLong, t, MaxContentSize)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("%w: unknown message type %q", ErrInvalidContent, t)
+	}
+}
+
+func validateLocation(content string) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &raw); err != nil {
+		return fmt.Errorf("%w: location is not JSON", ErrInvalidContent)
+	}
+	if raw["latitude"] == nil || raw["longitude"] == nil {
+		return fmt.Errorf("%w: location requires latitude and longitude", ErrInvalidContent)
+	}
+
+	var loc Location
+	if err := json.Unmarshal([]byte(content), &loc); err != nil {
+		return fmt.Errorf("%w: location coordinates must be numbers", ErrInvalidContent)
+	}
+	if loc.Latitude < -90 || loc.Latitude > 90 {
+		return fmt.Errorf("%w: latitude %v out of range", ErrInvalidContent, loc.Latitude)
+	}
+	if loc.Longitude < -180 || loc.Longitude > 180 {
+		return fmt.Errorf("%w: longitude %v out of range", ErrInvalidContent, loc.Longitude)
+	}
+	return nil
+}
+
+func validateContact(content string) error {
+	if len(content) > MaxContentSize {
+		return fmt.Errorf("%w: contact exceeds %d bytes", ErrContentTooLong, MaxContentSize)
+	}
+
+	lines := strings.Split(strings.ReplaceAll(strings.TrimSpace(content), "\r\n", "\n"), "\n")
+	if len(lines) < 3 ||
+		!strings.EqualFold(strings.TrimSpace(lines[0]), "BEGIN:VCARD") ||
+		!strings.EqualFold(strings.TrimSpace(lines[len(lines)-1]), "END:VCARD") {
+		return fmt.Errorf("%w: contact must be a vCard", ErrInvalidContent)
+	}
+
+	for _, line := range lines[1 : len(lines)-1] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(name, "FN") && strings.TrimSpace(value) != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: contact vCard requires an FN (name) line", ErrInvalidContent)
+}
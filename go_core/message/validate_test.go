@@ -0,0 +1,58 @@
+// Package message tests - per-type content validation
+package message
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateContentValid(t *testing.T) {
+	cases := []struct {
+		name    string
+		t       MessageType
+		content string
+	}{
+		{"text", TypeText, "Hello 🌍"},
+		{"empty text", TypeText, ""},
+		{"text at limit", TypeText, strings.Repeat("é", MaxTextLength)},
+		{"location", TypeLocation, `{"latitude": 28.6139, "longitude": 77.2090}`},
+		{"location at bounds", TypeLocation, `{"latitude": -90, "longitude": 180}`},
+		{"contact", TypeContact, "BEGIN:VCARD\nVERSION:3.0\nFN:Asha Rao\nTEL:+911234567890\nEND:VCARD"},
+		{"contact crlf", TypeContact, "BEGIN:VCARD\r\nFN:Asha\r\nEND:VCARD\r\n"},
+		{"image", TypeImage, "attachment:abc123"},
+	}
+
+	for _, tc := range cases {
+		if err := ValidateContent(tc.t, tc.content); err != nil {
+			t.Errorf("%s: ValidateContent() error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestValidateContentInvalid(t *testing.T) {
+	cases := []struct {
+		name    string
+		t       MessageType
+		content string
+		want    error
+	}{
+		{"text too long", TypeText, strings.Repeat("a", MaxTextLength+1), ErrContentTooLong},
+		{"location not json", TypeLocation, "28.6,77.2", ErrInvalidContent},
+		{"location missing longitude", TypeLocation, `{"latitude": 10}`, ErrInvalidContent},
+		{"location latitude out of range", TypeLocation, `{"latitude": 91, "longitude": 0}`, ErrInvalidContent},
+		{"location longitude out of range", TypeLocation, `{"latitude": 0, "longitude": -180.5}`, ErrInvalidContent},
+		{"location string coords", TypeLocation, `{"latitude": "10", "longitude": "20"}`, ErrInvalidContent},
+		{"contact plain text", TypeContact, "Asha 1234567890", ErrInvalidContent},
+		{"contact without name", TypeContact, "BEGIN:VCARD\nTEL:123\nEND:VCARD", ErrInvalidContent},
+		{"file too large", TypeFile, strings.Repeat("x", MaxContentSize+1), ErrContentTooLong},
+		{"unknown type", MessageType("sticker"), "x", ErrInvalidContent},
+	}
+
+	for _, tc := range cases {
+		err := ValidateContent(tc.t, tc.content)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: ValidateContent() error = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
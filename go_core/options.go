@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+
+	"merabriar_core/crypto"
+	"merabriar_core/storage"
+	"merabriar_core/sync"
+)
+
+// memoryPath is the path that selects an in-memory database
+const memoryPath = ":memory:"
+
+// coreOptions is the options JSON accepted by InitCoreWithOptions
+type coreOptions struct {
+	Path          string `json:"path"` // memoryPath for an in-memory database
+	EncryptionKey string `json:"encryption_key"`
+	// WAL selects WAL journaling; absent means on
+	WAL *bool `json:"wal"`
+	// BusyTimeoutMs is as storage.Options.BusyTimeout: zero selects the
+	// default and negative fails at once
+	BusyTimeoutMs int  `json:"busy_timeout_ms"`
+	ReadOnly      bool `json:"read_only"`
+}
+
+// errReadOnlyMemory is returned for options asking for a read-only
+// in-memory database, which would always be empty
+var errReadOnlyMemory = errors.New("an in-memory database can't be read-only")
+
+// errCoreNotInitialized is returned by SelfTest before InitCore
+var errCoreNotInitialized = errors.New("core not initialized")
+
+// parseCoreOptions parses the options JSON into storage options
+func parseCoreOptions(data string) (storage.Options, error) {
+	var opts coreOptions
+	if err := decodeJSON(data, &opts, "path", "encryption_key"); err != nil {
+		return storage.Options{}, err
+	}
+
+	inMemory := opts.Path == memoryPath
+	if inMemory && opts.ReadOnly {
+		return storage.Options{}, errReadOnlyMemory
+	}
+
+	storageOpts := storage.Options{
+		Path:          opts.Path,
+		EncryptionKey: opts.EncryptionKey,
+		BusyTimeout:   opts.BusyTimeoutMs,
+		DisableWAL:    opts.WAL != nil && !*opts.WAL,
+		ReadOnly:      opts.ReadOnly,
+		InMemory:      inMemory,
+	}
+	if inMemory {
+		storageOpts.Path = ""
+	}
+	return storageOpts, nil
+}
+
+// openCore opens storage with opts and sets up the global engine state.
+// The globals are only replaced once everything has loaded.
+func openCore(opts storage.Options) error {
+	store, err := storage.NewWithOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	// Restore messages saved by ShutdownCore
+	q := sync.NewMessageQueue()
+	if err := restoreQueue(store, q); err != nil {
+		store.Close()
+		return err
+	}
+
+	// Warm the session cache from storage
+	km := crypto.NewKeyManager()
+	sm := crypto.NewSessionManager(store, km)
+	if err := sm.LoadAll(); err != nil {
+		store.Close()
+		return err
+	}
+
+	db, queue, keyMgr, sessions, readOnly = store, q, km, sm, opts.ReadOnly
+	return nil
+}
+
+// selfTest checks that the core is open and its database answers queries
+func selfTest(store *storage.Storage) error {
+	if store == nil {
+		return errCoreNotInitialized
+	}
+	return store.Ping()
+}
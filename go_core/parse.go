@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"merabriar_core/crypto"
+	"merabriar_core/message"
+	"merabriar_core/sync"
+)
+
+// errMissingField is returned for a required JSON field that is absent,
+// null or empty
+var errMissingField = errors.New("missing required field")
+
+// fieldError is a parse error in one field of an FFI JSON argument
+type fieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("field %q: %v", e.Field, e.Err)
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.Err
+}
+
+// decodeJSON decodes the JSON object data into v, a pointer to a struct,
+// after checking that each required field is present and non-empty.
+// Errors name the field that failed where possible.
+func decodeJSON(data string, v any, required ...string) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if fields == nil {
+		return errors.New("invalid JSON: expected an object, got null")
+	}
+	for _, name := range required {
+		if isEmptyJSON(fields[name]) {
+			return &fieldError{Field: name, Err: errMissingField}
+		}
+	}
+
+	err := json.Unmarshal([]byte(data), v)
+	if err == nil {
+		return nil
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return &fieldError{Field: typeErr.Field, Err: err}
+	}
+
+	// Other errors, e.g. bad base64 in a []byte field, don't say which
+	// field failed: find it by decoding the fields one at a time
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		single, _ := json.Marshal(map[string]json.RawMessage{name: fields[name]})
+		if fieldErr := json.Unmarshal(single, reflect.New(reflect.TypeOf(v).Elem()).Interface()); fieldErr != nil {
+			return &fieldError{Field: name, Err: fieldErr}
+		}
+	}
+	return err
+}
+
+// isEmptyJSON reports whether a JSON value is absent, null, "" or []
+func isEmptyJSON(value json.RawMessage) bool {
+	switch string(bytes.TrimSpace(value)) {
+	case "", "null", `""`, "[]":
+		return true
+	}
+	return false
+}
+
+// parseKeyBundle parses the public key bundle passed to InitSession
+func parseKeyBundle(data string) (*crypto.PublicKeyBundle, error) {
+	var keys crypto.PublicKeyBundle
+	if err := decodeJSON(data, &keys, "identity_public_key", "signed_prekey", "signature"); err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+// parseQueuedMessage parses the message passed to QueueMessage
+func parseQueuedMessage(data string) (*sync.QueuedMessage, error) {
+	var msg sync.QueuedMessage
+	if err := decodeJSON(data, &msg, "id", "recipient_id", "encrypted_content"); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// parseMessage parses the message passed to StoreMessage
+func parseMessage(data string) (*message.Message, error) {
+	var msg message.Message
+	if err := decodeJSON(data, &msg, "id", "conversation_id", "sender_id"); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// parseIDs parses the JSON array of message IDs passed to ClearQueue
+func parseIDs(data string) ([]string, error) {
+	var ids []string
+	if err := json.Unmarshal([]byte(data), &ids); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	for i, id := range ids {
+		if id == "" {
+			return nil, &fieldError{Field: fmt.Sprintf("[%d]", i), Err: errMissingField}
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+
+	"merabriar_core/sync"
+)
+
+// maxQueuePageSize caps the messages returned by one
+// GetQueuedMessagesPage call, bounding the string crossing the FFI
+const maxQueuePageSize = 500
+
+// errInvalidPage is returned for a non-positive limit or negative cursor
+var errInvalidPage = errors.New("invalid page: limit must be positive and cursor non-negative")
+
+// queuePage is one chunk of the outbound queue. Pass Next as the cursor
+// of the following call while HasMore is set.
+type queuePage struct {
+	Messages []*sync.QueuedMessage `json:"messages"`
+	Next     int64                 `json:"next"`
+	HasMore  bool                  `json:"has_more"`
+}
+
+// queuedMessagesPage returns up to limit queued messages added after the
+// cursor, in the order they were added; 0 starts from the first. Limits
+// above maxQueuePageSize are reduced to it. The cursor is a queue
+// position (see sync.MessageQueue.GetPageAfter), so acks and dequeues
+// between calls don't shift the pages.
+func queuedMessagesPage(q *sync.MessageQueue, limit int, cursor int64) (*queuePage, error) {
+	if limit <= 0 || cursor < 0 {
+		return nil, errInvalidPage
+	}
+	limit = min(limit, maxQueuePageSize)
+
+	msgs, next := q.GetPageAfter(cursor, limit)
+	page := &queuePage{Messages: make([]*sync.QueuedMessage, 0, len(msgs)), Next: next}
+	page.Messages = append(page.Messages, msgs...)
+	if len(msgs) == limit {
+		more, _ := q.GetPageAfter(next, 1)
+		page.HasMore = len(more) > 0
+	}
+	return page, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"encoding/json"
+
+	"merabriar_core/crypto"
+)
+
+// sessionCounters is the JSON returned by GetSessionCounters
+type sessionCounters struct {
+	RecipientID string `json:"recipient_id"`
+	SendCounter uint32 `json:"send_counter"`
+	RecvCounter uint32 `json:"recv_counter"`
+}
+
+// sessionCountersJSON reports a session's counters without touching its state
+func sessionCountersJSON(session *crypto.Session) ([]byte, error) {
+	send, recv := session.Counters()
+	return json.Marshal(sessionCounters{
+		RecipientID: session.RecipientID,
+		SendCounter: send,
+		RecvCounter: recv,
+	})
+}
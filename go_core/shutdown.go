@@ -0,0 +1,43 @@
+package main
+
+import (
+	"merabriar_core/crypto"
+	"merabriar_core/sync"
+)
+
+// coreStore is the subset of storage.Storage used to persist core state
+// across restarts
+type coreStore interface {
+	crypto.SessionStore
+	StoreQueuedMessages(msgs []*sync.QueuedMessage) error
+	GetQueuedMessages() ([]*sync.QueuedMessage, error)
+	DeleteQueuedMessages(ids []string) error
+}
+
+// persistState saves every active session and drains the in-memory queue
+// to the store. If the queue can't be saved, the drained messages are put
+// back at the head of the queue so nothing is lost or reordered.
+func persistState(store coreStore, q *sync.MessageQueue, sessions *crypto.SessionManager) error {
+	if err := sessions.PersistAll(); err != nil {
+		return err
+	}
+
+	drained := q.DrainAll()
+	if err := store.StoreQueuedMessages(drained); err != nil {
+		q.Restore(drained)
+		return err
+	}
+	return nil
+}
+
+// restoreQueue loads messages persisted by a previous shutdown back into
+// q, ahead of any queued since startup. They stay in the store until
+// cleared, so a crash before the next shutdown doesn't lose them.
+func restoreQueue(store coreStore, q *sync.MessageQueue) error {
+	msgs, err := store.GetQueuedMessages()
+	if err != nil {
+		return err
+	}
+	q.Restore(msgs)
+	return nil
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrInvalidChunk is returned for a chunk index outside the manifest
+	ErrInvalidChunk = errors.New("chunk index out of range")
+	// ErrInvalidManifest is returned for a manifest with a negative size
+	// or chunk count, or a malformed hash
+	ErrInvalidManifest = errors.New("invalid attachment manifest")
+)
+
+// AttachmentManifest describes an attachment stored as numbered chunks
+type AttachmentManifest struct {
+	ID         string `json:"id"`
+	TotalSize  int64  `json:"total_size"`
+	ChunkCount int    `json:"chunk_count"`
+	SHA256     []byte `json:"sha256"` // Hash of the reassembled attachment
+}
+
+// StoreAttachmentManifest records an attachment's manifest. It must be
+// stored before the attachment's chunks. Replacing a manifest keeps the
+// chunks already stored that are still within it, and deletes the rest.
+func (s *Storage) StoreAttachmentManifest(m *AttachmentManifest) error {
+	if m.TotalSize < 0 || m.ChunkCount < 0 || len(m.SHA256) != sha256.Size {
+		return ErrInvalidManifest
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT OR REPLACE INTO attachments (id, total_size, chunk_count, sha256)
+		VALUES (?, ?, ?, ?)`,
+		m.ID, m.TotalSize, m.ChunkCount, m.SHA256,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		DELETE FROM attachment_chunks
+		WHERE attachment_id = ? AND chunk_index >= ?`,
+		m.ID, m.ChunkCount,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAttachmentManifest retrieves an attachment's manifest.
+// Returns ErrNotFound if there is no such attachment.
+func (s *Storage) GetAttachmentManifest(attachmentID string) (*AttachmentManifest, error) {
+	m := AttachmentManifest{ID: attachmentID}
+	err := s.db.QueryRow(`
+		SELECT total_size, chunk_count, sha256
+		FROM attachments WHERE id = ?`, attachmentID,
+	).Scan(&m.TotalSize, &m.ChunkCount, &m.SHA256)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// StoreAttachmentChunk stores one chunk of an attachment, replacing any
+// earlier copy. Chunks may arrive in any order. Returns ErrNotFound if the
+// attachment has no manifest and ErrInvalidChunk if index is outside it.
+func (s *Storage) StoreAttachmentChunk(attachmentID string, index int, data []byte) error {
+	m, err := s.GetAttachmentManifest(attachmentID)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= m.ChunkCount {
+		return ErrInvalidChunk
+	}
+
+	sealed, err := s.cipher.seal(data, chunkAAD(attachmentID, index))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		INSERT OR REPLACE INTO attachment_chunks (attachment_id, chunk_index, data)
+		VALUES (?, ?, ?)`,
+		attachmentID, index, sealed,
+	)
+	return err
+}
+
+// GetAttachmentChunk retrieves one chunk of an attachment.
+// Returns ErrNotFound if the chunk hasn't been stored.
+func (s *Storage) GetAttachmentChunk(attachmentID string, index int) ([]byte, error) {
+	var sealed []byte
+	err := s.db.QueryRow(`
+		SELECT data FROM attachment_chunks
+		WHERE attachment_id = ? AND chunk_index = ?`, attachmentID, index,
+	).Scan(&sealed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.cipher.open(sealed, chunkAAD(attachmentID, index))
+	if data == nil && err == nil {
+		data = []byte{}
+	}
+	return data, err
+}
+
+// MissingAttachmentChunks returns the indexes of an attachment's chunks
+// that haven't been stored yet, in order, so an interrupted download can
+// resume. Returns ErrNotFound if the attachment has no manifest.
+func (s *Storage) MissingAttachmentChunks(attachmentID string) ([]int, error) {
+	m, err := s.GetAttachmentManifest(attachmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT chunk_index FROM attachment_chunks
+		WHERE attachment_id = ?`, attachmentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	have := make([]bool, m.ChunkCount)
+	for rows.Next() {
+		var index int
+		if err := rows.Scan(&index); err != nil {
+			return nil, err
+		}
+		if index < len(have) {
+			have[index] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing []int
+	for i, ok := range have {
+		if !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing, nil
+}
+
+// chunkAAD binds a sealed chunk to its position, matching the aad
+// expression in encryptedColumns
+func chunkAAD(attachmentID string, index int) []byte {
+	return []byte(attachmentID + ":" + strconv.Itoa(index))
+}
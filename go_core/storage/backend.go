@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"merabriar_core/contact"
+	"merabriar_core/crypto"
+	"merabriar_core/message"
+	"merabriar_core/sync"
+)
+
+// Backend is the storage API. *Storage implements it over a database
+// file, or in memory when opened with Options.InMemory.
+type Backend interface {
+	// Messages
+	StoreMessage(msg *message.Message) error
+	StoreMessageIfNew(msg *message.Message) (inserted bool, err error)
+	EditMessage(id, newContent string, editedAt int64) error
+	GetEditHistory(id string) ([]message.MessageEdit, error)
+	TombstoneMessage(id string) error
+	GetMessage(id string) (*message.Message, error)
+	GetMessagesByIDs(ids []string) (map[string]*message.Message, error)
+	GetMessages(conversationID string, limit, offset int) ([]*message.Message, error)
+	GetMessagesAsc(conversationID string, limit, offset int) ([]*message.Message, error)
+	GetMessagePreviews(conversationID string, limit, offset int) ([]*MessagePreview, error)
+	GetMessagesBySender(conversationID, senderID string, limit, offset int) ([]*message.Message, error)
+	GetLatestMessage(conversationID string) (*message.Message, error)
+	GetMessagesSince(conversationID string, after SyncCursor, limit int) ([]*message.Message, SyncCursor, error)
+	GetMessagesBefore(conversationID string, beforeTimestamp int64, limit int) ([]*message.Message, error)
+	GetMessagesPage(conversationID string, limit int, cursor string) (msgs []*message.Message, nextCursor string, hasMore bool, err error)
+	CountByStatus(conversationID string) (map[message.MessageStatus]int, error)
+	PurgeExpired() (purged int, err error)
+	VerifyChain(conversationID string) (ok bool, brokenAt string, err error)
+	FindGaps(conversationID string) ([]int64, error)
+	StartExpirySweeper(ctx context.Context, interval time.Duration) error
+
+	// Conversations
+	SetConversationFlags(conversationID string, flags ConversationFlags) error
+	GetConversationFlags(conversationID string) (ConversationFlags, error)
+	GetConversations(includeArchived bool) ([]*Conversation, error)
+	SetConversationRetention(conversationID string, retention time.Duration) error
+	GetConversationRetention(conversationID string) (time.Duration, error)
+	ApplyRetention(now int64) (purged int, err error)
+	PruneConversations(keepMostRecent int) (int, error)
+
+	ExportConversation(conversationID string, w io.Writer) error
+
+	// Attachments
+	StoreAttachmentManifest(m *AttachmentManifest) error
+	GetAttachmentManifest(attachmentID string) (*AttachmentManifest, error)
+	StoreAttachmentChunk(attachmentID string, index int, data []byte) error
+	GetAttachmentChunk(attachmentID string, index int) ([]byte, error)
+	MissingAttachmentChunks(attachmentID string) ([]int, error)
+
+	// Sessions
+	StoreSession(recipientID string, sessionData []byte) error
+	GetSession(recipientID string) ([]byte, error)
+	DeleteSession(recipientID string) error
+	ListSessionRecipients() ([]string, error)
+	GetAllSessions() (map[string][]byte, error)
+
+	// Outbound queue
+	StoreQueuedMessages(msgs []*sync.QueuedMessage) error
+	GetQueuedMessages() ([]*sync.QueuedMessage, error)
+	DeleteQueuedMessages(ids []string) error
+
+	// Contacts
+	StoreContact(c *contact.Contact) error
+	GetContact(id string) (*contact.Contact, error)
+	FindContactByPhoneHash(hash string) (*contact.Contact, error)
+	SearchContactsByName(prefix string) ([]*contact.Contact, error)
+	SetContactVerified(id string, verified bool) error
+	SetContactBlocked(id string, blocked bool) error
+	IsBlocked(id string) (bool, error)
+
+	// Maintenance
+	Rekey(newKey string) error
+	WipeAll(newKey string) error
+	SetBusyTimeout(ms int) error
+	Ping() error
+	Close() error
+}
+
+var (
+	_ Backend             = (*Storage)(nil)
+	_ crypto.SessionStore = (*Storage)(nil)
+)
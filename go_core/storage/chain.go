@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	gosync "sync"
+
+	"merabriar_core/message"
+)
+
+// chainState serializes message inserts so each new message links to the
+// conversation's current chain head
+type chainState struct {
+	mu gosync.Mutex
+}
+
+// chainLink returns the chain position for storing msg, read within tx so
+// the insert that follows can't race another writer. An existing message
+// keeps its place and hash, so its successor's link stays valid. A new
+// one follows the conversation's head. The caller must hold s.chain.mu.
+func chainLink(tx *sql.Tx, msg *message.Message) (seq int64, prevHash, hash string, err error) {
+	err = tx.QueryRow(`SELECT chain_seq, prev_hash, hash FROM messages WHERE id = ? AND chain_seq != 0`, msg.ID).Scan(&seq, &prevHash, &hash)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return seq, prevHash, hash, err
+	}
+
+	err = tx.QueryRow(`
+		SELECT chain_seq, hash FROM messages
+		WHERE conversation_id = ?
+		ORDER BY chain_seq DESC
+		LIMIT 1`, msg.ConversationID,
+	).Scan(&seq, &prevHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		seq, prevHash, err = 0, "", nil
+	}
+	if err != nil {
+		return 0, "", "", err
+	}
+	return seq + 1, prevHash, message.ChainHash(prevHash, msg.ID, msg.Content, msg.Timestamp), nil
+}
+
+// chainEntry is a stored message's chain fields
+type chainEntry struct {
+	id        string
+	content   []byte // Sealed
+	timestamp int64
+	edited    bool
+	deleted   bool
+	prevHash  string
+	hash      string
+}
+
+// VerifyChain checks the hash chain of a conversation's messages in the
+// order they were stored. Each message must link to the previous one, and
+// its hash must match its content; an edited message is checked against
+// its original content. A tombstoned message's content is gone, so only
+// its link is checked. Messages stored before chaining are skipped.
+//
+// On a break it reports false and the ID of the first message that fails.
+// Purged expired messages also break the chain where they were.
+func (s *Storage) VerifyChain(conversationID string) (ok bool, brokenAt string, err error) {
+	rows, err := s.db.Query(`
+		SELECT id, content, timestamp, edited_at != 0, deleted, prev_hash, hash
+		FROM messages
+		WHERE conversation_id = ? AND hash != ''
+		ORDER BY chain_seq ASC`, conversationID,
+	)
+	if err != nil {
+		return false, "", err
+	}
+	var entries []chainEntry
+	for rows.Next() {
+		var e chainEntry
+		if err := rows.Scan(&e.id, &e.content, &e.timestamp, &e.edited, &e.deleted, &e.prevHash, &e.hash); err != nil {
+			rows.Close()
+			return false, "", err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, "", err
+	}
+
+	for i, e := range entries {
+		if i > 0 && e.prevHash != entries[i-1].hash {
+			return false, e.id, nil
+		}
+		if e.deleted {
+			continue
+		}
+
+		content, err := s.originalContent(e)
+		if err != nil {
+			return false, "", err
+		}
+		if message.ChainHash(e.prevHash, e.id, content, e.timestamp) != e.hash {
+			return false, e.id, nil
+		}
+	}
+	return true, "", nil
+}
+
+// originalContent returns the content e was first stored with: its
+// oldest edit-history entry if it has been edited
+func (s *Storage) originalContent(e chainEntry) (string, error) {
+	sealed := e.content
+	if e.edited {
+		err := s.db.QueryRow(`
+			SELECT content FROM message_edits
+			WHERE message_id = ?
+			ORDER BY id ASC
+			LIMIT 1`, e.id,
+		).Scan(&sealed)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+	}
+	return s.cipher.openString(sealed)
+}
+
+// FindGaps returns the sequence numbers (see message.Message.Seq) missing
+// from a conversation between 1 and its highest stored sequence, in
+// ascending order, e.g. after messages were deleted or purged. Messages
+// stored before sequencing are ignored.
+func (s *Storage) FindGaps(conversationID string) ([]int64, error) {
+	rows, err := s.db.Query(`
+		SELECT chain_seq FROM messages
+		WHERE conversation_id = ? AND chain_seq > 0
+		ORDER BY chain_seq ASC`, conversationID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gaps []int64
+	next := int64(1)
+	for rows.Next() {
+		var seq int64
+		if err := rows.Scan(&seq); err != nil {
+			return nil, err
+		}
+		for ; next < seq; next++ {
+			gaps = append(gaps, next)
+		}
+		next = seq + 1
+	}
+	return gaps, rows.Err()
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"merabriar_core/audit"
+	"merabriar_core/crypto"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrWrongKey is returned when opening a database with the wrong key
+var ErrWrongKey = errors.New("wrong database encryption key")
+
+// keyCheckName is the storage_meta row holding a value sealed with the
+// database key, used to detect a wrong key on open
+const keyCheckName = "key_check"
+
+var keyCheckPlaintext = []byte("merabriar_storage_key_check")
+
+// encryptedColumns lists the columns holding sensitive data. Their values
+// are sealed with the database key before they are written. When aad names
+// a column (or SQL expression), its value is bound to the sealed value as
+// associated data, so the value can't be moved to another row.
+var encryptedColumns = []struct{ table, column, aad string }{
+	{"messages", "content", ""},
+	{"message_edits", "content", ""},
+	{"sessions", "session_data", "recipient_id"},
+	{"keys", "key_data", ""},
+	{"attachment_chunks", "data", "attachment_id || ':' || chunk_index"},
+}
+
+// fieldCipher seals individual column values with crypto.AEADSeal.
+// The empty value is stored as-is.
+type fieldCipher struct {
+	key []byte
+}
+
+// newFieldCipher derives the column key from the database key
+func newFieldCipher(key string) (*fieldCipher, error) {
+	columnKey := make([]byte, crypto.AEADKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(key), nil, []byte("merabriar_storage")), columnKey); err != nil {
+		return nil, err
+	}
+	return &fieldCipher{key: columnKey}, nil
+}
+
+func (c *fieldCipher) seal(plaintext, aad []byte) ([]byte, error) {
+	if len(plaintext) == 0 {
+		return []byte{}, nil
+	}
+	return crypto.AEADSeal(c.key, plaintext, aad)
+}
+
+func (c *fieldCipher) open(sealed, aad []byte) ([]byte, error) {
+	if len(sealed) == 0 {
+		return nil, nil
+	}
+
+	plaintext, err := crypto.AEADOpen(c.key, sealed, aad)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return plaintext, nil
+}
+
+// sealString seals a text column value
+func (c *fieldCipher) sealString(s string) ([]byte, error) {
+	return c.seal([]byte(s), nil)
+}
+
+// openString opens a text column value
+func (c *fieldCipher) openString(sealed []byte) (string, error) {
+	plaintext, err := c.open(sealed, nil)
+	return string(plaintext), err
+}
+
+// initKey checks the key against the database's key check value. A database
+// without one is new or predates encryption, so its existing rows are
+// sealed with the key and the check value is written.
+func initKey(db *sql.DB, c *fieldCipher) error {
+	if err := checkKey(db, c); !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := reseal(tx, nil, c); err != nil {
+		return err
+	}
+	if err := writeKeyCheck(tx, c); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkKey verifies the key against the database's key check value,
+// without initializing it
+func checkKey(db *sql.DB, c *fieldCipher) error {
+	var check []byte
+	if err := db.QueryRow(`SELECT value FROM storage_meta WHERE name = ?`, keyCheckName).Scan(&check); err != nil {
+		return err
+	}
+	_, err := c.open(check, nil)
+	return err
+}
+
+// writeKeyCheck stores the key check value sealed with c
+func writeKeyCheck(tx *sql.Tx, c *fieldCipher) error {
+	check, err := c.seal(keyCheckPlaintext, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO storage_meta (name, value) VALUES (?, ?)`, keyCheckName, check)
+	return err
+}
+
+// reseal re-encrypts every encrypted column from one key to another.
+// A nil from means the existing values are plaintext.
+func reseal(tx *sql.Tx, from, to *fieldCipher) error {
+	for _, col := range encryptedColumns {
+		aadExpr := "''"
+		if col.aad != "" {
+			aadExpr = col.aad
+		}
+		rows, err := tx.Query(fmt.Sprintf(`SELECT rowid, %s, %s FROM %s WHERE %s IS NOT NULL`, col.column, aadExpr, col.table, col.column))
+		if err != nil {
+			return err
+		}
+
+		// Read everything before writing back on the same connection
+		type row struct {
+			rowid int64
+			value []byte
+			aad   []byte
+		}
+		var values []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.rowid, &r.value, &r.aad); err != nil {
+				rows.Close()
+				return err
+			}
+			values = append(values, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		update := fmt.Sprintf(`UPDATE %s SET %s = ? WHERE rowid = ?`, col.table, col.column)
+		for _, r := range values {
+			plaintext := r.value
+			if from != nil {
+				if plaintext, err = from.open(r.value, r.aad); err != nil {
+					return err
+				}
+			}
+			sealed, err := to.seal(plaintext, r.aad)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(update, sealed, r.rowid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Rekey re-encrypts all sensitive data under newKey in a single
+// transaction. Afterwards the database only opens with newKey.
+// It must not run concurrently with other operations on s.
+func (s *Storage) Rekey(newKey string) error {
+	next, err := newFieldCipher(newKey)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := reseal(tx, s.cipher, next); err != nil {
+		return err
+	}
+	if err := writeKeyCheck(tx, next); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.cipher = next
+	s.audit.Log(audit.EventRekey, nil)
+	return nil
+}
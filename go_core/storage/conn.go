@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// DefaultBusyTimeout is how long, in milliseconds, a connection waits for
+// a lock held by another connection before failing
+const DefaultBusyTimeout = 5000
+
+// DefaultPageSize is the page size of new databases
+const DefaultPageSize = 4096
+
+// defaultMaxIdleConns matches database/sql's default idle pool size
+const defaultMaxIdleConns = 2
+
+// ErrInvalidBusyTimeout is returned for a negative busy timeout
+var ErrInvalidBusyTimeout = errors.New("busy timeout must not be negative")
+
+// connector opens SQLite connections for the pool, configuring each one
+// from the Options. The current busy timeout is applied to every new
+// connection so concurrent writers wait for the lock instead of failing
+// with "database is locked".
+type connector struct {
+	dsn         string
+	opts        Options
+	driver      *sqlite3.SQLiteDriver
+	busyTimeout atomic.Int64
+}
+
+func newConnector(dsn string, opts Options) *connector {
+	c := &connector{dsn: dsn, opts: opts}
+	c.busyTimeout.Store(int64(opts.BusyTimeout))
+	c.driver = &sqlite3.SQLiteDriver{ConnectHook: c.configure}
+	return c
+}
+
+func (c *connector) configure(conn *sqlite3.SQLiteConn) error {
+	// The page size only takes effect before the database is first
+	// written, so it must precede switching to WAL
+	pragmas := []string{fmt.Sprintf("PRAGMA page_size = %d", c.opts.PageSize)}
+	if c.opts.ReadOnly {
+		pragmas = append(pragmas, "PRAGMA query_only = ON")
+	} else if !c.opts.DisableWAL {
+		pragmas = append(pragmas, "PRAGMA journal_mode = WAL")
+	}
+	pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d", c.busyTimeout.Load()))
+
+	for _, pragma := range pragmas {
+		if _, err := conn.Exec(pragma, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// SetBusyTimeout changes how long, in milliseconds, operations wait for a
+// locked database. Idle connections are closed so they reopen with the
+// new timeout; connections in use keep the old one until they're closed.
+func (s *Storage) SetBusyTimeout(ms int) error {
+	if ms < 0 {
+		return ErrInvalidBusyTimeout
+	}
+	s.conn.busyTimeout.Store(int64(ms))
+	s.db.SetMaxIdleConns(0)
+	s.db.SetMaxIdleConns(defaultMaxIdleConns)
+	return nil
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"merabriar_core/audit"
+	"merabriar_core/contact"
+	"merabriar_core/crypto"
+)
+
+// contactColumns is the column list read by scanContact
+const contactColumns = `id, display_name, phone_hash, public_keys, is_verified, is_blocked, pinned_identity_key, fingerprint, created_at`
+
+// scanContact scans a row selected with contactColumns
+func scanContact(row rowScanner) (*contact.Contact, error) {
+	var c contact.Contact
+	var displayName, phoneHash sql.NullString
+	var publicKeys []byte
+	if err := row.Scan(&c.ID, &displayName, &phoneHash, &publicKeys, &c.IsVerified, &c.IsBlocked, &c.PinnedIdentityKey, &c.Fingerprint, &c.CreatedAt); err != nil {
+		return nil, err
+	}
+	c.DisplayName, c.PhoneHash = displayName.String, phoneHash.String
+
+	if len(publicKeys) > 0 {
+		c.PublicKeys = new(crypto.PublicKeyBundle)
+		if err := json.Unmarshal(publicKeys, c.PublicKeys); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// StoreContact inserts or replaces a contact.
+// CreatedAt defaults to now when zero. Pinning a new identity key is
+// audited as a key import.
+func (s *Storage) StoreContact(c *contact.Contact) error {
+	var publicKeys []byte
+	if c.PublicKeys != nil {
+		var err error
+		if publicKeys, err = json.Marshal(c.PublicKeys); err != nil {
+			return err
+		}
+	}
+
+	// Read the old pin and write the new one in one transaction, so a
+	// concurrent store can't change which key this one replaced
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var pinned []byte
+	err = tx.QueryRow(`SELECT pinned_identity_key FROM contacts WHERE id = ?`, c.ID).Scan(&pinned)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO contacts
+		(id, display_name, phone_hash, public_keys, is_verified, is_blocked, pinned_identity_key, fingerprint, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, COALESCE(NULLIF(?, 0), strftime('%s', 'now')))`,
+		c.ID, c.DisplayName, c.PhoneHash, publicKeys, c.IsVerified, c.IsBlocked, c.PinnedIdentityKey, c.Fingerprint, c.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if len(c.PinnedIdentityKey) > 0 && !bytes.Equal(pinned, c.PinnedIdentityKey) {
+		s.audit.Log(audit.EventKeyImport, map[string]any{
+			"contact":  audit.Redact(c.ID),
+			"replaced": len(pinned) > 0,
+		})
+	}
+	return nil
+}
+
+// GetContact retrieves a contact by ID.
+// Returns contact.ErrNotFound if there is no such contact.
+func (s *Storage) GetContact(id string) (*contact.Contact, error) {
+	c, err := scanContact(s.db.QueryRow(`
+		SELECT `+contactColumns+`
+		FROM contacts WHERE id = ?`, id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, contact.ErrNotFound
+	}
+	return c, err
+}
+
+// SetContactVerified marks a contact as verified or unverified.
+// Verifying pins the identity key of the contact's current bundle.
+func (s *Storage) SetContactVerified(id string, verified bool) error {
+	c, err := s.GetContact(id)
+	if err != nil {
+		return err
+	}
+
+	if verified {
+		if c.PublicKeys == nil {
+			return errors.New("contact has no public keys to verify")
+		}
+		c.PinnedIdentityKey = c.PublicKeys.IdentityPublicKey
+		c.Fingerprint = c.PublicKeys.Fingerprint()
+	}
+	c.IsVerified = verified
+
+	if err := s.StoreContact(c); err != nil {
+		return err
+	}
+	s.audit.Log(audit.EventContactVerify, map[string]any{
+		"contact":  audit.Redact(id),
+		"verified": verified,
+	})
+	return nil
+}
+
+// SetContactBlocked blocks or unblocks a contact.
+// Returns contact.ErrNotFound if there is no such contact.
+func (s *Storage) SetContactBlocked(id string, blocked bool) error {
+	result, err := s.db.Exec(`UPDATE contacts SET is_blocked = ? WHERE id = ?`, blocked, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return contact.ErrNotFound
+	}
+	return nil
+}
+
+// IsBlocked reports whether messages from id should be dropped.
+// Unknown senders are not blocked.
+func (s *Storage) IsBlocked(id string) (bool, error) {
+	var blocked bool
+	err := s.db.QueryRow(`SELECT is_blocked FROM contacts WHERE id = ?`, id).Scan(&blocked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return blocked, err
+}
+
+// FindContactByPhoneHash returns the contact with the given phone hash.
+// Returns contact.ErrNotFound if there is none.
+func (s *Storage) FindContactByPhoneHash(hash string) (*contact.Contact, error) {
+	if hash == "" {
+		return nil, contact.ErrNotFound
+	}
+	c, err := scanContact(s.db.QueryRow(`
+		SELECT `+contactColumns+`
+		FROM contacts WHERE phone_hash = ?
+		ORDER BY created_at, id
+		LIMIT 1`, hash,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, contact.ErrNotFound
+	}
+	return c, err
+}
+
+// likeEscaper escapes the LIKE wildcards in a search term
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchContactsByName returns the contacts whose display name starts with
+// prefix, ignoring ASCII case, ordered by name
+func (s *Storage) SearchContactsByName(prefix string) ([]*contact.Contact, error) {
+	rows, err := s.db.Query(`
+		SELECT `+contactColumns+`
+		FROM contacts WHERE display_name LIKE ? ESCAPE '\'
+		ORDER BY display_name COLLATE NOCASE, id`, likeEscaper.Replace(prefix)+"%",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contacts []*contact.Contact
+	for rows.Next() {
+		c, err := scanContact(rows)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, rows.Err()
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"merabriar_core/message"
+)
+
+var (
+	// ErrInvalidRetention is returned for a negative conversation retention
+	ErrInvalidRetention = errors.New("retention must not be negative")
+	// ErrInvalidPruneLimit is returned by PruneConversations for a
+	// negative limit
+	ErrInvalidPruneLimit = errors.New("conversation limit must not be negative")
+)
+
+// ConversationFlags is a conversation's inbox state
+type ConversationFlags struct {
+	Archived  bool  `json:"archived"`
+	Muted     bool  `json:"muted"`
+	Pinned    bool  `json:"pinned"`
+	UpdatedAt int64 `json:"updated_at"` // When the flags last changed; zero if never set
+}
+
+// Conversation summarizes a conversation for the inbox
+type Conversation struct {
+	ID           string           `json:"id"`
+	MessageCount int              `json:"message_count"`
+	LastMessage  *message.Message `json:"last_message"`
+	ConversationFlags
+}
+
+// SetConversationFlags replaces a conversation's flags
+func (s *Storage) SetConversationFlags(conversationID string, flags ConversationFlags) error {
+	_, err := s.db.Exec(`
+		INSERT INTO conversations (id, archived, muted, pinned, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			archived = excluded.archived, muted = excluded.muted,
+			pinned = excluded.pinned, updated_at = excluded.updated_at`,
+		conversationID, flags.Archived, flags.Muted, flags.Pinned, s.clock.Now().Unix(),
+	)
+	return err
+}
+
+// GetConversationFlags returns a conversation's flags. A conversation
+// whose flags were never set has all flags cleared.
+func (s *Storage) GetConversationFlags(conversationID string) (ConversationFlags, error) {
+	var flags ConversationFlags
+	err := s.db.QueryRow(`
+		SELECT archived, muted, pinned, updated_at
+		FROM conversations WHERE id = ?`, conversationID,
+	).Scan(&flags.Archived, &flags.Muted, &flags.Pinned, &flags.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ConversationFlags{}, nil
+	}
+	return flags, err
+}
+
+// SetConversationRetention sets how long a conversation's messages are
+// kept before ApplyRetention purges them. Zero keeps them forever. The
+// conversation's flags are left unchanged.
+func (s *Storage) SetConversationRetention(conversationID string, retention time.Duration) error {
+	if retention < 0 {
+		return ErrInvalidRetention
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO conversations (id, retention_seconds, updated_at)
+		VALUES (?, ?, 0)
+		ON CONFLICT (id) DO UPDATE SET retention_seconds = excluded.retention_seconds`,
+		conversationID, int64(retention/time.Second),
+	)
+	return err
+}
+
+// GetConversationRetention returns a conversation's retention. A
+// conversation whose retention was never set keeps messages forever.
+func (s *Storage) GetConversationRetention(conversationID string) (time.Duration, error) {
+	var seconds int64
+	err := s.db.QueryRow(`SELECT retention_seconds FROM conversations WHERE id = ?`, conversationID).Scan(&seconds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return time.Duration(seconds) * time.Second, err
+}
+
+// ApplyRetention deletes every message older than its conversation's
+// retention as of now (Unix seconds), along with its edit history, and
+// returns how many were deleted. It is separate from per-message expiry,
+// which PurgeExpired handles.
+func (s *Storage) ApplyRetention(now int64) (purged int, err error) {
+	const expired = `
+		SELECT m.id FROM messages m
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE c.retention_seconds > 0 AND m.timestamp < ? - c.retention_seconds`
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM message_edits WHERE message_id IN (`+expired+`)`, now); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM messages WHERE id IN (`+expired+`)`, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// PruneConversations deletes every unpinned conversation beyond the
+// keepMostRecent most recently active ones, with its messages, their edit
+// history and its flags, and returns how many were deleted. A
+// conversation's activity is its latest message timestamp; one without
+// messages, e.g. after ApplyRetention, is the least active. Pinned
+// conversations are never pruned and don't count towards the limit.
+func (s *Storage) PruneConversations(keepMostRecent int) (int, error) {
+	if keepMostRecent < 0 {
+		return 0, ErrInvalidPruneLimit
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT a.id FROM (
+			SELECT id, MAX(last_active) AS last_active FROM (
+				SELECT conversation_id AS id, timestamp AS last_active FROM messages
+				UNION ALL
+				SELECT id, 0 FROM conversations
+			) GROUP BY id
+		) a
+		LEFT JOIN conversations c ON c.id = a.id
+		WHERE COALESCE(c.pinned, 0) = 0
+		ORDER BY a.last_active DESC, a.id
+		LIMIT -1 OFFSET ?`, keepMostRecent,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		for _, stmt := range []string{
+			`DELETE FROM message_edits WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)`,
+			`DELETE FROM messages WHERE conversation_id = ?`,
+			`DELETE FROM conversations WHERE id = ?`,
+		} {
+			if _, err := tx.Exec(stmt, id); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(ids), tx.Commit()
+}
+
+// GetConversations summarizes every conversation with messages, pinned
+// conversations first and then by most recent message. Archived
+// conversations are left out unless includeArchived is set.
+func (s *Storage) GetConversations(includeArchived bool) ([]*Conversation, error) {
+	rows, err := s.db.Query(`
+		SELECT m.conversation_id, COUNT(*),
+			COALESCE(c.archived, 0), COALESCE(c.muted, 0), COALESCE(c.pinned, 0), COALESCE(c.updated_at, 0)
+		FROM messages m
+		LEFT JOIN conversations c ON c.id = m.conversation_id
+		WHERE ? OR COALESCE(c.archived, 0) = 0
+		GROUP BY m.conversation_id
+		ORDER BY COALESCE(c.pinned, 0) DESC, MAX(m.timestamp) DESC`, includeArchived,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []*Conversation
+	for rows.Next() {
+		var c Conversation
+		if err := rows.Scan(&c.ID, &c.MessageCount, &c.Archived, &c.Muted, &c.Pinned, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, &c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range conversations {
+		if c.LastMessage, err = s.GetLatestMessage(c.ID); err != nil {
+			return nil, err
+		}
+	}
+	return conversations, nil
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	gosync "sync"
+	"time"
+
+	"merabriar_core/clock"
+)
+
+var (
+	// ErrInvalidInterval is returned by StartExpirySweeper for an
+	// interval that isn't positive
+	ErrInvalidInterval = errors.New("sweep interval must be positive")
+	// ErrStorageClosed is returned by StartExpirySweeper after Close
+	ErrStorageClosed = errors.New("storage is closed")
+)
+
+// sweeperState tracks background expiry sweepers so Close can stop them
+// and wait for any sweep in progress before closing the database
+type sweeperState struct {
+	mu      gosync.Mutex
+	done    chan struct{} // Closed by stop
+	stopped bool
+	wg      gosync.WaitGroup
+}
+
+// start registers a sweeper, returning the channel closed when the
+// storage is closed, or false if it already is. The sweeper calls
+// wg.Done when it exits.
+func (st *sweeperState) start() (<-chan struct{}, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.stopped {
+		return nil, false
+	}
+	if st.done == nil {
+		st.done = make(chan struct{})
+	}
+	st.wg.Add(1)
+	return st.done, true
+}
+
+// stop signals every sweeper to exit and waits until they have. It is
+// safe to call more than once.
+func (st *sweeperState) stop() {
+	st.mu.Lock()
+	if !st.stopped {
+		st.stopped = true
+		if st.done == nil {
+			st.done = make(chan struct{})
+		}
+		close(st.done)
+	}
+	st.mu.Unlock()
+
+	st.wg.Wait()
+}
+
+// StartExpirySweeper purges expired messages every interval of the
+// storage clock until ctx is cancelled or the storage is closed. It
+// returns immediately. A failed sweep is retried on the next tick.
+func (s *Storage) StartExpirySweeper(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return ErrInvalidInterval
+	}
+	done, ok := s.sweepers.start()
+	if !ok {
+		return ErrStorageClosed
+	}
+	ticker := clock.NewTicker(s.clock, interval)
+
+	go func() {
+		defer s.sweepers.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C():
+				s.PurgeExpired()
+			}
+		}
+	}()
+	return nil
+}
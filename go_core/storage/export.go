@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ExportConversation writes a conversation's messages to w as a JSON
+// array, oldest first. Messages are streamed from a single query, so
+// memory use doesn't grow with the size of the history.
+func (s *Storage) ExportConversation(conversationID string, w io.Writer) error {
+	rows, err := s.db.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE conversation_id = ?
+		ORDER BY timestamp ASC, rowid ASC`, conversationID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for first := true; rows.Next(); first = false {
+		msg, err := s.scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]\n")
+	return err
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"merabriar_core/message"
+)
+
+// ErrInvalidCursor is returned when a page cursor wasn't produced by
+// GetMessagesPage
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// GetMessagesPage retrieves one page of a conversation's messages, newest
+// first. Pass an empty cursor for the first page and the returned
+// nextCursor for each following one; hasMore is false and nextCursor empty
+// on the last page. Unlike GetMessagesBefore, the cursor pins both the
+// timestamp and the message ID, so pages are exactly limit long even when
+// timestamps collide.
+func (s *Storage) GetMessagesPage(conversationID string, limit int, cursor string) (msgs []*message.Message, nextCursor string, hasMore bool, err error) {
+	if limit <= 0 {
+		return nil, "", false, nil
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		WHERE conversation_id = ?`
+	args := []any{conversationID}
+	if cursor != "" {
+		ts, id, err := decodePageCursor(cursor)
+		if err != nil {
+			return nil, "", false, err
+		}
+		query += ` AND (timestamp < ? OR (timestamp = ? AND id < ?))`
+		args = append(args, ts, ts, id)
+	}
+	query += `
+		ORDER BY timestamp DESC, id DESC
+		LIMIT ?`
+	args = append(args, limit+1)
+
+	msgs, err = s.queryMessages(query, args...)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	if len(msgs) <= limit {
+		return msgs, "", false, nil
+	}
+	msgs = msgs[:limit]
+	last := msgs[limit-1]
+	return msgs, encodePageCursor(last.Timestamp, last.ID), true, nil
+}
+
+// encodePageCursor packs a message's position into an opaque cursor
+func encodePageCursor(timestamp int64, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(timestamp, 10) + ":" + id))
+}
+
+// decodePageCursor reverses encodePageCursor
+func decodePageCursor(cursor string) (timestamp int64, id string, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return 0, "", ErrInvalidCursor
+	}
+	timestamp, err = strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return timestamp, id, nil
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for DeriveKey (RFC 9106, second recommended option)
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
+// DerivedKeySize is the length of keys returned by DeriveKey
+const DerivedKeySize = 32
+
+// SaltSize is the length of the salt generated for a passphrase database
+const SaltSize = 16
+
+var (
+	// ErrKeyAndPassphrase is returned when Options sets both a raw key and a passphrase
+	ErrKeyAndPassphrase = errors.New("set either an encryption key or a passphrase, not both")
+	// ErrMissingSalt is returned when opening an existing passphrase
+	// database whose salt file is gone. A new salt would derive a
+	// different key, so the database couldn't be decrypted.
+	ErrMissingSalt = errors.New("salt file missing for existing database")
+)
+
+// DeriveKey stretches a passphrase into a database key with Argon2id
+func DeriveKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, argon2Time, argon2Memory, argon2Threads, DerivedKeySize)
+}
+
+// saltPath is where the salt of a passphrase database is kept. It lives
+// outside the database because the key is needed to read the database.
+func saltPath(dbPath string) string {
+	return dbPath + ".salt"
+}
+
+// loadOrCreateSalt reads the salt stored for dbPath, generating and
+// storing a new one for a new database. An existing database without a
+// salt file is an error. In-memory databases get a fresh salt that isn't
+// stored.
+func loadOrCreateSalt(opts Options) ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if opts.InMemory {
+		_, err := rand.Read(salt)
+		return salt, err
+	}
+
+	path := saltPath(opts.Path)
+	existing, err := os.ReadFile(path)
+	if err == nil {
+		if len(existing) != SaltSize {
+			return nil, errors.New("invalid salt file " + path)
+		}
+		return existing, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) || opts.ReadOnly {
+		return nil, err
+	}
+	// SQLite treats an empty file as a new database
+	if info, err := os.Stat(opts.Path); err == nil && info.Size() > 0 {
+		return nil, ErrMissingSalt
+	}
+
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, salt, 0o600); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// passphraseKey returns the encryption key derived from opts.Passphrase
+func passphraseKey(opts Options) (string, error) {
+	salt, err := loadOrCreateSalt(opts)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(DeriveKey(opts.Passphrase, salt)), nil
+}
@@ -0,0 +1,56 @@
+package storage
+
+import "merabriar_core/message"
+
+// PreviewMaxRunes is the longest preview GetMessagePreviews returns, in
+// runes
+const PreviewMaxRunes = 100
+
+// MessagePreview is the part of a message a conversation list shows.
+// MessageType and Deleted let the list label an attachment or a deleted
+// message, whose Preview is not text to show or is empty.
+type MessagePreview struct {
+	ID          string                `json:"id"`
+	SenderID    string                `json:"sender_id"`
+	Preview     string                `json:"preview"`
+	Truncated   bool                  `json:"truncated,omitempty"`
+	Timestamp   int64                 `json:"timestamp"`
+	Status      message.MessageStatus `json:"status"`
+	MessageType message.MessageType   `json:"message_type,omitempty"`
+	Deleted     bool                  `json:"deleted,omitempty"`
+}
+
+// GetMessagePreviews is GetMessages for list views: newest first, with
+// content cut to PreviewMaxRunes runes and only the fields of
+// MessagePreview
+func (s *Storage) GetMessagePreviews(conversationID string, limit, offset int) ([]*MessagePreview, error) {
+	rows, err := s.db.Query(`
+		SELECT id, sender_id, content, timestamp, status, message_type, deleted
+		FROM messages
+		WHERE conversation_id = ?
+		ORDER BY timestamp DESC, rowid DESC
+		LIMIT ? OFFSET ?`,
+		conversationID, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var previews []*MessagePreview
+	for rows.Next() {
+		var p MessagePreview
+		var content []byte
+		if err := rows.Scan(&p.ID, &p.SenderID, &content, &p.Timestamp, &p.Status, &p.MessageType, &p.Deleted); err != nil {
+			return nil, err
+		}
+		text, err := s.cipher.openString(content)
+		if err != nil {
+			return nil, err
+		}
+		p.Preview = message.TruncateRunes(text, PreviewMaxRunes)
+		p.Truncated = len(p.Preview) < len(text)
+		previews = append(previews, &p)
+	}
+	return previews, rows.Err()
+}
@@ -3,36 +3,187 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"sync/atomic"
 
+	"merabriar_core/audit"
+	"merabriar_core/clock"
+	"merabriar_core/crypto"
 	"merabriar_core/message"
+	"merabriar_core/sync"
+)
 
-	_ "github.com/mattn/go-sqlite3"
+var (
+	// ErrNotFound is returned when a lookup matches no rows
+	ErrNotFound = errors.New("not found")
+	// ErrMessageDeleted is returned when editing a tombstoned message
+	ErrMessageDeleted = errors.New("message has been deleted")
+	// ErrEphemeralMessage is returned when storing a typing or presence signal
+	ErrEphemeralMessage = errors.New("ephemeral messages are not stored")
 )
 
 // Storage handles encrypted database operations
 type Storage struct {
-	db *sql.DB
+	db        *sql.DB
+	conn      *connector
+	cipher    *fieldCipher
+	keepAlive *sql.Conn // Holds an in-memory database open
+	clock     clock.Clock
+	audit     audit.Logger
+	sweepers  sweeperState
+	chain     chainState
 }
 
-// New creates a new encrypted storage instance
+// Options configures a Storage. Zero values select the defaults.
+type Options struct {
+	Path          string
+	EncryptionKey string
+	// Passphrase, instead of EncryptionKey, derives the key with
+	// DeriveKey. The salt is stored next to the database file.
+	Passphrase string
+
+	// BusyTimeout is how long, in milliseconds, to wait for a locked
+	// database. Zero selects DefaultBusyTimeout; negative fails at once.
+	BusyTimeout int
+	// DisableWAL keeps SQLite's rollback journal instead of WAL
+	DisableWAL bool
+	// PageSize is the page size of a new database. Zero selects
+	// DefaultPageSize. It has no effect on an existing database.
+	PageSize int
+	// ReadOnly opens an existing database and rejects all writes.
+	// The schema is not created or migrated.
+	ReadOnly bool
+	// Clock is the time source for timestamps set by storage and for
+	// expiry. Nil selects the system clock.
+	Clock clock.Clock
+	// InMemory keeps the database in memory instead of at Path, e.g. for
+	// tests. Its contents are lost on Close, and WAL does not apply.
+	InMemory bool
+	// AuditLogger receives key import, contact verification and rekey
+	// events. Nil discards them.
+	AuditLogger audit.Logger
+}
+
+// memoryDatabases numbers in-memory databases so each Storage gets its own
+var memoryDatabases atomic.Int64
+
+// New creates a new encrypted storage instance with default options.
+// The database uses WAL journaling and DefaultBusyTimeout so concurrent
+// callers don't fail with "database is locked".
 func New(dbPath, encryptionKey string) (*Storage, error) {
+	return NewWithOptions(Options{Path: dbPath, EncryptionKey: encryptionKey})
+}
+
+// NewWithOptions creates a storage instance configured by opts
+func NewWithOptions(opts Options) (*Storage, error) {
+	if opts.Passphrase != "" {
+		if opts.EncryptionKey != "" {
+			return nil, ErrKeyAndPassphrase
+		}
+		key, err := passphraseKey(opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.EncryptionKey = key
+	}
+
+	if opts.BusyTimeout == 0 {
+		opts.BusyTimeout = DefaultBusyTimeout
+	} else if opts.BusyTimeout < 0 {
+		opts.BusyTimeout = 0
+	}
+	if opts.PageSize == 0 {
+		opts.PageSize = DefaultPageSize
+	}
+	if opts.Clock == nil {
+		opts.Clock = clock.System
+	}
+	if opts.AuditLogger == nil {
+		opts.AuditLogger = audit.Nop
+	}
+
 	// For SQLCipher, connection string includes encryption key
 	// Note: In production, use a SQLCipher build
-	connStr := fmt.Sprintf("%s?_pragma_key=%s&_pragma_cipher_page_size=4096", dbPath, encryptionKey)
-	
-	db, err := sql.Open("sqlite3", connStr)
+	path := opts.Path + "?"
+	if opts.InMemory {
+		// The memdb VFS shares one in-memory database between the pool's
+		// connections, with the same locking as a file
+		path = fmt.Sprintf("file:/merabriar_%d?vfs=memdb&", memoryDatabases.Add(1))
+	}
+	// Transactions take the write lock when they begin, so one that reads
+	// before writing waits for other writers instead of failing its write
+	connStr := fmt.Sprintf("%s_pragma_key=%s&_pragma_cipher_page_size=%d&_txlock=immediate", path, opts.EncryptionKey, opts.PageSize)
+
+	conn := newConnector(connStr, opts)
+	db := sql.OpenDB(conn)
+
+	// An in-memory database lives only while a connection is open
+	var keepAlive *sql.Conn
+	if opts.InMemory {
+		var err error
+		if keepAlive, err = db.Conn(context.Background()); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	s, err := initStorage(db, conn, opts)
 	if err != nil {
+		if keepAlive != nil {
+			keepAlive.Close()
+		}
+		db.Close()
 		return nil, err
 	}
+	s.keepAlive = keepAlive
+	s.clock = opts.Clock
+	s.audit = opts.AuditLogger
+	return s, nil
+}
+
+// initStorage prepares the schema and key on a newly opened database
+func initStorage(db *sql.DB, conn *connector, opts Options) (*Storage, error) {
+	if opts.ReadOnly {
+		return openReadOnly(db, conn, opts.EncryptionKey)
+	}
 
 	// Create tables
 	if err := createTables(db); err != nil {
 		return nil, err
 	}
 
-	return &Storage{db: db}, nil
+	// Bring older databases up to the current schema
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+
+	// Sensitive columns are sealed at the application level
+	cipher, err := newFieldCipher(opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := initKey(db, cipher); err != nil {
+		return nil, err
+	}
+
+	return &Storage{db: db, conn: conn, cipher: cipher}, nil
+}
+
+// openReadOnly checks the key against an existing database without
+// writing to it
+func openReadOnly(db *sql.DB, conn *connector, encryptionKey string) (*Storage, error) {
+	cipher, err := newFieldCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKey(db, cipher); err != nil {
+		return nil, err
+	}
+	return &Storage{db: db, conn: conn, cipher: cipher}, nil
 }
 
 // createTables creates the database schema
@@ -92,46 +243,644 @@ func createTables(db *sql.DB) error {
 	return err
 }
 
-// StoreMessage stores a message in the database
+// migrations holds schema changes made after the initial schema.
+// migrations[i] upgrades a database from user_version i to i+1.
+// Only ever append to this list.
+var migrations = []string{
+	// 1: message content type
+	`ALTER TABLE messages ADD COLUMN message_type TEXT NOT NULL DEFAULT ''`,
+
+	// 2: message edits
+	`ALTER TABLE messages ADD COLUMN edited_at INTEGER NOT NULL DEFAULT 0;
+
+	CREATE TABLE IF NOT EXISTS message_edits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id TEXT NOT NULL,
+		content TEXT NOT NULL,
+		edited_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_message_edits_message
+		ON message_edits(message_id, id);`,
+
+	// 3: tombstones for deleted messages
+	`ALTER TABLE messages ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0`,
+
+	// 4: storage metadata, including the encryption key check
+	`CREATE TABLE IF NOT EXISTS storage_meta (
+		name TEXT PRIMARY KEY,
+		value BLOB NOT NULL
+	)`,
+
+	// 5: retry attempts for persisted queue entries
+	`ALTER TABLE queue ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0`,
+
+	// 6: sender filtering
+	`CREATE INDEX IF NOT EXISTS idx_messages_sender
+		ON messages(conversation_id, sender_id, timestamp DESC)`,
+
+	// 7: contact identity key pinning
+	`ALTER TABLE contacts ADD COLUMN pinned_identity_key BLOB`,
+
+	// 8: per-conversation inbox state
+	`CREATE TABLE IF NOT EXISTS conversations (
+		id TEXT PRIMARY KEY,
+		archived INTEGER NOT NULL DEFAULT 0,
+		muted INTEGER NOT NULL DEFAULT 0,
+		pinned INTEGER NOT NULL DEFAULT 0,
+		updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+	)`,
+
+	// 9: message expiry
+	`ALTER TABLE messages ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+
+	CREATE INDEX IF NOT EXISTS idx_messages_expires
+		ON messages(expires_at) WHERE expires_at != 0;`,
+
+	// 10: contact key fingerprints
+	`ALTER TABLE contacts ADD COLUMN fingerprint TEXT NOT NULL DEFAULT ''`,
+
+	// 11: queue sequence, so reloads keep enqueue order even when
+	// created_at collides
+	`CREATE TABLE queue_new (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		recipient_id TEXT NOT NULL,
+		encrypted_content BLOB NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+		attempts INTEGER NOT NULL DEFAULT 0
+	);
+
+	INSERT INTO queue_new (id, recipient_id, encrypted_content, created_at, attempts)
+		SELECT id, recipient_id, encrypted_content, created_at, attempts
+		FROM queue ORDER BY rowid;
+
+	DROP TABLE queue;
+	ALTER TABLE queue_new RENAME TO queue;`,
+
+	// 12: contact blocking
+	`ALTER TABLE contacts ADD COLUMN is_blocked INTEGER NOT NULL DEFAULT 0`,
+
+	// 13: chunked attachments
+	`CREATE TABLE IF NOT EXISTS attachments (
+		id TEXT PRIMARY KEY,
+		total_size INTEGER NOT NULL,
+		chunk_count INTEGER NOT NULL,
+		sha256 BLOB NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+	);
+
+	CREATE TABLE IF NOT EXISTS attachment_chunks (
+		attachment_id TEXT NOT NULL,
+		chunk_index INTEGER NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (attachment_id, chunk_index)
+	);`,
+
+	// 14: per-conversation message hash chain
+	`ALTER TABLE messages ADD COLUMN prev_hash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN chain_seq INTEGER NOT NULL DEFAULT 0;
+
+	CREATE INDEX IF NOT EXISTS idx_messages_chain
+		ON messages(conversation_id, chain_seq);`,
+
+	// 15: per-conversation message retention
+	`ALTER TABLE conversations ADD COLUMN retention_seconds INTEGER NOT NULL DEFAULT 0`,
+
+	// 16: contact lookup by phone hash and name
+	`CREATE INDEX IF NOT EXISTS idx_contacts_phone_hash ON contacts(phone_hash);
+	CREATE INDEX IF NOT EXISTS idx_contacts_name ON contacts(display_name COLLATE NOCASE);`,
+
+	// 17: retry backoff for persisted queue entries
+	`ALTER TABLE queue ADD COLUMN next_attempt_at INTEGER NOT NULL DEFAULT 0`,
+}
+
+// migrate applies any migrations newer than the database's user_version
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// messageColumns is the column list read by scanMessage
+const messageColumns = `id, conversation_id, sender_id, content, timestamp, status, message_type, edited_at, deleted, expires_at, prev_hash, hash, chain_seq, encrypted_content`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanMessage scans a row selected with messageColumns
+func (s *Storage) scanMessage(row rowScanner) (*message.Message, error) {
+	var msg message.Message
+	var content []byte
+	if err := row.Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &content, &msg.Timestamp, &msg.Status, &msg.MessageType, &msg.EditedAt, &msg.Deleted, &msg.ExpiresAt, &msg.PrevHash, &msg.Hash, &msg.Seq, &msg.EncryptedContent); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if msg.Content, err = s.cipher.openString(content); err != nil {
+		return nil, err
+	}
+	msg.SchemaVersion = message.CurrentSchemaVersion
+	return &msg, nil
+}
+
+// StoreMessage stores a message in the database, replacing any
+// existing message with the same ID. A deleted message stays a
+// tombstone: storing it again leaves it unchanged.
+// It sets msg.PrevHash and msg.Hash to link msg into its conversation's
+// hash chain (see VerifyChain), and msg.Seq to its place in the
+// conversation (see FindGaps); a replaced message keeps its place and
+// hash.
+// Content is validated against the message type when the type is set.
+// Ephemeral signals (see message.IsEphemeral) are rejected.
 func (s *Storage) StoreMessage(msg *message.Message) error {
-	_, err := s.db.Exec(`
-		INSERT OR REPLACE INTO messages 
-		(id, conversation_id, sender_id, content, timestamp, status) 
-		VALUES (?, ?, ?, ?, ?, ?)`,
+	_, err := s.insertMessage("INSERT", messageUpsert, msg)
+	return err
+}
+
+// messageUpsert updates an existing message in place, unless it is a
+// tombstone
+const messageUpsert = `
+	ON CONFLICT(id) DO UPDATE SET
+		conversation_id = excluded.conversation_id,
+		sender_id = excluded.sender_id,
+		content = excluded.content,
+		timestamp = excluded.timestamp,
+		status = excluded.status,
+		message_type = excluded.message_type,
+		edited_at = excluded.edited_at,
+		deleted = excluded.deleted,
+		expires_at = excluded.expires_at,
+		prev_hash = excluded.prev_hash,
+		hash = excluded.hash,
+		chain_seq = excluded.chain_seq,
+		encrypted_content = excluded.encrypted_content
+	WHERE messages.deleted = 0`
+
+// StoreMessageIfNew stores a message unless one with the same ID already
+// exists, e.g. when an inbound message is replayed. An existing message,
+// including any local edits, is left untouched. It reports whether the
+// message was inserted.
+func (s *Storage) StoreMessageIfNew(msg *message.Message) (inserted bool, err error) {
+	result, err := s.insertMessage("INSERT OR IGNORE", "", msg)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// insertMessage validates and seals msg, then writes it with the given
+// INSERT statement variant and conflict clause
+func (s *Storage) insertMessage(insert, onConflict string, msg *message.Message) (sql.Result, error) {
+	if message.IsEphemeral(msg.MessageType) {
+		return nil, ErrEphemeralMessage
+	}
+	if msg.MessageType != "" && !msg.Deleted {
+		if err := message.ValidateContent(msg.MessageType, msg.Content); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := s.cipher.sealString(msg.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	s.chain.mu.Lock()
+	defer s.chain.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	seq, prevHash, hash, err := chainLink(tx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(insert+` INTO messages 
+		(id, conversation_id, sender_id, content, timestamp, status, message_type, edited_at, deleted, expires_at, prev_hash, hash, chain_seq, encrypted_content) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`+onConflict,
 		msg.ID,
 		msg.ConversationID,
 		msg.SenderID,
-		msg.Content,
+		content,
 		msg.Timestamp,
 		msg.Status,
+		msg.MessageType,
+		msg.EditedAt,
+		msg.Deleted,
+		msg.ExpiresAt,
+		prevHash,
+		hash,
+		seq,
+		msg.EncryptedContent,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		msg.PrevHash, msg.Hash, msg.Seq = prevHash, hash, seq
+	}
+	return result, nil
+}
+
+// PurgeExpired deletes every message whose ExpiresAt is at or before
+// the storage clock's now, along with its edit history, and returns how
+// many were deleted
+func (s *Storage) PurgeExpired() (purged int, err error) {
+	now := s.clock.Now().Unix()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM message_edits WHERE message_id IN (
+			SELECT id FROM messages WHERE expires_at != 0 AND expires_at <= ?
+		)`, now,
+	); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM messages WHERE expires_at != 0 AND expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// TombstoneMessage marks a message as deleted for everyone.
+// The row and its timestamp are kept so the UI can show a placeholder,
+// but the content, its ciphertext and any edit history are erased.
+func (s *Storage) TombstoneMessage(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE messages SET content = '', encrypted_content = NULL, deleted = 1 WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec(`DELETE FROM message_edits WHERE message_id = ?`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// EditMessage replaces a message's content, recording the previous
+// content in its edit history
+func (s *Storage) EditMessage(id, newContent string, editedAt int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldContent []byte // still sealed; copied into the history as-is
+	var msgType message.MessageType
+	var deleted bool
+	err = tx.QueryRow(`SELECT content, message_type, deleted FROM messages WHERE id = ?`, id).Scan(&oldContent, &msgType, &deleted)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		return ErrMessageDeleted
+	}
+
+	if msgType != "" {
+		if err := message.ValidateContent(msgType, newContent); err != nil {
+			return err
+		}
+	}
+
+	sealed, err := s.cipher.sealString(newContent)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO message_edits (message_id, content, edited_at)
+		VALUES (?, ?, ?)`,
+		id, oldContent, editedAt,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE messages SET content = ?, edited_at = ? WHERE id = ?`,
+		sealed, editedAt, id,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetEditHistory returns a message's previous versions, oldest first
+func (s *Storage) GetEditHistory(id string) ([]message.MessageEdit, error) {
+	rows, err := s.db.Query(`
+		SELECT message_id, content, edited_at
+		FROM message_edits
+		WHERE message_id = ?
+		ORDER BY id ASC`, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var edits []message.MessageEdit
+	for rows.Next() {
+		var edit message.MessageEdit
+		var content []byte
+		if err := rows.Scan(&edit.MessageID, &content, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		if edit.Content, err = s.cipher.openString(content); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+
+	return edits, rows.Err()
 }
 
 // GetMessage retrieves a single message by ID
 func (s *Storage) GetMessage(id string) (*message.Message, error) {
-	var msg message.Message
-	err := s.db.QueryRow(`
-		SELECT id, conversation_id, sender_id, content, timestamp, status 
+	return s.scanMessage(s.db.QueryRow(`
+		SELECT `+messageColumns+`
 		FROM messages WHERE id = ?`, id,
-	).Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.Content, &msg.Timestamp, &msg.Status)
-	
-	if err != nil {
-		return nil, err
+	))
+}
+
+// idChunkSize caps the IDs bound in one IN (...) query, well under
+// SQLite's limit on host parameters
+const idChunkSize = 500
+
+// GetMessagesByIDs looks up many messages at once, e.g. to resolve reply
+// targets. The result is keyed by ID; missing IDs are absent.
+func (s *Storage) GetMessagesByIDs(ids []string) (map[string]*message.Message, error) {
+	found := make(map[string]*message.Message, len(ids))
+	for start := 0; start < len(ids); start += idChunkSize {
+		chunk := ids[start:min(start+idChunkSize, len(ids))]
+
+		args := make([]any, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		msgs, err := s.queryMessages(`
+			SELECT `+messageColumns+`
+			FROM messages WHERE id IN (?`+strings.Repeat(", ?", len(chunk)-1)+`)`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			found[msg.ID] = msg
+		}
 	}
-	return &msg, nil
+	return found, nil
 }
 
-// GetMessages retrieves messages for a conversation
+// GetMessages retrieves messages for a conversation, newest first
 func (s *Storage) GetMessages(conversationID string, limit, offset int) ([]*message.Message, error) {
-	rows, err := s.db.Query(`
-		SELECT id, conversation_id, sender_id, content, timestamp, status 
+	return s.queryMessages(`
+		SELECT `+messageColumns+`
 		FROM messages 
 		WHERE conversation_id = ? 
-		ORDER BY timestamp DESC 
+		ORDER BY timestamp DESC, rowid DESC
+		LIMIT ? OFFSET ?`,
+		conversationID, limit, offset,
+	)
+}
+
+// GetMessagesAsc retrieves messages for a conversation, oldest first: the
+// reverse of GetMessages' order, for exports and full-thread rendering
+func (s *Storage) GetMessagesAsc(conversationID string, limit, offset int) ([]*message.Message, error) {
+	return s.queryMessages(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE conversation_id = ?
+		ORDER BY timestamp ASC, rowid ASC
 		LIMIT ? OFFSET ?`,
 		conversationID, limit, offset,
 	)
+}
+
+// GetMessagesBySender retrieves one sender's messages in a conversation,
+// newest first
+func (s *Storage) GetMessagesBySender(conversationID, senderID string, limit, offset int) ([]*message.Message, error) {
+	return s.queryMessages(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE conversation_id = ? AND sender_id = ?
+		ORDER BY timestamp DESC, rowid DESC
+		LIMIT ? OFFSET ?`,
+		conversationID, senderID, limit, offset,
+	)
+}
+
+// GetLatestMessage retrieves the newest message in a conversation.
+// Returns ErrNotFound if the conversation has no messages.
+func (s *Storage) GetLatestMessage(conversationID string) (*message.Message, error) {
+	msg, err := s.scanMessage(s.db.QueryRow(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE conversation_id = ?
+		ORDER BY timestamp DESC, rowid DESC
+		LIMIT 1`, conversationID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return msg, err
+}
+
+// MaxSyncPageSize caps the page size of GetMessagesSince
+const MaxSyncPageSize = 500
+
+// SyncCursor is a position in a conversation for GetMessagesSince: the
+// timestamp and row of the last message returned. The zero cursor is the
+// start of the conversation.
+type SyncCursor struct {
+	Timestamp int64
+	RowID     int64
+}
+
+// GetMessagesSince retrieves messages after the cursor, oldest first, for
+// incremental sync. Pass the zero cursor for the first page and the
+// returned next cursor for each following one; next is after unchanged
+// once no newer messages remain. Ties on timestamp are ordered by
+// insertion, so pages split them without skipping or repeating any.
+// limit is clamped to MaxSyncPageSize, which also applies when limit <= 0.
+func (s *Storage) GetMessagesSince(conversationID string, after SyncCursor, limit int) (messages []*message.Message, next SyncCursor, err error) {
+	if limit <= 0 || limit > MaxSyncPageSize {
+		limit = MaxSyncPageSize
+	}
+
+	rows, err := s.db.Query(`
+		SELECT rowid, `+messageColumns+`
+		FROM messages
+		WHERE conversation_id = ? AND (timestamp > ? OR (timestamp = ? AND rowid > ?))
+		ORDER BY timestamp ASC, rowid ASC
+		LIMIT ?`,
+		conversationID, after.Timestamp, after.Timestamp, after.RowID, limit,
+	)
+	if err != nil {
+		return nil, after, err
+	}
+	defer rows.Close()
+
+	next = after
+	for rows.Next() {
+		msg, err := s.scanMessage(rowIDScanner{rows, &next.RowID})
+		if err != nil {
+			return nil, after, err
+		}
+		next.Timestamp = msg.Timestamp
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, after, err
+	}
+	return messages, next, nil
+}
+
+// rowIDScanner scans a row selected with rowid followed by messageColumns
+type rowIDScanner struct {
+	row   rowScanner
+	rowID *int64
+}
+
+func (r rowIDScanner) Scan(dest ...any) error {
+	return r.row.Scan(append([]any{r.rowID}, dest...)...)
+}
+
+// GetMessagesBefore retrieves messages older than beforeTimestamp, newest
+// first, for loading history while scrolling back. Pass the last (oldest)
+// returned timestamp as the next cursor. Messages sharing a timestamp are
+// never split across pages, so a page may exceed limit when timestamps
+// collide.
+func (s *Storage) GetMessagesBefore(conversationID string, beforeTimestamp int64, limit int) ([]*message.Message, error) {
+	messages, err := s.queryMessages(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE conversation_id = ? AND timestamp < ?
+		ORDER BY timestamp DESC, rowid DESC
+		LIMIT ?`,
+		conversationID, beforeTimestamp, limit,
+	)
+	if err != nil || limit <= 0 || len(messages) < limit {
+		return messages, err
+	}
+	return s.completeTimestampGroup(conversationID, messages, "DESC")
+}
+
+// completeTimestampGroup replaces the trailing run of messages sharing the
+// page's last timestamp with the full group, so a timestamp cursor taken
+// from the page skips nothing. order is the page's rowid order.
+func (s *Storage) completeTimestampGroup(conversationID string, messages []*message.Message, order string) ([]*message.Message, error) {
+	last := messages[len(messages)-1].Timestamp
+	cut := len(messages)
+	for cut > 0 && messages[cut-1].Timestamp == last {
+		cut--
+	}
+
+	group, err := s.queryMessages(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE conversation_id = ? AND timestamp = ?
+		ORDER BY rowid `+order,
+		conversationID, last,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(messages[:cut], group...), nil
+}
+
+// CountByStatus counts messages per status in a conversation, or across
+// all conversations when conversationID is empty. Statuses with no
+// messages are absent from the map.
+func (s *Storage) CountByStatus(conversationID string) (map[message.MessageStatus]int, error) {
+	query := `SELECT status, COUNT(*) FROM messages`
+	var args []any
+	if conversationID != "" {
+		query += ` WHERE conversation_id = ?`
+		args = append(args, conversationID)
+	}
+	query += ` GROUP BY status`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[message.MessageStatus]int)
+	for rows.Next() {
+		var status message.MessageStatus
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+
+	return counts, rows.Err()
+}
+
+// queryMessages runs a query selecting messageColumns and scans every row
+func (s *Storage) queryMessages(query string, args ...any) ([]*message.Message, error) {
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -139,37 +888,187 @@ func (s *Storage) GetMessages(conversationID string, limit, offset int) ([]*mess
 
 	var messages []*message.Message
 	for rows.Next() {
-		var msg message.Message
-		if err := rows.Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.Content, &msg.Timestamp, &msg.Status); err != nil {
+		msg, err := s.scanMessage(rows)
+		if err != nil {
 			return nil, err
 		}
-		messages = append(messages, &msg)
+		messages = append(messages, msg)
 	}
 
-	return messages, nil
+	return messages, rows.Err()
 }
 
 // StoreSession stores a session in the database
 func (s *Storage) StoreSession(recipientID string, sessionData []byte) error {
-	_, err := s.db.Exec(`
+	// Bound to the recipient so one contact's session can't be swapped
+	// into another's row
+	sealed, err := s.cipher.seal(sessionData, []byte(recipientID))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
 		INSERT OR REPLACE INTO sessions (recipient_id, session_data, updated_at) 
 		VALUES (?, ?, strftime('%s', 'now'))`,
-		recipientID, sessionData,
+		recipientID, sealed,
 	)
 	return err
 }
 
-// GetSession retrieves a session from the database
+// GetSession retrieves a session from the database.
+// Returns crypto.ErrSessionNotFound if there is no session for recipientID.
 func (s *Storage) GetSession(recipientID string) ([]byte, error) {
 	var sessionData []byte
 	err := s.db.QueryRow(`SELECT session_data FROM sessions WHERE recipient_id = ?`, recipientID).Scan(&sessionData)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, crypto.ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.cipher.open(sessionData, []byte(recipientID))
+}
+
+// DeleteSession removes a recipient's session. Deleting a missing
+// session is not an error.
+func (s *Storage) DeleteSession(recipientID string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE recipient_id = ?`, recipientID)
+	return err
+}
+
+// ListSessionRecipients returns the recipients with a stored session,
+// sorted by ID
+func (s *Storage) ListSessionRecipients() ([]string, error) {
+	rows, err := s.db.Query(`SELECT recipient_id FROM sessions ORDER BY recipient_id`)
 	if err != nil {
 		return nil, err
 	}
-	return sessionData, nil
+	defer rows.Close()
+
+	var recipients []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, id)
+	}
+	return recipients, rows.Err()
 }
 
-// Close closes the database connection
+// GetAllSessions returns every stored session keyed by recipient ID.
+// Sessions that fail to decrypt are skipped and reported to the audit
+// logger as audit.EventSessionUnreadable, so one damaged row doesn't
+// block loading the rest.
+func (s *Storage) GetAllSessions() (map[string][]byte, error) {
+	rows, err := s.db.Query(`SELECT recipient_id, session_data FROM sessions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make(map[string][]byte)
+	for rows.Next() {
+		var id string
+		var sealed []byte
+		if err := rows.Scan(&id, &sealed); err != nil {
+			return nil, err
+		}
+		data, err := s.cipher.open(sealed, []byte(id))
+		if err != nil {
+			s.audit.Log(audit.EventSessionUnreadable, map[string]any{
+				"contact": audit.Redact(id),
+				"error":   err.Error(),
+			})
+			continue
+		}
+		sessions[id] = data
+	}
+	return sessions, rows.Err()
+}
+
+// StoreQueuedMessages persists outbound queue entries, with their retry
+// attempts and backoff, e.g. on shutdown. Entries are sequenced in slice
+// order, after any already stored; an entry that is already stored is
+// replaced and moves to the end. A zero CreatedAt is stamped from the
+// storage clock.
+func (s *Storage) StoreQueuedMessages(msgs []*sync.QueuedMessage) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := s.clock.Now().Unix()
+	for _, msg := range msgs {
+		createdAt := msg.CreatedAt
+		if createdAt == 0 {
+			createdAt = now
+		}
+		if _, err := tx.Exec(`
+			INSERT OR REPLACE INTO queue (id, recipient_id, encrypted_content, created_at, attempts, next_attempt_at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			msg.ID, msg.RecipientID, msg.EncryptedContent, createdAt, msg.Attempts, msg.NextAttemptAt,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetQueuedMessages returns all persisted queue entries, in sequence
+// order. They stay stored until DeleteQueuedMessages, so a crash after
+// loading them doesn't lose them.
+func (s *Storage) GetQueuedMessages() ([]*sync.QueuedMessage, error) {
+	rows, err := s.db.Query(`
+		SELECT id, recipient_id, encrypted_content, created_at, attempts, next_attempt_at
+		FROM queue ORDER BY seq ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []*sync.QueuedMessage
+	for rows.Next() {
+		var msg sync.QueuedMessage
+		if err := rows.Scan(&msg.ID, &msg.RecipientID, &msg.EncryptedContent, &msg.CreatedAt, &msg.Attempts, &msg.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs, rows.Err()
+}
+
+// DeleteQueuedMessages removes persisted queue entries, e.g. once they
+// have been delivered. Unknown IDs are ignored.
+func (s *Storage) DeleteQueuedMessages(ids []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		if _, err := tx.Exec(`DELETE FROM queue WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Ping checks that the database is open and answering queries
+func (s *Storage) Ping() error {
+	var one int
+	return s.db.QueryRow(`SELECT 1`).Scan(&one)
+}
+
+// Close stops any expiry sweepers, waiting for a sweep in progress, and
+// closes the database connection
 func (s *Storage) Close() error {
+	s.sweepers.stop()
+	if s.keepAlive != nil {
+		s.keepAlive.Close()
+	}
 	return s.db.Close()
 }
@@ -2,11 +2,26 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
+	gosync "sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"merabriar_core/audit"
+	"merabriar_core/clock"
+	"merabriar_core/contact"
+	"merabriar_core/crypto"
 	"merabriar_core/message"
+	"merabriar_core/sync"
 )
 
 // helper: create a temp storage instance
@@ -26,6 +41,8 @@ func newTestStorage(t *testing.T) (*Storage, string) {
 func cleanup(store *Storage, dbPath string) {
 	store.Close()
 	os.Remove(dbPath)
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
 }
 
 // ═══════════════════════════════════════
@@ -160,6 +177,95 @@ func TestStoreMessageUpsert(t *testing.T) {
 	}
 }
 
+func TestStoreMessageIfNew(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	msg := message.NewMessage("dedup-1", "conv-1", "alice", "Original", 1000)
+	inserted, err := store.StoreMessageIfNew(msg)
+	if err != nil {
+		t.Fatalf("StoreMessageIfNew() error: %v", err)
+	}
+	if !inserted {
+		t.Error("StoreMessageIfNew() inserted = false for a new message")
+	}
+
+	retrieved, _ := store.GetMessage("dedup-1")
+	if retrieved == nil || retrieved.Content != "Original" {
+		t.Fatalf("new message not stored: %+v", retrieved)
+	}
+}
+
+func TestStoreMessageIfNewIgnoresDuplicate(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreMessage(message.NewMessage("dedup-1", "conv-1", "alice", "Original", 1000))
+	if err := store.EditMessage("dedup-1", "Edited locally", 2000); err != nil {
+		t.Fatalf("EditMessage() error: %v", err)
+	}
+
+	// A replay of the original must not clobber the local edit
+	inserted, err := store.StoreMessageIfNew(message.NewMessage("dedup-1", "conv-1", "alice", "Original", 1000))
+	if err != nil {
+		t.Fatalf("StoreMessageIfNew() error: %v", err)
+	}
+	if inserted {
+		t.Error("StoreMessageIfNew() inserted = true for a duplicate")
+	}
+
+	retrieved, _ := store.GetMessage("dedup-1")
+	if retrieved.Content != "Edited locally" || retrieved.EditedAt != 2000 {
+		t.Errorf("duplicate overwrote message: content %q, edited_at %d", retrieved.Content, retrieved.EditedAt)
+	}
+}
+
+func TestStoreMessageIfNewRejectsEphemeral(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	msg := message.NewMessage("typing-1", "conv-1", "alice", "", 1000)
+	msg.MessageType = message.TypeTyping
+	if inserted, err := store.StoreMessageIfNew(msg); err != ErrEphemeralMessage || inserted {
+		t.Errorf("StoreMessageIfNew(typing) = %v, %v, want false, ErrEphemeralMessage", inserted, err)
+	}
+}
+
+func TestStoreMessageEncryptedContent(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	ciphertext := []byte{0x00, 0x00, 0x00, 0x01, 0x01, 0xde, 0xad, 0xbe, 0xef}
+	msg := message.NewMessage("ct-1", "conv-1", "alice", "Hello", 1000)
+	msg.EncryptedContent = ciphertext
+	msg.Status = message.StatusSent
+	if err := store.StoreMessage(msg); err != nil {
+		t.Fatalf("StoreMessage() error: %v", err)
+	}
+	store.StoreMessage(message.NewMessage("plain-1", "conv-1", "alice", "No ciphertext", 2000))
+
+	got, err := store.GetMessage("ct-1")
+	if err != nil {
+		t.Fatalf("GetMessage() error: %v", err)
+	}
+	if !bytes.Equal(got.EncryptedContent, ciphertext) {
+		t.Errorf("EncryptedContent = %x, want %x", got.EncryptedContent, ciphertext)
+	}
+	if got.Content != "Hello" || got.Status != message.StatusSent || got.Timestamp != 1000 {
+		t.Errorf("plaintext fields = %q/%s/%d, want Hello/sent/1000", got.Content, got.Status, got.Timestamp)
+	}
+
+	msgs, _ := store.GetMessages("conv-1", 10, 0)
+	if len(msgs) != 2 || !bytes.Equal(msgs[1].EncryptedContent, ciphertext) || msgs[0].EncryptedContent != nil {
+		t.Error("GetMessages() should return each message's ciphertext, or nil without one")
+	}
+
+	store.TombstoneMessage("ct-1")
+	if got, _ := store.GetMessage("ct-1"); got.EncryptedContent != nil {
+		t.Error("tombstone should erase the ciphertext")
+	}
+}
+
 // ═══════════════════════════════════════
 // 3. Message Retrieval
 // ═══════════════════════════════════════
@@ -294,161 +400,2783 @@ func TestGetMessagesDescendingOrder(t *testing.T) {
 	}
 }
 
-// ═══════════════════════════════════════
-// 4. Session Storage
-// ═══════════════════════════════════════
-
-func TestStoreAndGetSession(t *testing.T) {
+func TestGetMessagesAscending(t *testing.T) {
 	store, dbPath := newTestStorage(t)
 	defer cleanup(store, dbPath)
 
-	sessionData := []byte{0xCA, 0xFE, 0xBA, 0xBE, 0xDE, 0xAD}
+	// Two pairs share a timestamp, so the order relies on the tiebreak
+	for i, ts := range []int64{1000, 1001, 1001, 1002, 1003, 1003, 1004} {
+		store.StoreMessage(message.NewMessage(fmt.Sprintf("asc-%d", i), "conv-asc", "alice", "Content", ts))
+	}
 
-	err := store.StoreSession("alice", sessionData)
+	desc, _ := store.GetMessages("conv-asc", 10, 0)
+	asc, err := store.GetMessagesAsc("conv-asc", 10, 0)
 	if err != nil {
-		t.Fatalf("StoreSession() error: %v", err)
+		t.Fatalf("GetMessagesAsc() error: %v", err)
+	}
+	if len(asc) != 7 || len(desc) != 7 {
+		t.Fatalf("got %d ascending, %d descending messages, want 7 each", len(asc), len(desc))
+	}
+	for i := range asc {
+		if asc[i].ID != desc[len(desc)-1-i].ID {
+			t.Errorf("asc[%d] = %s, want the reverse of GetMessages (%s)", i, asc[i].ID, desc[len(desc)-1-i].ID)
+		}
 	}
 
-	retrieved, err := store.GetSession("alice")
+	// Paging in each direction covers every message once, in order
+	for _, dir := range []struct {
+		name string
+		get  func(conversationID string, limit, offset int) ([]*message.Message, error)
+		want []*message.Message
+	}{
+		{"asc", store.GetMessagesAsc, asc},
+		{"desc", store.GetMessages, desc},
+	} {
+		var paged []*message.Message
+		for offset := 0; ; offset += 3 {
+			page, _ := dir.get("conv-asc", 3, offset)
+			if len(page) == 0 {
+				break
+			}
+			paged = append(paged, page...)
+		}
+		if len(paged) != len(dir.want) {
+			t.Fatalf("%s: paged %d messages, want %d", dir.name, len(paged), len(dir.want))
+		}
+		for i := range paged {
+			if paged[i].ID != dir.want[i].ID {
+				t.Errorf("%s: paged[%d] = %s, want %s", dir.name, i, paged[i].ID, dir.want[i].ID)
+			}
+		}
+	}
+}
+
+func TestGetMessagePreviews(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	long := strings.Repeat("é", PreviewMaxRunes-1) + "🙂🙂" // Multi-byte runes straddle the cut
+	short := "hi 👋"
+	store.StoreMessage(message.NewMessage("p1", "conv-p", "alice", short, 1000))
+	read := message.NewMessage("p2", "conv-p", "bob", long, 2000)
+	read.Status = message.StatusRead
+	store.StoreMessage(read)
+	store.StoreMessage(message.NewMessage("other", "conv-other", "carol", "elsewhere", 3000))
+
+	previews, err := store.GetMessagePreviews("conv-p", 10, 0)
 	if err != nil {
-		t.Fatalf("GetSession() error: %v", err)
+		t.Fatalf("GetMessagePreviews() error: %v", err)
+	}
+	if len(previews) != 2 {
+		t.Fatalf("got %d previews, want 2", len(previews))
 	}
 
-	if len(retrieved) != len(sessionData) {
-		t.Errorf("session data length = %d, want %d", len(retrieved), len(sessionData))
+	// Newest first, with every field but the content carried over
+	p := previews[0]
+	if p.ID != "p2" || p.SenderID != "bob" || p.Timestamp != 2000 || p.Status != message.StatusRead {
+		t.Errorf("previews[0] = %+v, want p2 from bob at 2000, read", p)
+	}
+	if !p.Truncated || !utf8.ValidString(p.Preview) || utf8.RuneCountInString(p.Preview) != PreviewMaxRunes {
+		t.Errorf("long preview: truncated %v, valid %v, %d runes; want truncated valid %d runes",
+			p.Truncated, utf8.ValidString(p.Preview), utf8.RuneCountInString(p.Preview), PreviewMaxRunes)
+	}
+	if want := strings.Repeat("é", PreviewMaxRunes-1) + "🙂"; p.Preview != want {
+		t.Errorf("long preview = %q, want %q", p.Preview, want)
+	}
+	if p := previews[1]; p.ID != "p1" || p.Preview != short || p.Truncated {
+		t.Errorf("previews[1] = %+v, want p1 with the whole content", p)
 	}
 
-	for i, b := range sessionData {
-		if retrieved[i] != b {
-			t.Errorf("session data[%d] = %02x, want %02x", i, retrieved[i], b)
-		}
+	// Paging matches GetMessages; an empty page is nil
+	if page, _ := store.GetMessagePreviews("conv-p", 1, 1); len(page) != 1 || page[0].ID != "p1" {
+		t.Errorf("second page = %+v, want [p1]", page)
+	}
+	if page, err := store.GetMessagePreviews("conv-p", 10, 2); err != nil || page != nil {
+		t.Errorf("page past the end = %v, %v; want nil", page, err)
+	}
+
+	// Tombstones and attachments say what they are
+	photo := message.NewMessage("p3", "conv-p", "bob", `{"url":"https://example.com/a.jpg"}`, 3000)
+	photo.MessageType = message.TypeImage
+	store.StoreMessage(photo)
+	store.TombstoneMessage("p1")
+	previews, _ = store.GetMessagePreviews("conv-p", 10, 0)
+	if p := previews[0]; p.ID != "p3" || p.MessageType != message.TypeImage || p.Deleted {
+		t.Errorf("previews[0] = %+v, want p3 as a live image", p)
+	}
+	if p := previews[2]; p.ID != "p1" || !p.Deleted || p.Preview != "" {
+		t.Errorf("previews[2] = %+v, want p1 as an empty tombstone", p)
 	}
 }
 
-func TestGetSessionNotFound(t *testing.T) {
+func TestGetMessagesSinceCursorPaging(t *testing.T) {
 	store, dbPath := newTestStorage(t)
 	defer cleanup(store, dbPath)
 
-	_, err := store.GetSession("nonexistent")
-	if err == nil {
-		t.Error("GetSession() for nonexistent recipient should return error")
+	// Insert out of timestamp order to make sure ordering comes from SQL
+	for _, i := range []int{4, 0, 7, 2, 9, 1, 5, 3, 8, 6} {
+		store.StoreMessage(&message.Message{
+			ID: fmt.Sprintf("since-%d", i), ConversationID: "conv-since",
+			SenderID: "alice", Content: "Content", Timestamp: int64(1000 + i),
+			Status: message.StatusSent,
+		})
+	}
+
+	var seen []string
+	var cursor SyncCursor
+	for {
+		page, next, err := store.GetMessagesSince("conv-since", cursor, 3)
+		if err != nil {
+			t.Fatalf("GetMessagesSince() error: %v", err)
+		}
+		if len(page) == 0 {
+			if next != cursor {
+				t.Errorf("next cursor on an empty page = %+v, want %+v", next, cursor)
+			}
+			break
+		}
+		if len(page) > 3 {
+			t.Errorf("page has %d messages, want at most 3", len(page))
+		}
+		for _, m := range page {
+			if m.Timestamp < cursor.Timestamp {
+				t.Errorf("message %s at %d is before cursor %d", m.ID, m.Timestamp, cursor.Timestamp)
+			}
+			seen = append(seen, m.ID)
+		}
+		cursor = next
+	}
+
+	if len(seen) != 10 {
+		t.Fatalf("paged through %d messages, want 10", len(seen))
+	}
+	for i, id := range seen {
+		if want := fmt.Sprintf("since-%d", i); id != want {
+			t.Errorf("seen[%d] = %q, want %q (ascending, no gaps or overlaps)", i, id, want)
+		}
 	}
 }
 
-func TestStoreSessionUpsert(t *testing.T) {
+func TestGetMessagesSinceTimestampCollisions(t *testing.T) {
 	store, dbPath := newTestStorage(t)
 	defer cleanup(store, dbPath)
 
-	store.StoreSession("alice", []byte{1, 2, 3})
-	store.StoreSession("alice", []byte{4, 5, 6}) // update
+	// Five messages share a timestamp, straddling the page boundary
+	timestamps := []int64{100, 200, 200, 200, 200, 200, 300}
+	for i, ts := range timestamps {
+		store.StoreMessage(&message.Message{
+			ID: fmt.Sprintf("tie-%d", i), ConversationID: "conv-tie",
+			SenderID: "alice", Content: "Content", Timestamp: ts,
+			Status: message.StatusSent,
+		})
+	}
 
-	retrieved, _ := store.GetSession("alice")
-	if len(retrieved) != 3 || retrieved[0] != 4 {
-		t.Error("StoreSession should upsert (update existing)")
+	seen := map[string]int{}
+	var order []string
+	var cursor SyncCursor
+	for pages := 0; pages < 10; pages++ {
+		page, next, _ := store.GetMessagesSince("conv-tie", cursor, 3)
+		if len(page) == 0 {
+			break
+		}
+		if len(page) > 3 {
+			t.Errorf("page has %d messages, want at most 3", len(page))
+		}
+		for _, m := range page {
+			seen[m.ID]++
+			order = append(order, m.ID)
+		}
+		cursor = next
+	}
+
+	if len(seen) != len(timestamps) {
+		t.Errorf("saw %d distinct messages, want %d", len(seen), len(timestamps))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("message %s returned %d times, want 1", id, n)
+		}
+	}
+	for i, id := range order {
+		if want := fmt.Sprintf("tie-%d", i); id != want {
+			t.Errorf("order[%d] = %q, want %q", i, id, want)
+		}
 	}
 }
 
-func TestMultipleSessions(t *testing.T) {
+func TestGetMessagesSinceEmpty(t *testing.T) {
 	store, dbPath := newTestStorage(t)
 	defer cleanup(store, dbPath)
 
-	store.StoreSession("alice", []byte{1})
-	store.StoreSession("bob", []byte{2})
-	store.StoreSession("charlie", []byte{3})
+	page, _, err := store.GetMessagesSince("nothing-here", SyncCursor{}, 10)
+	if err != nil {
+		t.Fatalf("GetMessagesSince() error: %v", err)
+	}
+	if len(page) != 0 {
+		t.Errorf("GetMessagesSince() on empty conversation = %d messages, want 0", len(page))
+	}
+}
 
-	a, _ := store.GetSession("alice")
-	b, _ := store.GetSession("bob")
-	c, _ := store.GetSession("charlie")
+func TestGetMessagesSinceClampsLimit(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
 
-	if a[0] != 1 || b[0] != 2 || c[0] != 3 {
-		t.Error("each recipient should have their own session data")
+	for i := 0; i < MaxSyncPageSize+1; i++ {
+		store.StoreMessage(message.NewMessage(fmt.Sprintf("m%d", i), "conv-big", "alice", "hi", int64(i)))
 	}
-}
 
-// ═══════════════════════════════════════
-// 5. Close
-// ═══════════════════════════════════════
+	for _, limit := range []int{0, -1, MaxSyncPageSize + 10} {
+		page, _, err := store.GetMessagesSince("conv-big", SyncCursor{}, limit)
+		if err != nil || len(page) != MaxSyncPageSize {
+			t.Errorf("GetMessagesSince(limit %d) = %d messages, %v; want %d", limit, len(page), err, MaxSyncPageSize)
+		}
+	}
+}
 
-func TestClose(t *testing.T) {
+func TestGetMessagesBeforeCursorPaging(t *testing.T) {
 	store, dbPath := newTestStorage(t)
-	defer os.Remove(dbPath)
+	defer cleanup(store, dbPath)
 
-	err := store.Close()
-	if err != nil {
-		t.Fatalf("Close() error: %v", err)
+	for _, i := range []int{4, 0, 7, 2, 9, 1, 5, 3, 8, 6} {
+		store.StoreMessage(&message.Message{
+			ID: fmt.Sprintf("before-%d", i), ConversationID: "conv-before",
+			SenderID: "alice", Content: "Content", Timestamp: int64(1000 + i),
+			Status: message.StatusSent,
+		})
+	}
+
+	// Start from the newest page, then scroll back
+	var seen []string
+	cursor := int64(1 << 62)
+	for {
+		page, err := store.GetMessagesBefore("conv-before", cursor, 3)
+		if err != nil {
+			t.Fatalf("GetMessagesBefore() error: %v", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, m := range page {
+			if m.Timestamp >= cursor {
+				t.Errorf("message %s at %d is not before cursor %d", m.ID, m.Timestamp, cursor)
+			}
+			seen = append(seen, m.ID)
+		}
+		cursor = page[len(page)-1].Timestamp
+	}
+
+	if len(seen) != 10 {
+		t.Fatalf("paged through %d messages, want 10", len(seen))
+	}
+	for i, id := range seen {
+		if want := fmt.Sprintf("before-%d", 9-i); id != want {
+			t.Errorf("seen[%d] = %q, want %q (descending, no gaps or overlaps)", i, id, want)
+		}
 	}
 }
 
-// ═══════════════════════════════════════
-// 6. Unicode & Edge Cases
-// ═══════════════════════════════════════
+func TestGetMessagesBeforeTimestampCollisions(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
 
-func TestStoreUnicodeMessage(t *testing.T) {
+	timestamps := []int64{100, 200, 200, 200, 200, 200, 300}
+	for i, ts := range timestamps {
+		store.StoreMessage(&message.Message{
+			ID: fmt.Sprintf("tie-%d", i), ConversationID: "conv-tie",
+			SenderID: "alice", Content: "Content", Timestamp: ts,
+			Status: message.StatusSent,
+		})
+	}
+
+	seen := map[string]int{}
+	cursor := int64(1000)
+	for pages := 0; pages < 10; pages++ {
+		page, _ := store.GetMessagesBefore("conv-tie", cursor, 3)
+		if len(page) == 0 {
+			break
+		}
+		for _, m := range page {
+			seen[m.ID]++
+		}
+		cursor = page[len(page)-1].Timestamp
+	}
+
+	if len(seen) != len(timestamps) {
+		t.Errorf("saw %d distinct messages, want %d", len(seen), len(timestamps))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("message %s returned %d times, want 1", id, n)
+		}
+	}
+}
+
+func TestGetMessagesPage(t *testing.T) {
 	store, dbPath := newTestStorage(t)
 	defer cleanup(store, dbPath)
 
-	unicodeTexts := []string{
-		"Hello 🌍🔐💬",
-		"مرحبا",
-		"こんにちは",
-		"🇮🇳 भारत",
+	// Seven messages, five of them sharing a timestamp
+	timestamps := []int64{100, 200, 200, 200, 200, 200, 300}
+	for i, ts := range timestamps {
+		store.StoreMessage(&message.Message{
+			ID: fmt.Sprintf("page-%d", i), ConversationID: "conv-page",
+			SenderID: "alice", Content: "Content", Timestamp: ts,
+			Status: message.StatusSent,
+		})
 	}
 
-	for i, text := range unicodeTexts {
-		msg := &message.Message{
-			ID: "unicode-" + string(rune('a'+i)), ConversationID: "conv-unicode",
-			SenderID: "alice", Content: text, Timestamp: int64(1000 + i),
-			Status: message.StatusPending,
+	var seen []string
+	var pages int
+	cursor := ""
+	for {
+		page, next, hasMore, err := store.GetMessagesPage("conv-page", 3, cursor)
+		if err != nil {
+			t.Fatalf("GetMessagesPage() error: %v", err)
 		}
-		store.StoreMessage(msg)
+		pages++
+		for _, m := range page {
+			seen = append(seen, m.ID)
+		}
+
+		if !hasMore {
+			if next != "" {
+				t.Errorf("nextCursor on last page = %q, want empty", next)
+			}
+			break
+		}
+		if len(page) != 3 {
+			t.Errorf("page %d has %d messages, want 3", pages, len(page))
+		}
+		if next == "" {
+			t.Fatal("nextCursor should be set while hasMore is true")
+		}
+		if pages > 10 {
+			t.Fatal("paging did not terminate")
+		}
+		cursor = next
 	}
 
-	messages, _ := store.GetMessages("conv-unicode", 10, 0)
-	if len(messages) != len(unicodeTexts) {
-		t.Errorf("stored %d messages, retrieved %d", len(unicodeTexts), len(messages))
+	if pages != 3 {
+		t.Errorf("pages = %d, want 3", pages)
+	}
+	want := []string{"page-6", "page-5", "page-4", "page-3", "page-2", "page-1", "page-0"}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("paged IDs = %v, want %v", seen, want)
 	}
 }
 
-func TestStoreLargeMessage(t *testing.T) {
+func TestGetMessagesPageExactFit(t *testing.T) {
 	store, dbPath := newTestStorage(t)
 	defer cleanup(store, dbPath)
 
-	largeContent := ""
-	for i := 0; i < 10000; i++ {
-		largeContent += "A"
+	for i := 0; i < 4; i++ {
+		store.StoreMessage(&message.Message{
+			ID: fmt.Sprintf("fit-%d", i), ConversationID: "conv-fit",
+			SenderID: "alice", Content: "Content", Timestamp: int64(1000 + i),
+			Status: message.StatusSent,
+		})
 	}
 
-	msg := &message.Message{
-		ID: "large", ConversationID: "conv-large", SenderID: "alice",
-		Content: largeContent, Timestamp: 1000, Status: message.StatusPending,
+	// A full final page must not report a phantom next page
+	first, next, hasMore, _ := store.GetMessagesPage("conv-fit", 2, "")
+	if len(first) != 2 || !hasMore {
+		t.Fatalf("first page = %d messages, hasMore %v; want 2, true", len(first), hasMore)
 	}
-	err := store.StoreMessage(msg)
-	if err != nil {
-		t.Fatalf("StoreMessage (large) error: %v", err)
+	last, next, hasMore, _ := store.GetMessagesPage("conv-fit", 2, next)
+	if len(last) != 2 || hasMore || next != "" {
+		t.Errorf("last page = %d messages, hasMore %v, cursor %q; want 2, false, empty", len(last), hasMore, next)
 	}
+}
 
-	retrieved, _ := store.GetMessage("large")
-	if len(retrieved.Content) != 10000 {
-		t.Errorf("large message content length = %d, want 10000", len(retrieved.Content))
+func TestGetMessagesPageInvalidCursor(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	for _, cursor := range []string{"not base64!", "bm8tY29sb24", "YWJjOmlk"} {
+		if _, _, _, err := store.GetMessagesPage("conv", 10, cursor); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("GetMessagesPage(cursor %q) error = %v, want ErrInvalidCursor", cursor, err)
+		}
 	}
 }
 
-func TestStoreLargeSessionData(t *testing.T) {
+func TestGetMessagesBySender(t *testing.T) {
 	store, dbPath := newTestStorage(t)
 	defer cleanup(store, dbPath)
 
-	largeData := make([]byte, 10000)
-	for i := range largeData {
-		largeData[i] = byte(i % 256)
+	senders := []string{"alice", "bob", "alice", "carol", "alice", "bob"}
+	for i, sender := range senders {
+		store.StoreMessage(&message.Message{
+			ID: fmt.Sprintf("sender-%d", i), ConversationID: "conv-1",
+			SenderID: sender, Content: "Content", Timestamp: int64(1000 + i),
+			Status: message.StatusSent,
+		})
 	}
+	store.StoreMessage(message.NewMessage("elsewhere", "conv-2", "alice", "Content", 5000))
 
-	err := store.StoreSession("big-session", largeData)
+	messages, err := store.GetMessagesBySender("conv-1", "alice", 10, 0)
 	if err != nil {
-		t.Fatalf("StoreSession (large) error: %v", err)
+		t.Fatalf("GetMessagesBySender() error: %v", err)
 	}
 
-	retrieved, _ := store.GetSession("big-session")
-	if len(retrieved) != 10000 {
-		t.Errorf("large session data length = %d, want 10000", len(retrieved))
+	want := []string{"sender-4", "sender-2", "sender-0"}
+	if len(messages) != len(want) {
+		t.Fatalf("GetMessagesBySender() = %d messages, want %d", len(messages), len(want))
+	}
+	for i, msg := range messages {
+		if msg.ID != want[i] {
+			t.Errorf("messages[%d].ID = %s, want %s", i, msg.ID, want[i])
+		}
+		if msg.SenderID != "alice" {
+			t.Errorf("messages[%d].SenderID = %s, want alice", i, msg.SenderID)
+		}
+	}
+
+	page, _ := store.GetMessagesBySender("conv-1", "alice", 1, 1)
+	if len(page) != 1 || page[0].ID != "sender-2" {
+		t.Errorf("second page = %v, want sender-2", page)
+	}
+
+	none, _ := store.GetMessagesBySender("conv-1", "dave", 10, 0)
+	if len(none) != 0 {
+		t.Errorf("unknown sender returned %d messages, want 0", len(none))
+	}
+
+	// Equal timestamps come back newest-stored first
+	store.StoreMessage(message.NewMessage("tie-a", "conv-3", "alice", "Content", 7000))
+	store.StoreMessage(message.NewMessage("tie-b", "conv-3", "alice", "Content", 7000))
+	tied, _ := store.GetMessagesBySender("conv-3", "alice", 10, 0)
+	if len(tied) != 2 || tied[0].ID != "tie-b" || tied[1].ID != "tie-a" {
+		t.Errorf("tied messages = %v, want tie-b then tie-a", tied)
+	}
+}
+
+func TestGetLatestMessage(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreMessage(message.NewMessage("latest-1", "conv-1", "alice", "old", 1000))
+	store.StoreMessage(message.NewMessage("latest-3", "conv-1", "alice", "newest", 3000))
+	store.StoreMessage(message.NewMessage("latest-2", "conv-1", "bob", "middle", 2000))
+	store.StoreMessage(message.NewMessage("other", "conv-2", "carol", "elsewhere", 9000))
+
+	msg, err := store.GetLatestMessage("conv-1")
+	if err != nil {
+		t.Fatalf("GetLatestMessage() error: %v", err)
+	}
+	if msg.ID != "latest-3" {
+		t.Errorf("ID = %s, want latest-3", msg.ID)
+	}
+	if msg.Content != "newest" {
+		t.Errorf("Content = %q, want %q", msg.Content, "newest")
+	}
+}
+
+func TestGetLatestMessageEmpty(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	msg, err := store.GetLatestMessage("empty-conv")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetLatestMessage() error = %v, want ErrNotFound", err)
+	}
+	if msg != nil {
+		t.Errorf("GetLatestMessage() = %+v, want nil", msg)
+	}
+}
+
+func TestCountByStatus(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	statuses := map[string][]message.MessageStatus{
+		"conv-1": {message.StatusFailed, message.StatusFailed, message.StatusFailed, message.StatusPending, message.StatusRead},
+		"conv-2": {message.StatusPending, message.StatusPending},
+	}
+	for conv, list := range statuses {
+		for i, status := range list {
+			store.StoreMessage(&message.Message{
+				ID: fmt.Sprintf("%s-%d", conv, i), ConversationID: conv,
+				SenderID: "alice", Content: "Content", Timestamp: int64(1000 + i),
+				Status: status,
+			})
+		}
+	}
+
+	counts, err := store.CountByStatus("conv-1")
+	if err != nil {
+		t.Fatalf("CountByStatus() error: %v", err)
+	}
+	want := map[message.MessageStatus]int{message.StatusFailed: 3, message.StatusPending: 1, message.StatusRead: 1}
+	for status, n := range want {
+		if counts[status] != n {
+			t.Errorf("counts[%s] = %d, want %d", status, counts[status], n)
+		}
+	}
+	if n, ok := counts[message.StatusDelivered]; ok {
+		t.Errorf("counts[delivered] = %d, want absent", n)
+	}
+
+	all, _ := store.CountByStatus("")
+	if all[message.StatusPending] != 3 {
+		t.Errorf("all pending = %d, want 3", all[message.StatusPending])
+	}
+	if all[message.StatusFailed] != 3 {
+		t.Errorf("all failed = %d, want 3", all[message.StatusFailed])
+	}
+}
+
+func TestCountByStatusEmpty(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	counts, err := store.CountByStatus("empty-conv")
+	if err != nil {
+		t.Fatalf("CountByStatus() error: %v", err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("CountByStatus() on empty conversation = %v, want empty map", counts)
+	}
+}
+
+func TestGetMessagesByIDs(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreMessage(message.NewMessage("m1", "conv-1", "alice", "one", 1000))
+	store.StoreMessage(message.NewMessage("m2", "conv-2", "bob", "two", 2000))
+
+	got, err := store.GetMessagesByIDs([]string{"m1", "missing", "m2", "m1"})
+	if err != nil {
+		t.Fatalf("GetMessagesByIDs() error: %v", err)
+	}
+	if len(got) != 2 || got["m1"].Content != "one" || got["m2"].Content != "two" {
+		t.Errorf("GetMessagesByIDs() = %v, want m1 and m2", got)
+	}
+	if _, ok := got["missing"]; ok {
+		t.Error("missing IDs should be absent from the result")
+	}
+
+	if empty, err := store.GetMessagesByIDs(nil); err != nil || len(empty) != 0 {
+		t.Errorf("GetMessagesByIDs(nil) = %v, %v; want empty", empty, err)
+	}
+}
+
+func TestGetMessagesByIDsChunked(t *testing.T) {
+	store, _ := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true})
+	defer store.Close()
+
+	// More IDs than fit in one IN (...) query, half of them stored
+	n := idChunkSize*2 + 10
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("m%04d", i)
+		if i%2 == 0 {
+			store.StoreMessage(message.NewMessage(ids[i], "conv-1", "alice", "hi", int64(i)))
+		}
+	}
+
+	got, err := store.GetMessagesByIDs(ids)
+	if err != nil {
+		t.Fatalf("GetMessagesByIDs() error: %v", err)
+	}
+	if len(got) != (n+1)/2 {
+		t.Errorf("found %d messages, want %d", len(got), (n+1)/2)
+	}
+	if got[ids[n-1]] != nil || got[ids[n-2]] == nil {
+		t.Error("IDs in the last chunk should be resolved")
+	}
+}
+
+// ═══════════════════════════════════════
+// 4. Session Storage
+// ═══════════════════════════════════════
+
+func TestStoreAndGetSession(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	sessionData := []byte{0xCA, 0xFE, 0xBA, 0xBE, 0xDE, 0xAD}
+
+	err := store.StoreSession("alice", sessionData)
+	if err != nil {
+		t.Fatalf("StoreSession() error: %v", err)
+	}
+
+	retrieved, err := store.GetSession("alice")
+	if err != nil {
+		t.Fatalf("GetSession() error: %v", err)
+	}
+
+	if len(retrieved) != len(sessionData) {
+		t.Errorf("session data length = %d, want %d", len(retrieved), len(sessionData))
+	}
+
+	for i, b := range sessionData {
+		if retrieved[i] != b {
+			t.Errorf("session data[%d] = %02x, want %02x", i, retrieved[i], b)
+		}
+	}
+}
+
+func TestGetSessionNotFound(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	_, err := store.GetSession("nonexistent")
+	if !errors.Is(err, crypto.ErrSessionNotFound) {
+		t.Errorf("GetSession() for nonexistent recipient error = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestStoreSessionUpsert(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreSession("alice", []byte{1, 2, 3})
+	store.StoreSession("alice", []byte{4, 5, 6}) // update
+
+	retrieved, _ := store.GetSession("alice")
+	if len(retrieved) != 3 || retrieved[0] != 4 {
+		t.Error("StoreSession should upsert (update existing)")
+	}
+}
+
+func TestMultipleSessions(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreSession("alice", []byte{1})
+	store.StoreSession("bob", []byte{2})
+	store.StoreSession("charlie", []byte{3})
+
+	a, _ := store.GetSession("alice")
+	b, _ := store.GetSession("bob")
+	c, _ := store.GetSession("charlie")
+
+	if a[0] != 1 || b[0] != 2 || c[0] != 3 {
+		t.Error("each recipient should have their own session data")
+	}
+}
+
+func TestListSessionRecipients(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	if ids, err := store.ListSessionRecipients(); err != nil || len(ids) != 0 {
+		t.Fatalf("ListSessionRecipients() on empty db = %v, %v, want none", ids, err)
+	}
+
+	store.StoreSession("charlie", []byte{3})
+	store.StoreSession("alice", []byte{1})
+	store.StoreSession("bob", []byte{2})
+
+	ids, err := store.ListSessionRecipients()
+	if err != nil {
+		t.Fatalf("ListSessionRecipients() error: %v", err)
+	}
+	if fmt.Sprint(ids) != "[alice bob charlie]" {
+		t.Errorf("ListSessionRecipients() = %v, want [alice bob charlie]", ids)
+	}
+}
+
+func TestGetAllSessions(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	want := map[string][]byte{
+		"alice":   {1, 1},
+		"bob":     {2},
+		"charlie": bytes.Repeat([]byte{3}, 1000),
+	}
+	for id, data := range want {
+		store.StoreSession(id, data)
+	}
+
+	got, err := store.GetAllSessions()
+	if err != nil {
+		t.Fatalf("GetAllSessions() error: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("GetAllSessions() returned %d sessions, want %d", len(got), len(want))
+	}
+	for id, data := range want {
+		if !bytes.Equal(got[id], data) {
+			t.Errorf("session %q = %v, want %v", id, got[id], data)
+		}
+	}
+}
+
+// ═══════════════════════════════════════
+// 5. Close
+// ═══════════════════════════════════════
+
+func TestClose(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer os.Remove(dbPath)
+
+	err := store.Close()
+	if err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer os.Remove(dbPath)
+
+	if err := store.Ping(); err != nil {
+		t.Fatalf("Ping() on open store error: %v", err)
+	}
+	store.Close()
+	if err := store.Ping(); err == nil {
+		t.Error("Ping() after Close should fail")
+	}
+}
+
+// ═══════════════════════════════════════
+// 6. Unicode & Edge Cases
+// ═══════════════════════════════════════
+
+func TestStoreUnicodeMessage(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	unicodeTexts := []string{
+		"Hello 🌍🔐💬",
+		"مرحبا",
+		"こんにちは",
+		"🇮🇳 भारत",
+	}
+
+	for i, text := range unicodeTexts {
+		msg := &message.Message{
+			ID: "unicode-" + string(rune('a'+i)), ConversationID: "conv-unicode",
+			SenderID: "alice", Content: text, Timestamp: int64(1000 + i),
+			Status: message.StatusPending,
+		}
+		store.StoreMessage(msg)
+	}
+
+	messages, _ := store.GetMessages("conv-unicode", 10, 0)
+	if len(messages) != len(unicodeTexts) {
+		t.Errorf("stored %d messages, retrieved %d", len(unicodeTexts), len(messages))
+	}
+}
+
+func TestStoreLargeMessage(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	largeContent := ""
+	for i := 0; i < 10000; i++ {
+		largeContent += "A"
+	}
+
+	msg := &message.Message{
+		ID: "large", ConversationID: "conv-large", SenderID: "alice",
+		Content: largeContent, Timestamp: 1000, Status: message.StatusPending,
+	}
+	err := store.StoreMessage(msg)
+	if err != nil {
+		t.Fatalf("StoreMessage (large) error: %v", err)
+	}
+
+	retrieved, _ := store.GetMessage("large")
+	if len(retrieved.Content) != 10000 {
+		t.Errorf("large message content length = %d, want 10000", len(retrieved.Content))
+	}
+}
+
+func TestStoreLargeSessionData(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	largeData := make([]byte, 10000)
+	for i := range largeData {
+		largeData[i] = byte(i % 256)
+	}
+
+	err := store.StoreSession("big-session", largeData)
+	if err != nil {
+		t.Fatalf("StoreSession (large) error: %v", err)
+	}
+
+	retrieved, _ := store.GetSession("big-session")
+	if len(retrieved) != 10000 {
+		t.Errorf("large session data length = %d, want 10000", len(retrieved))
+	}
+}
+
+// ═══════════════════════════════════════
+// 7. Content Validation & Schema
+// ═══════════════════════════════════════
+
+func TestStoreMessageValidatesTypedContent(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	valid := message.NewMessage("loc-1", "conv-1", "alice", `{"latitude": 12.97, "longitude": 77.59}`, 1000)
+	valid.MessageType = message.TypeLocation
+	if err := store.StoreMessage(valid); err != nil {
+		t.Fatalf("StoreMessage(valid location) error: %v", err)
+	}
+
+	retrieved, _ := store.GetMessage("loc-1")
+	if retrieved.MessageType != message.TypeLocation {
+		t.Errorf("MessageType = %q, want %q", retrieved.MessageType, message.TypeLocation)
+	}
+
+	invalid := message.NewMessage("loc-2", "conv-1", "alice", `{"latitude": 200, "longitude": 0}`, 1001)
+	invalid.MessageType = message.TypeLocation
+	if err := store.StoreMessage(invalid); !errors.Is(err, message.ErrInvalidContent) {
+		t.Errorf("StoreMessage(invalid location) error = %v, want ErrInvalidContent", err)
+	}
+	if _, err := store.GetMessage("loc-2"); err == nil {
+		t.Error("invalid message should not be stored")
+	}
+}
+
+func TestStoreMessageRejectsEphemeral(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	for _, mt := range []message.MessageType{message.TypeTyping, message.TypePresence} {
+		msg := message.NewMessage("signal-"+string(mt), "conv-1", "alice", "{}", 1000)
+		msg.MessageType = mt
+		if err := store.StoreMessage(msg); !errors.Is(err, ErrEphemeralMessage) {
+			t.Errorf("StoreMessage(%s) error = %v, want ErrEphemeralMessage", mt, err)
+		}
+	}
+
+	messages, _ := store.GetMessages("conv-1", 10, 0)
+	if len(messages) != 0 {
+		t.Errorf("stored %d ephemeral messages, want 0", len(messages))
+	}
+}
+
+func TestMigrationsSetUserVersion(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	var version int
+	store.db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if version != len(migrations) {
+		t.Errorf("user_version = %d, want %d", version, len(migrations))
+	}
+
+	// Re-running is a no-op
+	if err := migrate(store.db); err != nil {
+		t.Errorf("migrate() on current schema error: %v", err)
+	}
+}
+
+// ═══════════════════════════════════════
+// 8. Message Edits
+// ═══════════════════════════════════════
+
+func TestEditMessageHistory(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreMessage(message.NewMessage("edit-1", "conv-1", "alice", "first draft", 1000))
+
+	if err := store.EditMessage("edit-1", "second draft", 1100); err != nil {
+		t.Fatalf("first EditMessage() error: %v", err)
+	}
+	if err := store.EditMessage("edit-1", "final", 1200); err != nil {
+		t.Fatalf("second EditMessage() error: %v", err)
+	}
+
+	msg, _ := store.GetMessage("edit-1")
+	if msg.Content != "final" {
+		t.Errorf("Content = %q, want %q", msg.Content, "final")
+	}
+	if msg.EditedAt != 1200 {
+		t.Errorf("EditedAt = %d, want 1200", msg.EditedAt)
+	}
+	if msg.Timestamp != 1000 {
+		t.Errorf("Timestamp = %d, editing should not change it", msg.Timestamp)
+	}
+
+	history, err := store.GetEditHistory("edit-1")
+	if err != nil {
+		t.Fatalf("GetEditHistory() error: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("history length = %d, want 2", len(history))
+	}
+	if history[0].Content != "first draft" || history[0].EditedAt != 1100 {
+		t.Errorf("history[0] = %+v, want first draft @1100", history[0])
+	}
+	if history[1].Content != "second draft" || history[1].EditedAt != 1200 {
+		t.Errorf("history[1] = %+v, want second draft @1200", history[1])
+	}
+}
+
+func TestEditMessageNotFound(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	if err := store.EditMessage("missing", "content", 1000); err == nil {
+		t.Error("EditMessage() on a missing message should return error")
+	}
+
+	history, _ := store.GetEditHistory("missing")
+	if len(history) != 0 {
+		t.Errorf("failed edit should not record history, got %d entries", len(history))
+	}
+}
+
+func TestEditMessageValidatesType(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	msg := message.NewMessage("edit-loc", "conv-1", "alice", `{"latitude": 1, "longitude": 2}`, 1000)
+	msg.MessageType = message.TypeLocation
+	store.StoreMessage(msg)
+
+	if err := store.EditMessage("edit-loc", "not a location", 1100); !errors.Is(err, message.ErrInvalidContent) {
+		t.Errorf("EditMessage() with invalid content error = %v, want ErrInvalidContent", err)
+	}
+
+	unchanged, _ := store.GetMessage("edit-loc")
+	if unchanged.EditedAt != 0 {
+		t.Error("rejected edit should leave the message untouched")
+	}
+}
+
+// ═══════════════════════════════════════
+// 9. Tombstones
+// ═══════════════════════════════════════
+
+func TestTombstoneMessage(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreMessage(message.NewMessage("tomb-1", "conv-1", "alice", "secret", 1000))
+	store.StoreMessage(message.NewMessage("tomb-2", "conv-1", "bob", "still here", 2000))
+	store.EditMessage("tomb-1", "edited secret", 1100)
+
+	if err := store.TombstoneMessage("tomb-1"); err != nil {
+		t.Fatalf("TombstoneMessage() error: %v", err)
+	}
+
+	msg, err := store.GetMessage("tomb-1")
+	if err != nil {
+		t.Fatalf("tombstoned row should remain, got error: %v", err)
+	}
+	if !msg.Deleted {
+		t.Error("Deleted = false, want true")
+	}
+	if msg.Content != "" {
+		t.Errorf("Content = %q, want empty", msg.Content)
+	}
+	if msg.Timestamp != 1000 {
+		t.Errorf("Timestamp = %d, want 1000", msg.Timestamp)
+	}
+
+	history, _ := store.GetEditHistory("tomb-1")
+	if len(history) != 0 {
+		t.Errorf("edit history should be erased, got %d entries", len(history))
+	}
+
+	// Tombstones are still listed so the UI can render a placeholder
+	messages, _ := store.GetMessages("conv-1", 10, 0)
+	if len(messages) != 2 {
+		t.Fatalf("GetMessages() returned %d, want 2", len(messages))
+	}
+	if messages[1].ID != "tomb-1" || !messages[1].Deleted {
+		t.Errorf("messages[1] = %+v, want tombstoned tomb-1", messages[1])
+	}
+	if messages[0].Deleted {
+		t.Error("other messages should be unaffected")
+	}
+}
+
+func TestStoreMessageKeepsTombstone(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreMessage(message.NewMessage("tomb-1", "conv-1", "alice", "secret", 1000))
+	store.TombstoneMessage("tomb-1")
+
+	// e.g. a sync replaying the original message
+	if err := store.StoreMessage(message.NewMessage("tomb-1", "conv-1", "alice", "secret", 1000)); err != nil {
+		t.Fatalf("StoreMessage() error: %v", err)
+	}
+
+	msg, err := store.GetMessage("tomb-1")
+	if err != nil {
+		t.Fatalf("GetMessage() error: %v", err)
+	}
+	if !msg.Deleted || msg.Content != "" {
+		t.Errorf("re-stored tombstone = %+v, want deleted with no content", msg)
+	}
+}
+
+func TestTombstoneMessageNotFound(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	if err := store.TombstoneMessage("missing"); err == nil {
+		t.Error("TombstoneMessage() on a missing message should return error")
+	}
+}
+
+func TestEditTombstonedMessage(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreMessage(message.NewMessage("tomb-edit", "conv-1", "alice", "hello", 1000))
+	store.TombstoneMessage("tomb-edit")
+
+	if err := store.EditMessage("tomb-edit", "resurrected", 1100); !errors.Is(err, ErrMessageDeleted) {
+		t.Errorf("EditMessage() error = %v, want ErrMessageDeleted", err)
+	}
+
+	msg, _ := store.GetMessage("tomb-edit")
+	if msg.Content != "" {
+		t.Errorf("Content = %q, tombstone should stay blank", msg.Content)
+	}
+}
+
+// ═══════════════════════════════════════
+// 10. Encryption at Rest & Rekey
+// ═══════════════════════════════════════
+
+func TestContentEncryptedAtRest(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreMessage(message.NewMessage("secret-1", "conv-1", "alice", "attack at dawn", 1000))
+	store.StoreSession("bob", []byte("session-state"))
+
+	var content, session []byte
+	store.db.QueryRow(`SELECT content FROM messages WHERE id = ?`, "secret-1").Scan(&content)
+	store.db.QueryRow(`SELECT session_data FROM sessions WHERE recipient_id = ?`, "bob").Scan(&session)
+
+	if bytes.Contains(content, []byte("attack at dawn")) {
+		t.Error("message content is stored in plaintext")
+	}
+	if bytes.Contains(session, []byte("session-state")) {
+		t.Error("session data is stored in plaintext")
+	}
+}
+
+func TestSessionKeyMaterialNotInClear(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	var root, send, recv [32]byte
+	for i := range root {
+		root[i], send[i], recv[i] = 0xA1, 0xB2, 0xC3
+	}
+	session := crypto.NewSessionDirect("bob", root, send, recv)
+	data, _ := session.Serialize()
+
+	if err := store.StoreSession("bob", data); err != nil {
+		t.Fatalf("StoreSession() error: %v", err)
+	}
+
+	var raw []byte
+	store.db.QueryRow(`SELECT session_data FROM sessions WHERE recipient_id = ?`, "bob").Scan(&raw)
+	for name, key := range map[string][32]byte{"root": root, "send chain": send, "recv chain": recv} {
+		if bytes.Contains(raw, key[:]) {
+			t.Errorf("%s key appears in the clear in session_data", name)
+		}
+	}
+	if bytes.Contains(raw, []byte("MBRS")) {
+		t.Error("serialized session header appears in the clear")
+	}
+
+	loaded, err := store.GetSession("bob")
+	if err != nil {
+		t.Fatalf("GetSession() error: %v", err)
+	}
+	if !bytes.Equal(loaded, data) {
+		t.Error("GetSession() should return the original serialized session")
+	}
+}
+
+func TestSessionDataBoundToRecipient(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreSession("bob", []byte("bob-session"))
+	store.StoreSession("carol", []byte("carol-session"))
+
+	// Copy Bob's sealed blob into Carol's row
+	store.db.Exec(`UPDATE sessions SET session_data = (SELECT session_data FROM sessions WHERE recipient_id = 'bob') WHERE recipient_id = 'carol'`)
+
+	if _, err := store.GetSession("carol"); err == nil {
+		t.Error("a session blob moved to another recipient should not open")
+	}
+}
+
+func TestNewWrongKey(t *testing.T) {
+	dbPath := "test_wrong_key.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	store, err := New(dbPath, "right")
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	store.Close()
+
+	if _, err := New(dbPath, "wrong"); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("New() with wrong key error = %v, want ErrWrongKey", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	dbPath := "test_rekey.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	store, err := New(dbPath, "old-key")
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	store.StoreMessage(message.NewMessage("rk-1", "conv-1", "alice", "before", 1000))
+	store.EditMessage("rk-1", "after", 1100)
+	store.StoreSession("bob", []byte("session-state"))
+
+	if err := store.Rekey("new-key"); err != nil {
+		t.Fatalf("Rekey() error: %v", err)
+	}
+
+	// The open handle keeps working under the new key
+	if msg, _ := store.GetMessage("rk-1"); msg == nil || msg.Content != "after" {
+		t.Errorf("GetMessage() after Rekey = %+v, want content %q", msg, "after")
+	}
+	store.Close()
+
+	if _, err := New(dbPath, "old-key"); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("New() with old key error = %v, want ErrWrongKey", err)
+	}
+
+	reopened, err := New(dbPath, "new-key")
+	if err != nil {
+		t.Fatalf("New() with new key error: %v", err)
+	}
+	defer reopened.Close()
+
+	msg, err := reopened.GetMessage("rk-1")
+	if err != nil {
+		t.Fatalf("GetMessage() error: %v", err)
+	}
+	if msg.Content != "after" {
+		t.Errorf("Content = %q, want %q", msg.Content, "after")
+	}
+
+	history, _ := reopened.GetEditHistory("rk-1")
+	if len(history) != 1 || history[0].Content != "before" {
+		t.Errorf("history = %+v, want one entry with %q", history, "before")
+	}
+
+	session, _ := reopened.GetSession("bob")
+	if string(session) != "session-state" {
+		t.Errorf("session = %q, want %q", session, "session-state")
+	}
+}
+
+func TestOpenEncryptsLegacyPlaintextRows(t *testing.T) {
+	dbPath := "test_legacy_plaintext.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	// A database written before encryption: schema but no key check
+	raw, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open() error: %v", err)
+	}
+	createTables(raw)
+	migrate(raw)
+	raw.Exec(`INSERT INTO messages (id, conversation_id, sender_id, content, timestamp) VALUES ('legacy', 'conv-1', 'alice', 'plain old text', 1000)`)
+	raw.Close()
+
+	store, err := New(dbPath, "key")
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer store.Close()
+
+	msg, err := store.GetMessage("legacy")
+	if err != nil {
+		t.Fatalf("GetMessage() error: %v", err)
+	}
+	if msg.Content != "plain old text" {
+		t.Errorf("Content = %q, want %q", msg.Content, "plain old text")
+	}
+
+	var content []byte
+	store.db.QueryRow(`SELECT content FROM messages WHERE id = 'legacy'`).Scan(&content)
+	if bytes.Contains(content, []byte("plain old text")) {
+		t.Error("legacy row should be encrypted on first open")
+	}
+}
+
+// ═══════════════════════════════════════
+// 11. Queue Persistence
+// ═══════════════════════════════════════
+
+func TestStoreAndGetQueuedMessages(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	first := sync.NewQueuedMessage("q1", "bob", []byte{1, 2, 3})
+	first.CreatedAt, first.Attempts, first.NextAttemptAt = 1000, 2, 1002
+	second := sync.NewQueuedMessage("q2", "carol", []byte{4})
+
+	if err := store.StoreQueuedMessages([]*sync.QueuedMessage{first, second}); err != nil {
+		t.Fatalf("StoreQueuedMessages() error: %v", err)
+	}
+
+	loaded, err := store.GetQueuedMessages()
+	if err != nil {
+		t.Fatalf("GetQueuedMessages() error: %v", err)
+	}
+	if len(loaded) != 2 {
+		t.Fatalf("GetQueuedMessages() = %d messages, want 2", len(loaded))
+	}
+	if loaded[0].ID != "q1" || loaded[1].ID != "q2" {
+		t.Errorf("order = %s, %s, want q1, q2", loaded[0].ID, loaded[1].ID)
+	}
+	if loaded[0].RecipientID != "bob" || !bytes.Equal(loaded[0].EncryptedContent, []byte{1, 2, 3}) ||
+		loaded[0].CreatedAt != first.CreatedAt || loaded[0].Attempts != 2 || loaded[0].NextAttemptAt != 1002 {
+		t.Errorf("loaded[0] = %+v, want %+v", loaded[0], first)
+	}
+	if loaded[1].CreatedAt == 0 {
+		t.Error("a zero CreatedAt should be stamped when stored")
+	}
+
+	// Loading doesn't remove them; deleting does
+	if again, _ := store.GetQueuedMessages(); len(again) != 2 {
+		t.Errorf("second GetQueuedMessages() = %d messages, want 2", len(again))
+	}
+	if err := store.DeleteQueuedMessages([]string{"q1", "unknown"}); err != nil {
+		t.Fatalf("DeleteQueuedMessages() error: %v", err)
+	}
+	if left, _ := store.GetQueuedMessages(); len(left) != 1 || left[0].ID != "q2" {
+		t.Errorf("GetQueuedMessages() after delete = %d messages, want only q2", len(left))
+	}
+}
+
+func TestQueueReloadKeepsFIFOOrder(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	// Enqueued within one second, so created_at can't order them
+	q := sync.NewMessageQueue()
+	for i := 0; i < 50; i++ {
+		msg := sync.NewQueuedMessage(fmt.Sprintf("q%02d", 49-i), "bob", []byte{byte(i)})
+		msg.CreatedAt = 1000
+		q.Enqueue(msg)
+	}
+	want := q.GetAll()
+
+	if err := store.StoreQueuedMessages(q.DrainAll()); err != nil {
+		t.Fatalf("StoreQueuedMessages() error: %v", err)
+	}
+	store.Close()
+
+	reopened, err := New(dbPath, "test_key")
+	if err != nil {
+		t.Fatalf("New() reopen error: %v", err)
+	}
+	defer reopened.Close()
+
+	loaded, err := reopened.GetQueuedMessages()
+	if err != nil {
+		t.Fatalf("GetQueuedMessages() error: %v", err)
+	}
+	reloaded := sync.NewMessageQueue()
+	reloaded.Restore(loaded)
+
+	got := reloaded.GetAll()
+	if len(got) != len(want) {
+		t.Fatalf("reloaded %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID {
+			t.Fatalf("reloaded[%d] = %s, want %s (enqueue order)", i, got[i].ID, want[i].ID)
+		}
+	}
+}
+
+// ═══════════════════════════════════════
+// 12. Contacts
+// ═══════════════════════════════════════
+
+func newTestBundle(t *testing.T) *crypto.PublicKeyBundle {
+	t.Helper()
+	km := crypto.NewKeyManager()
+	km.GenerateIdentityKeys()
+	bundle, _ := km.GetPublicKeyBundle()
+	return bundle
+}
+
+func TestStoreAndGetContact(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	bundle := newTestBundle(t)
+	c := &contact.Contact{ID: "bob", DisplayName: "Bob", PhoneHash: "h1", PublicKeys: bundle}
+	if err := store.StoreContact(c); err != nil {
+		t.Fatalf("StoreContact() error: %v", err)
+	}
+
+	got, err := store.GetContact("bob")
+	if err != nil {
+		t.Fatalf("GetContact() error: %v", err)
+	}
+	if got.DisplayName != "Bob" || got.PhoneHash != "h1" || got.IsVerified {
+		t.Errorf("GetContact() = %+v", got)
+	}
+	if got.PublicKeys == nil || !bytes.Equal(got.PublicKeys.IdentityPublicKey, bundle.IdentityPublicKey) {
+		t.Error("public keys should round-trip")
+	}
+	if got.CreatedAt == 0 {
+		t.Error("CreatedAt should default to now")
+	}
+
+	if _, err := store.GetContact("nobody"); !errors.Is(err, contact.ErrNotFound) {
+		t.Errorf("GetContact(missing) error = %v, want contact.ErrNotFound", err)
+	}
+}
+
+func TestContactKeyPinning(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	contacts := contact.NewManager(store)
+	original, rotated := newTestBundle(t), newTestBundle(t)
+	store.StoreContact(&contact.Contact{ID: "bob", DisplayName: "Bob"})
+
+	if changed, err := contacts.DetectKeyChange("bob", original); err != nil || changed {
+		t.Fatalf("first DetectKeyChange() = %v, %v; want false, nil", changed, err)
+	}
+	if changed, _ := contacts.DetectKeyChange("bob", original); changed {
+		t.Error("unchanged key reported as a change")
+	}
+	if changed, _ := contacts.DetectKeyChange("bob", rotated); !changed {
+		t.Error("changed identity key not reported")
+	}
+	if changed, _ := contacts.DetectKeyChange("bob", rotated); !changed {
+		t.Error("key change should keep being reported until re-verified")
+	}
+
+	// Re-verifying pins the current key
+	if err := store.SetContactVerified("bob", true); err != nil {
+		t.Fatalf("SetContactVerified() error: %v", err)
+	}
+	bob, _ := store.GetContact("bob")
+	if !bob.IsVerified || !bytes.Equal(bob.PinnedIdentityKey, rotated.IdentityPublicKey) {
+		t.Error("verification should pin the current identity key")
+	}
+	if bob.Fingerprint != rotated.Fingerprint() {
+		t.Errorf("Fingerprint = %q, want the pinned key's %q", bob.Fingerprint, rotated.Fingerprint())
+	}
+	if changed, _ := contacts.DetectKeyChange("bob", rotated); changed {
+		t.Error("re-pinned key reported as a change")
+	}
+}
+
+func TestSetContactVerifiedWithoutKeys(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreContact(&contact.Contact{ID: "bob"})
+	if err := store.SetContactVerified("bob", true); err == nil {
+		t.Error("verifying a contact without keys should fail")
+	}
+	if err := store.SetContactVerified("nobody", true); !errors.Is(err, contact.ErrNotFound) {
+		t.Errorf("SetContactVerified(missing) error = %v, want contact.ErrNotFound", err)
+	}
+}
+
+func TestFindContactByPhoneHash(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreContact(&contact.Contact{ID: "bob", DisplayName: "Bob", PhoneHash: "hash-bob"})
+	store.StoreContact(&contact.Contact{ID: "carol", DisplayName: "Carol", PhoneHash: "hash-carol"})
+	store.StoreContact(&contact.Contact{ID: "dave", DisplayName: "Dave"})
+
+	got, err := store.FindContactByPhoneHash("hash-carol")
+	if err != nil {
+		t.Fatalf("FindContactByPhoneHash() error: %v", err)
+	}
+	if got.ID != "carol" {
+		t.Errorf("FindContactByPhoneHash() = %s, want carol", got.ID)
+	}
+
+	for _, hash := range []string{"hash-erin", "hash", ""} {
+		if _, err := store.FindContactByPhoneHash(hash); !errors.Is(err, contact.ErrNotFound) {
+			t.Errorf("FindContactByPhoneHash(%q) error = %v, want contact.ErrNotFound", hash, err)
+		}
+	}
+}
+
+func TestSearchContactsByName(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	for id, name := range map[string]string{
+		"al": "Alice", "alb": "albert", "bob": "Bob", "pct": "100% Real", "und": "a_b",
+	} {
+		store.StoreContact(&contact.Contact{ID: id, DisplayName: name})
+	}
+
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"al", "[alb al]"},
+		{"ALI", "[al]"},
+		{"Bob", "[bob]"},
+		{"zed", "[]"},
+		{"100%", "[pct]"},
+		{"10%", "[]"}, // Wildcards in the prefix match literally
+		{"a_", "[und]"},
+	}
+	for _, tt := range tests {
+		got, err := store.SearchContactsByName(tt.prefix)
+		if err != nil {
+			t.Fatalf("SearchContactsByName(%q) error: %v", tt.prefix, err)
+		}
+		ids := make([]string, len(got))
+		for i, c := range got {
+			ids[i] = c.ID
+		}
+		if fmt.Sprint(ids) != tt.want {
+			t.Errorf("SearchContactsByName(%q) = %v, want %s", tt.prefix, ids, tt.want)
+		}
+	}
+}
+
+func TestSetContactBlocked(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreContact(&contact.Contact{ID: "bob", DisplayName: "Bob", IsVerified: true})
+
+	if blocked, err := store.IsBlocked("bob"); err != nil || blocked {
+		t.Fatalf("IsBlocked() before blocking = %v, %v; want false, nil", blocked, err)
+	}
+	if err := store.SetContactBlocked("bob", true); err != nil {
+		t.Fatalf("SetContactBlocked() error: %v", err)
+	}
+	if blocked, _ := store.IsBlocked("bob"); !blocked {
+		t.Error("IsBlocked() after blocking = false, want true")
+	}
+
+	bob, _ := store.GetContact("bob")
+	if !bob.IsBlocked || !bob.IsVerified || bob.DisplayName != "Bob" {
+		t.Errorf("blocked contact = %+v, want other fields unchanged", bob)
+	}
+
+	store.SetContactBlocked("bob", false)
+	if blocked, _ := store.IsBlocked("bob"); blocked {
+		t.Error("IsBlocked() after unblocking = true, want false")
+	}
+
+	if err := store.SetContactBlocked("nobody", true); !errors.Is(err, contact.ErrNotFound) {
+		t.Errorf("SetContactBlocked(missing) error = %v, want contact.ErrNotFound", err)
+	}
+	if blocked, err := store.IsBlocked("nobody"); err != nil || blocked {
+		t.Errorf("IsBlocked(unknown) = %v, %v; want false, nil", blocked, err)
+	}
+}
+
+// ═══════════════════════════════════════
+// 13. Concurrency & Locking
+// ═══════════════════════════════════════
+
+func TestWALAndBusyTimeoutEnabled(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	var mode string
+	store.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode)
+	if mode != "wal" {
+		t.Errorf("journal_mode = %q, want wal", mode)
+	}
+
+	var timeout int
+	store.db.QueryRow(`PRAGMA busy_timeout`).Scan(&timeout)
+	if timeout != DefaultBusyTimeout {
+		t.Errorf("busy_timeout = %d, want %d", timeout, DefaultBusyTimeout)
+	}
+}
+
+func TestSetBusyTimeout(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	if err := store.SetBusyTimeout(1234); err != nil {
+		t.Fatalf("SetBusyTimeout() error: %v", err)
+	}
+	var timeout int
+	store.db.QueryRow(`PRAGMA busy_timeout`).Scan(&timeout)
+	if timeout != 1234 {
+		t.Errorf("busy_timeout = %d, want 1234", timeout)
+	}
+
+	if err := store.SetBusyTimeout(-1); err != ErrInvalidBusyTimeout {
+		t.Errorf("SetBusyTimeout(-1) error = %v, want ErrInvalidBusyTimeout", err)
+	}
+}
+
+func TestConcurrentWritesNoLockErrors(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	const writers, perWriter = 8, 50
+	errs := make(chan error, writers*perWriter*2)
+	done := make(chan struct{})
+
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < perWriter; i++ {
+				msg := message.NewMessage(fmt.Sprintf("w%d-%d", w, i), "conv-1", "alice", "hi", int64(i))
+				errs <- store.StoreMessage(msg)
+				errs <- store.StoreSession(fmt.Sprintf("peer-%d", w), []byte{byte(i)})
+			}
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		<-done
+	}
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent write error: %v", err)
+		}
+	}
+	if messages, _ := store.GetMessages("conv-1", writers*perWriter, 0); len(messages) != writers*perWriter {
+		t.Errorf("stored %d messages, want %d", len(messages), writers*perWriter)
+	}
+}
+
+// ═══════════════════════════════════════
+// 14. Options
+// ═══════════════════════════════════════
+
+func TestNewWithOptionsReadOnly(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+	store.StoreMessage(message.NewMessage("m1", "conv-1", "alice", "hi", 1))
+
+	ro, err := NewWithOptions(Options{Path: dbPath, EncryptionKey: "test_key", ReadOnly: true})
+	if err != nil {
+		t.Fatalf("NewWithOptions(ReadOnly) error: %v", err)
+	}
+	defer ro.Close()
+
+	msgs, err := ro.GetMessages("conv-1", 10, 0)
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "hi" {
+		t.Errorf("read-only GetMessages() = %v, %v, want the stored message", msgs, err)
+	}
+	if err := ro.StoreMessage(message.NewMessage("m2", "conv-1", "alice", "no", 2)); err == nil {
+		t.Error("StoreMessage() on read-only storage should fail")
+	}
+
+	if _, err := NewWithOptions(Options{Path: dbPath, EncryptionKey: "wrong", ReadOnly: true}); err != ErrWrongKey {
+		t.Errorf("read-only open with wrong key error = %v, want ErrWrongKey", err)
+	}
+}
+
+func TestNewWithOptionsReadOnlyMissingDatabase(t *testing.T) {
+	dbPath := "test_storage_" + t.Name() + ".db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	if store, err := NewWithOptions(Options{Path: dbPath, EncryptionKey: "test_key", ReadOnly: true}); err == nil {
+		store.Close()
+		t.Error("read-only open of an uninitialized database should fail")
+	}
+}
+
+func TestNewWithOptionsPageSizeAndJournal(t *testing.T) {
+	dbPath := "test_storage_" + t.Name() + ".db"
+	os.Remove(dbPath)
+
+	store, err := NewWithOptions(Options{Path: dbPath, EncryptionKey: "test_key", PageSize: 8192, DisableWAL: true})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer cleanup(store, dbPath)
+
+	var pageSize int
+	store.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize)
+	if pageSize != 8192 {
+		t.Errorf("page_size = %d, want 8192", pageSize)
+	}
+
+	var mode string
+	store.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode)
+	if mode != "delete" {
+		t.Errorf("journal_mode = %q, want delete", mode)
+	}
+}
+
+func TestNewWithOptionsDefaults(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	var pageSize int
+	store.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize)
+	if pageSize != DefaultPageSize {
+		t.Errorf("page_size = %d, want %d", pageSize, DefaultPageSize)
+	}
+}
+
+// ═══════════════════════════════════════
+// 15. Backends
+// ═══════════════════════════════════════
+
+// exerciseBackend runs the same operations against any Backend
+func exerciseBackend(t *testing.T, b Backend) {
+	t.Helper()
+
+	if err := b.StoreMessage(message.NewMessage("m1", "conv-1", "alice", "Hello", 1000)); err != nil {
+		t.Fatalf("StoreMessage() error: %v", err)
+	}
+	if err := b.EditMessage("m1", "Hello!", 2000); err != nil {
+		t.Fatalf("EditMessage() error: %v", err)
+	}
+	msgs, err := b.GetMessages("conv-1", 10, 0)
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "Hello!" {
+		t.Errorf("GetMessages() = %v, %v, want the edited message", msgs, err)
+	}
+
+	if err := b.StoreSession("bob", []byte{1, 2, 3}); err != nil {
+		t.Fatalf("StoreSession() error: %v", err)
+	}
+	if data, err := b.GetSession("bob"); err != nil || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("GetSession() = %v, %v, want [1 2 3]", data, err)
+	}
+
+	if err := b.StoreContact(&contact.Contact{ID: "bob", DisplayName: "Bob"}); err != nil {
+		t.Fatalf("StoreContact() error: %v", err)
+	}
+	if c, err := b.GetContact("bob"); err != nil || c.DisplayName != "Bob" {
+		t.Errorf("GetContact() = %+v, %v, want Bob", c, err)
+	}
+
+	b.StoreQueuedMessages([]*sync.QueuedMessage{sync.NewQueuedMessage("q1", "bob", []byte{9})})
+	if queued, err := b.GetQueuedMessages(); err != nil || len(queued) != 1 {
+		t.Errorf("GetQueuedMessages() = %d messages, %v, want 1", len(queued), err)
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	exerciseBackend(t, store)
+}
+
+func TestInMemoryBackend(t *testing.T) {
+	store, err := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true})
+	if err != nil {
+		t.Fatalf("NewWithOptions(InMemory) error: %v", err)
+	}
+	defer store.Close()
+
+	exerciseBackend(t, store)
+
+	// Reopening pooled connections keeps the data
+	store.SetBusyTimeout(100)
+	if msg, err := store.GetMessage("m1"); err != nil || msg == nil {
+		t.Errorf("message lost after connections were recycled: %v", err)
+	}
+}
+
+func TestInMemoryBackendsAreIsolated(t *testing.T) {
+	a, _ := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true})
+	defer a.Close()
+	b, _ := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true})
+	defer b.Close()
+
+	a.StoreMessage(message.NewMessage("m1", "conv-1", "alice", "only in a", 1000))
+	if msgs, _ := b.GetMessages("conv-1", 10, 0); len(msgs) != 0 {
+		t.Errorf("in-memory backend b sees %d messages from a", len(msgs))
+	}
+}
+
+func TestInMemoryBackendConcurrentWrites(t *testing.T) {
+	store, _ := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true})
+	defer store.Close()
+
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		go func(w int) {
+			var err error
+			for i := 0; i < 25 && err == nil; i++ {
+				err = store.StoreMessage(message.NewMessage(fmt.Sprintf("w%d-%d", w, i), "conv-1", "alice", "hi", int64(i)))
+			}
+			errs <- err
+		}(w)
+	}
+	for w := 0; w < 8; w++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("concurrent in-memory write error: %v", err)
+		}
+	}
+}
+
+// ═══════════════════════════════════════
+// 16. Conversations
+// ═══════════════════════════════════════
+
+func TestConversationFlags(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	flags, err := store.GetConversationFlags("conv-1")
+	if err != nil {
+		t.Fatalf("GetConversationFlags() error: %v", err)
+	}
+	if flags != (ConversationFlags{}) {
+		t.Errorf("unset flags = %+v, want all cleared", flags)
+	}
+
+	if err := store.SetConversationFlags("conv-1", ConversationFlags{Muted: true, Pinned: true}); err != nil {
+		t.Fatalf("SetConversationFlags() error: %v", err)
+	}
+	flags, _ = store.GetConversationFlags("conv-1")
+	if !flags.Muted || !flags.Pinned || flags.Archived || flags.UpdatedAt == 0 {
+		t.Errorf("flags = %+v, want muted and pinned", flags)
+	}
+
+	// Flags are replaced, not merged
+	store.SetConversationFlags("conv-1", ConversationFlags{Archived: true})
+	flags, _ = store.GetConversationFlags("conv-1")
+	if !flags.Archived || flags.Muted || flags.Pinned {
+		t.Errorf("flags = %+v, want only archived", flags)
+	}
+}
+
+func TestGetConversations(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreMessage(message.NewMessage("a1", "conv-a", "alice", "old", 1000))
+	store.StoreMessage(message.NewMessage("b1", "conv-b", "bob", "newer", 2000))
+	store.StoreMessage(message.NewMessage("b2", "conv-b", "bob", "newest", 3000))
+	store.StoreMessage(message.NewMessage("c1", "conv-c", "carol", "middle", 2500))
+
+	conversations, err := store.GetConversations(false)
+	if err != nil {
+		t.Fatalf("GetConversations() error: %v", err)
+	}
+	if got := conversationIDs(conversations); got != "[conv-b conv-c conv-a]" {
+		t.Errorf("conversations = %s, want most recent first", got)
+	}
+	if conversations[0].MessageCount != 2 || conversations[0].LastMessage.ID != "b2" {
+		t.Errorf("conv-b summary = %d messages, last %q, want 2, b2",
+			conversations[0].MessageCount, conversations[0].LastMessage.ID)
+	}
+
+	// Pinned conversations come first, archived ones are hidden
+	store.SetConversationFlags("conv-a", ConversationFlags{Pinned: true, Muted: true})
+	store.SetConversationFlags("conv-c", ConversationFlags{Archived: true})
+
+	conversations, _ = store.GetConversations(false)
+	if got := conversationIDs(conversations); got != "[conv-a conv-b]" {
+		t.Errorf("conversations = %s, want [conv-a conv-b]", got)
+	}
+	if !conversations[0].Pinned || !conversations[0].Muted {
+		t.Errorf("conv-a flags = %+v, want pinned and muted", conversations[0].ConversationFlags)
+	}
+
+	conversations, _ = store.GetConversations(true)
+	if got := conversationIDs(conversations); got != "[conv-a conv-b conv-c]" {
+		t.Errorf("conversations with archived = %s, want [conv-a conv-b conv-c]", got)
+	}
+	if !conversations[2].Archived {
+		t.Error("archived conversation should be marked archived")
+	}
+
+	// Unarchiving brings it back
+	store.SetConversationFlags("conv-c", ConversationFlags{})
+	if conversations, _ = store.GetConversations(false); len(conversations) != 3 {
+		t.Errorf("conversations after unarchive = %d, want 3", len(conversations))
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	fake := clock.NewFake(time.Unix(10*86400, 0))
+	store, err := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true, Clock: fake})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	now := fake.Now().Unix()
+	hour, day := int64(3600), int64(86400)
+
+	// conv-day keeps 24 hours, conv-month keeps 30 days
+	store.StoreMessage(message.NewMessage("day-old", "conv-day", "alice", "old", now-2*day))
+	store.StoreMessage(message.NewMessage("day-recent", "conv-day", "alice", "recent", now-hour))
+	store.StoreMessage(message.NewMessage("month-old", "conv-month", "bob", "old", now-2*day))
+	store.StoreMessage(message.NewMessage("forever-old", "conv-forever", "carol", "old", now-9*day))
+	store.EditMessage("day-old", "edited", now-2*day+1)
+
+	store.SetConversationFlags("conv-day", ConversationFlags{Muted: true})
+	if err := store.SetConversationRetention("conv-day", 24*time.Hour); err != nil {
+		t.Fatalf("SetConversationRetention() error: %v", err)
+	}
+	store.SetConversationRetention("conv-month", 30*24*time.Hour)
+
+	if got, _ := store.GetConversationRetention("conv-day"); got != 24*time.Hour {
+		t.Errorf("GetConversationRetention() = %v, want 24h", got)
+	}
+	if got, _ := store.GetConversationRetention("conv-forever"); got != 0 {
+		t.Errorf("unset retention = %v, want 0", got)
+	}
+	if flags, _ := store.GetConversationFlags("conv-day"); !flags.Muted {
+		t.Error("setting retention should keep the conversation's flags")
+	}
+	if err := store.SetConversationRetention("conv-day", -time.Hour); !errors.Is(err, ErrInvalidRetention) {
+		t.Errorf("negative retention error = %v, want ErrInvalidRetention", err)
+	}
+
+	purged, err := store.ApplyRetention(now)
+	if err != nil {
+		t.Fatalf("ApplyRetention() error: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("ApplyRetention() = %d, want 1", purged)
+	}
+	for id, want := range map[string]bool{"day-old": false, "day-recent": true, "month-old": true, "forever-old": true} {
+		if msg, _ := store.GetMessage(id); (msg != nil) != want {
+			t.Errorf("message %q kept = %v, want %v", id, msg != nil, want)
+		}
+	}
+	if edits, _ := store.GetEditHistory("day-old"); len(edits) != 0 {
+		t.Error("purged message's edit history should be purged")
+	}
+
+	// Flags set later don't reset the retention: a month on, both
+	// remaining messages in retained conversations are purged
+	store.SetConversationFlags("conv-month", ConversationFlags{Pinned: true})
+	if purged, _ := store.ApplyRetention(now + 29*day); purged != 2 {
+		t.Errorf("ApplyRetention() a month later = %d, want 2", purged)
+	}
+	if msg, _ := store.GetMessage("forever-old"); msg == nil {
+		t.Error("conversation without retention should keep its messages")
+	}
+}
+
+func TestPruneConversations(t *testing.T) {
+	store, err := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	// conv-N's latest message is at N*1000; conv-1 and conv-4 have older
+	// messages too
+	for i := 1; i <= 8; i++ {
+		id := fmt.Sprintf("conv-%d", i)
+		store.StoreMessage(message.NewMessage(id+"-latest", id, "alice", "hi", int64(i*1000)))
+	}
+	store.StoreMessage(message.NewMessage("conv-1-older", "conv-1", "bob", "old", 10))
+	store.StoreMessage(message.NewMessage("conv-4-older", "conv-4", "bob", "old", 20))
+	store.EditMessage("conv-1-older", "edited", 11)
+
+	// conv-2 is pinned; conv-empty has flags but no messages
+	store.SetConversationFlags("conv-2", ConversationFlags{Pinned: true})
+	store.SetConversationFlags("conv-3", ConversationFlags{Archived: true})
+	store.SetConversationFlags("conv-empty", ConversationFlags{Muted: true})
+
+	if _, err := store.PruneConversations(-1); !errors.Is(err, ErrInvalidPruneLimit) {
+		t.Errorf("PruneConversations(-1) error = %v, want ErrInvalidPruneLimit", err)
+	}
+
+	// Keep the 4 most active unpinned: conv-8..conv-5
+	pruned, err := store.PruneConversations(4)
+	if err != nil {
+		t.Fatalf("PruneConversations() error: %v", err)
+	}
+	if pruned != 4 {
+		t.Errorf("PruneConversations(4) = %d, want 4 (conv-empty, conv-1, conv-3, conv-4)", pruned)
+	}
+
+	all, _ := store.GetConversations(true)
+	if got, want := conversationIDs(all), "[conv-2 conv-8 conv-7 conv-6 conv-5]"; got != want {
+		t.Errorf("conversations after prune = %s, want %s", got, want)
+	}
+	for _, id := range []string{"conv-1-older", "conv-1-latest", "conv-4-older", "conv-3-latest"} {
+		if msg, _ := store.GetMessage(id); msg != nil {
+			t.Errorf("message %s of a pruned conversation was kept", id)
+		}
+	}
+	if edits, _ := store.GetEditHistory("conv-1-older"); len(edits) != 0 {
+		t.Error("pruned message's edit history should be deleted")
+	}
+	for _, id := range []string{"conv-3", "conv-empty"} {
+		if flags, _ := store.GetConversationFlags(id); flags != (ConversationFlags{}) {
+			t.Errorf("pruned conversation %s kept flags %+v", id, flags)
+		}
+	}
+
+	// Within the limit nothing more goes; zero keeps only pinned
+	if pruned, _ := store.PruneConversations(4); pruned != 0 {
+		t.Errorf("second PruneConversations(4) = %d, want 0", pruned)
+	}
+	if pruned, _ := store.PruneConversations(0); pruned != 4 {
+		t.Errorf("PruneConversations(0) = %d, want 4", pruned)
+	}
+	if all, _ := store.GetConversations(true); conversationIDs(all) != "[conv-2]" {
+		t.Errorf("conversations after PruneConversations(0) = %s, want [conv-2]", conversationIDs(all))
+	}
+}
+
+func conversationIDs(conversations []*Conversation) string {
+	ids := make([]string, len(conversations))
+	for i, c := range conversations {
+		ids[i] = c.ID
+	}
+	return fmt.Sprint(ids)
+}
+
+// ═══════════════════════════════════════
+// 17. Export
+// ═══════════════════════════════════════
+
+func TestExportConversation(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	const count = 3000
+	tx, _ := store.db.Begin()
+	for i := 0; i < count; i++ {
+		content, _ := store.cipher.sealString(fmt.Sprintf("message %d", i))
+		// Inserted newest first so the export has to reorder
+		tx.Exec(`INSERT INTO messages (id, conversation_id, sender_id, content, timestamp, status)
+			VALUES (?, 'conv-1', 'alice', ?, ?, 'sent')`,
+			fmt.Sprintf("m%d", i), content, count-i)
+	}
+	tx.Commit()
+	store.StoreMessage(message.NewMessage("other", "conv-2", "bob", "elsewhere", 1))
+
+	var buf bytes.Buffer
+	if err := store.ExportConversation("conv-1", &buf); err != nil {
+		t.Fatalf("ExportConversation() error: %v", err)
+	}
+
+	var exported []*message.Message
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatalf("exported JSON doesn't parse: %v", err)
+	}
+	if len(exported) != count {
+		t.Fatalf("exported %d messages, want %d", len(exported), count)
+	}
+	for i, msg := range exported {
+		if msg.Timestamp != int64(i+1) {
+			t.Fatalf("message %d timestamp = %d, want %d (oldest first)", i, msg.Timestamp, i+1)
+		}
+	}
+	if exported[0].Content != fmt.Sprintf("message %d", count-1) {
+		t.Errorf("first content = %q, want decrypted content", exported[0].Content)
+	}
+}
+
+func TestExportEmptyConversation(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	var buf bytes.Buffer
+	if err := store.ExportConversation("none", &buf); err != nil {
+		t.Fatalf("ExportConversation() error: %v", err)
+	}
+
+	var exported []*message.Message
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil || len(exported) != 0 {
+		t.Errorf("empty export = %q, want an empty array", buf.String())
+	}
+}
+
+// ═══════════════════════════════════════
+// 18. Expiry & Clock
+// ═══════════════════════════════════════
+
+func TestPurgeExpired(t *testing.T) {
+	fake := clock.NewFake(time.Unix(100000, 0))
+	store, err := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true, Clock: fake})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	now := fake.Now().Unix()
+	soon := message.NewMessage("soon", "conv-1", "alice", "gone in a minute", now)
+	soon.ExpiresAt = now + 60
+	later := message.NewMessage("later", "conv-1", "alice", "gone in an hour", now)
+	later.ExpiresAt = now + 3600
+	store.StoreMessage(soon)
+	store.StoreMessage(later)
+	store.StoreMessage(message.NewMessage("forever", "conv-1", "alice", "kept", now))
+	store.EditMessage("soon", "edited", now+1)
+
+	if purged, _ := store.PurgeExpired(); purged != 0 {
+		t.Errorf("PurgeExpired() before expiry = %d, want 0", purged)
+	}
+
+	fake.Advance(time.Minute)
+	purged, err := store.PurgeExpired()
+	if err != nil {
+		t.Fatalf("PurgeExpired() error: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("PurgeExpired() after a minute = %d, want 1", purged)
+	}
+	if msg, _ := store.GetMessage("soon"); msg != nil {
+		t.Error("expired message should be purged")
+	}
+	if edits, _ := store.GetEditHistory("soon"); len(edits) != 0 {
+		t.Error("expired message's edit history should be purged")
+	}
+
+	fake.Advance(time.Hour)
+	store.PurgeExpired()
+	msgs, _ := store.GetMessages("conv-1", 10, 0)
+	if len(msgs) != 1 || msgs[0].ID != "forever" {
+		t.Errorf("remaining messages = %d, want only the one without expiry", len(msgs))
+	}
+}
+
+func TestExpiresAtRoundTrip(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	msg := message.NewMessage("m1", "conv-1", "alice", "hi", 1000)
+	msg.ExpiresAt = 5000
+	store.StoreMessage(msg)
+
+	if got, _ := store.GetMessage("m1"); got.ExpiresAt != 5000 {
+		t.Errorf("ExpiresAt = %d, want 5000", got.ExpiresAt)
+	}
+}
+
+func TestStorageUsesClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(123456, 0))
+	store, _ := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true, Clock: fake})
+	defer store.Close()
+
+	store.SetConversationFlags("conv-1", ConversationFlags{Muted: true})
+	if flags, _ := store.GetConversationFlags("conv-1"); flags.UpdatedAt != 123456 {
+		t.Errorf("UpdatedAt = %d, want the fake clock's time", flags.UpdatedAt)
+	}
+}
+
+// waitForMessageGone polls until id is no longer stored or a second passes
+func waitForMessageGone(store *Storage, id string) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if msg, _ := store.GetMessage(id); msg == nil {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestExpirySweeperPurgesAndStops(t *testing.T) {
+	fake := clock.NewFake(time.Unix(100000, 0))
+	store, err := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true, Clock: fake})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	now := fake.Now().Unix()
+	expiring := message.NewMessage("soon", "conv-1", "alice", "gone in a minute", now)
+	expiring.ExpiresAt = now + 60
+	store.StoreMessage(expiring)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := store.StartExpirySweeper(ctx, time.Second); err != nil {
+		t.Fatalf("StartExpirySweeper() error: %v", err)
+	}
+
+	fake.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if msg, _ := store.GetMessage("soon"); msg == nil {
+		t.Fatal("message should survive sweeps before it expires")
+	}
+
+	fake.Advance(time.Minute)
+	if !waitForMessageGone(store, "soon") {
+		t.Fatal("sweeper should purge the message once it expires")
+	}
+
+	cancel()
+	store.sweepers.wg.Wait()
+
+	// Nothing purges after the sweeper has stopped
+	late := message.NewMessage("late", "conv-1", "alice", "already expired", now)
+	late.ExpiresAt = now
+	store.StoreMessage(late)
+	fake.Advance(time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if msg, _ := store.GetMessage("late"); msg == nil {
+		t.Error("sweeper should stop when its context is cancelled")
+	}
+}
+
+func TestExpirySweeperFollowsClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(100000, 0))
+	store, err := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true, Clock: fake})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	expired := message.NewMessage("expired", "conv-1", "alice", "already expired", fake.Now().Unix())
+	expired.ExpiresAt = fake.Now().Unix()
+	store.StoreMessage(expired)
+	store.StartExpirySweeper(context.Background(), time.Millisecond)
+
+	// Real time passing doesn't tick a sweeper on a fake clock
+	time.Sleep(10 * time.Millisecond)
+	if msg, _ := store.GetMessage("expired"); msg == nil {
+		t.Fatal("sweeper should only run when the storage clock moves")
+	}
+
+	fake.Advance(time.Millisecond)
+	if !waitForMessageGone(store, "expired") {
+		t.Error("sweeper should run once the storage clock passes the interval")
+	}
+}
+
+func TestExpirySweeperStopsOnClose(t *testing.T) {
+	store, err := NewWithOptions(Options{EncryptionKey: "test_key", InMemory: true})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := store.StartExpirySweeper(context.Background(), interval); err != ErrInvalidInterval {
+			t.Errorf("StartExpirySweeper(%v) error = %v, want ErrInvalidInterval", interval, err)
+		}
+	}
+
+	store.StartExpirySweeper(context.Background(), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	// Close waits for the sweeper, so this would hang if it ignored Close
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	store.Close() // A second Close must not panic
+
+	if err := store.StartExpirySweeper(context.Background(), time.Millisecond); err != ErrStorageClosed {
+		t.Errorf("StartExpirySweeper() after Close error = %v, want ErrStorageClosed", err)
+	}
+}
+
+// ═══════════════════════════════════════
+// 19. Passphrase Keys
+// ═══════════════════════════════════════
+
+func TestDeriveKey(t *testing.T) {
+	salt := bytes.Repeat([]byte{1}, SaltSize)
+	otherSalt := bytes.Repeat([]byte{2}, SaltSize)
+
+	key := DeriveKey("correct horse", salt)
+	if len(key) != DerivedKeySize {
+		t.Fatalf("len(DeriveKey()) = %d, want %d", len(key), DerivedKeySize)
+	}
+	if !bytes.Equal(key, DeriveKey("correct horse", salt)) {
+		t.Error("same passphrase and salt should derive the same key")
+	}
+	if bytes.Equal(key, DeriveKey("correct horse", otherSalt)) {
+		t.Error("different salts should derive different keys")
+	}
+	if bytes.Equal(key, DeriveKey("battery staple", salt)) {
+		t.Error("different passphrases should derive different keys")
+	}
+}
+
+func TestPassphraseStorage(t *testing.T) {
+	dbPath := "test_storage_" + t.Name() + ".db"
+	os.Remove(dbPath)
+	os.Remove(saltPath(dbPath))
+	defer os.Remove(saltPath(dbPath))
+
+	store, err := NewWithOptions(Options{Path: dbPath, Passphrase: "correct horse"})
+	if err != nil {
+		t.Fatalf("NewWithOptions(Passphrase) error: %v", err)
+	}
+	store.StoreMessage(message.NewMessage("m1", "conv-1", "alice", "secret", 1000))
+	store.Close()
+
+	salt, err := os.ReadFile(saltPath(dbPath))
+	if err != nil || len(salt) != SaltSize {
+		t.Fatalf("salt file = %d bytes, %v, want %d bytes", len(salt), err, SaltSize)
+	}
+
+	// The same passphrase reopens the database
+	store, err = NewWithOptions(Options{Path: dbPath, Passphrase: "correct horse"})
+	if err != nil {
+		t.Fatalf("reopen with passphrase error: %v", err)
+	}
+	defer cleanup(store, dbPath)
+	if msg, _ := store.GetMessage("m1"); msg == nil || msg.Content != "secret" {
+		t.Error("message should be readable after reopening with the passphrase")
+	}
+
+	if _, err := NewWithOptions(Options{Path: dbPath, Passphrase: "wrong"}); err != ErrWrongKey {
+		t.Errorf("wrong passphrase error = %v, want ErrWrongKey", err)
+	}
+	if _, err := NewWithOptions(Options{Path: dbPath, Passphrase: "correct horse", EncryptionKey: "raw"}); err != ErrKeyAndPassphrase {
+		t.Errorf("key and passphrase error = %v, want ErrKeyAndPassphrase", err)
+	}
+
+	// Losing the salt must not silently derive a new key
+	os.Remove(saltPath(dbPath))
+	if _, err := NewWithOptions(Options{Path: dbPath, Passphrase: "correct horse"}); err != ErrMissingSalt {
+		t.Errorf("missing salt error = %v, want ErrMissingSalt", err)
+	}
+	if _, err := os.Stat(saltPath(dbPath)); !errors.Is(err, os.ErrNotExist) {
+		t.Error("a missing salt should not be regenerated for an existing database")
+	}
+}
+
+// ═══════════════════════════════════════
+// 20. Attachments
+// ═══════════════════════════════════════
+
+// storeTestAttachment stores data as an attachment split into chunkSize
+// chunks, in reverse order, and returns its manifest
+func storeTestAttachment(t *testing.T, store *Storage, id string, data []byte, chunkSize int) *AttachmentManifest {
+	t.Helper()
+
+	var chunks [][]byte
+	for off := 0; off < len(data); off += chunkSize {
+		chunks = append(chunks, data[off:min(off+chunkSize, len(data))])
+	}
+	sum := sha256.Sum256(data)
+	m := &AttachmentManifest{ID: id, TotalSize: int64(len(data)), ChunkCount: len(chunks), SHA256: sum[:]}
+	if err := store.StoreAttachmentManifest(m); err != nil {
+		t.Fatalf("StoreAttachmentManifest() error: %v", err)
+	}
+
+	for i := len(chunks) - 1; i >= 0; i-- {
+		if err := store.StoreAttachmentChunk(id, i, chunks[i]); err != nil {
+			t.Fatalf("StoreAttachmentChunk(%d) error: %v", i, err)
+		}
+	}
+	return m
+}
+
+func TestAttachmentChunksReassemble(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	data = append(data, "tail"...)
+	storeTestAttachment(t, store, "att-1", data, 4096)
+
+	m, err := store.GetAttachmentManifest("att-1")
+	if err != nil {
+		t.Fatalf("GetAttachmentManifest() error: %v", err)
+	}
+	if m.TotalSize != int64(len(data)) || m.ChunkCount != 4 {
+		t.Errorf("manifest = %d bytes in %d chunks, want %d in 4", m.TotalSize, m.ChunkCount, len(data))
+	}
+
+	var reassembled []byte
+	for i := 0; i < m.ChunkCount; i++ {
+		chunk, err := store.GetAttachmentChunk("att-1", i)
+		if err != nil {
+			t.Fatalf("GetAttachmentChunk(%d) error: %v", i, err)
+		}
+		reassembled = append(reassembled, chunk...)
+	}
+
+	if sum := sha256.Sum256(reassembled); !bytes.Equal(sum[:], m.SHA256) {
+		t.Error("reassembled attachment hash doesn't match the manifest")
+	}
+	if int64(len(reassembled)) != m.TotalSize {
+		t.Errorf("reassembled size = %d, want %d", len(reassembled), m.TotalSize)
+	}
+}
+
+func TestAttachmentMissingChunks(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	sum := sha256.Sum256(nil)
+	store.StoreAttachmentManifest(&AttachmentManifest{ID: "att-2", TotalSize: 40, ChunkCount: 4, SHA256: sum[:]})
+	store.StoreAttachmentChunk("att-2", 0, []byte("chunk 0"))
+	store.StoreAttachmentChunk("att-2", 2, []byte("chunk 2"))
+
+	missing, err := store.MissingAttachmentChunks("att-2")
+	if err != nil {
+		t.Fatalf("MissingAttachmentChunks() error: %v", err)
+	}
+	if fmt.Sprint(missing) != "[1 3]" {
+		t.Errorf("MissingAttachmentChunks() = %v, want [1 3]", missing)
+	}
+
+	if _, err := store.GetAttachmentChunk("att-2", 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetAttachmentChunk(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAttachmentManifestShrinkDropsChunks(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	sum := sha256.Sum256(nil)
+	store.StoreAttachmentManifest(&AttachmentManifest{ID: "att-5", TotalSize: 40, ChunkCount: 4, SHA256: sum[:]})
+	for i := 0; i < 4; i++ {
+		store.StoreAttachmentChunk("att-5", i, []byte(fmt.Sprintf("chunk %d", i)))
+	}
+
+	store.StoreAttachmentManifest(&AttachmentManifest{ID: "att-5", TotalSize: 20, ChunkCount: 2, SHA256: sum[:]})
+
+	var count int
+	store.db.QueryRow(`SELECT COUNT(*) FROM attachment_chunks WHERE attachment_id = ?`, "att-5").Scan(&count)
+	if count != 2 {
+		t.Errorf("%d chunks left after shrinking the manifest, want 2", count)
+	}
+	if data, err := store.GetAttachmentChunk("att-5", 1); err != nil || string(data) != "chunk 1" {
+		t.Errorf("GetAttachmentChunk(1) = %q, %v; want the kept chunk", data, err)
+	}
+	if _, err := store.GetAttachmentChunk("att-5", 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetAttachmentChunk(2) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAttachmentChunkValidation(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	if err := store.StoreAttachmentChunk("unknown", 0, []byte("x")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("StoreAttachmentChunk() without manifest error = %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetAttachmentManifest("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetAttachmentManifest(unknown) error = %v, want ErrNotFound", err)
+	}
+	if err := store.StoreAttachmentManifest(&AttachmentManifest{ID: "bad", ChunkCount: 1}); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("StoreAttachmentManifest() without hash error = %v, want ErrInvalidManifest", err)
+	}
+
+	sum := sha256.Sum256(nil)
+	store.StoreAttachmentManifest(&AttachmentManifest{ID: "att-3", TotalSize: 10, ChunkCount: 2, SHA256: sum[:]})
+	for _, index := range []int{-1, 2} {
+		if err := store.StoreAttachmentChunk("att-3", index, []byte("x")); !errors.Is(err, ErrInvalidChunk) {
+			t.Errorf("StoreAttachmentChunk(index %d) error = %v, want ErrInvalidChunk", index, err)
+		}
+	}
+}
+
+func TestAttachmentChunksEncryptedAtRest(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	storeTestAttachment(t, store, "att-4", []byte("holiday photo bytes"), 8)
+
+	var sealed []byte
+	store.db.QueryRow(`SELECT data FROM attachment_chunks WHERE attachment_id = ? AND chunk_index = 0`, "att-4").Scan(&sealed)
+	if bytes.Contains(sealed, []byte("holiday")) {
+		t.Error("attachment chunk is stored in plaintext")
+	}
+
+	// Rekeying re-seals chunks with the same binding
+	if err := store.Rekey("new_key"); err != nil {
+		t.Fatalf("Rekey() error: %v", err)
+	}
+	chunk, err := store.GetAttachmentChunk("att-4", 0)
+	if err != nil || string(chunk) != "holiday " {
+		t.Errorf("GetAttachmentChunk() after Rekey = %q, %v; want %q", chunk, err, "holiday ")
+	}
+
+	// Chunks are bound to their position
+	store.db.QueryRow(`SELECT data FROM attachment_chunks WHERE attachment_id = ? AND chunk_index = 0`, "att-4").Scan(&sealed)
+	store.db.Exec(`UPDATE attachment_chunks SET data = ? WHERE attachment_id = ? AND chunk_index = 1`, sealed, "att-4")
+	if _, err := store.GetAttachmentChunk("att-4", 1); err == nil {
+		t.Error("a chunk moved to another index should not open")
+	}
+}
+
+// ═══════════════════════════════════════
+// 21. Audit Logging
+// ═══════════════════════════════════════
+
+// captureLogger is an audit.Logger that records every event
+type captureLogger struct {
+	mu     gosync.Mutex
+	events []string
+	fields []map[string]any
+}
+
+func (l *captureLogger) Log(event string, fields map[string]any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	l.fields = append(l.fields, fields)
+}
+
+func TestAuditKeyImportAndVerification(t *testing.T) {
+	logger := &captureLogger{}
+	store, err := NewWithOptions(Options{InMemory: true, EncryptionKey: "test_key", AuditLogger: logger})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	bundle := newTestBundle(t)
+	store.StoreContact(&contact.Contact{ID: "bob", DisplayName: "Bob"})
+	if len(logger.events) != 0 {
+		t.Errorf("storing a contact without keys logged %v", logger.events)
+	}
+
+	// Pinning the first key is a key import; re-storing it is not
+	store.StoreContact(&contact.Contact{ID: "bob", DisplayName: "Bob", PublicKeys: bundle, PinnedIdentityKey: bundle.IdentityPublicKey})
+	store.StoreContact(&contact.Contact{ID: "bob", DisplayName: "Bobby", PublicKeys: bundle, PinnedIdentityKey: bundle.IdentityPublicKey})
+	store.SetContactVerified("bob", true)
+
+	want := []string{audit.EventKeyImport, audit.EventContactVerify}
+	if fmt.Sprint(logger.events) != fmt.Sprint(want) {
+		t.Fatalf("audit events = %v, want %v", logger.events, want)
+	}
+	if logger.fields[1]["verified"] != true {
+		t.Errorf("contact.verify fields = %v, want verified true", logger.fields[1])
+	}
+
+	// No plaintext IDs or key material
+	for i, fields := range logger.fields {
+		for k, v := range fields {
+			if s, ok := v.(string); ok && (s == "bob" || bytes.Contains([]byte(s), bundle.IdentityPublicKey)) {
+				t.Errorf("%s field %s = %q leaks plaintext", logger.events[i], k, s)
+			}
+		}
+		if fields["contact"] != audit.Redact("bob") {
+			t.Errorf("%s contact = %v, want the redacted ID", logger.events[i], fields["contact"])
+		}
+	}
+}
+
+func TestAuditKeyImportConcurrent(t *testing.T) {
+	logger := &captureLogger{}
+	store, err := NewWithOptions(Options{InMemory: true, EncryptionKey: "test_key", AuditLogger: logger})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	// Concurrent stores of the same new key pin it once
+	bundle := newTestBundle(t)
+	var wg gosync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.StoreContact(&contact.Contact{ID: "bob", DisplayName: "Bob", PublicKeys: bundle, PinnedIdentityKey: bundle.IdentityPublicKey}); err != nil {
+				t.Errorf("StoreContact() error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fmt.Sprint(logger.events) != fmt.Sprint([]string{audit.EventKeyImport}) {
+		t.Errorf("audit events = %v, want one %s", logger.events, audit.EventKeyImport)
+	}
+}
+
+func TestGetAllSessionsSkipsUnreadable(t *testing.T) {
+	logger := &captureLogger{}
+	store, err := NewWithOptions(Options{InMemory: true, EncryptionKey: "test_key", AuditLogger: logger})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	store.StoreSession("alice", []byte{1})
+	store.StoreSession("bob", []byte{2})
+	store.StoreSession("carol", []byte{3})
+	if _, err := store.db.Exec(`UPDATE sessions SET session_data = ? WHERE recipient_id = ?`, []byte("damaged"), "bob"); err != nil {
+		t.Fatalf("corrupting session: %v", err)
+	}
+
+	got, err := store.GetAllSessions()
+	if err != nil {
+		t.Fatalf("GetAllSessions() error: %v", err)
+	}
+	if len(got) != 2 || !bytes.Equal(got["alice"], []byte{1}) || !bytes.Equal(got["carol"], []byte{3}) {
+		t.Errorf("GetAllSessions() = %v, want alice and carol only", got)
+	}
+
+	if fmt.Sprint(logger.events) != fmt.Sprint([]string{audit.EventSessionUnreadable}) {
+		t.Fatalf("audit events = %v, want [%s]", logger.events, audit.EventSessionUnreadable)
+	}
+	if logger.fields[0]["contact"] != audit.Redact("bob") {
+		t.Errorf("session.unreadable contact = %v, want the redacted ID", logger.fields[0]["contact"])
+	}
+}
+
+func TestAuditRekey(t *testing.T) {
+	logger := &captureLogger{}
+	store, err := NewWithOptions(Options{InMemory: true, EncryptionKey: "test_key", AuditLogger: logger})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error: %v", err)
+	}
+	defer store.Close()
+
+	store.Rekey("new_key")
+	if fmt.Sprint(logger.events) != fmt.Sprint([]string{audit.EventRekey}) {
+		t.Errorf("audit events = %v, want [%s]", logger.events, audit.EventRekey)
+	}
+}
+
+// ═══════════════════════════════════════
+// 22. Hash Chain
+// ═══════════════════════════════════════
+
+// storeChain stores m1, m2 and m3 in conv-1 in order
+func storeChain(t *testing.T, store *Storage) {
+	t.Helper()
+	for i, id := range []string{"m1", "m2", "m3"} {
+		if err := store.StoreMessage(message.NewMessage(id, "conv-1", "alice", "message "+id, int64(1000+i))); err != nil {
+			t.Fatalf("StoreMessage(%s) error: %v", id, err)
+		}
+	}
+}
+
+func TestHashChainIntact(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+	storeChain(t, store)
+	store.StoreMessage(message.NewMessage("other", "conv-2", "bob", "elsewhere", 1000))
+
+	m1, _ := store.GetMessage("m1")
+	m2, _ := store.GetMessage("m2")
+	if m1.PrevHash != "" || m1.Hash == "" {
+		t.Errorf("first message PrevHash = %q, Hash = %q; want empty and set", m1.PrevHash, m1.Hash)
+	}
+	if m2.PrevHash != m1.Hash || m2.Hash != m2.ComputeHash() {
+		t.Error("second message should link to the first")
+	}
+
+	// Status updates, edits and tombstones are legitimate changes
+	m2.Status = message.StatusRead
+	store.StoreMessage(m2)
+	store.EditMessage("m1", "edited", 2000)
+	store.TombstoneMessage("m3")
+
+	ok, brokenAt, err := store.VerifyChain("conv-1")
+	if err != nil {
+		t.Fatalf("VerifyChain() error: %v", err)
+	}
+	if !ok || brokenAt != "" {
+		t.Errorf("VerifyChain() = %v, %q; want an intact chain", ok, brokenAt)
+	}
+}
+
+func TestHashChainDetectsTampering(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+	storeChain(t, store)
+
+	// Rewrite the middle message's content behind the chain's back
+	sealed, _ := store.cipher.sealString("forged")
+	store.db.Exec(`UPDATE messages SET content = ? WHERE id = 'm2'`, sealed)
+
+	ok, brokenAt, err := store.VerifyChain("conv-1")
+	if err != nil {
+		t.Fatalf("VerifyChain() error: %v", err)
+	}
+	if ok || brokenAt != "m2" {
+		t.Errorf("VerifyChain() after tampering = %v, %q; want false, m2", ok, brokenAt)
+	}
+}
+
+func TestHashChainDetectsDeletion(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+	storeChain(t, store)
+
+	store.db.Exec(`DELETE FROM messages WHERE id = 'm2'`)
+
+	if ok, brokenAt, _ := store.VerifyChain("conv-1"); ok || brokenAt != "m3" {
+		t.Errorf("VerifyChain() after deletion = %v, %q; want false, m3", ok, brokenAt)
+	}
+}
+
+func TestHashChainRestoreKeepsHash(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+	storeChain(t, store)
+
+	m2, _ := store.GetMessage("m2")
+	original := m2.Hash
+	m2.Content = "rewritten"
+	if err := store.StoreMessage(m2); err != nil {
+		t.Fatalf("StoreMessage() error: %v", err)
+	}
+	if m2.Hash != original {
+		t.Errorf("re-stored message Hash = %q, want the original %q", m2.Hash, original)
+	}
+
+	// The successor still links to m2, so only the rewrite is reported
+	m3, _ := store.GetMessage("m3")
+	if m3.PrevHash != original {
+		t.Error("successor should still link to the re-stored message")
+	}
+	if ok, brokenAt, _ := store.VerifyChain("conv-1"); ok || brokenAt != "m2" {
+		t.Errorf("VerifyChain() after rewrite = %v, %q; want false, m2", ok, brokenAt)
+	}
+}
+
+func TestMessageSequence(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+	storeChain(t, store)
+
+	other := message.NewMessage("other", "conv-2", "bob", "elsewhere", 1000)
+	store.StoreMessage(other)
+	if other.Seq != 1 {
+		t.Errorf("first message in conv-2 Seq = %d, want 1", other.Seq)
+	}
+	for i, id := range []string{"m1", "m2", "m3"} {
+		if msg, _ := store.GetMessage(id); msg.Seq != int64(i+1) {
+			t.Errorf("%s Seq = %d, want %d", id, msg.Seq, i+1)
+		}
+	}
+
+	// Replacing a message keeps its sequence
+	m2, _ := store.GetMessage("m2")
+	m2.Status = message.StatusRead
+	store.StoreMessage(m2)
+	if m2.Seq != 2 {
+		t.Errorf("replaced message Seq = %d, want 2", m2.Seq)
+	}
+
+	if gaps, err := store.FindGaps("conv-1"); err != nil || len(gaps) != 0 {
+		t.Errorf("FindGaps() = %v, %v; want no gaps", gaps, err)
+	}
+}
+
+func TestFindGaps(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	for i := 1; i <= 6; i++ {
+		msg := message.NewMessage(fmt.Sprintf("m%d", i), "conv-1", "alice", "hi", int64(1000+i))
+		if i == 1 || i == 3 || i == 4 {
+			msg.ExpiresAt = 1
+		}
+		store.StoreMessage(msg)
+	}
+	store.PurgeExpired()
+
+	gaps, err := store.FindGaps("conv-1")
+	if err != nil {
+		t.Fatalf("FindGaps() error: %v", err)
+	}
+	if fmt.Sprint(gaps) != "[1 3 4]" {
+		t.Errorf("FindGaps() = %v, want [1 3 4]", gaps)
+	}
+	if gaps, _ := store.FindGaps("conv-empty"); len(gaps) != 0 {
+		t.Errorf("FindGaps(empty conversation) = %v, want none", gaps)
+	}
+}
+
+// ═══════════════════════════════════════
+// 23. Factory Reset
+// ═══════════════════════════════════════
+
+func TestWipeAll(t *testing.T) {
+	store, dbPath := newTestStorage(t)
+	defer cleanup(store, dbPath)
+
+	store.StoreMessage(message.NewMessage("m1", "conv-1", "alice", "hello", 1000))
+	store.EditMessage("m1", "hello again", 2000)
+	store.SetConversationFlags("conv-1", ConversationFlags{Pinned: true})
+	store.StoreSession("bob", []byte("session"))
+	store.StoreQueuedMessages([]*sync.QueuedMessage{sync.NewQueuedMessage("q1", "bob", []byte{1})})
+	store.StoreContact(&contact.Contact{ID: "bob", DisplayName: "Bob"})
+	store.db.Exec(`INSERT INTO keys (key_type, key_data) VALUES ('identity', x'01')`)
+	data := []byte("chunk")
+	sum := sha256.Sum256(data)
+	store.StoreAttachmentManifest(&AttachmentManifest{ID: "a1", TotalSize: 5, ChunkCount: 1, SHA256: sum[:]})
+	store.StoreAttachmentChunk("a1", 0, data)
+
+	rows, err := store.db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT IN ('storage_meta', 'sqlite_sequence')`)
+	if err != nil {
+		t.Fatalf("listing tables error: %v", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	countRows := func(table string) int {
+		var n int
+		store.db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n)
+		return n
+	}
+	for _, table := range tables {
+		if countRows(table) == 0 {
+			t.Fatalf("table %s should be populated before the wipe", table)
+		}
+	}
+
+	if err := store.WipeAll(""); err != ErrEmptyKey {
+		t.Errorf("WipeAll(\"\") error = %v, want ErrEmptyKey", err)
+	}
+	if err := store.WipeAll("fresh_key"); err != nil {
+		t.Fatalf("WipeAll() error: %v", err)
+	}
+	if info, err := os.Stat(dbPath + "-wal"); err == nil && info.Size() != 0 {
+		t.Errorf("WAL is %d bytes after WipeAll, want truncated", info.Size())
+	}
+	var meta int
+	store.db.QueryRow(`SELECT COUNT(*) FROM storage_meta WHERE name != ?`, keyCheckName).Scan(&meta)
+	if meta != 0 {
+		t.Errorf("storage_meta has %d rows besides the key check after WipeAll, want 0", meta)
+	}
+
+	for _, table := range tables {
+		if n := countRows(table); n != 0 {
+			t.Errorf("table %s has %d rows after WipeAll, want 0", table, n)
+		}
+	}
+	if convs, _ := store.GetConversations(true); len(convs) != 0 {
+		t.Errorf("GetConversations() after WipeAll = %d, want 0", len(convs))
+	}
+
+	// The database stays usable, but only with the new key
+	if err := store.StoreMessage(message.NewMessage("m2", "conv-1", "alice", "fresh start", 3000)); err != nil {
+		t.Errorf("StoreMessage() after WipeAll error: %v", err)
+	}
+	store.Close()
+	if old, err := New(dbPath, "test_key"); err != ErrWrongKey {
+		if old != nil {
+			old.Close()
+		}
+		t.Errorf("reopening with the old key error = %v, want ErrWrongKey", err)
+	}
+	reopened, err := New(dbPath, "fresh_key")
+	if err != nil {
+		t.Fatalf("reopening after WipeAll error: %v", err)
+	}
+	if msg, err := reopened.GetMessage("m2"); err != nil || msg.Content != "fresh start" {
+		t.Errorf("GetMessage() after reopening = %v, %v", msg, err)
 	}
+	reopened.Close()
 }
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrEmptyKey is returned by WipeAll without a new key
+var ErrEmptyKey = errors.New("empty encryption key")
+
+// wipeTables lists every table holding user data, children before
+// parents. storage_meta is cleared separately, then holds only the new
+// key check.
+var wipeTables = []string{
+	"message_edits",
+	"messages",
+	"conversations",
+	"attachment_chunks",
+	"attachments",
+	"sessions",
+	"queue",
+	"keys",
+	"contacts",
+}
+
+// WipeAll deletes every message, session, queued message, key, contact,
+// conversation and attachment, and switches the database to newKey, in
+// one transaction. It then checkpoints the WAL and vacuums, so the deleted
+// data lingers in neither the -wal file nor free pages, and anything that
+// survives elsewhere was sealed with a key the database no longer uses.
+// It is a factory reset: the database stays open and usable, but from now
+// on only opens with newKey. It must not run concurrently with other
+// operations on s.
+func (s *Storage) WipeAll(newKey string) error {
+	if newKey == "" {
+		return ErrEmptyKey
+	}
+	next, err := newFieldCipher(newKey)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range append(wipeTables, "storage_meta") {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
+	}
+	if err := writeKeyCheck(tx, next); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.cipher = next
+
+	// VACUUM rewrites the database through the WAL, so checkpoint after
+	// it as well as before
+	if err := s.checkpointWAL(); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`VACUUM`); err != nil {
+		return err
+	}
+	return s.checkpointWAL()
+}
+
+// checkpointWAL copies the WAL into the database and truncates it to zero
+// bytes. It is a no-op without WAL.
+func (s *Storage) checkpointWAL() error {
+	var busy, logFrames, checkpointed int
+	if err := s.db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("wal checkpoint blocked: %d of %d frames checkpointed", checkpointed, logFrames)
+	}
+	return nil
+}
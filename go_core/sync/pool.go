@@ -0,0 +1,35 @@
+package sync
+
+import "sync"
+
+// queuedMessagePool recycles QueuedMessages between
+// AcquireQueuedMessage and ReleaseQueuedMessage
+var queuedMessagePool = sync.Pool{
+	New: func() any { return new(QueuedMessage) },
+}
+
+// AcquireQueuedMessage is NewQueuedMessage backed by a pool, for senders
+// that enqueue at a high rate. The caller owns the message until it is
+// enqueued; the queue owns it from then until it is removed by Ack,
+// Clear, Dequeue or DrainAll. Once removed and no longer referenced,
+// e.g. by a slice from GetAll or GetReady, it may be handed back with
+// ReleaseQueuedMessage. Messages that are never released are simply
+// garbage collected.
+func AcquireQueuedMessage(id, recipientID string, encryptedContent []byte) *QueuedMessage {
+	msg := queuedMessagePool.Get().(*QueuedMessage)
+	msg.ID = id
+	msg.RecipientID = recipientID
+	msg.EncryptedContent = encryptedContent
+	return msg
+}
+
+// ReleaseQueuedMessage returns a message from AcquireQueuedMessage to the
+// pool, typically after a successful Ack. It clears every field, so the
+// message must not be used, or still be queued, afterwards.
+func ReleaseQueuedMessage(msg *QueuedMessage) {
+	if msg == nil {
+		return
+	}
+	*msg = QueuedMessage{}
+	queuedMessagePool.Put(msg)
+}
@@ -3,8 +3,11 @@
 package sync
 
 import (
+	"sort"
 	"sync"
 	"time"
+
+	"merabriar_core/clock"
 )
 
 // QueuedMessage represents a message waiting to be sent
@@ -14,39 +17,144 @@ type QueuedMessage struct {
 	EncryptedContent []byte `json:"encrypted_content"`
 	CreatedAt        int64  `json:"created_at"`
 	Attempts         int    `json:"attempts"`
+	NextAttemptAt    int64  `json:"next_attempt_at,omitempty"` // Unix seconds; zero means ready now
+	InFlight         bool   `json:"in_flight,omitempty"`       // Checked out, awaiting Ack or Nack
+
+	position int64 // Order the message was added to its queue in; see GetPageAfter
 }
 
-// NewQueuedMessage creates a new queued message
+// Retry backoff bounds: the delay doubles with each failed attempt
+const (
+	RetryBackoffBase = time.Second
+	RetryBackoffMax  = 5 * time.Minute
+)
+
+// RetryBackoff returns the delay before retrying a message that has
+// failed attempts times
+func RetryBackoff(attempts int) time.Duration {
+	if attempts <= 0 {
+		return 0
+	}
+	delay := RetryBackoffBase
+	for i := 1; i < attempts && delay < RetryBackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, RetryBackoffMax)
+}
+
+// NewQueuedMessage creates a new queued message. Its CreatedAt is left
+// zero for Enqueue to stamp from the queue's clock.
 func NewQueuedMessage(id, recipientID string, encryptedContent []byte) *QueuedMessage {
 	return &QueuedMessage{
 		ID:               id,
 		RecipientID:      recipientID,
 		EncryptedContent: encryptedContent,
-		CreatedAt:        time.Now().Unix(),
 		Attempts:         0,
 	}
 }
 
+// compactMinDequeues is how many leading dequeues accumulate before
+// Dequeue considers moving the remaining messages to a new array
+const compactMinDequeues = 64
+
 // MessageQueue manages offline messages
 type MessageQueue struct {
 	messages []*QueuedMessage
+	dequeued int   // Slots before messages in its backing array
+	position int64 // Last position given to an added message
+	clock    clock.Clock
 	mu       sync.RWMutex
 }
 
 // NewMessageQueue creates a new message queue
 func NewMessageQueue() *MessageQueue {
+	return NewMessageQueueWithClock(clock.System)
+}
+
+// NewMessageQueueWithClock creates a message queue that reads the time,
+// for retry scheduling and stats, from c
+func NewMessageQueueWithClock(c clock.Clock) *MessageQueue {
 	return &MessageQueue{
 		messages: make([]*QueuedMessage, 0),
+		clock:    c,
 	}
 }
 
-// Enqueue adds a message to the queue
+// Enqueue adds a message to the queue, stamping a zero CreatedAt with
+// the queue's clock
 func (q *MessageQueue) Enqueue(msg *QueuedMessage) {
+	if msg.CreatedAt == 0 {
+		msg.CreatedAt = q.clock.Now().Unix()
+	}
+
 	q.mu.Lock()
 	defer q.mu.Unlock()
+	q.position++
+	msg.position = q.position
 	q.messages = append(q.messages, msg)
 }
 
+// BroadcastEntryID returns the ID of recipientID's entry in the broadcast
+// queued by EnqueueBroadcast with id
+func BroadcastEntryID(id, recipientID string) string {
+	return id + "/" + recipientID
+}
+
+// EnqueueBroadcast queues content once for each of recipientIDs. The
+// entries share a single copy of content rather than one copy each, and
+// each has its own ID, BroadcastEntryID(id, recipientID), so it is sent,
+// acked and cleared independently of the others. Repeated recipients are
+// queued once.
+func (q *MessageQueue) EnqueueBroadcast(id string, recipientIDs []string, content []byte) {
+	now := q.clock.Now().Unix()
+	entries := make([]*QueuedMessage, 0, len(recipientIDs))
+	seen := make(map[string]bool, len(recipientIDs))
+	for _, rid := range recipientIDs {
+		if seen[rid] {
+			continue
+		}
+		seen[rid] = true
+		entries = append(entries, &QueuedMessage{
+			ID:               BroadcastEntryID(id, rid),
+			RecipientID:      rid,
+			EncryptedContent: content,
+			CreatedAt:        now,
+		})
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range entries {
+		q.position++
+		entry.position = q.position
+	}
+	q.messages = append(q.messages, entries...)
+}
+
+// Restore puts msgs back at the head of the queue, in order and ahead of
+// anything enqueued since, e.g. when reloading messages persisted by a
+// previous shutdown or returning drained messages that couldn't be saved
+func (q *MessageQueue) Restore(msgs []*QueuedMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Drained messages keep their positions; reloaded ones are new here
+	for _, msg := range msgs {
+		if msg.position == 0 {
+			q.position++
+			msg.position = q.position
+		}
+	}
+	restored := make([]*QueuedMessage, 0, len(msgs)+len(q.messages))
+	restored = append(restored, msgs...)
+	q.messages = append(restored, q.messages...)
+	q.dequeued = 0
+}
+
 // Dequeue removes and returns the first message
 func (q *MessageQueue) Dequeue() *QueuedMessage {
 	q.mu.Lock()
@@ -57,10 +165,27 @@ func (q *MessageQueue) Dequeue() *QueuedMessage {
 	}
 
 	msg := q.messages[0]
+	q.messages[0] = nil
 	q.messages = q.messages[1:]
+	q.dequeued++
+
+	// Once most of the backing array is dequeued slots, copy the live
+	// messages out so the old array can be reclaimed
+	if q.dequeued >= compactMinDequeues && q.dequeued >= len(q.messages) {
+		q.messages = append(make([]*QueuedMessage, 0, len(q.messages)), q.messages...)
+		q.dequeued = 0
+	}
 	return msg
 }
 
+// backingCap returns the size of the array backing the queue, including
+// dequeued slots that haven't been reclaimed
+func (q *MessageQueue) backingCap() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.dequeued + cap(q.messages)
+}
+
 // Peek returns the first message without removing it
 func (q *MessageQueue) Peek() *QueuedMessage {
 	q.mu.RLock()
@@ -83,16 +208,110 @@ func (q *MessageQueue) GetAll() []*QueuedMessage {
 	return result
 }
 
-// GetForRecipient returns messages for a specific recipient
+// GetPage returns up to limit queued messages, skipping the first
+// offset, in enqueue order. A negative limit means no limit.
+func (q *MessageQueue) GetPage(limit, offset int) []*QueuedMessage {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(q.messages) {
+		return nil
+	}
+	end := len(q.messages)
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	if end == offset {
+		return nil
+	}
+	result := make([]*QueuedMessage, end-offset)
+	copy(result, q.messages[offset:end])
+	return result
+}
+
+// GetPageAfter returns up to limit queued messages added after position
+// after, in the order they were added, and the position of the last one
+// returned (after itself if none are). Pass 0 to start from the first.
+// Unlike offsets, positions don't shift as messages are acked, dequeued
+// or cleared, so paging with them neither skips nor repeats a message.
+// A negative limit means no limit.
+func (q *MessageQueue) GetPageAfter(after int64, limit int) (msgs []*QueuedMessage, last int64) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	for _, msg := range q.messages {
+		if msg.position > after {
+			msgs = append(msgs, msg)
+		}
+	}
+	// Restored messages sit at the head but may have been added later
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].position < msgs[j].position })
+	if limit >= 0 && len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+
+	last = after
+	if len(msgs) > 0 {
+		last = msgs[len(msgs)-1].position
+	}
+	return msgs, last
+}
+
+// DrainAll atomically removes and returns every queued message.
+// Messages enqueued concurrently either appear in the result or remain
+// queued afterwards; none are lost.
+func (q *MessageQueue) DrainAll() []*QueuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	drained := q.messages
+	q.messages = make([]*QueuedMessage, 0)
+	q.dequeued = 0
+	return drained
+}
+
+// Get returns a copy of the message with the given ID
+func (q *MessageQueue) Get(id string) (*QueuedMessage, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	for _, msg := range q.messages {
+		if msg.ID == id {
+			copied := *msg
+			return &copied, true
+		}
+	}
+	return nil, false
+}
+
+// GetForRecipient returns messages for a specific recipient, in enqueue order
 func (q *MessageQueue) GetForRecipient(recipientID string) []*QueuedMessage {
+	return q.GetForRecipientPaged(recipientID, -1, 0)
+}
+
+// GetForRecipientPaged returns up to limit of a recipient's messages,
+// skipping the first offset, in enqueue order. A negative limit means
+// no limit.
+func (q *MessageQueue) GetForRecipientPaged(recipientID string, limit, offset int) []*QueuedMessage {
 	q.mu.RLock()
 	defer q.mu.RUnlock()
 
 	var result []*QueuedMessage
 	for _, msg := range q.messages {
-		if msg.RecipientID == recipientID {
-			result = append(result, msg)
+		if msg.RecipientID != recipientID {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
 		}
+		if limit >= 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, msg)
 	}
 	return result
 }
@@ -115,6 +334,7 @@ func (q *MessageQueue) Clear(ids []string) {
 	}
 
 	q.messages = remaining
+	q.dequeued = 0
 }
 
 // IncrementAttempts increments the attempt counter for a message
@@ -130,6 +350,135 @@ func (q *MessageQueue) IncrementAttempts(id string) {
 	}
 }
 
+// ReEncrypt replaces the ciphertext of every message queued for
+// recipientID with the result of fn, e.g. after the recipient starts a
+// new session and can no longer decrypt the old ciphertexts. fn receives
+// a copy of each message in enqueue order and is called without the
+// queue locked. If fn fails, no message is changed. Messages removed
+// while fn runs are skipped.
+func (q *MessageQueue) ReEncrypt(recipientID string, fn func(old *QueuedMessage) ([]byte, error)) error {
+	pending := q.GetForRecipient(recipientID)
+
+	updated := make(map[*QueuedMessage][]byte, len(pending))
+	for _, msg := range pending {
+		q.mu.RLock()
+		copied := *msg
+		q.mu.RUnlock()
+
+		ciphertext, err := fn(&copied)
+		if err != nil {
+			return err
+		}
+		updated[msg] = ciphertext
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, msg := range q.messages {
+		if ciphertext, ok := updated[msg]; ok {
+			msg.EncryptedContent = ciphertext
+		}
+	}
+	return nil
+}
+
+// MarkFailed records a failed send attempt and schedules the next one
+// after RetryBackoff, ending any checkout. It reports whether the message
+// was found.
+func (q *MessageQueue) MarkFailed(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, msg := range q.messages {
+		if msg.ID == id {
+			msg.Attempts++
+			msg.NextAttemptAt = q.clock.Now().Add(RetryBackoff(msg.Attempts)).Unix()
+			msg.InFlight = false
+			return true
+		}
+	}
+	return false
+}
+
+// CheckoutForSend marks a message as in flight, so GetReady leaves it out
+// while a transport sends it. Finish with Ack once delivery is confirmed,
+// or Nack (or MarkFailed) if it fails; the message stays queued until
+// then, so nothing is lost if the send never completes. It reports
+// whether the message was checked out: false if it is missing or already
+// in flight.
+func (q *MessageQueue) CheckoutForSend(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, msg := range q.messages {
+		if msg.ID == id {
+			if msg.InFlight {
+				return false
+			}
+			msg.InFlight = true
+			return true
+		}
+	}
+	return false
+}
+
+// Ack removes a delivered message. It reports whether the message was
+// found.
+func (q *MessageQueue) Ack(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, msg := range q.messages {
+		if msg.ID == id {
+			// Shift in place; the backing array, and so its dequeued
+			// slots, are unchanged
+			last := len(q.messages) - 1
+			copy(q.messages[i:], q.messages[i+1:])
+			q.messages[last] = nil
+			q.messages = q.messages[:last]
+			return true
+		}
+	}
+	return false
+}
+
+// Nack returns a checked-out message to ready after a failed send,
+// counting the attempt. Use MarkFailed instead to also back off. It
+// reports whether the message was in flight.
+func (q *MessageQueue) Nack(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, msg := range q.messages {
+		if msg.ID == id {
+			if !msg.InFlight {
+				return false
+			}
+			msg.InFlight = false
+			msg.Attempts++
+			return true
+		}
+	}
+	return false
+}
+
+// GetReady returns the messages due to be sent now, in enqueue order.
+// Messages waiting out a retry backoff or checked out for sending are
+// left out.
+func (q *MessageQueue) GetReady() []*QueuedMessage {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	now := q.clock.Now().Unix()
+	var ready []*QueuedMessage
+	for _, msg := range q.messages {
+		if !msg.InFlight && msg.NextAttemptAt <= now {
+			ready = append(ready, msg)
+		}
+	}
+	return ready
+}
+
 // Len returns the number of queued messages
 func (q *MessageQueue) Len() int {
 	q.mu.RLock()
@@ -137,6 +486,65 @@ func (q *MessageQueue) Len() int {
 	return len(q.messages)
 }
 
+// TotalBytes returns the encrypted payload size of every queued message
+func (q *MessageQueue) TotalBytes() int64 {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	var total int64
+	for _, msg := range q.messages {
+		total += int64(len(msg.EncryptedContent))
+	}
+	return total
+}
+
+// BytesForRecipient returns the encrypted payload size of the messages
+// queued for recipientID
+func (q *MessageQueue) BytesForRecipient(recipientID string) int64 {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	var total int64
+	for _, msg := range q.messages {
+		if msg.RecipientID == recipientID {
+			total += int64(len(msg.EncryptedContent))
+		}
+	}
+	return total
+}
+
+// QueueStats summarizes the queue for monitoring
+type QueueStats struct {
+	TotalPending     int            `json:"total_pending"`
+	PerRecipient     map[string]int `json:"per_recipient"`
+	OldestAgeSeconds int64          `json:"oldest_age_seconds"`
+	MaxAttempts      int            `json:"max_attempts"`
+}
+
+// Stats computes queue statistics in a single pass
+func (q *MessageQueue) Stats() QueueStats {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	stats := QueueStats{
+		TotalPending: len(q.messages),
+		PerRecipient: make(map[string]int),
+	}
+
+	now := q.clock.Now().Unix()
+	for _, msg := range q.messages {
+		stats.PerRecipient[msg.RecipientID]++
+		if age := now - msg.CreatedAt; age > stats.OldestAgeSeconds {
+			stats.OldestAgeSeconds = age
+		}
+		if msg.Attempts > stats.MaxAttempts {
+			stats.MaxAttempts = msg.Attempts
+		}
+	}
+
+	return stats
+}
+
 // IsEmpty returns true if the queue is empty
 func (q *MessageQueue) IsEmpty() bool {
 	return q.Len() == 0
@@ -2,9 +2,16 @@
 package sync
 
 import (
+	"errors"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"merabriar_core/clock"
+	"merabriar_core/crypto"
 )
 
 // ═══════════════════════════════════════
@@ -114,6 +121,57 @@ func TestFIFOOrder(t *testing.T) {
 	}
 }
 
+func TestDequeueReclaimsCapacity(t *testing.T) {
+	q := NewMessageQueue()
+
+	for i := 0; i < 10000; i++ {
+		q.Enqueue(NewQueuedMessage("msg-"+strconv.Itoa(i), "alice", nil))
+	}
+	for i := 0; i < 9990; i++ {
+		q.Dequeue()
+	}
+	if got := q.backingCap(); got > 2*compactMinDequeues {
+		t.Errorf("backing capacity with 10 queued = %d, want <= %d", got, 2*compactMinDequeues)
+	}
+
+	// Order survives compaction
+	if msg := q.Dequeue(); msg.ID != "msg-9990" {
+		t.Errorf("Dequeue() after compaction ID = %q, want %q", msg.ID, "msg-9990")
+	}
+}
+
+func TestDequeueSteadyStateCapacity(t *testing.T) {
+	q := NewMessageQueue()
+
+	for i := 0; i < 100000; i++ {
+		q.Enqueue(NewQueuedMessage("msg", "alice", nil))
+		q.Enqueue(NewQueuedMessage("msg", "alice", nil))
+		q.Dequeue()
+		q.Dequeue()
+	}
+	if got := q.backingCap(); got > 4*compactMinDequeues {
+		t.Errorf("backing capacity = %d, want <= %d", got, 4*compactMinDequeues)
+	}
+}
+
+func TestDequeueAndAckReclaimCapacity(t *testing.T) {
+	q := NewMessageQueue()
+
+	for i := 0; i < 10000; i++ {
+		q.Enqueue(NewQueuedMessage("msg-"+strconv.Itoa(i), "alice", nil))
+	}
+	for i := 0; i < 9990; i += 2 {
+		q.Dequeue()
+		q.Ack("msg-" + strconv.Itoa(i+1))
+	}
+	if got := q.backingCap(); got > 2*compactMinDequeues {
+		t.Errorf("backing capacity with 10 queued = %d, want <= %d", got, 2*compactMinDequeues)
+	}
+	if msg := q.Peek(); msg.ID != "msg-9990" {
+		t.Errorf("Peek() after compaction ID = %q, want %q", msg.ID, "msg-9990")
+	}
+}
+
 // ═══════════════════════════════════════
 // 2. Queue Filtering
 // ═══════════════════════════════════════
@@ -179,6 +237,234 @@ func TestGetForRecipientNotFound(t *testing.T) {
 	}
 }
 
+func TestGetForRecipientEnqueueOrder(t *testing.T) {
+	q := NewMessageQueue()
+	for i := 0; i < 10; i++ {
+		recipient := "alice"
+		if i%3 == 0 {
+			recipient = "bob"
+		}
+		q.Enqueue(NewQueuedMessage(strconv.Itoa(i), recipient, []byte{byte(i)}))
+	}
+
+	want := []string{"1", "2", "4", "5", "7", "8"}
+	got := q.GetForRecipient("alice")
+	if len(got) != len(want) {
+		t.Fatalf("GetForRecipient(alice) = %d messages, want %d", len(got), len(want))
+	}
+	for i, msg := range got {
+		if msg.ID != want[i] {
+			t.Errorf("got[%d].ID = %s, want %s", i, msg.ID, want[i])
+		}
+	}
+}
+
+func TestGetForRecipientPaged(t *testing.T) {
+	q := NewMessageQueue()
+	for i := 0; i < 7; i++ {
+		q.Enqueue(NewQueuedMessage(strconv.Itoa(i), "alice", []byte{byte(i)}))
+		q.Enqueue(NewQueuedMessage("other-"+strconv.Itoa(i), "bob", []byte{byte(i)}))
+	}
+
+	tests := []struct {
+		name          string
+		limit, offset int
+		want          []string
+	}{
+		{"first page", 3, 0, []string{"0", "1", "2"}},
+		{"middle page", 3, 3, []string{"3", "4", "5"}},
+		{"partial last page", 3, 6, []string{"6"}},
+		{"offset at end", 3, 7, nil},
+		{"offset past end", 3, 100, nil},
+		{"zero limit", 0, 0, nil},
+		{"no limit", -1, 4, []string{"4", "5", "6"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := q.GetForRecipientPaged("alice", tt.limit, tt.offset)
+			if len(got) != len(tt.want) {
+				t.Fatalf("GetForRecipientPaged(%d, %d) = %d messages, want %d", tt.limit, tt.offset, len(got), len(tt.want))
+			}
+			for i, msg := range got {
+				if msg.ID != tt.want[i] {
+					t.Errorf("got[%d].ID = %s, want %s", i, msg.ID, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetPage(t *testing.T) {
+	q := NewMessageQueue()
+	for i := 0; i < 7; i++ {
+		q.Enqueue(NewQueuedMessage(strconv.Itoa(i), "alice", []byte{byte(i)}))
+	}
+
+	tests := []struct {
+		name          string
+		limit, offset int
+		want          []string
+	}{
+		{"first page", 3, 0, []string{"0", "1", "2"}},
+		{"partial last page", 3, 6, []string{"6"}},
+		{"offset at end", 3, 7, nil},
+		{"offset past end", 3, 100, nil},
+		{"zero limit", 0, 0, nil},
+		{"no limit", -1, 4, []string{"4", "5", "6"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := q.GetPage(tt.limit, tt.offset)
+			if len(got) != len(tt.want) {
+				t.Fatalf("GetPage(%d, %d) = %d messages, want %d", tt.limit, tt.offset, len(got), len(tt.want))
+			}
+			for i, msg := range got {
+				if msg.ID != tt.want[i] {
+					t.Errorf("got[%d].ID = %s, want %s", i, msg.ID, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// pageIDs joins the IDs of a page
+func pageIDs(msgs []*QueuedMessage) string {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestGetPageAfterSurvivesRemovals(t *testing.T) {
+	q := NewMessageQueue()
+	for i := 0; i < 6; i++ {
+		q.Enqueue(NewQueuedMessage(strconv.Itoa(i), "alice", nil))
+	}
+
+	first, cursor := q.GetPageAfter(0, 2)
+	if got := pageIDs(first); got != "0,1" {
+		t.Fatalf("first page = %s, want 0,1", got)
+	}
+
+	// Removing messages before and at the cursor doesn't shift the next
+	// page, and a message added meanwhile comes after the rest
+	q.Dequeue()
+	q.Ack("1")
+	q.Clear([]string{"2"})
+	q.Enqueue(NewQueuedMessage("6", "alice", nil))
+
+	second, cursor := q.GetPageAfter(cursor, 2)
+	if got := pageIDs(second); got != "3,4" {
+		t.Errorf("second page = %s, want 3,4", got)
+	}
+	rest, last := q.GetPageAfter(cursor, -1)
+	if got := pageIDs(rest); got != "5,6" {
+		t.Errorf("rest = %s, want 5,6", got)
+	}
+	if empty, end := q.GetPageAfter(last, 10); len(empty) != 0 || end != last {
+		t.Errorf("page past the end = %s at %d, want empty at %d", pageIDs(empty), end, last)
+	}
+}
+
+func TestGetPageAfterRestore(t *testing.T) {
+	q := NewMessageQueue()
+	q.Enqueue(NewQueuedMessage("a", "alice", nil))
+	q.Enqueue(NewQueuedMessage("b", "alice", nil))
+	_, cursor := q.GetPageAfter(0, 1)
+
+	// Drained messages keep their place; reloaded ones are added after
+	// everything already queued, although they are sent first
+	q.Restore(q.DrainAll())
+	q.Restore([]*QueuedMessage{NewQueuedMessage("reloaded", "alice", nil)})
+
+	if got := pageIDs(q.GetAll()); got != "reloaded,a,b" {
+		t.Fatalf("queue order = %s, want reloaded,a,b", got)
+	}
+	if page, _ := q.GetPageAfter(cursor, -1); pageIDs(page) != "b,reloaded" {
+		t.Errorf("page after a = %s, want b,reloaded", pageIDs(page))
+	}
+}
+
+func TestEnqueueBroadcast(t *testing.T) {
+	q := NewMessageQueue()
+	content := []byte("to everyone")
+	q.Enqueue(NewQueuedMessage("direct", "alice", []byte("just alice")))
+	q.EnqueueBroadcast("bcast", []string{"alice", "bob", "carol", "bob"}, content)
+
+	if q.Len() != 4 {
+		t.Fatalf("Len() = %d, want 4 (duplicate recipient queued once)", q.Len())
+	}
+
+	var shared *byte
+	for _, rid := range []string{"alice", "bob", "carol"} {
+		msgs := q.GetForRecipient(rid)
+		msg := msgs[len(msgs)-1]
+		if msg.ID != BroadcastEntryID("bcast", rid) {
+			t.Errorf("%s entry ID = %q, want %q", rid, msg.ID, BroadcastEntryID("bcast", rid))
+		}
+		if string(msg.EncryptedContent) != "to everyone" {
+			t.Errorf("%s content = %q, want broadcast content", rid, msg.EncryptedContent)
+		}
+		// Every entry references the same payload
+		if shared == nil {
+			shared = &msg.EncryptedContent[0]
+		} else if &msg.EncryptedContent[0] != shared {
+			t.Errorf("%s entry has its own copy of the payload", rid)
+		}
+	}
+	if got := q.GetForRecipient("alice"); len(got) != 2 || got[0].ID != "direct" {
+		t.Errorf("alice's messages = %d, want direct then broadcast", len(got))
+	}
+
+	// Clearing one recipient's entry leaves the others intact
+	q.Clear([]string{BroadcastEntryID("bcast", "bob")})
+	if got := q.GetForRecipient("bob"); len(got) != 0 {
+		t.Errorf("bob's messages after clear = %d, want 0", len(got))
+	}
+	for _, rid := range []string{"alice", "carol"} {
+		msg, ok := q.Get(BroadcastEntryID("bcast", rid))
+		if !ok || string(msg.EncryptedContent) != "to everyone" {
+			t.Errorf("%s entry should survive clearing bob's", rid)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	q := NewMessageQueue()
+	q.Enqueue(NewQueuedMessage("msg-1", "alice", []byte{1}))
+	q.Enqueue(NewQueuedMessage("msg-2", "bob", []byte{2}))
+	q.Enqueue(NewQueuedMessage("msg-3", "alice", []byte{3}))
+	q.IncrementAttempts("msg-2")
+
+	msg, ok := q.Get("msg-2")
+	if !ok {
+		t.Fatal("Get() should find msg-2")
+	}
+	if msg.RecipientID != "bob" || msg.Attempts != 1 {
+		t.Errorf("Get() = %s/%d attempts, want bob/1", msg.RecipientID, msg.Attempts)
+	}
+
+	// The result is a copy
+	msg.Attempts = 99
+	again, _ := q.Get("msg-2")
+	if again.Attempts != 1 {
+		t.Errorf("mutating Get() result changed the queue: attempts = %d", again.Attempts)
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	q := NewMessageQueue()
+	q.Enqueue(NewQueuedMessage("msg-1", "alice", nil))
+
+	msg, ok := q.Get("missing")
+	if ok || msg != nil {
+		t.Errorf("Get(missing) = %v, %v; want nil, false", msg, ok)
+	}
+}
+
 // ═══════════════════════════════════════
 // 3. Queue Clearing
 // ═══════════════════════════════════════
@@ -236,6 +522,93 @@ func TestClearAllMessages(t *testing.T) {
 	}
 }
 
+func TestDrainAll(t *testing.T) {
+	q := NewMessageQueue()
+	for i := 0; i < 5; i++ {
+		q.Enqueue(NewQueuedMessage("msg-"+strconv.Itoa(i), "alice", []byte{byte(i)}))
+	}
+
+	drained := q.DrainAll()
+
+	if len(drained) != 5 {
+		t.Fatalf("DrainAll() returned %d messages, want 5", len(drained))
+	}
+	for i, msg := range drained {
+		if want := "msg-" + strconv.Itoa(i); msg.ID != want {
+			t.Errorf("drained[%d].ID = %q, want %q", i, msg.ID, want)
+		}
+	}
+	if !q.IsEmpty() {
+		t.Errorf("queue length after DrainAll() = %d, want 0", q.Len())
+	}
+
+	// The queue remains usable
+	q.Enqueue(NewQueuedMessage("after", "bob", nil))
+	if q.Len() != 1 {
+		t.Errorf("queue length after re-enqueue = %d, want 1", q.Len())
+	}
+}
+
+func TestDrainAllConcurrentEnqueue(t *testing.T) {
+	q := NewMessageQueue()
+	for i := 0; i < 100; i++ {
+		q.Enqueue(NewQueuedMessage("pre-"+strconv.Itoa(i), "alice", nil))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			q.Enqueue(NewQueuedMessage("during-"+strconv.Itoa(i), "bob", nil))
+		}
+	}()
+
+	drained := q.DrainAll()
+	wg.Wait()
+	remaining := q.DrainAll()
+
+	seen := make(map[string]int)
+	for _, msg := range append(drained, remaining...) {
+		seen[msg.ID]++
+	}
+	if len(seen) != 200 {
+		t.Errorf("saw %d distinct messages across drains, want 200", len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("message %s seen %d times, want 1", id, n)
+		}
+	}
+
+	// Every pre-existing message was taken by the first drain
+	for i := 0; i < 100; i++ {
+		if drained[i].ID != "pre-"+strconv.Itoa(i) {
+			t.Fatalf("drained[%d] = %q, want pre-existing messages first", i, drained[i].ID)
+		}
+	}
+}
+
+func TestRestoreGoesAheadOfNewMessages(t *testing.T) {
+	q := NewMessageQueue()
+	q.Enqueue(NewQueuedMessage("new-0", "alice", nil))
+
+	q.Restore([]*QueuedMessage{
+		NewQueuedMessage("old-0", "alice", nil),
+		NewQueuedMessage("old-1", "bob", nil),
+	})
+	q.Enqueue(NewQueuedMessage("new-1", "alice", nil))
+
+	var got []string
+	for msg := q.Dequeue(); msg != nil; msg = q.Dequeue() {
+		got = append(got, msg.ID)
+	}
+	want := []string{"old-0", "old-1", "new-0", "new-1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("order after Restore = %v, want %v", got, want)
+	}
+}
+
 // ═══════════════════════════════════════
 // 4. Queue Attempts & Metadata
 // ═══════════════════════════════════════
@@ -252,8 +625,22 @@ func TestNewQueuedMessage(t *testing.T) {
 	if msg.Attempts != 0 {
 		t.Errorf("Attempts = %d, want 0", msg.Attempts)
 	}
-	if msg.CreatedAt <= 0 {
-		t.Error("CreatedAt should be a positive timestamp")
+	if msg.CreatedAt != 0 {
+		t.Errorf("CreatedAt = %d, want 0 until enqueued", msg.CreatedAt)
+	}
+
+	q := NewMessageQueueWithClock(clock.NewFake(time.Unix(10000, 0)))
+	q.Enqueue(msg)
+	if msg.CreatedAt != 10000 {
+		t.Errorf("CreatedAt after Enqueue = %d, want the queue clock's 10000", msg.CreatedAt)
+	}
+
+	// An explicit CreatedAt, e.g. from the caller, is kept
+	stamped := NewQueuedMessage("stamped", "alice", []byte{1})
+	stamped.CreatedAt = 500
+	q.Enqueue(stamped)
+	if stamped.CreatedAt != 500 {
+		t.Errorf("CreatedAt after Enqueue = %d, want 500 kept", stamped.CreatedAt)
 	}
 }
 
@@ -288,6 +675,286 @@ func TestIncrementAttemptsNonexistent(t *testing.T) {
 	q.IncrementAttempts("nonexistent")
 }
 
+func TestStats(t *testing.T) {
+	q := NewMessageQueue()
+	now := time.Now().Unix()
+
+	old := NewQueuedMessage("m1", "alice", []byte{1})
+	old.CreatedAt = now - 300
+	old.Attempts = 4
+	q.Enqueue(old)
+
+	mid := NewQueuedMessage("m2", "alice", []byte{2})
+	mid.CreatedAt = now - 60
+	mid.Attempts = 1
+	q.Enqueue(mid)
+
+	q.Enqueue(NewQueuedMessage("m3", "bob", []byte{3}))
+
+	stats := q.Stats()
+
+	if stats.TotalPending != 3 {
+		t.Errorf("TotalPending = %d, want 3", stats.TotalPending)
+	}
+	if stats.PerRecipient["alice"] != 2 || stats.PerRecipient["bob"] != 1 {
+		t.Errorf("PerRecipient = %v, want alice:2 bob:1", stats.PerRecipient)
+	}
+	if stats.OldestAgeSeconds < 300 || stats.OldestAgeSeconds > 305 {
+		t.Errorf("OldestAgeSeconds = %d, want ~300", stats.OldestAgeSeconds)
+	}
+	if stats.MaxAttempts != 4 {
+		t.Errorf("MaxAttempts = %d, want 4", stats.MaxAttempts)
+	}
+}
+
+func TestStatsEmpty(t *testing.T) {
+	stats := NewMessageQueue().Stats()
+
+	if stats.TotalPending != 0 || stats.OldestAgeSeconds != 0 || stats.MaxAttempts != 0 {
+		t.Errorf("empty queue stats = %+v, want zeroes", stats)
+	}
+	if len(stats.PerRecipient) != 0 {
+		t.Errorf("empty queue PerRecipient = %v, want empty", stats.PerRecipient)
+	}
+}
+
+func TestStatsUsesClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(10000, 0))
+	q := NewMessageQueueWithClock(fake)
+
+	msg := NewQueuedMessage("m1", "alice", nil)
+	msg.CreatedAt = 10000
+	q.Enqueue(msg)
+
+	fake.Advance(42 * time.Second)
+	if age := q.Stats().OldestAgeSeconds; age != 42 {
+		t.Errorf("OldestAgeSeconds = %d, want 42", age)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		0:  0,
+		1:  time.Second,
+		2:  2 * time.Second,
+		4:  8 * time.Second,
+		9:  256 * time.Second,
+		10: RetryBackoffMax,
+		64: RetryBackoffMax,
+	}
+	for attempts, want := range cases {
+		if got := RetryBackoff(attempts); got != want {
+			t.Errorf("RetryBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestMarkFailedSchedulesRetry(t *testing.T) {
+	fake := clock.NewFake(time.Unix(10000, 0))
+	q := NewMessageQueueWithClock(fake)
+	q.Enqueue(NewQueuedMessage("m1", "alice", nil))
+	q.Enqueue(NewQueuedMessage("m2", "bob", nil))
+
+	if !q.MarkFailed("m1") {
+		t.Fatal("MarkFailed() should find the message")
+	}
+	if ready := q.GetReady(); len(ready) != 1 || ready[0].ID != "m2" {
+		t.Fatalf("GetReady() after failure = %v, want only m2", ready)
+	}
+
+	// Ready again once the first backoff has passed
+	fake.Advance(RetryBackoffBase)
+	if ready := q.GetReady(); len(ready) != 2 || ready[0].ID != "m1" {
+		t.Errorf("GetReady() after backoff = %d messages, want m1 and m2 in order", len(ready))
+	}
+
+	// The second failure waits twice as long
+	q.MarkFailed("m1")
+	fake.Advance(RetryBackoffBase)
+	if ready := q.GetReady(); len(ready) != 1 {
+		t.Errorf("GetReady() within second backoff = %d messages, want 1", len(ready))
+	}
+	fake.Advance(RetryBackoffBase)
+	if ready := q.GetReady(); len(ready) != 2 {
+		t.Errorf("GetReady() after second backoff = %d messages, want 2", len(ready))
+	}
+
+	if m1, _ := q.Get("m1"); m1.Attempts != 2 {
+		t.Errorf("Attempts = %d, want 2", m1.Attempts)
+	}
+	if q.MarkFailed("missing") {
+		t.Error("MarkFailed() should report a missing message")
+	}
+}
+
+func TestCheckoutAck(t *testing.T) {
+	q := NewMessageQueue()
+	q.Enqueue(NewQueuedMessage("m1", "alice", nil))
+	q.Enqueue(NewQueuedMessage("m2", "bob", nil))
+
+	if !q.CheckoutForSend("m1") {
+		t.Fatal("CheckoutForSend() should check out a ready message")
+	}
+	if q.CheckoutForSend("m1") {
+		t.Error("CheckoutForSend() should refuse a message already in flight")
+	}
+	if ready := q.GetReady(); len(ready) != 1 || ready[0].ID != "m2" {
+		t.Errorf("GetReady() during checkout = %v, want only m2", ready)
+	}
+	if q.Len() != 2 {
+		t.Errorf("queue length during checkout = %d, want 2 (not removed yet)", q.Len())
+	}
+
+	if !q.Ack("m1") {
+		t.Fatal("Ack() should find the message")
+	}
+	if _, ok := q.Get("m1"); ok {
+		t.Error("acked message should be removed")
+	}
+	if q.Ack("m1") {
+		t.Error("second Ack() should report the message missing")
+	}
+	if q.CheckoutForSend("missing") {
+		t.Error("CheckoutForSend() should report a missing message")
+	}
+}
+
+func TestCheckoutNackRetry(t *testing.T) {
+	q := NewMessageQueue()
+	q.Enqueue(NewQueuedMessage("m1", "alice", nil))
+
+	if q.Nack("m1") {
+		t.Error("Nack() should refuse a message that isn't in flight")
+	}
+
+	q.CheckoutForSend("m1")
+	if !q.Nack("m1") {
+		t.Fatal("Nack() should return an in-flight message")
+	}
+
+	ready := q.GetReady()
+	if len(ready) != 1 || ready[0].ID != "m1" {
+		t.Fatalf("GetReady() after Nack = %v, want m1", ready)
+	}
+	if ready[0].Attempts != 1 || ready[0].InFlight {
+		t.Errorf("after Nack: Attempts %d, InFlight %v; want 1, false", ready[0].Attempts, ready[0].InFlight)
+	}
+
+	// Retry succeeds
+	if !q.CheckoutForSend("m1") {
+		t.Fatal("CheckoutForSend() after Nack should succeed")
+	}
+	q.Ack("m1")
+	if !q.IsEmpty() {
+		t.Errorf("queue length after retry and Ack = %d, want 0", q.Len())
+	}
+}
+
+func TestMarkFailedEndsCheckout(t *testing.T) {
+	fake := clock.NewFake(time.Unix(10000, 0))
+	q := NewMessageQueueWithClock(fake)
+	q.Enqueue(NewQueuedMessage("m1", "alice", nil))
+
+	q.CheckoutForSend("m1")
+	q.MarkFailed("m1")
+	fake.Advance(RetryBackoffBase)
+
+	if ready := q.GetReady(); len(ready) != 1 {
+		t.Errorf("GetReady() after MarkFailed and backoff = %d messages, want 1", len(ready))
+	}
+}
+
+// sessionPair returns an outbound session to bob and bob's matching
+// inbound session, derived from seed
+func sessionPair(seed byte) (*crypto.Session, *crypto.Session) {
+	var root, chain [32]byte
+	root[0], chain[0] = seed, seed+1
+	return crypto.NewSessionDirect("bob", root, chain, [32]byte{}),
+		crypto.NewSessionDirect("alice", root, [32]byte{}, chain)
+}
+
+func TestReEncrypt(t *testing.T) {
+	q := NewMessageQueue()
+	oldSession, _ := sessionPair(1)
+	plaintexts := map[string]string{"m1": "first", "m2": "second"}
+
+	for _, id := range []string{"m1", "m2"} {
+		ct, _ := oldSession.Encrypt([]byte(plaintexts[id]))
+		q.Enqueue(NewQueuedMessage(id, "bob", ct))
+	}
+	q.Enqueue(NewQueuedMessage("m3", "carol", []byte{7}))
+
+	// Bob reinstalled: encrypt the pending plaintexts under a new session
+	newSession, bobSession := sessionPair(2)
+	err := q.ReEncrypt("bob", func(old *QueuedMessage) ([]byte, error) {
+		return newSession.Encrypt([]byte(plaintexts[old.ID]))
+	})
+	if err != nil {
+		t.Fatalf("ReEncrypt() error: %v", err)
+	}
+
+	for _, msg := range q.GetForRecipient("bob") {
+		pt, err := bobSession.Decrypt(msg.EncryptedContent)
+		if err != nil {
+			t.Fatalf("Decrypt(%s) with new session error: %v", msg.ID, err)
+		}
+		if string(pt) != plaintexts[msg.ID] {
+			t.Errorf("%s decrypted = %q, want %q", msg.ID, pt, plaintexts[msg.ID])
+		}
+	}
+
+	if other, _ := q.Get("m3"); other.EncryptedContent[0] != 7 {
+		t.Error("other recipients' messages should be untouched")
+	}
+}
+
+func TestReEncryptFailureChangesNothing(t *testing.T) {
+	q := NewMessageQueue()
+	q.Enqueue(NewQueuedMessage("m1", "bob", []byte{1}))
+	q.Enqueue(NewQueuedMessage("m2", "bob", []byte{2}))
+
+	errFail := errors.New("no plaintext")
+	err := q.ReEncrypt("bob", func(old *QueuedMessage) ([]byte, error) {
+		if old.ID == "m2" {
+			return nil, errFail
+		}
+		return []byte{9}, nil
+	})
+	if err != errFail {
+		t.Fatalf("ReEncrypt() error = %v, want %v", err, errFail)
+	}
+
+	if m1, _ := q.Get("m1"); m1.EncryptedContent[0] != 1 {
+		t.Error("failed ReEncrypt should leave every message unchanged")
+	}
+}
+
+func TestQueueByteTotals(t *testing.T) {
+	q := NewMessageQueue()
+	if q.TotalBytes() != 0 {
+		t.Errorf("TotalBytes() on empty queue = %d, want 0", q.TotalBytes())
+	}
+
+	q.Enqueue(NewQueuedMessage("m1", "alice", make([]byte, 100)))
+	q.Enqueue(NewQueuedMessage("m2", "bob", make([]byte, 250)))
+	q.Enqueue(NewQueuedMessage("m3", "alice", make([]byte, 40)))
+
+	if got := q.TotalBytes(); got != 390 {
+		t.Errorf("TotalBytes() = %d, want 390", got)
+	}
+	if got := q.BytesForRecipient("alice"); got != 140 {
+		t.Errorf("BytesForRecipient(alice) = %d, want 140", got)
+	}
+	if got := q.BytesForRecipient("carol"); got != 0 {
+		t.Errorf("BytesForRecipient(carol) = %d, want 0", got)
+	}
+
+	q.Dequeue()
+	if got := q.TotalBytes(); got != 290 {
+		t.Errorf("TotalBytes() after Dequeue = %d, want 290", got)
+	}
+}
+
 // ═══════════════════════════════════════
 // 5. Concurrency Tests
 // ═══════════════════════════════════════
@@ -362,6 +1029,33 @@ func TestConcurrentReadWrite(t *testing.T) {
 	// If we reach here without panic/race detection, concurrency is safe
 }
 
+func TestReleasedQueuedMessageHasNoStaleData(t *testing.T) {
+	q := NewMessageQueue()
+	for i := 0; i < 10; i++ {
+		msg := AcquireQueuedMessage("m"+strconv.Itoa(i), "alice", []byte{byte(i)})
+		if msg.Attempts != 0 || msg.NextAttemptAt != 0 || msg.InFlight {
+			t.Fatalf("acquired message %d carries stale state: %+v", i, msg)
+		}
+		if msg.ID != "m"+strconv.Itoa(i) || msg.RecipientID != "alice" || msg.EncryptedContent[0] != byte(i) || msg.CreatedAt != 0 {
+			t.Fatalf("acquired message %d = %+v", i, msg)
+		}
+
+		// Dirty every field before handing it back
+		q.Enqueue(msg)
+		q.CheckoutForSend(msg.ID)
+		q.MarkFailed(msg.ID)
+		q.CheckoutForSend(msg.ID)
+		if !q.Ack(msg.ID) {
+			t.Fatalf("Ack(%s) = false", msg.ID)
+		}
+		ReleaseQueuedMessage(msg)
+		if !reflect.DeepEqual(*msg, QueuedMessage{}) {
+			t.Fatalf("released message not cleared: %+v", msg)
+		}
+	}
+	ReleaseQueuedMessage(nil)
+}
+
 // ═══════════════════════════════════════
 // 6. Benchmarks
 // ═══════════════════════════════════════
@@ -387,3 +1081,29 @@ func BenchmarkDequeue(b *testing.B) {
 		q.Dequeue()
 	}
 }
+
+func BenchmarkEnqueueAck(b *testing.B) {
+	q := NewMessageQueue()
+	content := []byte{1, 2, 3}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Enqueue(NewQueuedMessage("bench-msg", "alice", content))
+		q.Ack("bench-msg")
+	}
+}
+
+func BenchmarkEnqueueAckPooled(b *testing.B) {
+	q := NewMessageQueue()
+	content := []byte{1, 2, 3}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := AcquireQueuedMessage("bench-msg", "alice", content)
+		q.Enqueue(msg)
+		q.Ack("bench-msg")
+		ReleaseQueuedMessage(msg)
+	}
+}
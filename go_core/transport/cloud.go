@@ -0,0 +1,440 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"merabriar_core/message"
+
+	"github.com/gorilla/websocket"
+)
+
+// Cloud transport property keys
+const (
+	PropCloudURL    = "url"     // Supabase project URL, e.g. https://xyz.supabase.co
+	PropCloudAPIKey = "api_key" // Supabase anon key or user access token
+	PropCloudUserID = "user_id" // Our own user ID, used for the inbound channel
+)
+
+// broadcastEvent is the Realtime broadcast event name used for messages
+const broadcastEvent = "message"
+
+// cloudHeartbeatInterval is how often a Phoenix heartbeat is sent
+var cloudHeartbeatInterval = 30 * time.Second
+
+// cloudJoinTimeout bounds how long Start waits for the channel join reply
+var cloudJoinTimeout = 10 * time.Second
+
+var (
+	// ErrNotConfigured is returned when required transport properties are missing
+	ErrNotConfigured = errors.New("transport not configured")
+	// ErrNotStarted is returned when sending on a transport that is not active
+	ErrNotStarted = errors.New("transport not started")
+)
+
+// phoenixMessage is the Realtime (Phoenix channels) wire frame
+type phoenixMessage struct {
+	Topic   string          `json:"topic"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+	Ref     string          `json:"ref,omitempty"`
+}
+
+// broadcastPayload is the payload of a Realtime "broadcast" event
+type broadcastPayload struct {
+	Type    string          `json:"type"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// cloudFrame is our payload within a broadcast: one codec-encoded
+// EncryptedMessage, base64 in JSON
+type cloudFrame struct {
+	Data []byte `json:"data"`
+}
+
+// CloudTransport implements Transport for Supabase Realtime.
+// Inbound messages arrive as broadcasts on our own channel over the
+// Realtime websocket; outbound messages are published to the
+// recipient's channel via the Realtime REST broadcast endpoint. Each
+// broadcast carries one message encoded with the manager's codec (see
+// CodecAware).
+type CloudTransport struct {
+	stateNotifier
+
+	mu      sync.Mutex
+	writeMu sync.Mutex
+	state   TransportState
+	props   TransportProperties
+	handler ReceiveHandler
+	codec   Codec // Decodes inbound broadcasts; nil means BinaryCodec
+	client  *http.Client
+	conn    *websocket.Conn
+	ref     int
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewCloudTransport creates a new cloud transport
+func NewCloudTransport() *CloudTransport {
+	return NewCloudTransportWithProperties(TransportProperties{})
+}
+
+// NewCloudTransportWithProperties creates a cloud transport with the given
+// endpoint configuration (see the PropCloud* keys)
+func NewCloudTransportWithProperties(props TransportProperties) *CloudTransport {
+	return &CloudTransport{
+		state:  StateDisabled,
+		props:  props,
+		client: &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// SetProperties replaces the endpoint configuration.
+// It takes effect on the next Start.
+func (t *CloudTransport) SetProperties(props TransportProperties) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.props = props
+}
+
+func (t *CloudTransport) ID() TransportID {
+	return TransportCloud
+}
+
+func (t *CloudTransport) State() TransportState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+func (t *CloudTransport) IsAvailable() bool {
+	return t.State() == StateActive
+}
+
+func (t *CloudTransport) SetReceiveHandler(handler ReceiveHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handler = handler
+}
+
+// SetCodec sets the codec inbound broadcasts are decoded with, and
+// SendMessage encodes with
+func (t *CloudTransport) SetCodec(c Codec) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.codec = c
+}
+
+// SendMessage encodes msg with the transport's codec and publishes it to
+// its recipient's channel
+func (t *CloudTransport) SendMessage(msg *message.EncryptedMessage) error {
+	t.mu.Lock()
+	codec := codecOrDefault(t.codec)
+	t.mu.Unlock()
+
+	data, err := codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return t.Send(msg.RecipientID, data)
+}
+
+// Send publishes data, an encoded EncryptedMessage, to the recipient's
+// channel as it is
+func (t *CloudTransport) Send(recipientID string, data []byte) error {
+	t.mu.Lock()
+	state, props := t.state, t.props
+	t.mu.Unlock()
+
+	if state != StateActive {
+		return ErrNotStarted
+	}
+
+	payload, err := json.Marshal(cloudFrame{Data: data})
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"messages": []map[string]any{{
+			"topic":   channelFor(recipientID),
+			"event":   broadcastEvent,
+			"payload": json.RawMessage(payload),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimRight(props[PropCloudURL], "/") + "/realtime/v1/api/broadcast"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apikey", props[PropCloudAPIKey])
+	req.Header.Set("Authorization", "Bearer "+props[PropCloudAPIKey])
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusBadRequest, resp.StatusCode == http.StatusRequestEntityTooLarge:
+		// The message itself was rejected; resending it won't help
+		return Permanent("realtime broadcast rejected", errors.New(resp.Status))
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("realtime broadcast failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// Start connects to Realtime and subscribes to our own channel
+func (t *CloudTransport) Start() error {
+	t.mu.Lock()
+	if t.state == StateActive {
+		t.mu.Unlock()
+		return nil
+	}
+	props := t.props
+	// A connection lost in readLoop is still attached; tear it down so its
+	// heartbeat stops and the socket is released before redialing
+	stale, staleDone := t.conn, t.done
+	t.conn, t.done = nil, nil
+	t.mu.Unlock()
+
+	if stale != nil {
+		t.closeConn(stale, staleDone)
+	}
+
+	if props[PropCloudURL] == "" || props[PropCloudAPIKey] == "" || props[PropCloudUserID] == "" {
+		return ErrNotConfigured
+	}
+
+	wsURL, err := realtimeSocketURL(props[PropCloudURL], props[PropCloudAPIKey])
+	if err != nil {
+		return err
+	}
+
+	t.setState(StateEnabling)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.setState(StateUnavailable)
+		return err
+	}
+
+	topic := "realtime:" + channelFor(props[PropCloudUserID])
+	if err := t.join(conn, topic, props[PropCloudAPIKey]); err != nil {
+		conn.Close()
+		t.setState(StateUnavailable)
+		return err
+	}
+
+	done := make(chan struct{})
+	t.mu.Lock()
+	t.conn = conn
+	t.done = done
+	t.state = StateActive
+	t.mu.Unlock()
+
+	t.wg.Add(2)
+	go t.readLoop(conn)
+	go t.heartbeatLoop(conn, done)
+	t.notify(TransportCloud, StateActive)
+
+	return nil
+}
+
+// Stop closes the Realtime connection and waits for background goroutines
+func (t *CloudTransport) Stop() error {
+	t.mu.Lock()
+	conn, done := t.conn, t.done
+	t.conn, t.done = nil, nil
+	changed := t.state != StateDisabled
+	t.state = StateDisabled
+	t.mu.Unlock()
+
+	if changed {
+		t.notify(TransportCloud, StateDisabled)
+	}
+
+	if conn != nil {
+		t.closeConn(conn, done)
+	}
+	t.wg.Wait()
+	return nil
+}
+
+// closeConn stops conn's heartbeat and closes it. Its readLoop exits once
+// the read fails.
+func (t *CloudTransport) closeConn(conn *websocket.Conn, done chan struct{}) {
+	close(done)
+	t.writeMu.Lock()
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	t.writeMu.Unlock()
+	conn.Close()
+}
+
+// join sends phx_join for topic and waits for an ok reply
+func (t *CloudTransport) join(conn *websocket.Conn, topic, accessToken string) error {
+	payload, _ := json.Marshal(map[string]any{
+		"config": map[string]any{
+			"broadcast": map[string]any{"self": false, "ack": false},
+			"presence":  map[string]any{"key": ""},
+		},
+		"access_token": accessToken,
+	})
+
+	ref := t.nextRef()
+	if err := t.write(conn, phoenixMessage{Topic: topic, Event: "phx_join", Payload: payload, Ref: ref}); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(cloudJoinTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		var reply phoenixMessage
+		if err := conn.ReadJSON(&reply); err != nil {
+			return err
+		}
+		if reply.Event != "phx_reply" || reply.Ref != ref {
+			continue
+		}
+
+		var status struct {
+			Status string `json:"status"`
+		}
+		json.Unmarshal(reply.Payload, &status)
+		if status.Status != "ok" {
+			return fmt.Errorf("realtime join rejected: %s", string(reply.Payload))
+		}
+		return nil
+	}
+}
+
+// readLoop dispatches inbound broadcasts until the connection closes
+func (t *CloudTransport) readLoop(conn *websocket.Conn) {
+	defer t.wg.Done()
+
+	for {
+		var frame phoenixMessage
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.mu.Lock()
+			lost := t.conn == conn
+			if lost {
+				t.state = StateUnavailable
+			}
+			t.mu.Unlock()
+			if lost {
+				t.notify(TransportCloud, StateUnavailable)
+			}
+			return
+		}
+		if frame.Event != "broadcast" {
+			continue
+		}
+
+		var bc broadcastPayload
+		if err := json.Unmarshal(frame.Payload, &bc); err != nil || bc.Event != broadcastEvent {
+			continue
+		}
+
+		var cf cloudFrame
+		if err := json.Unmarshal(bc.Payload, &cf); err != nil || len(cf.Data) == 0 {
+			continue
+		}
+
+		t.mu.Lock()
+		handler, codec := t.handler, codecOrDefault(t.codec)
+		t.mu.Unlock()
+
+		msg, err := codec.Decode(cf.Data)
+		if err != nil {
+			continue
+		}
+		deliver(handler, msg)
+	}
+}
+
+// heartbeatLoop keeps the Realtime connection alive
+func (t *CloudTransport) heartbeatLoop(conn *websocket.Conn, done chan struct{}) {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(cloudHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			msg := phoenixMessage{Topic: "phoenix", Event: "heartbeat", Payload: json.RawMessage("{}"), Ref: t.nextRef()}
+			if err := t.write(conn, msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (t *CloudTransport) write(conn *websocket.Conn, msg phoenixMessage) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return conn.WriteJSON(msg)
+}
+
+func (t *CloudTransport) nextRef() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ref++
+	return strconv.Itoa(t.ref)
+}
+
+// setState sets the state, notifying the StateListener if it changed
+func (t *CloudTransport) setState(state TransportState) {
+	t.mu.Lock()
+	changed := t.state != state
+	t.state = state
+	t.mu.Unlock()
+
+	if changed {
+		t.notify(TransportCloud, state)
+	}
+}
+
+// channelFor returns the Realtime channel a user receives messages on
+func channelFor(userID string) string {
+	return "user:" + userID
+}
+
+// realtimeSocketURL builds the Realtime websocket URL from the project URL
+func realtimeSocketURL(baseURL, apiKey string) (string, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil {
+		return "", err
+	}
+
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	u.Path += "/realtime/v1/websocket"
+	u.RawQuery = url.Values{"apikey": {apiKey}, "vsn": {"1.0.0"}}.Encode()
+
+	return u.String(), nil
+}
@@ -0,0 +1,373 @@
+// Package transport tests - cloud transport against a mock Realtime server
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"merabriar_core/message"
+
+	"github.com/gorilla/websocket"
+)
+
+// mockRealtime emulates the parts of Supabase Realtime the cloud transport uses
+type mockRealtime struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	joined     chan string
+	conn       *websocket.Conn
+	broadcasts []map[string]any
+	apiKeys    []string
+	rejectJoin bool
+	sendStatus int // Broadcast response status; zero means accepted
+}
+
+func newMockRealtime(t *testing.T) *mockRealtime {
+	t.Helper()
+
+	m := &mockRealtime{joined: make(chan string, 1)}
+	upgrader := websocket.Upgrader{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realtime/v1/websocket", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		m.conn = conn
+		m.apiKeys = append(m.apiKeys, r.URL.Query().Get("apikey"))
+		reject := m.rejectJoin
+		m.mu.Unlock()
+
+		for {
+			var frame phoenixMessage
+			if err := conn.ReadJSON(&frame); err != nil {
+				return
+			}
+			if frame.Event != "phx_join" {
+				continue
+			}
+
+			status := `{"status":"ok","response":{}}`
+			if reject {
+				status = `{"status":"error","response":{"reason":"unauthorized"}}`
+			}
+			m.mu.Lock()
+			conn.WriteJSON(phoenixMessage{Topic: frame.Topic, Event: "phx_reply", Payload: json.RawMessage(status), Ref: frame.Ref})
+			m.mu.Unlock()
+			m.joined <- frame.Topic
+		}
+	})
+	mux.HandleFunc("/realtime/v1/api/broadcast", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []map[string]any `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		m.broadcasts = append(m.broadcasts, body.Messages...)
+		m.apiKeys = append(m.apiKeys, r.Header.Get("apikey"))
+		status := m.sendStatus
+		m.mu.Unlock()
+		if status == 0 {
+			status = http.StatusAccepted
+		}
+		w.WriteHeader(status)
+	})
+
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// push sends an inbound broadcast carrying msg in the default codec to
+// the connected client
+func (m *mockRealtime) push(t *testing.T, topic string, msg *message.EncryptedMessage) {
+	t.Helper()
+
+	data, _ := BinaryCodec{}.Encode(msg)
+	inner, _ := json.Marshal(cloudFrame{Data: data})
+	payload, _ := json.Marshal(broadcastPayload{Type: "broadcast", Event: broadcastEvent, Payload: inner})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.conn.WriteJSON(phoenixMessage{Topic: topic, Event: "broadcast", Payload: payload}); err != nil {
+		t.Fatalf("push broadcast error: %v", err)
+	}
+}
+
+func newTestCloud(m *mockRealtime) *CloudTransport {
+	return NewCloudTransportWithProperties(TransportProperties{
+		PropCloudURL:    m.server.URL,
+		PropCloudAPIKey: "anon-key",
+		PropCloudUserID: "alice",
+	})
+}
+
+// ═══════════════════════════════════════
+// 1. Cloud Transport Lifecycle
+// ═══════════════════════════════════════
+
+func TestCloudStartJoinsOwnChannel(t *testing.T) {
+	m := newMockRealtime(t)
+	cloud := newTestCloud(m)
+
+	if err := cloud.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer cloud.Stop()
+
+	select {
+	case topic := <-m.joined:
+		if topic != "realtime:user:alice" {
+			t.Errorf("joined topic = %q, want %q", topic, "realtime:user:alice")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server never saw phx_join")
+	}
+
+	if !cloud.IsAvailable() {
+		t.Error("cloud transport should be available after Start()")
+	}
+	if m.apiKeys[0] != "anon-key" {
+		t.Errorf("websocket apikey = %q, want %q", m.apiKeys[0], "anon-key")
+	}
+}
+
+func TestCloudStartWithoutConfig(t *testing.T) {
+	cloud := NewCloudTransport()
+	if err := cloud.Start(); err != ErrNotConfigured {
+		t.Errorf("Start() without properties error = %v, want ErrNotConfigured", err)
+	}
+	if cloud.IsAvailable() {
+		t.Error("unconfigured cloud transport should not be available")
+	}
+}
+
+func TestCloudStartJoinRejected(t *testing.T) {
+	m := newMockRealtime(t)
+	m.rejectJoin = true
+	cloud := newTestCloud(m)
+
+	if err := cloud.Start(); err == nil {
+		cloud.Stop()
+		t.Fatal("Start() should fail when the join is rejected")
+	}
+	if cloud.State() != StateUnavailable {
+		t.Errorf("state = %v, want StateUnavailable", cloud.State())
+	}
+}
+
+func TestCloudStop(t *testing.T) {
+	m := newMockRealtime(t)
+	cloud := newTestCloud(m)
+	cloud.Start()
+
+	if err := cloud.Stop(); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	if cloud.State() != StateDisabled {
+		t.Errorf("state after Stop() = %v, want StateDisabled", cloud.State())
+	}
+}
+
+func TestCloudRestartClosesLostConnection(t *testing.T) {
+	m := newMockRealtime(t)
+	cloud := newTestCloud(m)
+	if err := cloud.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer cloud.Stop()
+	<-m.joined
+
+	cloud.mu.Lock()
+	oldConn, oldDone := cloud.conn, cloud.done
+	cloud.mu.Unlock()
+
+	// Drop the connection from the server side
+	m.mu.Lock()
+	m.conn.Close()
+	m.mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for cloud.State() != StateUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("transport should become unavailable when the connection drops")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := cloud.Start(); err != nil {
+		t.Fatalf("restart error: %v", err)
+	}
+	<-m.joined
+
+	select {
+	case <-oldDone:
+	default:
+		t.Error("restart should stop the lost connection's heartbeat")
+	}
+	cloud.mu.Lock()
+	replaced := cloud.conn != oldConn
+	cloud.mu.Unlock()
+	if !replaced || !cloud.IsAvailable() {
+		t.Error("restart should attach a new connection")
+	}
+}
+
+// ═══════════════════════════════════════
+// 2. Cloud Send / Receive
+// ═══════════════════════════════════════
+
+func TestCloudSendPublishesToRecipientChannel(t *testing.T) {
+	m := newMockRealtime(t)
+	cloud := newTestCloud(m)
+	cloud.Start()
+	defer cloud.Stop()
+
+	if err := cloud.Send("bob", []byte{0xDE, 0xAD}); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.broadcasts) != 1 {
+		t.Fatalf("broadcasts = %d, want 1", len(m.broadcasts))
+	}
+
+	bc := m.broadcasts[0]
+	if bc["topic"] != "user:bob" {
+		t.Errorf("topic = %v, want %q", bc["topic"], "user:bob")
+	}
+	if bc["event"] != broadcastEvent {
+		t.Errorf("event = %v, want %q", bc["event"], broadcastEvent)
+	}
+
+	// The data is published as it is, not wrapped in another message
+	raw, _ := json.Marshal(bc["payload"])
+	var sent cloudFrame
+	if err := json.Unmarshal(raw, &sent); err != nil {
+		t.Fatalf("payload is not a frame: %v", err)
+	}
+	if !bytes.Equal(sent.Data, []byte{0xDE, 0xAD}) {
+		t.Errorf("payload data = %x, want dead", sent.Data)
+	}
+}
+
+func TestCloudSendMessageUsesCodec(t *testing.T) {
+	m := newMockRealtime(t)
+	cloud := newTestCloud(m)
+	cloud.SetCodec(markingCodec{})
+	cloud.Start()
+	defer cloud.Stop()
+
+	msg := testEncryptedMessage()
+	if err := cloud.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	raw, _ := json.Marshal(m.broadcasts[0]["payload"])
+	var sent cloudFrame
+	json.Unmarshal(raw, &sent)
+	if want, _ := (markingCodec{}).Encode(msg); !bytes.Equal(sent.Data, want) {
+		t.Errorf("payload data = %x, want the codec's encoding %x", sent.Data, want)
+	}
+	if m.broadcasts[0]["topic"] != "user:bob" {
+		t.Errorf("topic = %v, want user:bob", m.broadcasts[0]["topic"])
+	}
+}
+
+func TestCloudSendNotStarted(t *testing.T) {
+	m := newMockRealtime(t)
+	cloud := newTestCloud(m)
+
+	if err := cloud.Send("bob", []byte{1}); err != ErrNotStarted {
+		t.Errorf("Send() before Start() error = %v, want ErrNotStarted", err)
+	}
+}
+
+func TestCloudSendClassifiesFailures(t *testing.T) {
+	m := newMockRealtime(t)
+	cloud := newTestCloud(m)
+	cloud.Start()
+	defer cloud.Stop()
+
+	for _, tc := range []struct {
+		status    int
+		retryable bool
+	}{
+		{http.StatusRequestEntityTooLarge, false},
+		{http.StatusBadRequest, false},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusUnauthorized, true},
+	} {
+		m.mu.Lock()
+		m.sendStatus = tc.status
+		m.mu.Unlock()
+
+		err := cloud.Send("bob", []byte{1})
+		if err == nil {
+			t.Errorf("Send() with status %d should fail", tc.status)
+			continue
+		}
+		if IsRetryable(err) != tc.retryable {
+			t.Errorf("IsRetryable(status %d) = %v, want %v", tc.status, !tc.retryable, tc.retryable)
+		}
+	}
+}
+
+func TestCloudReceiveHandler(t *testing.T) {
+	m := newMockRealtime(t)
+	cloud := newTestCloud(m)
+
+	received := make(chan *message.EncryptedMessage, 1)
+	cloud.SetReceiveHandler(func(msg *message.EncryptedMessage) {
+		received <- msg
+	})
+
+	cloud.Start()
+	defer cloud.Stop()
+	<-m.joined
+
+	m.push(t, "realtime:user:alice", &message.EncryptedMessage{
+		ID:               "in-1",
+		SenderID:         "bob",
+		RecipientID:      "alice",
+		EncryptedContent: []byte{1, 2, 3},
+		MessageType:      message.TypeText,
+		Timestamp:        1234,
+	})
+
+	select {
+	case msg := <-received:
+		if msg.ID != "in-1" || msg.SenderID != "bob" {
+			t.Errorf("received %q from %q, want in-1 from bob", msg.ID, msg.SenderID)
+		}
+		if !bytes.Equal(msg.EncryptedContent, []byte{1, 2, 3}) {
+			t.Errorf("EncryptedContent = %x, want 010203", msg.EncryptedContent)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive handler was not called")
+	}
+}
+
+func TestRealtimeSocketURL(t *testing.T) {
+	got, err := realtimeSocketURL("https://xyz.supabase.co/", "key")
+	if err != nil {
+		t.Fatalf("realtimeSocketURL() error: %v", err)
+	}
+	want := "wss://xyz.supabase.co/realtime/v1/websocket?apikey=key&vsn=1.0.0"
+	if got != want {
+		t.Errorf("realtimeSocketURL() = %q, want %q", got, want)
+	}
+}
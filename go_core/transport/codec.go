@@ -0,0 +1,35 @@
+package transport
+
+import "merabriar_core/message"
+
+// Codec converts an EncryptedMessage to and from the blob transports
+// carry, so the wire format doesn't depend on which transport sends it
+type Codec interface {
+	Encode(msg *message.EncryptedMessage) ([]byte, error)
+	Decode(data []byte) (*message.EncryptedMessage, error)
+}
+
+// BinaryCodec is the default Codec, using EncryptedMessage's binary form
+type BinaryCodec struct{}
+
+// codecOrDefault returns c, or BinaryCodec if c is nil
+func codecOrDefault(c Codec) Codec {
+	if c == nil {
+		return BinaryCodec{}
+	}
+	return c
+}
+
+// Encode implements Codec
+func (BinaryCodec) Encode(msg *message.EncryptedMessage) ([]byte, error) {
+	return msg.MarshalBinary()
+}
+
+// Decode implements Codec
+func (BinaryCodec) Decode(data []byte) (*message.EncryptedMessage, error) {
+	var msg message.EncryptedMessage
+	if err := msg.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+
+	msgsync "merabriar_core/sync"
+)
+
+// DrainQueue is the outbound queue a QueueDrainer sends from.
+// *msgsync.MessageQueue implements it.
+type DrainQueue interface {
+	SendQueue
+	GetReady() []*msgsync.QueuedMessage
+}
+
+// QueueDrainer sends a queue's ready messages whenever one of the
+// manager's transports becomes active, so messages queued while offline
+// go out as soon as there is a way to send them. Each message is sent
+// with EnqueueQueued, which acks it on success and schedules a retry on
+// failure.
+type QueueDrainer struct {
+	manager *TransportManager
+	queue   DrainQueue
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+}
+
+// NewQueueDrainer creates a drainer sending q's messages through m.
+// It does nothing until Start.
+func NewQueueDrainer(m *TransportManager, q DrainQueue) *QueueDrainer {
+	return &QueueDrainer{manager: m, queue: q}
+}
+
+// Start subscribes to the manager's transport state changes and drains
+// once now, in case a transport is already active
+func (d *QueueDrainer) Start() {
+	d.mu.Lock()
+	if d.started || d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	d.started = true
+	d.mu.Unlock()
+
+	d.manager.OnStateChange(d.onStateChange)
+	if d.manager.GetBestTransport() != nil {
+		d.Drain()
+	}
+}
+
+// Stop makes the drainer ignore further state changes. Sends already
+// enqueued still complete.
+func (d *QueueDrainer) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+}
+
+func (d *QueueDrainer) onStateChange(_ TransportID, state TransportState) {
+	d.mu.Lock()
+	stopped := d.stopped
+	d.mu.Unlock()
+
+	if state == StateActive && !stopped {
+		d.Drain()
+	}
+}
+
+// Drain enqueues every ready message whose recipient an available
+// transport can reach (see TransportManager.CanReach) and returns how
+// many were enqueued. Messages for unreachable recipients stay queued
+// without using up an attempt. Drain stops early if the send pool is full
+// or stopped; the rest are sent on the next activation or Drain.
+func (d *QueueDrainer) Drain() int {
+	n := 0
+	for _, msg := range d.queue.GetReady() {
+		if !d.manager.CanReach(msg.RecipientID) {
+			continue
+		}
+		err := d.manager.EnqueueQueued(d.queue, msg.ID, msg.RecipientID, msg.EncryptedContent)
+		if errors.Is(err, ErrSendQueueFull) || errors.Is(err, ErrSendStopped) {
+			break
+		}
+		n++
+	}
+	return n
+}
@@ -0,0 +1,288 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// LAN transport property keys
+const (
+	PropLANListenAddr = "listen_addr" // TCP address to accept peers on, e.g. ":7070"
+)
+
+// defaultLANListenAddr lets the system pick a port
+const defaultLANListenAddr = ":0"
+
+// maxLANFrameSize bounds a single inbound frame
+const maxLANFrameSize = 16 << 20
+
+// lanDialTimeout bounds how long Send waits to connect to a peer
+var lanDialTimeout = 5 * time.Second
+
+// errLANFrameTooLarge is returned when a peer announces an oversized frame
+var errLANFrameTooLarge = errors.New("lan frame too large")
+
+// LANTransport implements Transport for local network.
+// Peers connect over TCP and send EncryptedMessages encoded with the
+// manager's codec (see CodecAware), each prefixed with its uvarint
+// length. Send reaches only
+// peers whose address was registered with SetPeer; discovery is not
+// implemented yet.
+type LANTransport struct {
+	stateNotifier
+
+	mu       sync.Mutex
+	state    TransportState
+	props    TransportProperties
+	handler  ReceiveHandler
+	codec    Codec             // Decodes inbound frames; nil means BinaryCodec
+	peers    map[string]string // Recipient ID to TCP address
+	listener net.Listener
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// NewLANTransport creates a new LAN transport
+func NewLANTransport() *LANTransport {
+	return NewLANTransportWithProperties(TransportProperties{})
+}
+
+// NewLANTransportWithProperties creates a LAN transport with the given
+// configuration (see the PropLAN* keys)
+func NewLANTransportWithProperties(props TransportProperties) *LANTransport {
+	return &LANTransport{state: StateDisabled, props: props}
+}
+
+func (t *LANTransport) ID() TransportID {
+	return TransportLAN
+}
+
+func (t *LANTransport) State() TransportState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+func (t *LANTransport) IsAvailable() bool {
+	return t.State() == StateActive
+}
+
+// Addr returns the address the transport is accepting peers on, or nil
+// when it isn't started
+func (t *LANTransport) Addr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Addr()
+}
+
+// SetCodec sets the codec inbound frames are decoded with
+func (t *LANTransport) SetCodec(c Codec) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.codec = c
+}
+
+// SetPeer records the TCP address recipientID accepts LAN connections
+// on. An empty addr forgets the peer.
+func (t *LANTransport) SetPeer(recipientID, addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if addr == "" {
+		delete(t.peers, recipientID)
+		return
+	}
+	if t.peers == nil {
+		t.peers = make(map[string]string)
+	}
+	t.peers[recipientID] = addr
+}
+
+// CanReach reports whether the transport is started and has an address
+// for recipientID
+func (t *LANTransport) CanReach(recipientID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.peers[recipientID]
+	return ok && t.state == StateActive
+}
+
+// Send connects to the recipient's registered address and writes data as
+// one frame. A recipient without an address fails with a retryable
+// ErrNoRoute, so the manager falls back to another transport.
+func (t *LANTransport) Send(recipientID string, data []byte) error {
+	t.mu.Lock()
+	state, addr := t.state, t.peers[recipientID]
+	t.mu.Unlock()
+
+	if state != StateActive {
+		return ErrNotStarted
+	}
+	if addr == "" {
+		return &SendError{Reason: "lan peer " + recipientID, Err: ErrNoRoute, Retryable: true}
+	}
+	if len(data) > maxLANFrameSize {
+		return Permanent("lan send", errLANFrameTooLarge)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, lanDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(lanDialTimeout))
+	frame := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(data)), uint64(len(data)))
+	_, err = conn.Write(append(frame, data...))
+	return err
+}
+
+func (t *LANTransport) SetReceiveHandler(handler ReceiveHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handler = handler
+}
+
+// Start listens for peers and launches the accept loop
+func (t *LANTransport) Start() error {
+	before := t.State()
+	err := t.start()
+	if state := t.State(); state != before {
+		t.notify(TransportLAN, state)
+	}
+	return err
+}
+
+func (t *LANTransport) start() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state == StateActive {
+		return nil
+	}
+
+	addr := t.props[PropLANListenAddr]
+	if addr == "" {
+		addr = defaultLANListenAddr
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener, err := (&net.ListenConfig{}).Listen(ctx, "tcp", addr)
+	if err != nil {
+		cancel()
+		t.state = StateUnavailable
+		return err
+	}
+
+	t.listener = listener
+	t.cancel = cancel
+	t.state = StateActive
+
+	t.wg.Add(1)
+	go t.acceptLoop(ctx, listener)
+
+	return nil
+}
+
+// Stop cancels the accept loop and open peer connections, and waits for
+// their goroutines to exit
+func (t *LANTransport) Stop() error {
+	t.mu.Lock()
+	listener, cancel := t.listener, t.cancel
+	t.listener, t.cancel = nil, nil
+	changed := t.state != StateDisabled
+	t.state = StateDisabled
+	t.mu.Unlock()
+
+	if changed {
+		t.notify(TransportLAN, StateDisabled)
+	}
+
+	if cancel != nil {
+		cancel()
+		listener.Close()
+	}
+	t.wg.Wait()
+	return nil
+}
+
+// acceptLoop serves peer connections until ctx is cancelled
+func (t *LANTransport) acceptLoop(ctx context.Context, listener net.Listener) {
+	defer t.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				t.mu.Lock()
+				lost := t.listener == listener
+				if lost {
+					t.state = StateUnavailable
+				}
+				t.mu.Unlock()
+				if lost {
+					t.notify(TransportLAN, StateUnavailable)
+				}
+			}
+			return
+		}
+
+		t.wg.Add(1)
+		go t.serveConn(ctx, conn)
+	}
+}
+
+// serveConn dispatches a peer's messages until it disconnects or ctx is
+// cancelled
+func (t *LANTransport) serveConn(ctx context.Context, conn net.Conn) {
+	defer t.wg.Done()
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := readLANFrame(r)
+		if err != nil {
+			return
+		}
+
+		t.mu.Lock()
+		handler, codec := t.handler, codecOrDefault(t.codec)
+		t.mu.Unlock()
+
+		msg, err := codec.Decode(frame)
+		if err != nil {
+			return
+		}
+		if ctx.Err() == nil {
+			deliver(handler, msg)
+		}
+	}
+}
+
+// readLANFrame reads one length-prefixed frame
+func readLANFrame(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxLANFrameSize {
+		return nil, errLANFrameTooLarge
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,216 @@
+// Package transport tests - LAN transport lifecycle and framing
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"merabriar_core/message"
+)
+
+func startTestLAN(t *testing.T) *LANTransport {
+	t.Helper()
+	lan := NewLANTransportWithProperties(TransportProperties{PropLANListenAddr: "127.0.0.1:0"})
+	if err := lan.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	return lan
+}
+
+// writeTestFrame sends msg in the LAN framing
+func writeTestFrame(t *testing.T, conn net.Conn, msg *message.EncryptedMessage) {
+	t.Helper()
+	data, _ := msg.MarshalBinary()
+	if _, err := conn.Write(append(binary.AppendUvarint(nil, uint64(len(data))), data...)); err != nil {
+		t.Fatalf("write frame error: %v", err)
+	}
+}
+
+func TestLANTransportReceives(t *testing.T) {
+	lan := startTestLAN(t)
+	defer lan.Stop()
+
+	received := make(chan *message.EncryptedMessage, 2)
+	lan.SetReceiveHandler(func(msg *message.EncryptedMessage) { received <- msg })
+
+	conn, err := net.Dial("tcp", lan.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+
+	writeTestFrame(t, conn, &message.EncryptedMessage{ID: "m1", SenderID: "alice", EncryptedContent: []byte{1, 2}})
+	writeTestFrame(t, conn, &message.EncryptedMessage{ID: "m2", SenderID: "alice"})
+
+	for _, want := range []string{"m1", "m2"} {
+		select {
+		case msg := <-received:
+			if msg.ID != want {
+				t.Errorf("received ID = %q, want %q", msg.ID, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("message %s not received", want)
+		}
+	}
+}
+
+func TestLANTransportDropsPastHopLimit(t *testing.T) {
+	lan := startTestLAN(t)
+	defer lan.Stop()
+
+	received := make(chan *message.EncryptedMessage, 2)
+	lan.SetReceiveHandler(func(msg *message.EncryptedMessage) { received <- msg })
+
+	conn, err := net.Dial("tcp", lan.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+
+	writeTestFrame(t, conn, &message.EncryptedMessage{ID: "looping", HopCount: message.MaxHopCount + 1})
+	writeTestFrame(t, conn, &message.EncryptedMessage{ID: "relayed", TransportHint: string(TransportLAN), HopCount: 1})
+
+	select {
+	case msg := <-received:
+		if msg.ID != "relayed" || msg.HopCount != 1 || msg.TransportHint != string(TransportLAN) {
+			t.Errorf("received %+v, want only the relayed message", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("relayed message not received")
+	}
+}
+
+func TestLANTransportState(t *testing.T) {
+	lan := NewLANTransportWithProperties(TransportProperties{PropLANListenAddr: "127.0.0.1:0"})
+	if lan.IsAvailable() || lan.Addr() != nil {
+		t.Error("transport should be unavailable before Start")
+	}
+
+	lan.Start()
+	if !lan.IsAvailable() || lan.Addr() == nil {
+		t.Error("transport should be available after Start")
+	}
+
+	lan.Stop()
+	if lan.State() != StateDisabled || lan.Addr() != nil {
+		t.Errorf("state after Stop = %v, want StateDisabled", lan.State())
+	}
+}
+
+func TestLANTransportStopClosesPeers(t *testing.T) {
+	lan := startTestLAN(t)
+
+	conn, err := net.Dial("tcp", lan.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+
+	// Make sure the connection is being served before stopping
+	received := make(chan struct{}, 1)
+	lan.SetReceiveHandler(func(*message.EncryptedMessage) { received <- struct{}{} })
+	writeTestFrame(t, conn, &message.EncryptedMessage{ID: "m1"})
+	<-received
+
+	lan.Stop()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("peer connection should be closed by Stop")
+	}
+}
+
+func TestLANTransportRejectsOversizedFrame(t *testing.T) {
+	lan := startTestLAN(t)
+	defer lan.Stop()
+
+	conn, err := net.Dial("tcp", lan.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write(binary.AppendUvarint(nil, maxLANFrameSize+1))
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection announcing an oversized frame should be closed")
+	}
+}
+
+func TestLANTransportStartStopNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		lan := startTestLAN(t)
+		conn, err := net.Dial("tcp", lan.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error: %v", err)
+		}
+		lan.Stop()
+		conn.Close()
+	}
+
+	// Stop waits for its goroutines, but allow the runtime a moment to
+	// retire unrelated ones
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines after start/stop cycles = %d, want <= %d", after, before)
+	}
+}
+
+func TestLANTransportSendsToPeer(t *testing.T) {
+	alice, bob := startTestLAN(t), startTestLAN(t)
+	defer alice.Stop()
+	defer bob.Stop()
+
+	received := make(chan *message.EncryptedMessage, 1)
+	bob.SetReceiveHandler(func(msg *message.EncryptedMessage) { received <- msg })
+
+	data, _ := (&message.EncryptedMessage{ID: "m1", SenderID: "alice", RecipientID: "bob"}).MarshalBinary()
+	if alice.CanReach("bob") {
+		t.Error("CanReach() before SetPeer = true, want false")
+	}
+	if err := alice.Send("bob", data); !errors.Is(err, ErrNoRoute) || !IsRetryable(err) {
+		t.Errorf("Send() to an unknown peer error = %v, want retryable ErrNoRoute", err)
+	}
+
+	alice.SetPeer("bob", bob.Addr().String())
+	if !alice.CanReach("bob") {
+		t.Error("CanReach() after SetPeer = false, want true")
+	}
+	if err := alice.Send("bob", data); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	select {
+	case msg := <-received:
+		if msg.ID != "m1" || msg.SenderID != "alice" {
+			t.Errorf("received %+v, want m1 from alice", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	alice.SetPeer("bob", "")
+	if alice.CanReach("bob") {
+		t.Error("CanReach() after forgetting the peer = true, want false")
+	}
+}
+
+func TestLANTransportSendWhenStopped(t *testing.T) {
+	lan := NewLANTransport()
+	lan.SetPeer("bob", "127.0.0.1:1")
+	if err := lan.Send("bob", []byte("x")); err == nil || !IsRetryable(err) {
+		t.Errorf("Send() before Start error = %v, want a retryable error", err)
+	}
+	if lan.CanReach("bob") {
+		t.Error("CanReach() before Start = true, want false")
+	}
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"bytes"
+	"sync"
+
+	"merabriar_core/message"
+)
+
+// SentPayload is one successful MockTransport send
+type SentPayload struct {
+	RecipientID string
+	Data        []byte
+}
+
+// MockTransport is a controllable in-memory Transport for tests. It is
+// available once created; Stop, or SetAvailable(false), takes it down.
+// Sends fail with the error set by SetSendError, and otherwise are
+// recorded for Sent. Inject simulates an inbound message. State changes
+// are reported to the StateListener. It is safe for concurrent use, e.g.
+// by the manager's send workers.
+type MockTransport struct {
+	id TransportID
+	stateNotifier
+
+	mu        sync.Mutex
+	available bool
+	sendErr   error
+	sent      []SentPayload
+	handler   ReceiveHandler
+}
+
+// NewMockTransport creates an available mock transport with the given ID
+func NewMockTransport(id TransportID) *MockTransport {
+	return &MockTransport{id: id, available: true}
+}
+
+func (t *MockTransport) ID() TransportID {
+	return t.id
+}
+
+func (t *MockTransport) State() TransportState {
+	if t.IsAvailable() {
+		return StateActive
+	}
+	return StateDisabled
+}
+
+func (t *MockTransport) IsAvailable() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.available
+}
+
+// SetAvailable brings the transport up or down, notifying the
+// StateListener if that changes its state
+func (t *MockTransport) SetAvailable(available bool) {
+	t.mu.Lock()
+	changed := t.available != available
+	t.available = available
+	t.mu.Unlock()
+
+	if changed {
+		t.notify(t.id, t.State())
+	}
+}
+
+// SetSendError makes every Send fail with err until it is reset with nil
+func (t *MockTransport) SetSendError(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sendErr = err
+}
+
+// Send records data, or returns the error set by SetSendError. It doesn't
+// check availability, as the manager skips unavailable transports.
+func (t *MockTransport) Send(recipientID string, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sendErr != nil {
+		return t.sendErr
+	}
+	t.sent = append(t.sent, SentPayload{RecipientID: recipientID, Data: bytes.Clone(data)})
+	return nil
+}
+
+// Sent returns the successful sends, oldest first
+func (t *MockTransport) Sent() []SentPayload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]SentPayload(nil), t.sent...)
+}
+
+// SentCount returns how many sends succeeded
+func (t *MockTransport) SentCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sent)
+}
+
+// LastSent returns the data of the latest successful send, or nil
+func (t *MockTransport) LastSent() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.sent) == 0 {
+		return nil
+	}
+	return t.sent[len(t.sent)-1].Data
+}
+
+func (t *MockTransport) SetReceiveHandler(handler ReceiveHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handler = handler
+}
+
+// Inject delivers msg to the receive handler as if it had arrived over
+// the transport, applying the same hop limit as real transports
+func (t *MockTransport) Inject(msg *message.EncryptedMessage) {
+	t.mu.Lock()
+	handler := t.handler
+	t.mu.Unlock()
+	deliver(handler, msg)
+}
+
+func (t *MockTransport) Start() error {
+	t.SetAvailable(true)
+	return nil
+}
+
+func (t *MockTransport) Stop() error {
+	t.SetAvailable(false)
+	return nil
+}
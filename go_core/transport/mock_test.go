@@ -0,0 +1,93 @@
+// Package transport tests - mock transport behaviour
+package transport
+
+import (
+	"errors"
+	"testing"
+
+	"merabriar_core/message"
+)
+
+var _ Transport = (*MockTransport)(nil)
+
+func TestMockTransportAvailability(t *testing.T) {
+	mock := NewMockTransport(TransportLAN)
+	if mock.ID() != TransportLAN || !mock.IsAvailable() || mock.State() != StateActive {
+		t.Fatalf("new mock: id %s, available %v, state %v; want available LAN", mock.ID(), mock.IsAvailable(), mock.State())
+	}
+
+	mock.SetAvailable(false)
+	if mock.IsAvailable() || mock.State() != StateDisabled {
+		t.Error("SetAvailable(false) should take the mock down")
+	}
+	mock.Start()
+	if !mock.IsAvailable() {
+		t.Error("Start() should bring the mock up")
+	}
+	mock.Stop()
+	if mock.IsAvailable() {
+		t.Error("Stop() should take the mock down")
+	}
+}
+
+func TestMockTransportRecordsSends(t *testing.T) {
+	mock := NewMockTransport(TransportCloud)
+	if mock.LastSent() != nil || mock.SentCount() != 0 {
+		t.Fatal("new mock should have sent nothing")
+	}
+
+	data := []byte("one")
+	mock.Send("bob", data)
+	data[0] = 'X' // The mock keeps its own copy
+	mock.Send("carol", []byte("two"))
+
+	sent := mock.Sent()
+	if len(sent) != 2 || sent[0].RecipientID != "bob" || string(sent[0].Data) != "one" ||
+		sent[1].RecipientID != "carol" || string(mock.LastSent()) != "two" {
+		t.Errorf("Sent() = %+v, want bob/one then carol/two", sent)
+	}
+
+	offline := errors.New("offline")
+	mock.SetSendError(offline)
+	if err := mock.Send("bob", []byte("three")); err != offline {
+		t.Errorf("Send() with a send error = %v, want %v", err, offline)
+	}
+	mock.SetSendError(nil)
+	if err := mock.Send("bob", []byte("four")); err != nil || mock.SentCount() != 3 {
+		t.Errorf("Send() after clearing the error = %v, count %d; want nil, 3", err, mock.SentCount())
+	}
+}
+
+func TestMockTransportInject(t *testing.T) {
+	mock := NewMockTransport(TransportLAN)
+	mock.Inject(&message.EncryptedMessage{ID: "no handler"}) // Dropped
+
+	var got []string
+	mock.SetReceiveHandler(func(msg *message.EncryptedMessage) { got = append(got, msg.ID) })
+	mock.Inject(&message.EncryptedMessage{ID: "m1"})
+	mock.Inject(&message.EncryptedMessage{ID: "looping", HopCount: message.MaxHopCount + 1})
+	mock.Inject(&message.EncryptedMessage{ID: "m2"})
+
+	if len(got) != 2 || got[0] != "m1" || got[1] != "m2" {
+		t.Errorf("handler received %v, want [m1 m2]", got)
+	}
+}
+
+func TestMockTransportNotifiesStateChanges(t *testing.T) {
+	mock := NewMockTransport(TransportLAN)
+	var got []TransportState
+	mock.SetStateListener(func(id TransportID, state TransportState) {
+		if id != TransportLAN {
+			t.Errorf("listener got id %s, want %s", id, TransportLAN)
+		}
+		got = append(got, state)
+	})
+
+	mock.Stop()
+	mock.Stop() // No change, no notification
+	mock.Start()
+
+	if len(got) != 2 || got[0] != StateDisabled || got[1] != StateActive {
+		t.Errorf("notified %v, want [%d %d] (disabled, active)", got, StateDisabled, StateActive)
+	}
+}
@@ -0,0 +1,174 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+)
+
+// Asynchronous send pool sizing
+const (
+	SendWorkers   = 4   // Goroutines performing queued sends
+	SendQueueSize = 256 // Sends that may wait for a worker
+)
+
+var (
+	// ErrSendQueueFull is returned when every send worker is busy and the
+	// pending queue is full; the caller should retry later
+	ErrSendQueueFull = errors.New("send queue full")
+	// ErrSendStopped is returned by sends enqueued after Stop
+	ErrSendStopped = errors.New("send pool stopped")
+)
+
+// SendQueue is the outbound queue whose ack state EnqueueQueued updates.
+// *sync.MessageQueue implements it.
+type SendQueue interface {
+	CheckoutForSend(id string) bool
+	Ack(id string) bool
+	MarkFailed(id string) bool
+}
+
+// DropHandler is called for a queued message that EnqueueQueued removed
+// from its queue because the send failed permanently
+type DropHandler func(id, recipientID string, err error)
+
+// sendJob is one send waiting for a worker
+type sendJob struct {
+	queue       SendQueue // Nil for a plain EnqueueSend
+	id          string
+	recipientID string
+	data        []byte
+}
+
+// sendPool runs sends on background workers, started on first use
+type sendPool struct {
+	mu      sync.Mutex
+	jobs    chan sendJob
+	stopped bool
+	pending int        // Jobs enqueued but not finished
+	idle    *sync.Cond // Signalled when pending drops to zero
+	workers sync.WaitGroup
+}
+
+// done records that a job has finished
+func (p *sendPool) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending--
+	if p.pending == 0 {
+		p.idle.Broadcast()
+	}
+}
+
+// EnqueueSend sends data to recipientID like Send, but on a background
+// worker, so it never blocks the caller. The outcome isn't reported;
+// use EnqueueQueued for messages whose delivery must be tracked.
+func (m *TransportManager) EnqueueSend(recipientID string, data []byte) error {
+	return m.enqueue(sendJob{recipientID: recipientID, data: data})
+}
+
+// EnqueueQueued sends a message from q on a background worker. The worker
+// checks the message out of q, sends it like Send, then Acks it on
+// success or marks it failed, so it is retried after a backoff. A
+// permanent failure (see IsRetryable) would fail again on every retry, so
+// the message is removed from q and reported to the OnDrop handler
+// instead. A message already in flight or no longer queued is skipped.
+func (m *TransportManager) EnqueueQueued(q SendQueue, id, recipientID string, data []byte) error {
+	return m.enqueue(sendJob{queue: q, id: id, recipientID: recipientID, data: data})
+}
+
+// OnDrop sets the handler told about queued messages dropped after a
+// permanent send failure, replacing any previous one
+func (m *TransportManager) OnDrop(h DropHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onDrop = h
+}
+
+func (m *TransportManager) enqueue(job sendJob) error {
+	p := &m.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return ErrSendStopped
+	}
+	if p.jobs == nil {
+		p.jobs = make(chan sendJob, SendQueueSize)
+		p.idle = sync.NewCond(&p.mu)
+		for i := 0; i < SendWorkers; i++ {
+			p.workers.Add(1)
+			go m.sendWorker(p.jobs)
+		}
+	}
+
+	select {
+	case p.jobs <- job:
+		p.pending++
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+func (m *TransportManager) sendWorker(jobs <-chan sendJob) {
+	defer m.pool.workers.Done()
+	for job := range jobs {
+		m.runSend(job)
+		m.pool.done()
+	}
+}
+
+func (m *TransportManager) runSend(job sendJob) {
+	if job.queue == nil {
+		m.Send(job.recipientID, job.data)
+		return
+	}
+
+	if !job.queue.CheckoutForSend(job.id) {
+		return
+	}
+	err := m.Send(job.recipientID, job.data)
+	switch {
+	case err == nil:
+		job.queue.Ack(job.id)
+	case IsRetryable(err):
+		job.queue.MarkFailed(job.id)
+	default:
+		job.queue.Ack(job.id)
+		m.mu.Lock()
+		onDrop := m.onDrop
+		m.mu.Unlock()
+		if onDrop != nil {
+			onDrop(job.id, job.recipientID, err)
+		}
+	}
+}
+
+// Drain waits until every enqueued send has finished
+func (m *TransportManager) Drain() {
+	p := &m.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.pending > 0 {
+		p.idle.Wait()
+	}
+}
+
+// Stop finishes the enqueued sends, then stops the workers. Sends
+// enqueued afterwards fail with ErrSendStopped.
+func (m *TransportManager) Stop() {
+	p := &m.pool
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	jobs := p.jobs
+	p.mu.Unlock()
+
+	if jobs != nil {
+		close(jobs)
+	}
+	p.workers.Wait()
+}
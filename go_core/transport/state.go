@@ -0,0 +1,66 @@
+package transport
+
+import "sync"
+
+// StateListener is called after a transport changes state
+type StateListener func(id TransportID, state TransportState)
+
+// StateNotifier is implemented by transports that report their state
+// changes. A transport has one listener; the TransportManager installs
+// its own and fans out to OnStateChange subscribers.
+type StateNotifier interface {
+	SetStateListener(l StateListener)
+}
+
+// stateNotifier holds a transport's StateListener. Embed it to implement
+// StateNotifier.
+type stateNotifier struct {
+	listenerMu sync.Mutex
+	listener   StateListener
+}
+
+func (n *stateNotifier) SetStateListener(l StateListener) {
+	n.listenerMu.Lock()
+	defer n.listenerMu.Unlock()
+	n.listener = l
+}
+
+// notify calls the listener, if any. Call it without holding the
+// transport's own lock, as the listener may query the transport.
+func (n *stateNotifier) notify(id TransportID, state TransportState) {
+	n.listenerMu.Lock()
+	l := n.listener
+	n.listenerMu.Unlock()
+	if l != nil {
+		l(id, state)
+	}
+}
+
+// OnStateChange subscribes l to the state changes of the manager's
+// transports that implement StateNotifier. l runs on the goroutine that
+// changed the state, so it should not block.
+func (m *TransportManager) OnStateChange(l StateListener) {
+	m.mu.Lock()
+	first := len(m.listeners) == 0
+	m.listeners = append(m.listeners, l)
+	m.mu.Unlock()
+
+	if first {
+		for _, t := range m.transports {
+			if n, ok := t.(StateNotifier); ok {
+				n.SetStateListener(m.notifyState)
+			}
+		}
+	}
+}
+
+// notifyState passes a transport state change to every subscriber
+func (m *TransportManager) notifyState(id TransportID, state TransportState) {
+	m.mu.Lock()
+	listeners := append([]StateListener(nil), m.listeners...)
+	m.mu.Unlock()
+
+	for _, l := range listeners {
+		l(id, state)
+	}
+}
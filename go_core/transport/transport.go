@@ -2,6 +2,63 @@
 // This mirrors Briar's plugin-based transport system in bramble-api/plugin
 package transport
 
+import (
+	"errors"
+	"sync"
+
+	"merabriar_core/message"
+)
+
+var (
+	// ErrNoTransport is returned when no transport is available to send
+	ErrNoTransport = errors.New("no transport available")
+	// ErrRateLimited is matched by Send's error when a transport was over
+	// its send rate; the caller should re-queue the message and retry later
+	ErrRateLimited = errors.New("transport rate limited")
+	// ErrNoRoute is returned, as a retryable SendError, by a transport that
+	// doesn't know how to reach the recipient
+	ErrNoRoute = errors.New("no route to recipient")
+)
+
+// SendError is a classified send failure. Transports return one with
+// Retryable false for failures that no retry or other transport will fix,
+// such as an invalid recipient or an oversized message. Errors that
+// aren't SendErrors are treated as retryable.
+type SendError struct {
+	Reason    string
+	Retryable bool
+	Err       error // Underlying error, if any
+}
+
+func (e *SendError) Error() string {
+	if e.Err != nil {
+		return e.Reason + ": " + e.Err.Error()
+	}
+	return e.Reason
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent returns a non-retryable SendError
+func Permanent(reason string, err error) error {
+	return &SendError{Reason: reason, Err: err}
+}
+
+// IsRetryable reports whether a send that failed with err may succeed if
+// retried. It is false for nil and for non-retryable SendErrors.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var sendErr *SendError
+	if errors.As(err, &sendErr) {
+		return sendErr.Retryable
+	}
+	return true
+}
+
 // TransportID identifies a transport
 type TransportID string
 
@@ -25,94 +82,50 @@ const (
 // TransportProperties holds transport-specific configuration
 type TransportProperties map[string]string
 
-// Transport interface (like Briar's Plugin)
+// ReceiveHandler is called for every inbound message a transport receives
+type ReceiveHandler func(msg *message.EncryptedMessage)
+
+// deliver passes an inbound message to handler, if set, dropping messages
+// that have been relayed more than message.MaxHopCount times
+func deliver(handler ReceiveHandler, msg *message.EncryptedMessage) {
+	if handler == nil || msg.HopLimitExceeded() {
+		return
+	}
+	handler(msg)
+}
+
+// Transport interface (like Briar's Plugin).
+// Start launches any background goroutines the transport needs to
+// receive. Stop cancels them and returns only after they have exited,
+// so a stopped transport never calls its receive handler.
 type Transport interface {
 	ID() TransportID
 	State() TransportState
 	IsAvailable() bool
 	Send(recipientID string, data []byte) error
+	SetReceiveHandler(handler ReceiveHandler)
 	Start() error
 	Stop() error
 }
 
-// CloudTransport implements Transport for Supabase Realtime
-type CloudTransport struct {
-	state TransportState
-}
-
-// NewCloudTransport creates a new cloud transport
-func NewCloudTransport() *CloudTransport {
-	return &CloudTransport{state: StateDisabled}
-}
-
-func (t *CloudTransport) ID() TransportID {
-	return TransportCloud
-}
-
-func (t *CloudTransport) State() TransportState {
-	return t.state
-}
-
-func (t *CloudTransport) IsAvailable() bool {
-	return t.state == StateActive
-}
-
-func (t *CloudTransport) Send(recipientID string, data []byte) error {
-	// In production: Send via Supabase Realtime
-	// This is handled by Flutter/Dart side
-	return nil
-}
-
-func (t *CloudTransport) Start() error {
-	t.state = StateActive
-	return nil
-}
-
-func (t *CloudTransport) Stop() error {
-	t.state = StateDisabled
-	return nil
-}
-
-// LANTransport implements Transport for local network
-type LANTransport struct {
-	state TransportState
-}
-
-// NewLANTransport creates a new LAN transport
-func NewLANTransport() *LANTransport {
-	return &LANTransport{state: StateDisabled}
-}
-
-func (t *LANTransport) ID() TransportID {
-	return TransportLAN
-}
-
-func (t *LANTransport) State() TransportState {
-	return t.state
-}
-
-func (t *LANTransport) IsAvailable() bool {
-	return t.state == StateActive
+// CodecAware is implemented by transports that decode inbound messages
+// themselves. The manager passes them its codec, so what they receive is
+// decoded with the codec peers encode with. Until then they use
+// BinaryCodec.
+type CodecAware interface {
+	SetCodec(c Codec)
 }
 
-func (t *LANTransport) Send(recipientID string, data []byte) error {
-	// Phase 2: Implement mDNS discovery + TCP
-	return nil
-}
-
-func (t *LANTransport) Start() error {
-	// Phase 2: Start mDNS
-	return nil
-}
-
-func (t *LANTransport) Stop() error {
-	t.state = StateDisabled
-	return nil
+// Reachability is implemented by transports that can only reach some
+// recipients, e.g. LAN peers with a known address
+type Reachability interface {
+	CanReach(recipientID string) bool
 }
 
 // BluetoothTransport implements Transport for Bluetooth LE
 type BluetoothTransport struct {
-	state TransportState
+	state   TransportState
+	handler ReceiveHandler
 }
 
 // NewBluetoothTransport creates a new Bluetooth transport
@@ -137,6 +150,10 @@ func (t *BluetoothTransport) Send(recipientID string, data []byte) error {
 	return nil
 }
 
+func (t *BluetoothTransport) SetReceiveHandler(handler ReceiveHandler) {
+	t.handler = handler
+}
+
 func (t *BluetoothTransport) Start() error {
 	// Phase 2: Start BLE scanning
 	return nil
@@ -149,7 +166,8 @@ func (t *BluetoothTransport) Stop() error {
 
 // TorTransport implements Transport for Tor hidden services
 type TorTransport struct {
-	state TransportState
+	state   TransportState
+	handler ReceiveHandler
 }
 
 // NewTorTransport creates a new Tor transport
@@ -174,6 +192,10 @@ func (t *TorTransport) Send(recipientID string, data []byte) error {
 	return nil
 }
 
+func (t *TorTransport) SetReceiveHandler(handler ReceiveHandler) {
+	t.handler = handler
+}
+
 func (t *TorTransport) Start() error {
 	// Phase 3: Start Tor client
 	return nil
@@ -187,18 +209,151 @@ func (t *TorTransport) Stop() error {
 // TransportManager manages and selects transports
 type TransportManager struct {
 	transports []Transport
+	limiters   map[TransportID]*rateLimiter
+	codec      Codec
+	pool       sendPool
+	listeners  []StateListener // See OnStateChange
+	onDrop     DropHandler
+	mu         sync.Mutex
 }
 
 // NewTransportManager creates a new transport manager
 func NewTransportManager() *TransportManager {
-	return &TransportManager{
-		transports: []Transport{
-			NewCloudTransport(),
-			NewLANTransport(),
-			NewBluetoothTransport(),
-			NewTorTransport(),
-		},
+	return NewTransportManagerWith(
+		NewCloudTransport(),
+		NewLANTransport(),
+		NewBluetoothTransport(),
+		NewTorTransport(),
+	)
+}
+
+// NewTransportManagerWith creates a manager over the given transports,
+// in priority order
+func NewTransportManagerWith(transports ...Transport) *TransportManager {
+	m := &TransportManager{
+		transports: transports,
+		limiters:   make(map[TransportID]*rateLimiter),
+	}
+	m.SetCodec(BinaryCodec{})
+	return m
+}
+
+// SetCodec replaces the codec used by SendMessage and Decode, and passes
+// it to the transports that implement CodecAware, so inbound messages are
+// decoded with it too. Both peers must use the same codec.
+func (m *TransportManager) SetCodec(c Codec) {
+	m.mu.Lock()
+	m.codec = c
+	m.mu.Unlock()
+
+	for _, t := range m.transports {
+		if ca, ok := t.(CodecAware); ok {
+			ca.SetCodec(c)
+		}
+	}
+}
+
+// SendMessage encodes msg with the manager's codec and sends it to
+// msg.RecipientID like Send. Whichever transport is used carries the
+// same bytes, unwrapped.
+func (m *TransportManager) SendMessage(msg *message.EncryptedMessage) error {
+	m.mu.Lock()
+	codec := m.codec
+	m.mu.Unlock()
+
+	data, err := codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return m.Send(msg.RecipientID, data)
+}
+
+// Relay forwards a message received for another peer to msg.RecipientID
+// like SendMessage, incrementing its hop count and recording the best
+// available transport as its TransportHint. A message that has already
+// passed through message.MaxHopCount relays is dropped with
+// message.ErrHopLimitExceeded.
+func (m *TransportManager) Relay(msg *message.EncryptedMessage) error {
+	var via TransportID
+	if t := m.GetBestTransport(); t != nil {
+		via = t.ID()
+	}
+	relayed, err := msg.Relayed(string(via))
+	if err != nil {
+		return err
 	}
+	return m.SendMessage(relayed)
+}
+
+// Decode decodes a blob with the manager's codec, for transports that
+// don't implement CodecAware
+func (m *TransportManager) Decode(data []byte) (*message.EncryptedMessage, error) {
+	m.mu.Lock()
+	codec := m.codec
+	m.mu.Unlock()
+
+	return codec.Decode(data)
+}
+
+// SetRateLimit limits sends on a transport. A zero PerSecond removes the limit.
+func (m *TransportManager) SetRateLimit(id TransportID, limit RateLimit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if limit.PerSecond <= 0 {
+		delete(m.limiters, id)
+		return
+	}
+	m.limiters[id] = newRateLimiter(limit)
+}
+
+// Send sends data over the best available transport, falling back to the
+// next one in priority order if a transport fails or is over its rate
+// limit. A permanent failure (see IsRetryable) is returned at once without
+// trying the remaining transports. If any transport was over its rate
+// limit, the error matches ErrRateLimited (see errors.Is), joined with the
+// last failure of the others.
+func (m *TransportManager) Send(recipientID string, data []byte) error {
+	var lastErr error
+	rateLimited := false
+	for _, t := range m.transports {
+		if !t.IsAvailable() {
+			continue
+		}
+
+		if !m.allow(t.ID()) {
+			rateLimited = true
+			continue
+		}
+
+		err := t.Send(recipientID, data)
+		if err == nil {
+			return nil
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+		lastErr = err
+	}
+
+	switch {
+	case rateLimited && lastErr != nil:
+		return errors.Join(ErrRateLimited, lastErr)
+	case rateLimited:
+		return ErrRateLimited
+	case lastErr == nil:
+		return ErrNoTransport
+	}
+	return lastErr
+}
+
+// allow reports whether a transport may send now
+func (m *TransportManager) allow(id TransportID) bool {
+	m.mu.Lock()
+	limiter := m.limiters[id]
+	m.mu.Unlock()
+
+	return limiter == nil || limiter.Allow()
 }
 
 // GetBestTransport returns the best available transport
@@ -212,6 +367,21 @@ func (m *TransportManager) GetBestTransport() Transport {
 	return nil
 }
 
+// CanReach reports whether an available transport can send to
+// recipientID. Transports that don't implement Reachability are assumed
+// to reach every recipient.
+func (m *TransportManager) CanReach(recipientID string) bool {
+	for _, t := range m.transports {
+		if !t.IsAvailable() {
+			continue
+		}
+		if r, ok := t.(Reachability); !ok || r.CanReach(recipientID) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetAvailableTransports returns all available transports
 func (m *TransportManager) GetAvailableTransports() []Transport {
 	var available []Transport
@@ -0,0 +1,574 @@
+// Package transport tests - transport manager selection and rate limiting
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"merabriar_core/message"
+	msgsync "merabriar_core/sync"
+)
+
+// failingTransport returns an available MockTransport whose sends fail
+// with err
+func failingTransport(id TransportID, err error) *MockTransport {
+	t := NewMockTransport(id)
+	t.SetSendError(err)
+	return t
+}
+
+// fakeClock returns a controllable time source
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.t }
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// ═══════════════════════════════════════
+// 1. Manager Send
+// ═══════════════════════════════════════
+
+func TestManagerSendUsesBestTransport(t *testing.T) {
+	primary := NewMockTransport(TransportCloud)
+	secondary := NewMockTransport(TransportLAN)
+	m := NewTransportManagerWith(primary, secondary)
+
+	if err := m.Send("bob", []byte("hi")); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	if primary.SentCount() != 1 || secondary.SentCount() != 0 {
+		t.Errorf("sent primary=%d secondary=%d, want 1/0", primary.SentCount(), secondary.SentCount())
+	}
+}
+
+func TestManagerSendFallsBack(t *testing.T) {
+	primary := failingTransport(TransportCloud, errors.New("offline"))
+	secondary := NewMockTransport(TransportLAN)
+	m := NewTransportManagerWith(primary, secondary)
+
+	if err := m.Send("bob", []byte("hi")); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	if secondary.SentCount() != 1 {
+		t.Errorf("fallback transport sent = %d, want 1", secondary.SentCount())
+	}
+}
+
+func TestManagerSendNoTransport(t *testing.T) {
+	down := NewMockTransport(TransportCloud)
+	down.SetAvailable(false)
+	m := NewTransportManagerWith(down)
+
+	if err := m.Send("bob", []byte("hi")); err != ErrNoTransport {
+		t.Errorf("Send() error = %v, want ErrNoTransport", err)
+	}
+}
+
+func TestManagerSendStopsOnPermanentError(t *testing.T) {
+	rejected := Permanent("recipient blocked", nil)
+	primary := failingTransport(TransportCloud, rejected)
+	secondary := NewMockTransport(TransportLAN)
+	m := NewTransportManagerWith(primary, secondary)
+
+	err := m.Send("bob", []byte("hi"))
+	if err != rejected {
+		t.Errorf("Send() error = %v, want the permanent error", err)
+	}
+	if IsRetryable(err) {
+		t.Error("permanent error should not be retryable")
+	}
+	if secondary.SentCount() != 0 {
+		t.Errorf("fallback transport sent = %d after a permanent error, want 0", secondary.SentCount())
+	}
+}
+
+func TestManagerSendFallsBackOnRetryableError(t *testing.T) {
+	for _, sendErr := range []error{
+		&SendError{Reason: "network down", Retryable: true},
+		errors.New("unclassified"),
+	} {
+		primary := failingTransport(TransportCloud, sendErr)
+		secondary := NewMockTransport(TransportLAN)
+		m := NewTransportManagerWith(primary, secondary)
+
+		if err := m.Send("bob", []byte("hi")); err != nil {
+			t.Errorf("Send() with %v error: %v", sendErr, err)
+		}
+		if secondary.SentCount() != 1 {
+			t.Errorf("fallback after %v sent = %d, want 1", sendErr, secondary.SentCount())
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cause := errors.New("413")
+	permanent := Permanent("too large", cause)
+
+	if IsRetryable(nil) {
+		t.Error("IsRetryable(nil) = true, want false")
+	}
+	if IsRetryable(fmt.Errorf("wrapped: %w", permanent)) {
+		t.Error("a wrapped permanent error should not be retryable")
+	}
+	if !IsRetryable(ErrRateLimited) || !IsRetryable(ErrNoTransport) {
+		t.Error("rate limiting and no transport should be retryable")
+	}
+	if !errors.Is(permanent, cause) || permanent.Error() != "too large: 413" {
+		t.Errorf("Permanent() = %q, want it to wrap its cause", permanent)
+	}
+}
+
+// ═══════════════════════════════════════
+// 2. Rate Limiting
+// ═══════════════════════════════════════
+
+func TestRateLimitRejectsExcessThenRecovers(t *testing.T) {
+	cloud := NewMockTransport(TransportCloud)
+	m := NewTransportManagerWith(cloud)
+	m.SetRateLimit(TransportCloud, RateLimit{PerSecond: 2, Burst: 3})
+
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	m.limiters[TransportCloud].now = clock.Now
+	m.limiters[TransportCloud].last = clock.Now()
+
+	// Burst is allowed
+	for i := 0; i < 3; i++ {
+		if err := m.Send("bob", []byte{byte(i)}); err != nil {
+			t.Fatalf("send %d within burst error: %v", i, err)
+		}
+	}
+
+	// Excess is rejected
+	if err := m.Send("bob", []byte{9}); err != ErrRateLimited {
+		t.Fatalf("send beyond burst error = %v, want ErrRateLimited", err)
+	}
+	if cloud.SentCount() != 3 {
+		t.Errorf("transport sent = %d, want 3", cloud.SentCount())
+	}
+
+	// Half a second refills one token at 2/s
+	clock.Advance(500 * time.Millisecond)
+	if err := m.Send("bob", []byte{10}); err != nil {
+		t.Errorf("send after window advanced error: %v", err)
+	}
+	if err := m.Send("bob", []byte{11}); err != ErrRateLimited {
+		t.Errorf("second send after one refill error = %v, want ErrRateLimited", err)
+	}
+}
+
+func TestRateLimitIsPerTransport(t *testing.T) {
+	cloud := NewMockTransport(TransportCloud)
+	lan := NewMockTransport(TransportLAN)
+	m := NewTransportManagerWith(cloud, lan)
+	m.SetRateLimit(TransportCloud, RateLimit{PerSecond: 1, Burst: 1})
+
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	m.limiters[TransportCloud].now = clock.Now
+	m.limiters[TransportCloud].last = clock.Now()
+
+	m.Send("bob", []byte{1})
+	m.Send("bob", []byte{2}) // cloud limited, LAN is not
+
+	if cloud.SentCount() != 1 || lan.SentCount() != 1 {
+		t.Errorf("sent cloud=%d lan=%d, want 1/1", cloud.SentCount(), lan.SentCount())
+	}
+}
+
+func TestRateLimitKeptWhenFallbackFails(t *testing.T) {
+	offline := errors.New("offline")
+	cloud := NewMockTransport(TransportCloud)
+	lan := failingTransport(TransportLAN, offline)
+	m := NewTransportManagerWith(cloud, lan)
+	m.SetRateLimit(TransportCloud, RateLimit{PerSecond: 1, Burst: 1})
+
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	m.limiters[TransportCloud].now = clock.Now
+	m.limiters[TransportCloud].last = clock.Now()
+
+	m.Send("bob", []byte{1})
+	err := m.Send("bob", []byte{2}) // cloud limited, LAN fails
+	if !errors.Is(err, ErrRateLimited) || !errors.Is(err, offline) {
+		t.Errorf("error = %v, want both ErrRateLimited and the LAN failure", err)
+	}
+	if !IsRetryable(err) {
+		t.Error("a rate-limited send should be retryable")
+	}
+}
+
+func TestRateLimitRemoved(t *testing.T) {
+	cloud := NewMockTransport(TransportCloud)
+	m := NewTransportManagerWith(cloud)
+	m.SetRateLimit(TransportCloud, RateLimit{PerSecond: 1, Burst: 1})
+	m.SetRateLimit(TransportCloud, RateLimit{})
+
+	for i := 0; i < 10; i++ {
+		if err := m.Send("bob", []byte{byte(i)}); err != nil {
+			t.Fatalf("send %d without limit error: %v", i, err)
+		}
+	}
+}
+
+// ═══════════════════════════════════════
+// 3. Codec
+// ═══════════════════════════════════════
+
+func testEncryptedMessage() *message.EncryptedMessage {
+	return &message.EncryptedMessage{
+		ID:               "m1",
+		SenderID:         "alice",
+		RecipientID:      "bob",
+		EncryptedContent: []byte{0, 1, 2, 0xFF},
+		MessageType:      message.TypeText,
+		Timestamp:        1700000000,
+	}
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	msg := testEncryptedMessage()
+
+	data, err := BinaryCodec{}.Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	decoded, err := BinaryCodec{}.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if decoded.ID != msg.ID || decoded.SenderID != msg.SenderID || decoded.RecipientID != msg.RecipientID ||
+		!bytes.Equal(decoded.EncryptedContent, msg.EncryptedContent) ||
+		decoded.MessageType != msg.MessageType || decoded.Timestamp != msg.Timestamp {
+		t.Errorf("Decode(Encode()) = %+v, want %+v", decoded, msg)
+	}
+
+	if _, err := (BinaryCodec{}).Decode([]byte{0xFF}); err == nil {
+		t.Error("Decode() of garbage should fail")
+	}
+}
+
+func TestManagerSendMessageSameBytesOnEveryTransport(t *testing.T) {
+	msg := testEncryptedMessage()
+	want, _ := BinaryCodec{}.Encode(msg)
+
+	// The primary succeeds first time; then it fails and the fallback is used
+	primary := NewMockTransport(TransportCloud)
+	fallback := NewMockTransport(TransportLAN)
+	m := NewTransportManagerWith(primary, fallback)
+
+	if err := m.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error: %v", err)
+	}
+	primary.SetSendError(errors.New("offline"))
+	if err := m.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() with fallback error: %v", err)
+	}
+
+	if !bytes.Equal(primary.LastSent(), want) || !bytes.Equal(fallback.LastSent(), want) {
+		t.Error("transports should receive the codec's canonical bytes")
+	}
+
+	got, err := m.Decode(fallback.LastSent())
+	if err != nil || got.ID != msg.ID {
+		t.Errorf("Decode() = %+v, %v; want message m1", got, err)
+	}
+}
+
+// markingCodec is a Codec that marks its output, to check SetCodec
+type markingCodec struct{ BinaryCodec }
+
+func (c markingCodec) Encode(msg *message.EncryptedMessage) ([]byte, error) {
+	data, err := c.BinaryCodec.Encode(msg)
+	return append([]byte("X"), data...), err
+}
+
+func (c markingCodec) Decode(data []byte) (*message.EncryptedMessage, error) {
+	return c.BinaryCodec.Decode(data[1:])
+}
+
+func TestManagerSetCodec(t *testing.T) {
+	cloud := NewMockTransport(TransportCloud)
+	m := NewTransportManagerWith(cloud)
+	m.SetCodec(markingCodec{})
+
+	m.SendMessage(testEncryptedMessage())
+	if len(cloud.LastSent()) == 0 || cloud.LastSent()[0] != 'X' {
+		t.Fatal("SendMessage() should encode with the configured codec")
+	}
+	if got, err := m.Decode(cloud.LastSent()); err != nil || got.ID != "m1" {
+		t.Errorf("Decode() = %+v, %v; want message m1", got, err)
+	}
+}
+
+func TestManagerCodecAppliesToReceive(t *testing.T) {
+	peer := startTestLAN(t)
+	defer peer.Stop()
+	NewTransportManagerWith(peer).SetCodec(markingCodec{})
+	received := make(chan *message.EncryptedMessage, 1)
+	peer.SetReceiveHandler(func(msg *message.EncryptedMessage) { received <- msg })
+
+	lan := startTestLAN(t)
+	defer lan.Stop()
+	lan.SetPeer("bob", peer.Addr().String())
+	m := NewTransportManagerWith(lan)
+	m.SetCodec(markingCodec{})
+
+	if err := m.SendMessage(testEncryptedMessage()); err != nil {
+		t.Fatalf("SendMessage() error: %v", err)
+	}
+	select {
+	case msg := <-received:
+		if msg.ID != "m1" || msg.SenderID != "alice" {
+			t.Errorf("received %+v, want m1 from alice", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message encoded with the manager's codec was not received")
+	}
+}
+
+// ═══════════════════════════════════════
+// 4. Async Send
+// ═══════════════════════════════════════
+
+func TestEnqueueSendDeliversAll(t *testing.T) {
+	tr := NewMockTransport(TransportCloud)
+	m := NewTransportManagerWith(tr)
+	defer m.Stop()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		if err := m.EnqueueSend("bob", []byte(fmt.Sprintf("msg-%d", i))); err != nil {
+			t.Fatalf("EnqueueSend(%d) error: %v", i, err)
+		}
+	}
+	m.Drain()
+
+	distinct := make(map[string]bool)
+	for _, p := range tr.Sent() {
+		distinct[string(p.Data)] = true
+	}
+	if len(distinct) != n {
+		t.Errorf("delivered %d distinct payloads, want %d", len(distinct), n)
+	}
+}
+
+func TestEnqueueQueuedUpdatesAckState(t *testing.T) {
+	tr := NewMockTransport(TransportCloud)
+	m := NewTransportManagerWith(tr)
+	defer m.Stop()
+
+	q := msgsync.NewMessageQueue()
+	for _, id := range []string{"m1", "m2", "m3"} {
+		q.Enqueue(msgsync.NewQueuedMessage(id, "bob", []byte(id)))
+		m.EnqueueQueued(q, id, "bob", []byte(id))
+	}
+	m.Drain()
+
+	if !q.IsEmpty() {
+		t.Errorf("queue length after delivery = %d, want 0 (all acked)", q.Len())
+	}
+
+	// A failed send is marked for retry, not lost
+	tr.SetSendError(errors.New("offline"))
+	q.Enqueue(msgsync.NewQueuedMessage("m4", "bob", []byte("m4")))
+	m.EnqueueQueued(q, "m4", "bob", []byte("m4"))
+	m.Drain()
+
+	msg, ok := q.Get("m4")
+	if !ok || msg.Attempts != 1 || msg.InFlight {
+		t.Errorf("failed message = %+v, want queued with 1 attempt and not in flight", msg)
+	}
+}
+
+func TestEnqueueQueuedDropsPermanentFailure(t *testing.T) {
+	tr := NewMockTransport(TransportCloud)
+	m := NewTransportManagerWith(tr)
+	defer m.Stop()
+
+	var dropped []string
+	var dropErr error
+	m.OnDrop(func(id, recipientID string, err error) {
+		dropped = append(dropped, id+"->"+recipientID)
+		dropErr = err
+	})
+
+	rejected := Permanent("recipient blocked", nil)
+	tr.SetSendError(rejected)
+	q := msgsync.NewMessageQueue()
+	q.Enqueue(msgsync.NewQueuedMessage("m1", "bob", []byte("m1")))
+	m.EnqueueQueued(q, "m1", "bob", []byte("m1"))
+	m.Drain()
+
+	if !q.IsEmpty() {
+		t.Errorf("queue length after permanent failure = %d, want 0", q.Len())
+	}
+	if fmt.Sprint(dropped) != "[m1->bob]" || !errors.Is(dropErr, rejected) {
+		t.Errorf("dropped = %v with %v, want [m1->bob] with the send error", dropped, dropErr)
+	}
+}
+
+func TestEnqueueSendAfterStop(t *testing.T) {
+	m := NewTransportManagerWith(NewMockTransport(TransportCloud))
+	m.EnqueueSend("bob", []byte("before"))
+	m.Stop()
+	m.Stop() // Idempotent
+
+	if err := m.EnqueueSend("bob", []byte("after")); !errors.Is(err, ErrSendStopped) {
+		t.Errorf("EnqueueSend() after Stop error = %v, want ErrSendStopped", err)
+	}
+	m.Drain() // Returns immediately with nothing pending
+}
+
+// ═══════════════════════════════════════
+// 5. Relaying
+// ═══════════════════════════════════════
+
+func TestManagerRelayIncrementsHops(t *testing.T) {
+	lan := NewMockTransport(TransportLAN)
+	m := NewTransportManagerWith(lan)
+
+	msg := testEncryptedMessage()
+	if err := m.Relay(msg); err != nil {
+		t.Fatalf("Relay() error: %v", err)
+	}
+	got, err := m.Decode(lan.LastSent())
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if got.HopCount != 1 || got.TransportHint != string(TransportLAN) || got.ID != msg.ID {
+		t.Errorf("relayed = %+v, want hop 1 via LAN", got)
+	}
+	if msg.HopCount != 0 {
+		t.Error("Relay() should not modify the caller's message")
+	}
+}
+
+func TestManagerRelayDropsPastHopLimit(t *testing.T) {
+	lan := NewMockTransport(TransportLAN)
+	m := NewTransportManagerWith(lan)
+
+	msg := testEncryptedMessage()
+	msg.HopCount = message.MaxHopCount
+	if err := m.Relay(msg); !errors.Is(err, message.ErrHopLimitExceeded) {
+		t.Errorf("Relay() at the hop limit error = %v, want ErrHopLimitExceeded", err)
+	}
+	if lan.SentCount() != 0 {
+		t.Errorf("Relay() at the hop limit sent %d messages, want 0", lan.SentCount())
+	}
+}
+
+func TestDeliverDropsPastHopLimit(t *testing.T) {
+	var got []string
+	handler := func(msg *message.EncryptedMessage) { got = append(got, msg.ID) }
+
+	deliver(handler, &message.EncryptedMessage{ID: "direct"})
+	deliver(handler, &message.EncryptedMessage{ID: "at-limit", HopCount: message.MaxHopCount})
+	deliver(handler, &message.EncryptedMessage{ID: "looping", HopCount: message.MaxHopCount + 1})
+	deliver(nil, &message.EncryptedMessage{ID: "no handler"})
+
+	if fmt.Sprint(got) != "[direct at-limit]" {
+		t.Errorf("delivered %v, want [direct at-limit]", got)
+	}
+}
+
+// ═══════════════════════════════════════
+// 6. Queue Draining
+// ═══════════════════════════════════════
+
+func TestQueueDrainerSendsOnActivation(t *testing.T) {
+	tr := NewMockTransport(TransportCloud)
+	tr.SetAvailable(false)
+	m := NewTransportManagerWith(tr)
+	defer m.Stop()
+
+	q := msgsync.NewMessageQueue()
+	d := NewQueueDrainer(m, q)
+	d.Start()
+
+	// Queued while offline: nothing goes out yet
+	for _, id := range []string{"m1", "m2", "m3"} {
+		q.Enqueue(msgsync.NewQueuedMessage(id, "bob", []byte(id)))
+	}
+	m.Drain()
+	if tr.SentCount() != 0 || q.Len() != 3 {
+		t.Fatalf("offline: sent %d, queued %d; want 0, 3", tr.SentCount(), q.Len())
+	}
+
+	tr.SetAvailable(true)
+	m.Drain()
+
+	if tr.SentCount() != 3 {
+		t.Errorf("sent %d messages on activation, want 3", tr.SentCount())
+	}
+	if !q.IsEmpty() {
+		t.Errorf("queue length after activation = %d, want 0 (all acked)", q.Len())
+	}
+
+	// A stopped drainer ignores later activations
+	d.Stop()
+	tr.SetAvailable(false)
+	q.Enqueue(msgsync.NewQueuedMessage("m4", "bob", []byte("m4")))
+	tr.SetAvailable(true)
+	m.Drain()
+	if tr.SentCount() != 3 || q.Len() != 1 {
+		t.Errorf("after Stop: sent %d, queued %d; want 3, 1", tr.SentCount(), q.Len())
+	}
+}
+
+func TestQueueDrainerStartDrainsWhenActive(t *testing.T) {
+	tr := NewMockTransport(TransportLAN)
+	m := NewTransportManagerWith(tr)
+	defer m.Stop()
+
+	q := msgsync.NewMessageQueue()
+	q.Enqueue(msgsync.NewQueuedMessage("m1", "bob", []byte("m1")))
+	NewQueueDrainer(m, q).Start()
+	m.Drain()
+
+	if tr.SentCount() != 1 || !q.IsEmpty() {
+		t.Errorf("sent %d, queued %d; want 1, 0", tr.SentCount(), q.Len())
+	}
+}
+
+func TestQueueDrainerOverLANKeepsUnreachable(t *testing.T) {
+	peer := startTestLAN(t)
+	defer peer.Stop()
+	received := make(chan *message.EncryptedMessage, 2)
+	peer.SetReceiveHandler(func(msg *message.EncryptedMessage) { received <- msg })
+
+	lan := NewLANTransportWithProperties(TransportProperties{PropLANListenAddr: "127.0.0.1:0"})
+	lan.SetPeer("carol", peer.Addr().String())
+	m := NewTransportManagerWith(lan)
+	defer m.Stop()
+	defer lan.Stop()
+
+	q := msgsync.NewMessageQueue()
+	for _, to := range []string{"bob", "carol"} {
+		data, _ := (&message.EncryptedMessage{ID: "to-" + to, RecipientID: to}).MarshalBinary()
+		q.Enqueue(msgsync.NewQueuedMessage("to-"+to, to, data))
+	}
+	NewQueueDrainer(m, q).Start()
+
+	if err := lan.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	m.Drain()
+
+	select {
+	case msg := <-received:
+		if msg.ID != "to-carol" {
+			t.Errorf("peer received %s, want to-carol", msg.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message for the LAN peer not delivered")
+	}
+
+	// Bob has no LAN address: his message stays queued, untried
+	if _, ok := q.Get("to-carol"); ok {
+		t.Error("delivered message should be acked")
+	}
+	msg, ok := q.Get("to-bob")
+	if !ok || msg.Attempts != 0 {
+		t.Errorf("unreachable message = %+v, want still queued with no attempts", msg)
+	}
+}
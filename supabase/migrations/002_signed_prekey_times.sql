@@ -0,0 +1,7 @@
+-- Signed prekey creation and expiry times (Unix seconds).
+-- They are covered by signed_prekey_signature, so clients must publish
+-- them exactly as the core stamped them. Zero means unstamped/no expiry.
+
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS signed_prekey_created_at BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS signed_prekey_expires_at BIGINT NOT NULL DEFAULT 0;